@@ -26,6 +26,7 @@ import (
 	"github.com/ubuntu/adsys/internal/ad/backends"
 	adcommon "github.com/ubuntu/adsys/internal/ad/common"
 	"github.com/ubuntu/adsys/internal/ad/registry"
+	"github.com/ubuntu/adsys/internal/ad/wmi"
 	"github.com/ubuntu/adsys/internal/consts"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
 	"github.com/ubuntu/adsys/internal/policies"
@@ -63,7 +64,12 @@ const (
 	gpoListGPOFailed int = 3
 )
 
-type gpo downloadable
+type gpo struct {
+	name string
+	url  string
+	// wmiFilter is the WMI filter linked to the GPO, if any.
+	wmiFilter *wmi.Filter
+}
 
 type downloadable struct {
 	name     string
@@ -85,6 +91,7 @@ type AD struct {
 	sysvolCacheDir   string
 	policiesCacheDir string
 	krb5CacheDir     string
+	systemRoot       string
 
 	downloadables map[string]*downloadable
 	// downloadablesMu guards the downloadables map so that parsing, which only
@@ -99,9 +106,10 @@ type AD struct {
 }
 
 type options struct {
-	versionID string
-	runDir    string
-	cacheDir  string
+	versionID  string
+	runDir     string
+	cacheDir   string
+	systemRoot string
 
 	withoutKerberos bool
 	gpoListCmd      []string
@@ -154,6 +162,7 @@ func New(ctx context.Context, configBackend backends.Backend, hostname string, o
 	args := options{
 		runDir:         consts.DefaultRunDir,
 		cacheDir:       consts.DefaultCacheDir,
+		systemRoot:     "/",
 		gpoListCmd:     []string{"python3", "-c", AdsysGpoListCode},
 		versionID:      versionID,
 		gpoListTimeout: 30 * time.Second, // this is used in tests and set to consts.DefaultGpoListTimeout in production
@@ -202,6 +211,7 @@ func New(ctx context.Context, configBackend backends.Backend, hostname string, o
 		sysvolCacheDir:   sysvolCacheDir,
 		policiesCacheDir: policiesCacheDir,
 		krb5CacheDir:     krb5CacheDir,
+		systemRoot:       args.systemRoot,
 
 		downloadables:  make(map[string]*downloadable),
 		gpoListCmd:     args.gpoListCmd,
@@ -278,56 +288,30 @@ func (ad *AD) GetPolicies(ctx context.Context, objectName string, objectClass Ob
 	}
 
 	// Otherwise, try fetching the GPO list from LDAP
-	args := append([]string{}, ad.gpoListCmd...) // Copy gpoListCmd to prevent data race
-	scriptArgs := []string{"--objectclass", string(objectClass), adServerFQDN, objectName}
-	if logrus.GetLevel() >= logrus.DebugLevel {
-		scriptArgs = append(scriptArgs, "--debug")
+	orderedGPOs, err := ad.gpoList(ctx, objectName, objectClass, adServerFQDN, krb5CCPath)
+	if err != nil {
+		return pols, err
 	}
-	cmdArgs := append(args, scriptArgs...)
-	cmdCtx, cancel := context.WithTimeout(ctx, ad.gpoListTimeout)
-	defer cancel()
-	log.Debugf(ctx, "Getting gpo list with arguments: %q", strings.Join(scriptArgs, " "))
-	// #nosec G204 - cmdArgs is under our control (python embedded script or mock for tests)
-	cmd := exec.CommandContext(cmdCtx, cmdArgs[0], cmdArgs[1:]...)
-	cmd.Env = append(os.Environ(), fmt.Sprintf("KRB5CCNAME=%s", krb5CCPath))
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
 
-	smbsafe.WaitExec()
-	err = cmd.Run()
-	smbsafe.DoneExec()
-	if err != nil {
-		exitCode := cmd.ProcessState.ExitCode()
-		var reason string
-		switch exitCode {
-		case gpoListNotFound:
-			reason = gotext.Get("account %q was not found in Active Directory", objectName)
-		case gpoListConnectionFailed:
-			reason = gotext.Get("could not connect to the Active Directory server %q", adServerFQDN)
-		case gpoListGPOFailed:
-			reason = gotext.Get("could not compute the GPO list for %q", objectName)
-		default:
-			reason = gotext.Get("unexpected error while retrieving the GPO list")
+	// Loopback processing evaluates the computer GPOs as user configuration.
+	var loopback string
+	if objectClass == UserObject {
+		if orderedGPOs, loopback, err = ad.withLoopbackGPOs(ctx, adServerFQDN, orderedGPOs); err != nil {
+			return pols, err
 		}
-		return pols, errors.New(gotext.Get("failed to retrieve the list of GPO: %s (exited with %d): %v\n%s", reason, exitCode, err, stderr.String()))
 	}
 
+	// GPOs are only applied to the clients matching their WMI filter.
+	orderedGPOs, filteredGPOs := ad.applyWMIFilters(ctx, orderedGPOs)
+
 	downloadables := make(map[string]string)
-	var orderedGPOs []gpo
-	scanner := bufio.NewScanner(&stdout)
-	for scanner.Scan() {
-		t := scanner.Text()
-		res := strings.SplitN(t, "\t", 2)
-		gpoName, gpoURL := res[0], res[1]
-		log.Debugf(ctx, "GPO %q for %q available at %q", gpoName, objectName, gpoURL)
-		downloadables[gpoName] = gpoURL
-		orderedGPOs = append(orderedGPOs, gpo{name: gpoName, url: gpoURL})
+	for _, g := range orderedGPOs {
+		downloadables[g.name] = g.url
 
 		if _, ok := downloadables["assets"]; ok {
 			continue
 		}
-		u, err := url.Parse(gpoURL)
+		u, err := url.Parse(g.url)
 		if err != nil {
 			return pols, err
 		}
@@ -335,9 +319,6 @@ func (ad *AD) GetPolicies(ctx context.Context, objectName string, objectClass Ob
 		u.Path = filepath.Join(filepath.Dir(filepath.Dir(u.Path)), consts.DistroID)
 		downloadables["assets"] = u.String()
 	}
-	if err := scanner.Err(); err != nil {
-		return pols, err
-	}
 
 	// Fetching mutates the shared on-disk caches and the krb5cc tickets and,
 	// through libsmbclient, is serialized process-wide anyway, so run it under
@@ -358,7 +339,7 @@ func (ad *AD) GetPolicies(ctx context.Context, objectName string, objectClass Ob
 	// objects at once.
 	var gposRules []policies.GPO
 	errg.Go(func() (err error) {
-		gposRules, err = ad.parseGPOs(ctx, orderedGPOs, objectClass)
+		gposRules, err = ad.parseGPOs(ctx, orderedGPOs, objectClass, adServerFQDN, krb5CCPath)
 		return err
 	})
 
@@ -428,7 +409,87 @@ func (ad *AD) GetPolicies(ctx context.Context, objectName string, objectClass Ob
 		defer ad.Unlock()
 	}
 
-	return policies.New(ctx, gposRules, assetsDBPath)
+	pols, err = policies.New(ctx, gposRules, assetsDBPath)
+	if err != nil {
+		return pols, err
+	}
+	pols.Loopback = loopback
+	pols.FilteredGPOs = filteredGPOs
+	return pols, nil
+}
+
+// gpoList returns the GPOs applying to objectName, from the highest priority in the hierarchy,
+// as listed by the adsys-gpolist script authenticated with the ticket at krb5CCPath.
+func (ad *AD) gpoList(ctx context.Context, objectName string, objectClass ObjectClass, adServerFQDN, krb5CCPath string) (gpos []gpo, err error) {
+	scriptArgs := []string{"--objectclass", string(objectClass), adServerFQDN, objectName}
+	if logrus.GetLevel() >= logrus.DebugLevel {
+		scriptArgs = append(scriptArgs, "--debug")
+	}
+	log.Debugf(ctx, "Getting gpo list with arguments: %q", strings.Join(scriptArgs, " "))
+	stdout, exitCode, err := ad.runGPOListScript(ctx, scriptArgs, krb5CCPath)
+	if err != nil {
+		var reason string
+		switch exitCode {
+		case gpoListNotFound:
+			reason = gotext.Get("account %q was not found in Active Directory", objectName)
+		case gpoListConnectionFailed:
+			reason = gotext.Get("could not connect to the Active Directory server %q", adServerFQDN)
+		case gpoListGPOFailed:
+			reason = gotext.Get("could not compute the GPO list for %q", objectName)
+		default:
+			reason = gotext.Get("unexpected error while retrieving the GPO list")
+		}
+		return nil, errors.New(gotext.Get("failed to retrieve the list of GPO: %s (exited with %d): %v", reason, exitCode, err))
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		t := scanner.Text()
+		// <name>\t<url>[\t<WMI filter name>\t<namespace>;<query>…]
+		res := strings.Split(t, "\t")
+		g := gpo{name: res[0], url: res[1]}
+		log.Debugf(ctx, "GPO %q for %q available at %q", g.name, objectName, g.url)
+		if len(res) > 2 {
+			g.wmiFilter = &wmi.Filter{Name: res[2]}
+			for _, q := range res[3:] {
+				namespace, wql, _ := strings.Cut(q, ";")
+				g.wmiFilter.Queries = append(g.wmiFilter.Queries, wmi.Query{Namespace: namespace, WQL: wql})
+			}
+			log.Debugf(ctx, "GPO %q is filtered by WMI filter %q", g.name, g.wmiFilter.Name)
+		}
+		gpos = append(gpos, g)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return gpos, nil
+}
+
+// runGPOListScript runs the adsys-gpolist script with scriptArgs, authenticated with the ticket at krb5CCPath,
+// and returns its standard output. The exit code of the script is returned on failure, with its error output
+// in the error.
+func (ad *AD) runGPOListScript(ctx context.Context, scriptArgs []string, krb5CCPath string) (stdout *bytes.Buffer, exitCode int, err error) {
+	args := append([]string{}, ad.gpoListCmd...) // Copy gpoListCmd to prevent data race
+	cmdArgs := append(args, scriptArgs...)
+	cmdCtx, cancel := context.WithTimeout(ctx, ad.gpoListTimeout)
+	defer cancel()
+	// #nosec G204 - cmdArgs is under our control (python embedded script or mock for tests)
+	cmd := exec.CommandContext(cmdCtx, cmdArgs[0], cmdArgs[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("KRB5CCNAME=%s", krb5CCPath))
+	var stderr bytes.Buffer
+	stdout = &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	smbsafe.WaitExec()
+	err = cmd.Run()
+	smbsafe.DoneExec()
+	if err != nil {
+		return nil, cmd.ProcessState.ExitCode(), fmt.Errorf("%w\n%s", err, stderr.String())
+	}
+
+	return stdout, 0, nil
 }
 
 // ListUsers returns the list of users on the system based on their cached policy information.
@@ -556,7 +617,9 @@ func safeCopyFile(src, dst string, mode os.FileMode) error {
 	return os.Rename(dst+".new", dst)
 }
 
-func (ad *AD) parseGPOs(ctx context.Context, gpos []gpo, objectClass ObjectClass) (r []policies.GPO, err error) {
+// parseGPOs returns the rules of gpos for objectClass. The domain accounts referenced by SID in the security
+// templates are looked up on adServerFQDN, authenticated with the ticket at krb5CCPath.
+func (ad *AD) parseGPOs(ctx context.Context, gpos []gpo, objectClass ObjectClass, adServerFQDN, krb5CCPath string) (r []policies.GPO, err error) {
 	keyFilterPrefix := fmt.Sprintf("%s/%s/", adcommon.KeyPrefix, consts.DistroID)
 
 	for _, g := range gpos {
@@ -570,6 +633,16 @@ func (ad *AD) parseGPOs(ctx context.Context, gpos []gpo, objectClass ObjectClass
 		if err = ad.parseGPO(ctx, name, url, keyFilterPrefix, objectClass, gpoWithRules); err != nil {
 			return r, err
 		}
+		if err = ad.parsePreferences(ctx, name, url, objectClass, gpoWithRules); err != nil {
+			return r, err
+		}
+		// Security templates only apply to computers.
+		if objectClass != ComputerObject {
+			continue
+		}
+		if err = ad.parseSecurityTemplate(ctx, name, url, adServerFQDN, krb5CCPath, gpoWithRules); err != nil {
+			return r, err
+		}
 	}
 
 	return r, nil
@@ -654,6 +727,25 @@ classLoop:
 			pol.Key = fmt.Sprintf("%scertificate/%s/all", keyFilterPrefix, pol.Key)
 		}
 
+		// Trusted certificates are machine wide and shipped as blobs we decode here,
+		// so that they don't depend on AD CS being deployed.
+		if objectClass == ComputerObject && strings.HasPrefix(pol.Key, trustedCertificatesPrefix) {
+			e, ok, err := trustedCertificateEntry(pol)
+			if err != nil {
+				return errors.New(gotext.Get("%s: %v", f.Name(), err))
+			}
+			if ok {
+				gpoWithRules.Rules["certificate"] = append(gpoWithRules.Rules["certificate"], e)
+			}
+			continue
+		}
+
+		// The loopback processing mode is read from the computer policies when computing the user ones.
+		if objectClass == ComputerObject && pol.Key == loopbackPolicyKey {
+			gpoWithRules.Rules[loopbackRuleType] = append(gpoWithRules.Rules[loopbackRuleType], loopbackEntry(pol))
+			continue
+		}
+
 		// Only consider supported policies for this distro
 		if !strings.HasPrefix(pol.Key, keyFilterPrefix) {
 			continue
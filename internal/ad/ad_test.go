@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -85,6 +86,11 @@ func TestGetPolicies(t *testing.T) {
 	hostname, err := os.Hostname()
 	require.NoError(t, err, "Setup: failed to get hostname")
 
+	rootCertificate, err := os.ReadFile(filepath.Join("testdata", "trusted-certificates", "root.pem"))
+	require.NoError(t, err, "Setup: failed to read root certificate")
+	intermediateCertificate, err := os.ReadFile(filepath.Join("testdata", "trusted-certificates", "intermediate.pem"))
+	require.NoError(t, err, "Setup: failed to read intermediate certificate")
+
 	/*
 				GPOs layout:
 
@@ -415,6 +421,154 @@ func TestGetPolicies(t *testing.T) {
 					}}},
 			}},
 		},
+		"Include password policies from the security template": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":security-template"},
+			want: policies.Policies{GPOs: []policies.GPO{
+				{ID: "security-template", Name: "security-template-name", Rules: map[string][]entry.Entry{
+					"password": {
+						{Key: "password/min-length", Value: "12"},
+						{Key: "password/complexity"},
+						{Key: "password/history", Value: "24"},
+						{Key: "password/lockout-threshold", Value: "5"},
+						{Key: "password/lockout-duration", Value: "0"},
+						{Key: "password/lockout-reset", Value: "15"},
+					}}},
+			}},
+		},
+		"Include logon rights from the security template": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":logon-rights"},
+			want: policies.Policies{GPOs: []policies.GPO{
+				{ID: "logon-rights", Name: "logon-rights-name", Rules: map[string][]entry.Entry{
+					"access": {
+						{Key: "access/allow-local", Value: "root\n%sudo\n%admin\nEXAMPLE\\linux-users"},
+						{Key: "access/deny-local", Value: "EXAMPLE\\bob"},
+						{Key: "access/deny-remote", Value: "ALL"},
+					}}},
+			}},
+		},
+		"Include logon rights of domain accounts referenced by SID": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":logon-rights-domain-sids"},
+			want: policies.Policies{GPOs: []policies.GPO{
+				{ID: "logon-rights-domain-sids", Name: "logon-rights-domain-sids-name", Rules: map[string][]entry.Entry{
+					"access": {
+						{Key: "access/allow-local", Value: "root\n%sudo\n%admin\n%linux-users@gpoonly.com"},
+						{Key: "access/deny-local", Value: "alice@gpoonly.com"},
+						{Key: "access/allow-remote", Value: "%linux-users@gpoonly.com\nalice@gpoonly.com"},
+					}}},
+			}},
+		},
+		"Loopback processing mode, computer object": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":loopback-merge::" + hostname + ":loopback-replace"},
+			want: policies.Policies{GPOs: []policies.GPO{
+				{ID: "loopback-merge", Name: "loopback-merge-name", Rules: map[string][]entry.Entry{
+					"loopback": {{Key: "mode", Value: "merge"}}}},
+				{ID: "loopback-replace", Name: "loopback-replace-name", Rules: map[string][]entry.Entry{
+					"loopback": {{Key: "mode", Value: "replace"}}}},
+			}},
+		},
+		"Disabled loopback processing, computer object": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":loopback-disabled"},
+			want: policies.Policies{GPOs: []policies.GPO{
+				{ID: "loopback-disabled", Name: "loopback-disabled-name", Rules: map[string][]entry.Entry{
+					"loopback": {{Key: "mode", Disabled: true}}}},
+			}},
+		},
+		"Loopback processing mode is ignored on user object": {
+			gpoListArgs: []string{"gpoonly.com", "bob:loopback-merge"},
+			want: policies.Policies{GPOs: []policies.GPO{
+				{ID: "loopback-merge", Name: "loopback-merge-name", Rules: map[string][]entry.Entry{
+					"dconf": {
+						{Key: "A", Value: "loopbackMergeA"},
+						{Key: "D", Value: "loopbackMergeD"},
+					}}},
+			}},
+		},
+		"WMI filter matching the system, GPO is applied": {
+			gpoListArgs: []string{"gpoonly.com", `bob:standard|Ubuntu 24.04|root\CIMv2;SELECT * FROM Win32_OperatingSystem WHERE Version = "24.04"`},
+			want:        policies.Policies{GPOs: []policies.GPO{standardUserGPO("standard")}},
+		},
+		"WMI filter with all queries matching the system, GPO is applied": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + `:standard|Lenovo laptops|root\CIMv2;SELECT * FROM Win32_ComputerSystem WHERE Manufacturer = "LENOVO" AND PCSystemType = 2|root\CIMv2;SELECT * FROM Win32_Battery`},
+			want:        policies.Policies{GPOs: []policies.GPO{standardComputerGPO("standard")}},
+		},
+		"WMI filter not matching the system, GPO is filtered out": {
+			gpoListArgs: []string{"gpoonly.com", `bob:standard|Ubuntu 22.04|root\CIMv2;SELECT * FROM Win32_OperatingSystem WHERE Version = "22.04"::bob:user-only`},
+			want: policies.Policies{
+				GPOs: []policies.GPO{
+					{ID: "user-only", Name: "user-only-name", Rules: map[string][]entry.Entry{
+						"dconf": {
+							{Key: "A", Value: "userOnlyA"},
+							{Key: "B", Value: "userOnlyB"},
+						}}}},
+				FilteredGPOs: []policies.FilteredGPO{{ID: "standard", Name: "standard-name", WMIFilter: "Ubuntu 22.04"}},
+			},
+		},
+		"WMI filter with one query not matching the system, GPO is filtered out": {
+			gpoListArgs: []string{"gpoonly.com", `bob:standard|Servers|root\CIMv2;SELECT * FROM Win32_OperatingSystem|root\CIMv2;SELECT * FROM Win32_OperatingSystem WHERE ProductType = 3`},
+			want:        policies.Policies{FilteredGPOs: []policies.FilteredGPO{{ID: "standard", Name: "standard-name", WMIFilter: "Servers"}}},
+		},
+		"WMI filter which can't be evaluated, GPO is filtered out": {
+			gpoListArgs: []string{"gpoonly.com", `bob:standard|Antivirus|root\SecurityCenter2;SELECT * FROM AntiVirusProduct::bob:one-value|Processors|root\CIMv2;SELECT * FROM Win32_Processor`},
+			want: policies.Policies{FilteredGPOs: []policies.FilteredGPO{
+				{ID: "standard", Name: "standard-name", WMIFilter: "Antivirus"},
+				{ID: "one-value", Name: "one-value-name", WMIFilter: "Processors"},
+			}},
+		},
+		"Include trusted certificates from the public key policies": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":trusted-certificates"},
+			want: policies.Policies{GPOs: []policies.GPO{
+				{ID: "trusted-certificates", Name: "trusted-certificates-name", Rules: map[string][]entry.Entry{
+					"certificate": {
+						{Key: "trusted-root/9344e5268d3440fdeca7cee223986340c17f2b4e", Value: string(rootCertificate)},
+						{Key: "trusted-intermediate/0707ac4e2a9e2560703ce4992de115db6bce6681", Value: string(intermediateCertificate)},
+						{Key: "trusted-root/4b2f7f3fb0e8d7ac9e1c1c5d1d33f5a1e1e6b8c2", Disabled: true},
+					}}},
+			}},
+		},
+		"Include user preferences": {
+			gpoListArgs: []string{"gpoonly.com", "bob:preferences"},
+			want: policies.Policies{GPOs: []policies.GPO{
+				{ID: "preferences", Name: "preferences-name", Rules: map[string][]entry.Entry{
+					"mount": {
+						{Key: "user-mounts", Value: "[krb5]smb://fileserver.example.com/homes/${USER}\n[krb5]smb://fileserver.example.com/projects", Strategy: entry.StrategyAppend},
+					},
+					"environment": {
+						{Key: "environment/variables-user", Value: "PROJECTS=$HOME/projects/${USER}", Strategy: entry.StrategyAppend},
+					}}},
+			}},
+		},
+		"Include machine preferences": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":preferences"},
+			want: policies.Policies{GPOs: []policies.GPO{
+				{ID: "preferences", Name: "preferences-name", Rules: map[string][]entry.Entry{
+					"environment": {
+						{Key: "environment/variables-machine", Value: "HTTP_PROXY=http://proxy.example.com:3128\nPATH+=/opt/tools/bin\nMACHINE=${HOSTNAME}", Strategy: entry.StrategyAppend},
+					},
+					"groups": {
+						{Key: "groups/members", Value: "docker: EXAMPLE\\alice, carol@example.com", Strategy: entry.StrategyAppend},
+					}}},
+			}},
+		},
+		"Ignore security template for user objects": {
+			gpoListArgs: []string{"gpoonly.com", "bob:security-template"},
+			want:        policies.Policies{GPOs: []policies.GPO{{ID: "security-template", Name: "security-template-name", Rules: make(map[string][]entry.Entry)}}},
+		},
 		"Ignore errors on non Ubuntu keys": {
 			gpoListArgs: []string{"gpoonly.com", "bob:unsupported-with-errors"},
 			want: policies.Policies{GPOs: []policies.GPO{
@@ -541,6 +695,34 @@ func TestGetPolicies(t *testing.T) {
 			gpoListArgs: []string{"gpoonly.com", "bob:corrupted-policy"},
 			wantErr:     true,
 		},
+		"Corrupted security template": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":corrupted-security-template"},
+			wantErr:     true,
+		},
+		"Unresolved SID in a logon right allowing logons": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":logon-rights-unresolved-allow"},
+			wantErr:     true,
+		},
+		"Unresolved SID in a logon right denying logons": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":logon-rights-unresolved-deny"},
+			wantErr:     true,
+		},
+		"Corrupted preferences": {
+			gpoListArgs: []string{"gpoonly.com", "bob:corrupted-preferences"},
+			wantErr:     true,
+		},
+		"Trusted certificate not matching its thumbprint": {
+			objectName:  hostname,
+			objectClass: ad.ComputerObject,
+			gpoListArgs: []string{"gpoonly.com", hostname + ":trusted-certificate-thumbprint-mismatch"},
+			wantErr:     true,
+		},
 		"Policy can’t be downloaded": {
 			gpoListArgs: []string{"gpoonly.com", "bob:no-gpt-ini"},
 			wantErr:     true,
@@ -624,7 +806,7 @@ func TestGetPolicies(t *testing.T) {
 			adc, err := ad.New(context.Background(), tc.backend, hostname,
 				ad.WithCacheDir(cachedir), ad.WithRunDir(rundir), ad.WithoutKerberos(),
 				ad.WithGPOListCmd(mockGPOListCmd(t, tc.gpoListArgs...)),
-				ad.WithVersionID(tc.versionID))
+				ad.WithVersionID(tc.versionID), ad.WithSystemRoot(filepath.Join("testdata", "wmi-system")))
 			require.NoError(t, err, "Setup: cannot create ad object")
 
 			if tc.turnKrb5CCCacheRO {
@@ -648,6 +830,7 @@ func TestGetPolicies(t *testing.T) {
 
 			// Compare GPOs
 			require.Equal(t, tc.want.GPOs, entries.GPOs, "GetPolicies returns expected GPO entries in correct order")
+			require.Equal(t, tc.want.FilteredGPOs, entries.FilteredGPOs, "GetPolicies returns expected GPOs filtered out by their WMI filter")
 
 			// Compare assets
 			uncompressedAssets := t.TempDir()
@@ -789,6 +972,129 @@ func TestGetPoliciesOffline(t *testing.T) {
 	}
 }
 
+func TestGetPoliciesWithLoopback(t *testing.T) {
+	t.Parallel()
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err, "Setup: failed to get hostname")
+
+	loopbackMergeGPO := policies.GPO{ID: "loopback-merge", Name: "loopback-merge-name", Rules: map[string][]entry.Entry{
+		"dconf": {
+			{Key: "A", Value: "loopbackMergeA"},
+			{Key: "D", Value: "loopbackMergeD"},
+		}}}
+	loopbackReplaceGPO := policies.GPO{ID: "loopback-replace", Name: "loopback-replace-name", Rules: map[string][]entry.Entry{
+		"dconf": {
+			{Key: "A", Value: "loopbackReplaceA"},
+		}}}
+
+	tests := map[string]struct {
+		computerGPOs []string
+		userGPOs     []string
+
+		noComputerPolicies   bool
+		noComputerKrb5CCLink bool
+
+		want         []policies.GPO
+		wantLoopback string
+		wantErr      bool
+	}{
+		"Merge mode, computer GPOs take precedence": {
+			computerGPOs: []string{"loopback-merge"},
+			want:         []policies.GPO{loopbackMergeGPO, standardUserGPO("standard")},
+			wantLoopback: "merge",
+		},
+		"Merge mode, GPOs applying to both are listed once": {
+			computerGPOs: []string{"loopback-merge", "standard"},
+			userGPOs:     []string{"standard", "one-value"},
+			want: []policies.GPO{loopbackMergeGPO, standardUserGPO("standard"),
+				{ID: "one-value", Name: "one-value-name", Rules: map[string][]entry.Entry{
+					"dconf": {
+						{Key: "C", Value: "oneValueC"},
+					}}}},
+			wantLoopback: "merge",
+		},
+		"Replace mode, only computer GPOs are used": {
+			computerGPOs: []string{"loopback-replace"},
+			want:         []policies.GPO{loopbackReplaceGPO},
+			wantLoopback: "replace",
+		},
+		"Closest computer GPO defines the mode": {
+			computerGPOs: []string{"loopback-replace", "loopback-merge"},
+			want:         []policies.GPO{loopbackReplaceGPO, loopbackMergeGPO},
+			wantLoopback: "replace",
+		},
+		"Disabled loopback processing": {
+			computerGPOs: []string{"loopback-disabled", "loopback-merge"},
+			want:         []policies.GPO{standardUserGPO("standard")},
+		},
+		"No loopback processing without computer policies": {
+			computerGPOs:       []string{"loopback-merge"},
+			noComputerPolicies: true,
+			want:               []policies.GPO{standardUserGPO("standard")},
+		},
+
+		// Error cases
+		"Error on computer GPOs can't be listed": {
+			computerGPOs:         []string{"loopback-merge"},
+			noComputerKrb5CCLink: true,
+			wantErr:              true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.userGPOs == nil {
+				tc.userGPOs = []string{"standard"}
+			}
+			var gpoList []string
+			for _, g := range tc.computerGPOs {
+				gpoList = append(gpoList, hostname+":"+g)
+			}
+			for _, g := range tc.userGPOs {
+				gpoList = append(gpoList, "bob:"+g)
+			}
+
+			backend := mock.Backend{
+				Dom:                "gpoonly.com",
+				ServURL:            "myserver.gpoonly.com",
+				Online:             true,
+				HostKrb5CCNamePath: filepath.Join(t.TempDir(), "host_ccache"),
+			}
+			testutils.CreatePath(t, backend.HostKrb5CCNamePath)
+
+			cachedir, rundir := t.TempDir(), t.TempDir()
+			adc, err := ad.New(context.Background(), backend, hostname,
+				ad.WithCacheDir(cachedir), ad.WithRunDir(rundir), ad.WithoutKerberos(),
+				ad.WithGPOListCmd(mockGPOListCmd(t, "gpoonly.com", strings.Join(gpoList, "::"))))
+			require.NoError(t, err, "Setup: cannot create ad object")
+
+			// Policies applied to the computer define the loopback processing mode.
+			computerPolicies, err := adc.GetPolicies(context.Background(), hostname, ad.ComputerObject, "")
+			require.NoError(t, err, "Setup: GetPolicies for the computer should return no error")
+			if !tc.noComputerPolicies {
+				err = computerPolicies.Save(filepath.Join(adc.PoliciesCacheDir(), hostname))
+				require.NoError(t, err, "Setup: cannot save computer policies to cache")
+			}
+			if tc.noComputerKrb5CCLink {
+				require.NoError(t, os.Remove(filepath.Join(adc.Krb5CacheDir(), "tracking", hostname)), "Setup: cannot remove computer ticket symlink")
+			}
+
+			got, err := adc.GetPolicies(context.Background(), "bob@GPOONLY.COM", ad.UserObject, setKrb5CC(t, "bob"))
+			if tc.wantErr {
+				require.Error(t, err, "GetPolicies should have errored out")
+				return
+			}
+			require.NoError(t, err, "GetPolicies should return no error")
+
+			require.Equal(t, tc.want, got.GPOs, "GetPolicies returns expected GPO entries in correct order")
+			require.Equal(t, tc.wantLoopback, got.Loopback, "GetPolicies returns expected loopback processing mode")
+		})
+	}
+}
+
 func TestGetPoliciesWorkflows(t *testing.T) {
 	t.Parallel() // libsmbclient overrides SIGCHILD, but we have one global lock
 
@@ -1380,6 +1686,30 @@ func TestMockGPOList(_ *testing.T) {
 		os.Exit(code)
 	}
 
+	// Accounts looked up by SID, as printed by the script: "<SID>\t<sAMAccountName>\t<user|computer|group>"
+	if slices.Contains(args, "--sid") {
+		accounts := map[string]string{
+			"S-1-5-21-1004336348-1177238915-682003330-1105": "alice\tuser",
+			"S-1-5-21-1004336348-1177238915-682003330-1107": "linux-users\tgroup",
+		}
+		for i, arg := range args[:len(args)-1] {
+			if arg != "--sid" {
+				continue
+			}
+			sid := args[i+1]
+			if _, ok := accounts[sid]; !ok {
+				fmt.Fprintf(os.Stderr, "Failed to find account with SID %s", sid)
+				os.Exit(1)
+			}
+		}
+		for i, arg := range args[:len(args)-1] {
+			if arg == "--sid" {
+				fmt.Fprintf(os.Stdout, "%s\t%s\n", args[i+1], accounts[args[i+1]])
+			}
+		}
+		return
+	}
+
 	// Get Domain
 	domain := args[0]
 
@@ -1390,6 +1720,7 @@ func TestMockGPOList(_ *testing.T) {
 	var gpos []string
 
 	// Arg 0 is the list of GPOs to return, in the form: "user1:GPO1::user2:GPO2::user1:GPO3"
+	// A GPO can have a WMI filter, in the form: "GPO1|filter name|root\CIMv2;query1|root\CIMv2;query2"
 	for _, gpoItem := range strings.Split(args[1], "::") {
 		e := strings.SplitN(gpoItem, ":", 2)
 		if e[0] != objectName {
@@ -1398,8 +1729,13 @@ func TestMockGPOList(_ *testing.T) {
 		gpos = append(gpos, e[1])
 	}
 
-	for _, gpo := range gpos {
-		fmt.Fprintf(os.Stdout, "%s-name\tsmb://localhost:%d/SYSVOL/%s/Policies/%s\n", gpo, ad.SmbPort, domain, gpo)
+	for _, gpoItem := range gpos {
+		gpo, wmiFilter, _ := strings.Cut(gpoItem, "|")
+		line := fmt.Sprintf("%s-name\tsmb://localhost:%d/SYSVOL/%s/Policies/%s", gpo, ad.SmbPort, domain, gpo)
+		if wmiFilter != "" {
+			line += "\t" + strings.ReplaceAll(wmiFilter, "|", "\t")
+		}
+		fmt.Fprintln(os.Stdout, line)
 	}
 }
 
@@ -23,6 +23,7 @@ func TestExpand(t *testing.T) {
 		wantErr bool
 	}{
 		"dconf":                            {root: "simple"},
+		"browser":                          {root: "simple"},
 		"expanded policy":                  {root: "simple"},
 		"expanded policy with meta":        {root: "simple"},
 		"expanded policy with release any": {root: "simple"},
@@ -30,12 +31,14 @@ func TestExpand(t *testing.T) {
 		"ignore categories and non yaml files": {root: "simple"},
 
 		/* Error cases */
-		"no release file":         {root: "no release file", wantErr: true},
-		"no version_id":           {root: "no version id", wantErr: true},
-		"unsupported policy type": {root: "simple", wantErr: true},
-		"no source directory":     {root: "simple", wantErr: true},
-		"invalid dconf.yaml":      {root: "simple", wantErr: true},
-		"dconf generation fails":  {root: "unsupported dconf type", wantErr: true},
+		"no release file":          {root: "no release file", wantErr: true},
+		"no version_id":            {root: "no version id", wantErr: true},
+		"unsupported policy type":  {root: "simple", wantErr: true},
+		"no source directory":      {root: "simple", wantErr: true},
+		"invalid dconf.yaml":       {root: "simple", wantErr: true},
+		"dconf generation fails":   {root: "unsupported dconf type", wantErr: true},
+		"invalid browser.yaml":     {root: "simple", wantErr: true},
+		"browser generation fails": {root: "simple", wantErr: true},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -64,7 +67,9 @@ func TestExpand(t *testing.T) {
 			expandedPoliciesByType := make(map[string][]common.ExpandedPolicy)
 			var types []string
 			for _, p := range got {
-				types = append(types, p.Type)
+				if _, ok := expandedPoliciesByType[p.Type]; !ok {
+					types = append(types, p.Type)
+				}
 				expandedPoliciesByType[p.Type] = append(expandedPoliciesByType[p.Type], p)
 			}
 			sort.Strings(types)
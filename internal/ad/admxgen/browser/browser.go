@@ -0,0 +1,169 @@
+// Package browser generates expanded policies from JSON schemas describing the browser policies.
+//
+// The schemas are maintained in adsys, next to the policy definitions. They only list the policies exposed by adsys,
+// with the value types documented by each browser, and are not the browsers upstream schemas.
+package browser
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/adsys/internal/ad/admxgen/common"
+	"github.com/ubuntu/decorate"
+)
+
+// Policy represents a browser policy entry used to generate an ADMX.
+// DisplayName and ExplainText override the title and description from the schema, which are optional.
+// Browsers only read system-wide policy files, so the policies are always generated for computers.
+type Policy struct {
+	Browser     string
+	Name        string
+	DisplayName string
+	ExplainText string
+}
+
+// SchemasDir is the directory, relative to the policy definition files, containing one <browser>.json schema per browser.
+const SchemasDir = "browser"
+
+// policyType is the type of rules the browser policies are applied by.
+const policyType = "browser"
+
+// schemaProperty is a subset of the JSON schema keywords describing a single browser policy.
+type schemaProperty struct {
+	Type        string          `json:"type"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Default     json.RawMessage `json:"default"`
+	Enum        []any           `json:"enum"`
+	Minimum     *json.Number    `json:"minimum"`
+	Maximum     *json.Number    `json:"maximum"`
+	Items       *schemaProperty `json:"items"`
+}
+
+type schema struct {
+	Properties map[string]schemaProperty `json:"properties"`
+}
+
+// Generate creates a set of expanded policies from a list of policies and
+// the browser JSON policy schemas available in schemasDir.
+func Generate(policies []Policy, release string, schemasDir string) (ep []common.ExpandedPolicy, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't generate browser expanded policies"))
+
+	schemas := make(map[string]schema)
+	var r []common.ExpandedPolicy
+	for _, policy := range policies {
+		if policy.Browser == "" || policy.Name == "" {
+			return nil, errors.New(gotext.Get("browser policy definition needs a browser and a name: %v", policy))
+		}
+
+		s, ok := schemas[policy.Browser]
+		if !ok {
+			if s, err = loadSchema(filepath.Join(schemasDir, policy.Browser+".json")); err != nil {
+				return nil, err
+			}
+			schemas[policy.Browser] = s
+		}
+
+		prop, ok := s.Properties[policy.Name]
+		if !ok {
+			log.Warningf("%s policy %q is not available in the browser schema", policy.Browser, policy.Name)
+			continue
+		}
+
+		p := common.ExpandedPolicy{
+			Key:         fmt.Sprintf("/%s/%s", policy.Browser, policy.Name),
+			DisplayName: firstNonEmpty(policy.DisplayName, prop.Title, policy.Name),
+			ExplainText: strings.TrimSpace(firstNonEmpty(policy.ExplainText, prop.Description)),
+			Class:       "Machine",
+			Release:     release,
+			Type:        policyType,
+		}
+
+		// meta is the value type, used by the browser manager to convert the value to JSON.
+		var meta string
+		switch {
+		case len(prop.Enum) > 0:
+			p.ElementType = common.WidgetTypeDropdownList
+			for _, e := range prop.Enum {
+				p.Choices = append(p.Choices, fmt.Sprint(e))
+			}
+			meta = prop.Type
+		case prop.Type == "boolean":
+			p.ElementType = common.WidgetTypeBool
+			meta = prop.Type
+		case prop.Type == "integer":
+			p.ElementType = common.WidgetTypeDecimal
+			if prop.Minimum != nil {
+				p.RangeValues.Min = prop.Minimum.String()
+			}
+			if prop.Maximum != nil {
+				p.RangeValues.Max = prop.Maximum.String()
+			}
+			meta = prop.Type
+		case prop.Type == "string":
+			p.ElementType = common.WidgetTypeText
+			meta = prop.Type
+		case prop.Type == "array" && prop.Items != nil && prop.Items.Type == "string":
+			p.ElementType = common.WidgetTypeMultiText
+			meta = prop.Type
+		default:
+			// Any other type (objects, arrays of objects…) is entered as raw JSON.
+			p.ElementType = common.WidgetTypeText
+			meta = "json"
+			p.ExplainText = strings.TrimSpace(gotext.Get("%s\n\nThe value must be a valid JSON document.", p.ExplainText))
+		}
+
+		if len(prop.Default) > 0 {
+			p.Default = defaultToString(prop.Default)
+		}
+
+		p.MetaEnabled = map[string]string{"meta": meta}
+		p.MetaDisabled = map[string]string{"meta": meta}
+
+		r = append(r, p)
+	}
+
+	return r, nil
+}
+
+// loadSchema loads a browser JSON policy schema.
+func loadSchema(p string) (s schema, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load browser policy schema %q", p))
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return s, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// defaultToString returns the schema default value as displayed in the policy description.
+func defaultToString(v json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		return s
+	}
+	return string(v)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
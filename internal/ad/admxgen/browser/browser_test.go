@@ -0,0 +1,66 @@
+package browser_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/ad/admxgen/browser"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestGenerate(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		policies []browser.Policy
+		schemas  string
+
+		wantErr bool
+	}{
+		"Boolean policy":                 {policies: []browser.Policy{{Browser: "firefox", Name: "DisableTelemetry"}}},
+		"String policy":                  {policies: []browser.Policy{{Browser: "chromium", Name: "HomepageLocation"}}},
+		"Array of strings policy":        {policies: []browser.Policy{{Browser: "chromium", Name: "URLBlocklist"}}},
+		"Integer policy with range":      {policies: []browser.Policy{{Browser: "chromium", Name: "MaxConnectionsPerProxy"}}},
+		"String enum policy":             {policies: []browser.Policy{{Browser: "firefox", Name: "DisplayBookmarksToolbar"}}},
+		"Integer enum policy":            {policies: []browser.Policy{{Browser: "chromium", Name: "DefaultCookiesSetting"}}},
+		"Object policy is raw JSON":      {policies: []browser.Policy{{Browser: "firefox", Name: "Homepage"}}},
+		"Array of objects is raw JSON":   {policies: []browser.Policy{{Browser: "chromium", Name: "ManagedBookmarks"}}},
+		"Policy with default":            {policies: []browser.Policy{{Browser: "chromium", Name: "BookmarkBarEnabled"}}},
+		"Definition overrides schema":    {policies: []browser.Policy{{Browser: "chromium", Name: "HomepageLocation", DisplayName: "Home page", ExplainText: "Custom description."}}},
+		"Multiple browsers and policies": {policies: []browser.Policy{{Browser: "firefox", Name: "DisableTelemetry"}, {Browser: "chromium", Name: "HomepageLocation"}, {Browser: "firefox", Name: "SearchEngines"}}},
+
+		// Edge cases
+		"Policy not in schema is ignored": {policies: []browser.Policy{{Browser: "firefox", Name: "DoesNotExist"}, {Browser: "firefox", Name: "DisableTelemetry"}}},
+		"Empty":                           {policies: []browser.Policy{}},
+
+		// Error cases
+		"Error on missing browser": {policies: []browser.Policy{{Name: "DisableTelemetry"}}, wantErr: true},
+		"Error on missing name":    {policies: []browser.Policy{{Browser: "firefox"}}, wantErr: true},
+		"Error on missing schema":  {policies: []browser.Policy{{Browser: "opera", Name: "DisableTelemetry"}}, wantErr: true},
+		"Error on invalid schema":  {policies: []browser.Policy{{Browser: "firefox", Name: "DisableTelemetry"}}, schemas: "invalid", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.schemas == "" {
+				tc.schemas = "valid"
+			}
+
+			got, err := browser.Generate(tc.policies, "20.04", filepath.Join(testutils.TestFamilyPath(t), "schemas", tc.schemas))
+			if tc.wantErr {
+				require.Error(t, err, "Generate should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Generate should issue no error")
+
+			want := testutils.LoadWithUpdateFromGoldenYAML(t, got)
+			if len(want) == 0 {
+				want = nil
+			}
+			assert.Equal(t, want, got, "expected and got differs")
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/ad/admxgen/browser"
 	"github.com/ubuntu/adsys/internal/ad/admxgen/common"
 	"github.com/ubuntu/adsys/internal/ad/admxgen/dconf"
 	adcommon "github.com/ubuntu/adsys/internal/ad/common"
@@ -68,6 +69,17 @@ func Expand(src, dst, root, currentSession string) error {
 					return err
 				}
 				expandedPoliciesStream <- ep
+			case "browser":
+				var policies []browser.Policy
+				if err = yaml.Unmarshal(data, &policies); err != nil {
+					return err
+				}
+
+				ep, err := browser.Generate(policies, release, filepath.Join(src, browser.SchemasDir))
+				if err != nil {
+					return err
+				}
+				expandedPoliciesStream <- ep
 			default:
 				var policies []common.ExpandedPolicy
 				if err = yaml.Unmarshal(data, &policies); err != nil {
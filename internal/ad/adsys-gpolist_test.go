@@ -29,6 +29,7 @@ func TestAdsysGPOList(t *testing.T) {
 		url             string
 		accountName     string
 		objectClass     string
+		sids            []string
 		krb5ccNameState string
 
 		wantErr        bool
@@ -148,6 +149,12 @@ func TestAdsysGPOList(t *testing.T) {
 			accountName: "UserEveryoneDenied@GPOONLY.COM",
 		},
 
+		// The WMI filter of a GPO is printed for the client to evaluate it. A GPO whose
+		// filter doesn't exist anymore can't be evaluated and is skipped.
+		"WMI filters are printed alongside their GPO": {
+			accountName: "UserWMIFilter@GPOONLY.COM",
+		},
+
 		"No gPOptions fallbacks to 0": {
 			accountName: "UserNogPOptions@GPOONLY.COM",
 		},
@@ -170,6 +177,15 @@ func TestAdsysGPOList(t *testing.T) {
 			objectClass: "computer",
 		},
 
+		// SID lookups
+		"Look up accounts by SID": {
+			sids: []string{
+				"S-1-5-21-16178157-162784614-155579044-1105",
+				"S-1-5-21-16178157-162784614-155579044-1107",
+				"S-1-5-21-16178157-162784614-155579044-1108",
+			},
+		},
+
 		// Error cases
 		"Error on no network": {
 			url:            "NT_STATUS_NETWORK_UNREACHABLE",
@@ -219,6 +235,17 @@ func TestAdsysGPOList(t *testing.T) {
 			wantErr:        true,
 		},
 
+		"Error on SID not found": {
+			sids:           []string{"S-1-5-21-16178157-162784614-155579044-1105", "S-1-5-21-16178157-162784614-155579044-9999"},
+			wantReturnCode: 1,
+			wantErr:        true,
+		},
+		"Error on SID of another domain": {
+			sids:           []string{"S-1-5-21-11111111-222222222-333333333-1107"},
+			wantReturnCode: 1,
+			wantErr:        true,
+		},
+
 		"Error on KRB5CCNAME unset": {
 			accountName:     "UserAtRoot@GPOONLY.COM",
 			krb5ccNameState: "unset",
@@ -273,7 +300,15 @@ func TestAdsysGPOList(t *testing.T) {
 			}
 
 			// #nosec G204: we control the command line name and only change it for tests
-			cmd := exec.Command(adsysGPOListcmd, "--objectclass", tc.objectClass, tc.url, tc.accountName)
+			args := []string{"--objectclass", tc.objectClass, tc.url, tc.accountName}
+			if tc.sids != nil {
+				args = nil
+				for _, sid := range tc.sids {
+					args = append(args, "--sid", sid)
+				}
+				args = append(args, tc.url)
+			}
+			cmd := exec.Command(adsysGPOListcmd, args...)
 			got, err := cmd.CombinedOutput()
 			if tc.wantErr {
 				require.Error(t, err, "adsys-gpostlist should have failed but didn’t")
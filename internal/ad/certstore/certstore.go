@@ -0,0 +1,64 @@
+// Package certstore handles parsing the certificates of Windows Public Key Policies.
+//
+// Those certificates are stored in Registry.pol as serialized certificate store elements: a list of
+// properties, each one made of a little endian property ID, a reserved field, the length of its data
+// and the data itself. The encoded certificate is the data of the CERT_CERT_PROP_ID property.
+package certstore
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // SHA-1 is only used to identify certificates, like Windows does.
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+)
+
+// certPropID is the ID of the property containing the DER encoded certificate (CERT_CERT_PROP_ID).
+const certPropID = 0x20
+
+type propertyHeader struct {
+	ID       uint32
+	Reserved uint32
+	Length   uint32
+}
+
+// Decode parses a serialized certificate store element and returns its certificate.
+func Decode(r io.Reader) (cert *x509.Certificate, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse certificate store element"))
+
+	for {
+		var h propertyHeader
+		if err := binary.Read(r, binary.LittleEndian, &h); errors.Is(err, io.EOF) {
+			return nil, errors.New(gotext.Get("no certificate found"))
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Don't trust the length to allocate the data: the buffer grows with what we actually read.
+		var data bytes.Buffer
+		if _, err := io.CopyN(&data, r, int64(h.Length)); errors.Is(err, io.EOF) {
+			return nil, errors.New(gotext.Get("property %#x is truncated", h.ID))
+		} else if err != nil {
+			return nil, err
+		}
+
+		if h.ID != certPropID {
+			continue
+		}
+		return x509.ParseCertificate(data.Bytes())
+	}
+}
+
+// Thumbprint returns the thumbprint identifying cert in Windows certificate stores: its uppercase
+// hexadecimal SHA-1 hash.
+func Thumbprint(cert *x509.Certificate) string {
+	//nolint:gosec // SHA-1 is only used to identify certificates, like Windows does.
+	h := sha1.Sum(cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(h[:]))
+}
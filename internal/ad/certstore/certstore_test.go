@@ -0,0 +1,53 @@
+package certstore_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/ad/certstore"
+)
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		wantCommonName string
+		wantThumbprint string
+		wantErr        bool
+	}{
+		"root certificate":                         {wantCommonName: "example-ROOT-CA", wantThumbprint: "9344E5268D3440FDECA7CEE223986340C17F2B4E"},
+		"intermediate certificate":                 {wantCommonName: "example-ISSUING-CA", wantThumbprint: "0707AC4E2A9E2560703CE4992DE115DB6BCE6681"},
+		"certificate only":                         {wantCommonName: "example-ROOT-CA", wantThumbprint: "9344E5268D3440FDECA7CEE223986340C17F2B4E"},
+		"properties after certificate are ignored": {wantCommonName: "example-ROOT-CA", wantThumbprint: "9344E5268D3440FDECA7CEE223986340C17F2B4E"},
+
+		// Error cases
+		"error on empty blob":                {wantErr: true},
+		"error on blob without certificate":  {wantErr: true},
+		"error on truncated property header": {wantErr: true},
+		"error on truncated property":        {wantErr: true},
+		"error on invalid certificate":       {wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := os.Open(filepath.Join("testdata", strings.ReplaceAll(name, " ", "_")+".blob"))
+			require.NoError(t, err, "Setup: can't open certificate blob")
+			defer f.Close()
+
+			cert, err := certstore.Decode(f)
+			if tc.wantErr {
+				require.Error(t, err, "Decode should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Decode failed but shouldn't have")
+
+			require.Equal(t, tc.wantCommonName, cert.Subject.CommonName, "Decode returned an unexpected certificate")
+			require.Equal(t, tc.wantThumbprint, certstore.Thumbprint(cert), "Thumbprint returned an unexpected value")
+		})
+	}
+}
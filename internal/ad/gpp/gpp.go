@@ -0,0 +1,113 @@
+// Package gpp handles parsing Windows Group Policy Preferences XML files, like Drives.xml or Groups.xml,
+// to convert them to a datastructure for adsys to consume.
+package gpp
+
+import (
+	"encoding/xml"
+	"io"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Item is a preference item, like a mapped drive, an environment variable or a local group.
+type Item struct {
+	// Type is the element name of the item, like Drive, EnvironmentVariable or Group.
+	Type string
+	// Name is the name displayed in the Group Policy Management Editor.
+	Name string
+	// Disabled is true if the item, or one of the collections it belongs to, is disabled.
+	Disabled bool
+	// Properties are the attributes of the Properties element of the item, like action or path.
+	Properties map[string]string
+	// Members are the members of a local group item.
+	Members []Member
+}
+
+// Member is a member of a local group item.
+type Member struct {
+	Name   string
+	Action string
+	SID    string
+}
+
+// Action returns the action of the item: C (create), R (replace), U (update) or D (delete).
+// Items without any action are updated, as on Windows.
+func (i Item) Action() string {
+	if a := i.Properties["action"]; a != "" {
+		return a
+	}
+	return "U"
+}
+
+// collection is the element name of a collection, grouping items in the Group Policy Management Editor.
+const collection = "Collection"
+
+type file struct {
+	Items []element `xml:",any"`
+}
+
+// element is either an item or a collection of elements.
+type element struct {
+	XMLName    xml.Name
+	Name       string `xml:"name,attr"`
+	Disabled   string `xml:"disabled,attr"`
+	Properties *struct {
+		Attrs   []xml.Attr `xml:",any,attr"`
+		Members []struct {
+			Name   string `xml:"name,attr"`
+			Action string `xml:"action,attr"`
+			SID    string `xml:"sid,attr"`
+		} `xml:"Members>Member"`
+	} `xml:"Properties"`
+	Children []element `xml:",any"`
+}
+
+// Decode parses a preferences stream and returns its items, in order. Items of collections are flattened.
+// Preferences written by Windows are encoded in UTF-8, and can start with a byte order mark.
+func Decode(r io.Reader) (items []Item, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse preferences"))
+
+	d := xml.NewDecoder(transform.NewReader(r, unicode.BOMOverride(unicode.UTF8.NewDecoder())))
+	// The stream is already converted to UTF-8, whatever the declared encoding is.
+	d.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) { return input, nil }
+
+	var f file
+	if err := d.Decode(&f); err != nil {
+		return nil, err
+	}
+
+	return flatten(f.Items, false), nil
+}
+
+// flatten returns the items of elements, with the items of nested collections in place.
+func flatten(elements []element, disabled bool) (items []Item) {
+	for _, e := range elements {
+		disabled := disabled || e.Disabled == "1"
+		if e.XMLName.Local == collection {
+			items = append(items, flatten(e.Children, disabled)...)
+			continue
+		}
+		// Other child elements, like filters, are not items.
+		if e.Properties == nil {
+			continue
+		}
+
+		item := Item{
+			Type:       e.XMLName.Local,
+			Name:       e.Name,
+			Disabled:   disabled,
+			Properties: make(map[string]string),
+		}
+		for _, a := range e.Properties.Attrs {
+			item.Properties[a.Name.Local] = a.Value
+		}
+		for _, m := range e.Properties.Members {
+			item.Members = append(item.Members, Member{Name: m.Name, Action: m.Action, SID: m.SID})
+		}
+		items = append(items, item)
+	}
+	return items
+}
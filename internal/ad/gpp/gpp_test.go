@@ -0,0 +1,104 @@
+package gpp_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/ad/gpp"
+)
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		want    []gpp.Item
+		wantErr bool
+	}{
+		"drives with bom": {want: []gpp.Item{
+			{Type: "Drive", Name: "H:", Properties: map[string]string{
+				"action": "U", "thisDrive": "NOCHANGE", "allDrives": "NOCHANGE", "userName": "", "path": `\\fileserver.example.com\homes\%LogonUser%`,
+				"label": "Home", "persistent": "1", "useLetter": "1", "letter": "H",
+			}},
+			{Type: "Drive", Name: "S:", Disabled: true, Properties: map[string]string{
+				"action": "R", "thisDrive": "NOCHANGE", "allDrives": "NOCHANGE", "userName": "", "path": `\\fileserver.example.com\shared`,
+				"label": "Shared", "persistent": "1", "useLetter": "1", "letter": "S",
+			}},
+		}},
+		"environment variables": {want: []gpp.Item{
+			{Type: "EnvironmentVariable", Name: "HTTP_PROXY", Properties: map[string]string{
+				"action": "U", "name": "HTTP_PROXY", "value": "http://proxy.example.com:3128", "user": "0", "partial": "0",
+			}},
+			{Type: "EnvironmentVariable", Name: "Path", Properties: map[string]string{
+				"action": "U", "name": "Path", "value": `C:\Tools`, "user": "0", "partial": "1",
+			}},
+		}},
+		"groups with members": {want: []gpp.Item{
+			{Type: "Group", Name: "docker",
+				Properties: map[string]string{
+					"action": "U", "newName": "", "description": "", "deleteAllUsers": "0", "deleteAllGroups": "0", "removeAccounts": "0", "groupName": "docker",
+				},
+				Members: []gpp.Member{
+					{Name: `EXAMPLE\alice`, Action: "ADD", SID: "S-1-5-21-1004336348-1177238915-682003330-1105"},
+					{Name: `EXAMPLE\bob`, Action: "REMOVE", SID: "S-1-5-21-1004336348-1177238915-682003330-1106"},
+				}},
+			{Type: "User", Name: "localadmin", Properties: map[string]string{
+				"action": "U", "newName": "", "fullName": "", "description": "", "cpassword": "", "changeLogon": "0", "noChange": "0",
+				"neverExpires": "0", "acctDisabled": "1", "userName": "localadmin",
+			}},
+		}},
+		"collections are flattened": {want: []gpp.Item{
+			{Type: "Drive", Name: "H:", Properties: map[string]string{"action": "U", "path": `\\fileserver.example.com\homes`, "letter": "H"}},
+			{Type: "Drive", Name: "P:", Properties: map[string]string{"action": "C", "path": `\\fileserver.example.com\projects`, "letter": "P"}},
+			{Type: "Drive", Name: "A:", Disabled: true, Properties: map[string]string{"action": "U", "path": `\\fileserver.example.com\archives`, "letter": "A"}},
+		}},
+		"empty preferences": {},
+
+		// Error cases
+		"error on empty file":  {wantErr: true},
+		"error on invalid xml": {wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := os.Open(filepath.Join("testdata", strings.ReplaceAll(name, " ", "_")+".xml"))
+			require.NoError(t, err, "Setup: can't open preferences file")
+			defer f.Close()
+
+			got, err := gpp.Decode(f)
+			if tc.wantErr {
+				require.Error(t, err, "Decode should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Decode failed but shouldn't have")
+			require.Equal(t, tc.want, got, "Decode returned unexpected items")
+		})
+	}
+}
+
+func TestAction(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		properties map[string]string
+
+		want string
+	}{
+		"Action of the item":             {properties: map[string]string{"action": "D"}, want: "D"},
+		"Items without action update":    {properties: map[string]string{"path": `\\server\share`}, want: "U"},
+		"Items with empty action update": {properties: map[string]string{"action": ""}, want: "U"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got := gpp.Item{Properties: tc.properties}.Action()
+			require.Equal(t, tc.want, got, "Action returned unexpected action")
+		})
+	}
+}
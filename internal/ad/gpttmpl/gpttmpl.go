@@ -0,0 +1,77 @@
+// Package gpttmpl handles parsing Windows security template GptTmpl.inf files
+// to convert them to a datastructure for adsys to consume.
+package gpttmpl
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Template is the content of a security template: the values of each key, per section.
+type Template map[string]map[string]string
+
+// Value returns the value of key in section, and if it was found.
+// Sections and keys are case insensitive, as on Windows.
+func (t Template) Value(section, key string) (string, bool) {
+	for s, values := range t {
+		if !strings.EqualFold(s, section) {
+			continue
+		}
+		for k, v := range values {
+			if strings.EqualFold(k, key) {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Decode parses a security template stream and returns its content.
+// Templates written by Windows are encoded in UTF-16 with a byte order mark. Templates without a byte
+// order mark are read as UTF-8.
+func Decode(r io.Reader) (t Template, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse security template"))
+
+	t = make(Template)
+	var section string
+
+	scanner := bufio.NewScanner(transform.NewReader(r, unicode.BOMOverride(unicode.UTF8.NewDecoder())))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, errors.New(gotext.Get("invalid section %q", line))
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if t[section] == nil {
+				t[section] = make(map[string]string)
+			}
+			continue
+		}
+
+		if section == "" {
+			return nil, errors.New(gotext.Get("value %q is not part of any section", line))
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, errors.New(gotext.Get("invalid line %q in section %q: expected <key> = <value>", line, section))
+		}
+		t[section][strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
@@ -0,0 +1,109 @@
+package gpttmpl_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/ad/gpttmpl"
+)
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	windowsTemplate := gpttmpl.Template{
+		"Unicode": {"Unicode": "yes"},
+		"System Access": {
+			"MinimumPasswordAge":    "1",
+			"MaximumPasswordAge":    "42",
+			"MinimumPasswordLength": "12",
+			"PasswordComplexity":    "1",
+			"PasswordHistorySize":   "24",
+			"LockoutBadCount":       "5",
+			"ResetLockoutCount":     "15",
+			"LockoutDuration":       "30",
+		},
+		"Privilege Rights": {"SeInteractiveLogonRight": "*S-1-5-32-544,*S-1-5-32-545"},
+		"Version":          {"signature": `"$CHICAGO$"`, "Revision": "1"},
+	}
+
+	tests := map[string]struct {
+		want    gpttmpl.Template
+		wantErr bool
+	}{
+		"utf-16le with bom":                    {want: windowsTemplate},
+		"utf-16be with bom":                    {want: windowsTemplate},
+		"utf-8 with bom":                       {want: windowsTemplate},
+		"utf-8 without bom":                    {want: windowsTemplate},
+		"comments and empty lines are ignored": {want: gpttmpl.Template{"System Access": {"MinimumPasswordLength": "12"}}},
+		"empty section":                        {want: gpttmpl.Template{"System Access": {}}},
+		"empty file":                           {want: gpttmpl.Template{}},
+		"value with equal sign":                {want: gpttmpl.Template{"Registry Values": {`MACHINE\Software\Key`: "4,1"}}},
+		"duplicated section is merged": {want: gpttmpl.Template{
+			"System Access": {"MinimumPasswordLength": "12", "PasswordComplexity": "1"},
+			"Version":       {"Revision": "1"},
+		}},
+		"duplicated key last wins": {want: gpttmpl.Template{"System Access": {"MinimumPasswordLength": "12"}}},
+
+		// Error cases
+		"error on invalid section":          {wantErr: true},
+		"error on value outside of section": {wantErr: true},
+		"error on line without value":       {wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := os.Open(templateFilePath(name))
+			require.NoError(t, err, "Setup: can't open template file")
+			defer f.Close()
+
+			got, err := gpttmpl.Decode(f)
+			if tc.wantErr {
+				require.Error(t, err, "Decode should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Decode failed but shouldn't have")
+			require.Equal(t, tc.want, got, "Decode returned unexpected template")
+		})
+	}
+}
+
+func TestValue(t *testing.T) {
+	t.Parallel()
+
+	tmpl := gpttmpl.Template{
+		"System Access": {"MinimumPasswordLength": "12"},
+	}
+
+	tests := map[string]struct {
+		section string
+		key     string
+
+		want      string
+		wantFound bool
+	}{
+		"Existing key":                         {section: "System Access", key: "MinimumPasswordLength", want: "12", wantFound: true},
+		"Section and key are case insensitive": {section: "system access", key: "MINIMUMPASSWORDLENGTH", want: "12", wantFound: true},
+
+		"Missing key":     {section: "System Access", key: "PasswordComplexity"},
+		"Missing section": {section: "Privilege Rights", key: "MinimumPasswordLength"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, found := tmpl.Value(tc.section, tc.key)
+			require.Equal(t, tc.wantFound, found, "Value should report if the key was found")
+			require.Equal(t, tc.want, got, "Value returned unexpected value")
+		})
+	}
+}
+
+func templateFilePath(name string) string {
+	return filepath.Join("testdata", strings.ReplaceAll(name, " ", "_")+".inf")
+}
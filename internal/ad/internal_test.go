@@ -535,7 +535,7 @@ func TestFetchOneGPOWhileParsingItConcurrently(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		// we can’t test returned values as it’s either the old of new version of the gpo
-		_, err := adc.parseGPOs(context.Background(), orderedGPOs, UserObject)
+		_, err := adc.parseGPOs(context.Background(), orderedGPOs, UserObject, "", "")
 		require.NoError(t, err, "parseGPOs returned an error but shouldn't")
 	}()
 	wg.Wait()
@@ -569,7 +569,7 @@ func TestParseGPOConcurrent(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			// we can’t test returned values as it’s either the old of new version of the gpo
-			_, err := adc.parseGPOs(context.Background(), orderedGPOs, UserObject)
+			_, err := adc.parseGPOs(context.Background(), orderedGPOs, UserObject, "", "")
 			require.NoError(t, err, "parseGPOs returned an error but shouldn't")
 		}()
 	}
@@ -44,7 +44,8 @@ var ErrTicketNotPresent = errors.New(gotext.Get("ticket not found or not accessi
 
 // TicketPath returns the path of the default kerberos ticket cache for the
 // current user.
-// It returns an error if the path is empty or does not exist on the disk.
+// It returns an error if the path is empty, does not exist on the disk or
+// if the default ticket cache is not a file.
 func TicketPath() (string, error) {
 	cKrb5cc, err := C.get_ticket_path()
 	defer C.free(unsafe.Pointer(cKrb5cc))
@@ -56,7 +57,12 @@ func TicketPath() (string, error) {
 		return "", errors.New(gotext.Get("path is empty"))
 	}
 
+	// Only file caches can be shared with the daemon. Other types, like KEYRING or KCM when the default
+	// ccache name is changed in the Kerberos configuration, are reported as not accessible.
 	krb5ccPath := strings.TrimPrefix(krb5cc, "FILE:")
+	if ccType, _, found := strings.Cut(krb5ccPath, ":"); found {
+		return "", errors.Join(ErrTicketNotPresent, errors.New(gotext.Get("ticket cache type %s is not supported", ccType)))
+	}
 	fileInfo, err := os.Stat(krb5ccPath)
 	if err != nil {
 		return "", errors.Join(ErrTicketNotPresent, err)
@@ -40,6 +40,7 @@ func TestTicketPath(t *testing.T) {
 		"Error on empty ticket path":            {krb5Behavior: "return_empty_ccache", wantErr: true},
 		"Error on NULL ticket path":             {krb5Behavior: "return_null_ccache", wantErr: true},
 		"Error on non-FILE ccache":              {krb5Behavior: "return_memory_ccache", wantErrType: ad.ErrTicketNotPresent},
+		"Error on KEYRING ccache":               {krb5Behavior: "return_ccache:KEYRING:persistent:%s", wantErrType: ad.ErrTicketNotPresent},
 	}
 
 	for name, tc := range tests {
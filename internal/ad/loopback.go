@@ -0,0 +1,105 @@
+package ad
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// loopbackPolicyKey is the computer GPO entry of the Windows "Configure user Group Policy loopback processing mode"
+	// policy. Its value is 1 for the merge mode and 2 for the replace mode.
+	loopbackPolicyKey = "Software/Policies/Microsoft/Windows/System/UserPolicyMode"
+
+	// loopbackRuleType and loopbackModeKey store the loopback processing mode in the computer policies.
+	loopbackRuleType = "loopback"
+	loopbackModeKey  = "mode"
+
+	// loopbackMerge appends the computer GPOs to the user ones, with a higher priority.
+	loopbackMerge = "merge"
+	// loopbackReplace replaces the user GPOs by the computer ones.
+	loopbackReplace = "replace"
+)
+
+// loopbackEntry converts the loopback processing policy to the entry of the loopback mode.
+// The entry is disabled if the policy is disabled or doesn't request any supported mode.
+func loopbackEntry(pol entry.Entry) entry.Entry {
+	e := entry.Entry{Key: loopbackModeKey, Disabled: true}
+	if pol.Disabled {
+		return e
+	}
+
+	switch pol.Value {
+	case "1":
+		e.Value = loopbackMerge
+	case "2":
+		e.Value = loopbackReplace
+	default:
+		return e
+	}
+	e.Disabled = false
+	return e
+}
+
+// loopbackMode returns the loopback processing mode from the policies last applied to the computer,
+// or an empty string if loopback processing is not enabled.
+func (ad *AD) loopbackMode(ctx context.Context) string {
+	pols, err := policies.NewFromCache(ctx, filepath.Join(ad.policiesCacheDir, ad.hostname))
+	if err != nil {
+		log.Debugf(ctx, "No policies applied to the computer, loopback processing is disabled: %v", err)
+		return ""
+	}
+	defer decorate.LogFuncOnErrorContext(ctx, pols.Close)
+
+	for _, e := range pols.GetUniqueRules()[loopbackRuleType] {
+		if e.Key != loopbackModeKey || e.Disabled {
+			continue
+		}
+		return e.Value
+	}
+	return ""
+}
+
+// withLoopbackGPOs returns the user GPOs with the computer ones, depending on the loopback processing mode
+// applied to the computer. The mode is returned alongside, and is empty if loopback processing is not enabled.
+//
+// In merge mode, the computer GPOs take precedence over the user ones. A GPO applying to both is only
+// listed once, with the computer priority. In replace mode, only the computer GPOs are returned.
+func (ad *AD) withLoopbackGPOs(ctx context.Context, adServerFQDN string, userGPOs []gpo) (gpos []gpo, mode string, err error) {
+	mode = ad.loopbackMode(ctx)
+	if mode == "" {
+		return userGPOs, "", nil
+	}
+	log.Debugf(ctx, "Loopback processing is enabled in %s mode", mode)
+
+	defer decorate.OnError(&err, gotext.Get("can't get computer GPOs for loopback processing"))
+
+	// The computer ticket copy is kept up to date for the computer list.
+	krb5CCPath := filepath.Join(ad.krb5CacheDir, ad.hostname)
+	if err := ad.ensureKrb5CCCopy(filepath.Join(ad.krb5CacheDir, "tracking", ad.hostname), krb5CCPath); err != nil {
+		return nil, "", err
+	}
+	computerGPOs, err := ad.gpoList(ctx, ad.hostname, ComputerObject, adServerFQDN, krb5CCPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if mode == loopbackReplace {
+		return computerGPOs, mode, nil
+	}
+
+	gpos = computerGPOs
+	for _, g := range userGPOs {
+		if slices.ContainsFunc(computerGPOs, func(c gpo) bool { return c.name == g.name }) {
+			continue
+		}
+		gpos = append(gpos, g)
+	}
+	return gpos, mode, nil
+}
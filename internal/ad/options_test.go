@@ -21,3 +21,11 @@ func WithVersionID(versionID string) Option {
 		return nil
 	}
 }
+
+// WithSystemRoot specifies a personalized root directory, to evaluate the WMI filters against.
+func WithSystemRoot(root string) Option {
+	return func(o *options) error {
+		o.systemRoot = root
+		return nil
+	}
+}
@@ -0,0 +1,222 @@
+package ad
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/ad/gpp"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+// preferenceFiles are the supported Group Policy Preferences, stored in <class>/Preferences/<name>/<name>.xml
+// in the GPO directory. Their items are converted to the lines of a single entry of ruleType, whose key
+// depends on the object class. Preferences without any key for the object class are ignored.
+var preferenceFiles = []struct {
+	name     string
+	ruleType string
+	keys     map[ObjectClass]string
+	convert  func(context.Context, []gpp.Item, ObjectClass) []string
+}{
+	{
+		name:     "Drives",
+		ruleType: "mount",
+		keys:     map[ObjectClass]string{UserObject: "user-mounts"},
+		convert:  drivesToMounts,
+	},
+	{
+		name:     "EnvironmentVariables",
+		ruleType: "environment",
+		keys: map[ObjectClass]string{
+			ComputerObject: "environment/variables-machine",
+			UserObject:     "environment/variables-user",
+		},
+		convert: environmentVariablesToVariables,
+	},
+	{
+		name:     "Groups",
+		ruleType: "groups",
+		keys:     map[ObjectClass]string{ComputerObject: "groups/members"},
+		convert:  groupsToMembers,
+	},
+}
+
+var (
+	// preferenceVariables maps the Group Policy Preferences variables to their dynamic values.
+	preferenceVariables = map[string]string{
+		"LOGONUSER":    "${USER}",
+		"USERNAME":     "${USER}",
+		"LOGONDOMAIN":  "${DOMAIN}",
+		"USERDOMAIN":   "${DOMAIN}",
+		"COMPUTERNAME": "${HOSTNAME}",
+	}
+
+	// preferenceVariableRegexp matches a variable in a preference value, like %LogonUser%.
+	preferenceVariableRegexp = regexp.MustCompile(`%([A-Za-z_][A-Za-z0-9_]*)%`)
+)
+
+// builtinGroupSIDPrefix is the SID prefix of the Windows built-in local groups, like Administrators.
+const builtinGroupSIDPrefix = "S-1-5-32-"
+
+// parsePreferences adds the entries converted from the Group Policy Preferences of the GPO, if any, to the GPO rules.
+// They are added after the ones from the registry policy, with the append strategy, so that values from both are merged.
+func (ad *AD) parsePreferences(ctx context.Context, name, url string, objectClass ObjectClass, gpoWithRules policies.GPO) (err error) {
+	ad.downloadablesMu.RLock()
+	d := ad.downloadables[name]
+	ad.downloadablesMu.RUnlock()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	class := "User"
+	if objectClass == ComputerObject {
+		class = "Machine"
+	}
+
+	for _, p := range preferenceFiles {
+		key, ok := p.keys[objectClass]
+		if !ok {
+			continue
+		}
+
+		path, err := findCaseInsensitive(filepath.Join(ad.sysvolCacheDir, "Policies", filepath.Base(url)), class, "Preferences", p.name, p.name+".xml")
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			continue
+		}
+		log.Debugf(ctx, "Found preferences %q", path)
+
+		items, err := decodePreferences(ctx, path)
+		if err != nil {
+			return err
+		}
+
+		lines := p.convert(ctx, items, objectClass)
+		if len(lines) == 0 {
+			continue
+		}
+		gpoWithRules.Rules[p.ruleType] = append(gpoWithRules.Rules[p.ruleType], entry.Entry{
+			Key:      key,
+			Value:    strings.Join(lines, "\n"),
+			Strategy: entry.StrategyAppend,
+		})
+	}
+
+	return nil
+}
+
+// decodePreferences returns the items of the preferences file at path.
+func decodePreferences(ctx context.Context, path string) (items []gpp.Item, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse preferences %q", path))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer decorate.LogFuncOnErrorContext(ctx, f.Close)
+
+	return gpp.Decode(f)
+}
+
+// applicableItems returns the items of type itemType which are not disabled nor deleting their target.
+// Deletions can't be converted, as removing a policy already restores the previous state on the client.
+func applicableItems(ctx context.Context, items []gpp.Item, itemType string) (r []gpp.Item) {
+	for _, item := range items {
+		if item.Type != itemType {
+			continue
+		}
+		if item.Disabled {
+			log.Debugf(ctx, "Preference %q is disabled", item.Name)
+			continue
+		}
+		if item.Action() == "D" {
+			log.Debugf(ctx, "Preference %q deletes its target, which is not supported", item.Name)
+			continue
+		}
+		r = append(r, item)
+	}
+	return r
+}
+
+// drivesToMounts converts the mapped drives to user mounts lines.
+// Windows authenticates to the share with the user credentials, which translates to a Kerberos mount.
+func drivesToMounts(ctx context.Context, items []gpp.Item, _ ObjectClass) (lines []string) {
+	for _, item := range applicableItems(ctx, items, "Drive") {
+		path := item.Properties["path"]
+		if !strings.HasPrefix(path, `\\`) {
+			log.Debugf(ctx, "Mapped drive %q is not a network share: %q", item.Name, path)
+			continue
+		}
+		path = strings.TrimSuffix(strings.ReplaceAll(strings.TrimPrefix(path, `\\`), `\`, "/"), "/")
+		lines = append(lines, fmt.Sprintf("[krb5]smb://%s", convertPreferenceVariables(path, false)))
+	}
+	return lines
+}
+
+// environmentVariablesToVariables converts the environment variables to NAME=value lines.
+// Partial variables, appended to the current value on Windows, use the NAME+=value form.
+// Computers only set system variables, as user variables of computers apply to the system account on Windows.
+func environmentVariablesToVariables(ctx context.Context, items []gpp.Item, objectClass ObjectClass) (lines []string) {
+	for _, item := range applicableItems(ctx, items, "EnvironmentVariable") {
+		if objectClass == ComputerObject && item.Properties["user"] == "1" {
+			log.Debugf(ctx, "Environment variable %q is a user variable of the computer", item.Name)
+			continue
+		}
+
+		op := "="
+		if item.Properties["partial"] == "1" {
+			op = "+="
+		}
+		lines = append(lines, item.Properties["name"]+op+convertPreferenceVariables(item.Properties["value"], true))
+	}
+	return lines
+}
+
+// groupsToMembers converts the local groups to <local group>: <member>, <member>… lines.
+// Only added members are converted, as members are never removed from local groups. Windows built-in groups
+// and local users don't exist on the client and are ignored.
+func groupsToMembers(ctx context.Context, items []gpp.Item, _ ObjectClass) (lines []string) {
+	for _, item := range applicableItems(ctx, items, "Group") {
+		if strings.HasPrefix(item.Properties["groupSid"], builtinGroupSIDPrefix) {
+			log.Debugf(ctx, "Local group %q is a Windows built-in group", item.Name)
+			continue
+		}
+
+		var members []string
+		for _, m := range item.Members {
+			if !strings.EqualFold(m.Action, "ADD") {
+				continue
+			}
+			members = append(members, m.Name)
+		}
+		if len(members) == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", item.Properties["groupName"], strings.Join(members, ", ")))
+	}
+	return lines
+}
+
+// convertPreferenceVariables replaces the Group Policy Preferences variables of value by their dynamic values.
+// Other variables are kept as is, or converted to the $NAME form if toEnvironment is true.
+func convertPreferenceVariables(value string, toEnvironment bool) string {
+	return preferenceVariableRegexp.ReplaceAllStringFunc(value, func(v string) string {
+		name := strings.Trim(v, "%")
+		if dynamicValue, ok := preferenceVariables[strings.ToUpper(name)]; ok {
+			return dynamicValue
+		}
+		if toEnvironment {
+			return "$" + name
+		}
+		return v
+	})
+}
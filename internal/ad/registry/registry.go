@@ -5,6 +5,7 @@ package registry
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -53,6 +54,7 @@ type meta struct {
 	Empty    string
 	Meta     string
 	Strategy string
+	Target   string
 }
 
 // DecodePolicy parses a policy stream in registry file format and returns a slice of entries.
@@ -153,6 +155,8 @@ func DecodePolicy(rs io.ReadSeeker) (entries []entry.Entry, err error) {
 					return nil, err
 				}
 				res = strconv.FormatUint(uint64(resInt), 10)
+			case regBinary:
+				res = base64.StdEncoding.EncodeToString(e.data)
 			default:
 				e.err = fmt.Errorf("%d type is not supported for key %s", t, e.key)
 			}
@@ -164,6 +168,7 @@ func DecodePolicy(rs io.ReadSeeker) (entries []entry.Entry, err error) {
 			Disabled: disabled,
 			Meta:     metaValues[e.key].Meta,
 			Strategy: metaValues[e.key].Strategy,
+			Target:   metaValues[e.key].Target,
 			Err:      e.err,
 		})
 	}
@@ -237,6 +242,7 @@ func scanPolicyEntries(data []byte, atEOF bool) (advance int, token []byte, err
 	sectionStart := []byte{'[', 0}                 // [ in UTF-16 (little endian)
 	sectionEnd := []byte{0, 0, ']', 0}             // \0] in UTF-16 (little endian)
 	sectionEndNoNullChar := []byte{';', 0, ']', 0} // ;] in UTF-16 (little endian) - last field can be empty
+	binarySectionEnd := []byte{']', 0}             // ] in UTF-16 (little endian) - binary data has no terminator
 	dataOffset := len(sectionStart)
 	sectionEndWidth := len(sectionEnd)
 
@@ -248,6 +254,21 @@ func scanPolicyEntries(data []byte, atEOF bool) (advance int, token []byte, err
 		}
 	}
 
+	// Binary data can contain any separator: rely on its size instead.
+	if start+dataOffset <= len(data) {
+		if end, isBinary := binaryDataEnd(data[start+dataOffset:]); isBinary {
+			if end >= 0 {
+				end += start + dataOffset
+				return end + len(binarySectionEnd), data[start+dataOffset : end], nil
+			}
+			if atEOF {
+				return 0, nil, fmt.Errorf("binary item does not end with ']'")
+			}
+			// Request more data.
+			return start, nil, nil
+		}
+	}
+
 	// Scan until sectionEnd, marking end of word.
 	for i := start + dataOffset; i+sectionEndWidth-1 < len(data); i++ {
 		if bytes.Equal(data[i:i+sectionEndWidth], sectionEnd) ||
@@ -268,6 +289,45 @@ func scanPolicyEntries(data []byte, atEOF bool) (advance int, token []byte, err
 	return start, nil, nil
 }
 
+// binaryDataEnd returns the end of the data of a binary policy entry, computed from its size field.
+// It returns isBinary as false if the entry is not a binary one, and end as -1 if the entry is incomplete.
+func binaryDataEnd(data []byte) (end int, isBinary bool) {
+	delimiter := []byte{0, 0, ';', 0} // \0; in little endian (UTF-16)
+
+	// Skip key and value fields.
+	var offset int
+	for range 2 {
+		i := bytes.Index(data[offset:], delimiter)
+		if i < 0 {
+			return 0, false
+		}
+		offset += i + len(delimiter)
+	}
+
+	// type and size are both 4 bytes little endian integers, followed by ";".
+	const fieldSize = 4 + 2
+	if len(data) < offset+2*fieldSize {
+		return 0, false
+	}
+	if !bytes.Equal(data[offset+4:offset+fieldSize], []byte{';', 0}) ||
+		!bytes.Equal(data[offset+fieldSize+4:offset+2*fieldSize], []byte{';', 0}) {
+		return 0, false
+	}
+	if binary.LittleEndian.Uint32(data[offset:offset+4]) != uint32(regBinary) {
+		return 0, false
+	}
+
+	size := binary.LittleEndian.Uint32(data[offset+fieldSize : offset+fieldSize+4])
+	end = offset + 2*fieldSize + int(size)
+	if len(data) < end+2 {
+		return -1, true
+	}
+	if !bytes.Equal(data[end:end+2], []byte{']', 0}) {
+		return 0, false
+	}
+	return end, true
+}
+
 func scanForPolicies(s *bufio.Scanner) (entries []policyRawEntry, err error) {
 	defer decorate.OnError(&err, gotext.Get("can't read policy entries"))
 
@@ -43,6 +43,13 @@ func TestDecodePolicy(t *testing.T) {
 					Value: "B\nA",
 				},
 			}},
+		"one element, binary value": {
+			want: []entry.Entry{
+				{
+					Key:   defaultKey,
+					Value: "AQAAXQA7AF0A/w==",
+				},
+			}},
 		"two elements": {
 			want: []entry.Entry{
 				{
@@ -116,6 +123,15 @@ func TestDecodePolicy(t *testing.T) {
 					Strategy: "override",
 				},
 			}},
+		"basic type with target": {
+			want: []entry.Entry{
+				{
+					Key:    `Software/Policies/Ubuntu/privilege/allow-local-admins/all`,
+					Value:  "",
+					Meta:   "foo",
+					Target: "group:admins AND release:>=24.04",
+				},
+			}},
 		"basic type is ignored for meta of wrong type": {
 			want: nil},
 
@@ -156,6 +172,14 @@ func TestDecodePolicy(t *testing.T) {
 					Strategy: "override",
 				},
 			}},
+		"container target is reflected on child": {
+			want: []entry.Entry{
+				{
+					Key:    `Software/Container/Child`,
+					Value:  "MyValue",
+					Target: "hostname:ws-*",
+				},
+			}},
 		// This ignores child value because container is disabled
 		"disabled container with disabled option values": {
 			want: []entry.Entry{
@@ -360,6 +384,7 @@ func TestDecodePolicy(t *testing.T) {
 
 		// Error cases
 		"invalid decimal value":               {wantErr: true},
+		"invalid binary value size":           {wantErr: true},
 		"invalid header, header doesnt match": {wantErr: true},
 		"invalid header, header too short":    {wantErr: true},
 		"invalid header, file truncated":      {wantErr: true},
@@ -0,0 +1,306 @@
+package ad
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/ad/gpttmpl"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+// securityTemplatePath is the path of the security template, relative to the GPO directory.
+var securityTemplatePath = []string{"Machine", "Microsoft", "Windows NT", "SecEdit", "GptTmpl.inf"}
+
+const (
+	// systemAccessSection is the security template section containing the password and account lockout policies.
+	systemAccessSection = "System Access"
+	// passwordRuleType is the rule type of the password and account lockout policies.
+	passwordRuleType = "password"
+
+	// privilegeRightsSection is the security template section containing the user rights assignments.
+	privilegeRightsSection = "Privilege Rights"
+	// accessRuleType is the rule type of the logon rights.
+	accessRuleType = "access"
+)
+
+// systemAccessPasswordKeys maps the password and account lockout settings of the security template
+// to the keys of the password policy.
+var systemAccessPasswordKeys = []struct {
+	setting string
+	key     string
+}{
+	{"MinimumPasswordLength", "password/min-length"},
+	{"PasswordComplexity", "password/complexity"},
+	{"PasswordHistorySize", "password/history"},
+	{"LockoutBadCount", "password/lockout-threshold"},
+	{"LockoutDuration", "password/lockout-duration"},
+	{"ResetLockoutCount", "password/lockout-reset"},
+}
+
+// privilegeRightsAccessKeys maps the logon rights of the user rights assignments to the keys of the access policy.
+var privilegeRightsAccessKeys = []struct {
+	setting string
+	key     string
+}{
+	{"SeInteractiveLogonRight", "access/allow-local"},
+	{"SeDenyInteractiveLogonRight", "access/deny-local"},
+	{"SeRemoteInteractiveLogonRight", "access/allow-remote"},
+	{"SeDenyRemoteInteractiveLogonRight", "access/deny-remote"},
+}
+
+// wellKnownSIDs maps the SIDs of the Windows well-known accounts to members of the access policy.
+// Domain relative SIDs are matched on their relative identifier, like -513.
+var wellKnownSIDs = map[string][]string{
+	// Everyone, Authenticated Users, Users and Domain Users.
+	"S-1-1-0":      {"ALL"},
+	"S-1-5-11":     {"ALL"},
+	"S-1-5-32-545": {"ALL"},
+	"-513":         {"ALL"},
+	// Administrators are the local administrators of the client.
+	"S-1-5-32-544": {"root", "%sudo", "%admin"},
+}
+
+// parseSecurityTemplate adds the password and account lockout policies, and the logon rights, defined in the
+// security template of the GPO, if any, to the GPO rules.
+// They are added after the ones from the registry policy, so that Ubuntu keys of the same GPO take precedence.
+// The domain accounts referenced by SID in the logon rights are looked up on adServerFQDN.
+func (ad *AD) parseSecurityTemplate(ctx context.Context, name, url, adServerFQDN, krb5CCPath string, gpoWithRules policies.GPO) (err error) {
+	ad.downloadablesMu.RLock()
+	d := ad.downloadables[name]
+	ad.downloadablesMu.RUnlock()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	templatePath, err := findCaseInsensitive(filepath.Join(ad.sysvolCacheDir, "Policies", filepath.Base(url)), securityTemplatePath...)
+	if err != nil {
+		return err
+	}
+	if templatePath == "" {
+		log.Debugf(ctx, "Policy %q doesn't have any security template", name)
+		return nil
+	}
+	log.Debugf(ctx, "Found security template %q", templatePath)
+
+	defer decorate.OnError(&err, gotext.Get("can't parse security template %q", templatePath))
+
+	f, err := os.Open(templatePath)
+	if err != nil {
+		return err
+	}
+	defer decorate.LogFuncOnErrorContext(ctx, f.Close)
+
+	tmpl, err := gpttmpl.Decode(f)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range systemAccessPasswordKeys {
+		v, ok := tmpl.Value(systemAccessSection, k.setting)
+		if !ok {
+			continue
+		}
+		e, err := passwordEntry(k.key, v)
+		if err != nil {
+			return errors.New(gotext.Get("invalid value %q for %s: %v", v, k.setting, err))
+		}
+		gpoWithRules.Rules[passwordRuleType] = append(gpoWithRules.Rules[passwordRuleType], e)
+	}
+
+	rights := make(map[string]string)
+	var domainSIDs []string
+	for _, k := range privilegeRightsAccessKeys {
+		v, ok := tmpl.Value(privilegeRightsSection, k.setting)
+		if !ok {
+			continue
+		}
+		rights[k.setting] = v
+		for _, account := range splitAccounts(v) {
+			sid, isSID := strings.CutPrefix(account, "*")
+			if _, wellKnown := wellKnownMembers(sid); !isSID || wellKnown || slices.Contains(domainSIDs, sid) {
+				continue
+			}
+			domainSIDs = append(domainSIDs, sid)
+		}
+	}
+	domainMembers, err := ad.lookupSIDs(ctx, domainSIDs, adServerFQDN, krb5CCPath)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range privilegeRightsAccessKeys {
+		v, ok := rights[k.setting]
+		if !ok {
+			continue
+		}
+		e, err := accessEntry(k.key, v, domainMembers)
+		if err != nil {
+			return errors.New(gotext.Get("invalid value %q for %s: %v", v, k.setting, err))
+		}
+		gpoWithRules.Rules[accessRuleType] = append(gpoWithRules.Rules[accessRuleType], e)
+	}
+
+	return nil
+}
+
+// accessEntry converts a logon right of the security template, a comma separated list of accounts,
+// to an access policy entry with one member per line.
+// Accounts are either names or SIDs prefixed by *. SIDs are either well-known ones or the ones of domain accounts
+// listed in domainMembers. An error is returned for any other SID, as applying a partial list could grant or deny
+// logons to the wrong accounts.
+func accessEntry(key, value string, domainMembers map[string]string) (entry.Entry, error) {
+	var members []string
+	for _, account := range splitAccounts(value) {
+		sid, isSID := strings.CutPrefix(account, "*")
+		if !isSID {
+			members = append(members, account)
+			continue
+		}
+
+		if m, found := wellKnownMembers(sid); found {
+			members = append(members, m...)
+			continue
+		}
+		m, found := domainMembers[strings.ToUpper(sid)]
+		if !found {
+			return entry.Entry{}, errors.New(gotext.Get("account %s can't be resolved", sid))
+		}
+		members = append(members, m)
+	}
+
+	return entry.Entry{Key: key, Value: strings.Join(members, "\n")}, nil
+}
+
+// splitAccounts returns the accounts of a comma separated list of the security template.
+func splitAccounts(value string) (accounts []string) {
+	for _, account := range strings.Split(value, ",") {
+		account = strings.TrimSpace(account)
+		if account == "" {
+			continue
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+// wellKnownMembers returns the access policy members of sid if it is the one of a well-known account.
+func wellKnownMembers(sid string) (members []string, found bool) {
+	members, found = wellKnownSIDs[strings.ToUpper(sid)]
+	if !found && strings.HasPrefix(strings.ToUpper(sid), "S-1-5-21-") {
+		members, found = wellKnownSIDs[sid[strings.LastIndex(sid, "-"):]]
+	}
+	return members, found
+}
+
+// lookupSIDs returns the access policy members of the domain accounts with the given SIDs, indexed by their
+// SID in upper case. The accounts are looked up on adServerFQDN by the adsys-gpolist script, authenticated with
+// the ticket at krb5CCPath: user@domain for users and computers, %group@domain for groups.
+func (ad *AD) lookupSIDs(ctx context.Context, sids []string, adServerFQDN, krb5CCPath string) (members map[string]string, err error) {
+	if len(sids) == 0 {
+		return nil, nil
+	}
+	defer decorate.OnError(&err, gotext.Get("can't look up accounts %s", strings.Join(sids, ", ")))
+
+	log.Debugf(ctx, "Looking up accounts %s", strings.Join(sids, ", "))
+	var scriptArgs []string
+	for _, sid := range sids {
+		scriptArgs = append(scriptArgs, "--sid", sid)
+	}
+	scriptArgs = append(scriptArgs, adServerFQDN)
+	stdout, exitCode, err := ad.runGPOListScript(ctx, scriptArgs, krb5CCPath)
+	if err != nil {
+		var reason string
+		switch exitCode {
+		case gpoListNotFound:
+			reason = gotext.Get("not all accounts were found in Active Directory")
+		case gpoListConnectionFailed:
+			reason = gotext.Get("could not connect to the Active Directory server %q", adServerFQDN)
+		default:
+			reason = gotext.Get("unexpected error while looking up the accounts")
+		}
+		return nil, errors.New(gotext.Get("%s (exited with %d): %v", reason, exitCode, err))
+	}
+
+	domain := ad.configBackend.Domain()
+	members = make(map[string]string)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		// <SID>\t<sAMAccountName>\t<user|computer|group>
+		res := strings.Split(scanner.Text(), "\t")
+		if len(res) != 3 {
+			return nil, errors.New(gotext.Get("unexpected account %q", scanner.Text()))
+		}
+		m := fmt.Sprintf("%s@%s", res[1], domain)
+		if res[2] == "group" {
+			m = "%" + m
+		}
+		log.Debugf(ctx, "Account %s is %s", res[0], m)
+		members[strings.ToUpper(res[0])] = m
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// passwordEntry converts a security template setting value to a password policy entry.
+func passwordEntry(key, value string) (entry.Entry, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return entry.Entry{}, err
+	}
+
+	switch key {
+	case "password/complexity":
+		// Complexity is a boolean policy, without any value.
+		return entry.Entry{Key: key, Disabled: n == 0}, nil
+	case "password/lockout-duration":
+		// Windows uses -1 for accounts locked until an administrator unlocks them, which is 0 in our policy.
+		n = max(n, 0)
+	}
+	if n < 0 {
+		return entry.Entry{}, errors.New(gotext.Get("negative value"))
+	}
+
+	return entry.Entry{Key: key, Value: fmt.Sprint(n)}, nil
+}
+
+// findCaseInsensitive returns the path of the file matching elems in dir, whatever the case of each element is.
+// It returns an empty path if the file doesn't exist.
+func findCaseInsensitive(dir string, elems ...string) (string, error) {
+	p := dir
+	for _, elem := range elems {
+		files, err := os.ReadDir(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+
+		var found bool
+		for _, f := range files {
+			if strings.EqualFold(f.Name(), elem) {
+				p = filepath.Join(p, f.Name())
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", nil
+		}
+	}
+	return p, nil
+}
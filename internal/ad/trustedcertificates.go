@@ -0,0 +1,75 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/ad/certstore"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+// trustedCertificatesPrefix is the GPO prefix containing the certificate stores of the Public Key Policies.
+const trustedCertificatesPrefix = "Software/Policies/Microsoft/SystemCertificates/"
+
+// trustedCertificateStores maps the certificate stores of the Public Key Policies to the key prefix of their
+// certificates in the certificate policy.
+var trustedCertificateStores = map[string]string{
+	"Root": "trusted-root",
+	"CA":   "trusted-intermediate",
+}
+
+// trustedCertificateEntry converts a certificate of the trusted root or intermediate certification authorities
+// stores to a certificate policy entry, with its PEM encoded certificate as value.
+// ok is false if the key is not a certificate of those stores, like other certificate store settings.
+func trustedCertificateEntry(pol entry.Entry) (e entry.Entry, ok bool, err error) {
+	// Keys are in the form <store>/Certificates/<thumbprint>/Blob.
+	elems := strings.Split(strings.TrimPrefix(pol.Key, trustedCertificatesPrefix), "/")
+	if len(elems) != 4 || !strings.EqualFold(elems[1], "Certificates") || !strings.EqualFold(elems[3], "Blob") {
+		return entry.Entry{}, false, nil
+	}
+	var prefix string
+	for store, p := range trustedCertificateStores {
+		if strings.EqualFold(elems[0], store) {
+			prefix = p
+			break
+		}
+	}
+	if prefix == "" {
+		return entry.Entry{}, false, nil
+	}
+	thumbprint := elems[2]
+
+	defer decorate.OnError(&err, gotext.Get("can't decode trusted certificate %s", thumbprint))
+
+	e = entry.Entry{
+		Key:      fmt.Sprintf("%s/%s", prefix, strings.ToLower(thumbprint)),
+		Disabled: pol.Disabled,
+	}
+	if pol.Disabled {
+		return e, true, nil
+	}
+	if pol.Err != nil {
+		return entry.Entry{}, false, pol.Err
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(pol.Value)
+	if err != nil {
+		return entry.Entry{}, false, err
+	}
+	cert, err := certstore.Decode(bytes.NewReader(blob))
+	if err != nil {
+		return entry.Entry{}, false, err
+	}
+	if got := certstore.Thumbprint(cert); !strings.EqualFold(got, thumbprint) {
+		return entry.Entry{}, false, errors.New(gotext.Get("certificate thumbprint %s doesn't match its key", got))
+	}
+
+	e.Value = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	return e, true, nil
+}
@@ -0,0 +1,175 @@
+package wmi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type options struct {
+	root string
+}
+
+// Option reprents an optional function to change how facts are computed.
+type Option func(*options)
+
+// WithRoot specifies a personalized root directory, to read the system files from.
+func WithRoot(root string) Option {
+	return func(o *options) {
+		o.root = root
+	}
+}
+
+// LocalFacts returns the supported WMI classes, with properties computed from the local system:
+//   - Win32_OperatingSystem: Caption and Version, from os-release, OSArchitecture, and ProductType, which is 1
+//     (workstation) if a display manager is enabled and 3 (server) otherwise;
+//   - Win32_ComputerSystem: Name (hostname), Domain, Manufacturer and Model, from the DMI, PCSystemType, from the
+//     DMI chassis type, and TotalPhysicalMemory in bytes;
+//   - Win32_Battery: DeviceID and Name, for each battery of the system, peripherals excluded.
+func LocalFacts(hostname, domain string, opts ...Option) Facts {
+	// defaults
+	args := options{
+		root: "/",
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+	root := args.root
+
+	osRelease := readOSRelease(root)
+	productType := "3"
+	if _, err := os.Stat(filepath.Join(root, "etc/systemd/system/display-manager.service")); err == nil {
+		productType = "1"
+	}
+
+	var batteries []Instance
+	powerSupplies, _ := os.ReadDir(filepath.Join(root, "sys/class/power_supply"))
+	for _, p := range powerSupplies {
+		dir := filepath.Join("sys/class/power_supply", p.Name())
+		// Batteries of peripherals, like wireless mice, are not system batteries.
+		if readValue(root, filepath.Join(dir, "type")) != "Battery" || readValue(root, filepath.Join(dir, "scope")) == "Device" {
+			continue
+		}
+		batteries = append(batteries, Instance{
+			"DeviceID": p.Name(),
+			"Name":     readValue(root, filepath.Join(dir, "model_name")),
+		})
+	}
+
+	return Facts{
+		"Win32_OperatingSystem": {
+			Properties: []string{"Caption", "Version", "OSArchitecture", "ProductType"},
+			Instances: []Instance{{
+				"Caption":        osRelease["PRETTY_NAME"],
+				"Version":        osRelease["VERSION_ID"],
+				"OSArchitecture": fmt.Sprintf("%d-bit", strconv.IntSize),
+				"ProductType":    productType,
+			}},
+		},
+		"Win32_ComputerSystem": {
+			Properties: []string{"Name", "Domain", "Manufacturer", "Model", "PCSystemType", "TotalPhysicalMemory"},
+			Instances: []Instance{{
+				"Name":                hostname,
+				"Domain":              domain,
+				"Manufacturer":        readValue(root, "sys/class/dmi/id/sys_vendor"),
+				"Model":               readValue(root, "sys/class/dmi/id/product_name"),
+				"PCSystemType":        pcSystemType(readValue(root, "sys/class/dmi/id/chassis_type")),
+				"TotalPhysicalMemory": totalPhysicalMemory(root),
+			}},
+		},
+		"Win32_Battery": {
+			Properties: []string{"DeviceID", "Name"},
+			Instances:  batteries,
+		},
+	}
+}
+
+// readValue returns the trimmed content of the file at path, relative to root, or an empty string if it can't be read.
+func readValue(root, path string) string {
+	d, err := os.ReadFile(filepath.Join(root, path))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(d))
+}
+
+// readOSRelease returns the fields of os-release, unquoted.
+func readOSRelease(root string) map[string]string {
+	fields := make(map[string]string)
+
+	f, err := os.Open(filepath.Join(root, "etc/os-release"))
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = os.Open(filepath.Join(root, "usr/lib/os-release"))
+	}
+	if err != nil {
+		return fields
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || strings.HasPrefix(k, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(v); err == nil {
+			v = unquoted
+		} else {
+			v = strings.Trim(v, `'"`)
+		}
+		fields[k] = v
+	}
+	return fields
+}
+
+// chassisSystemTypes maps the SMBIOS chassis types to the PCSystemType values of Windows.
+var chassisSystemTypes = map[string]string{
+	// Desktop
+	"3": "1", "4": "1", "5": "1", "6": "1", "7": "1", "13": "1", "15": "1", "16": "1", "24": "1", "35": "1", "36": "1",
+	// Mobile
+	"8": "2", "9": "2", "10": "2", "11": "2", "12": "2", "14": "2", "30": "2", "31": "2", "32": "2",
+	// Enterprise server
+	"17": "4", "23": "4", "25": "4", "28": "4", "29": "4",
+}
+
+// pcSystemType converts the SMBIOS chassis type to the PCSystemType value of Windows.
+// It is 0 (unspecified) if the chassis type can't be mapped, and NULL if it is not available.
+func pcSystemType(chassisType string) string {
+	if chassisType == "" {
+		return ""
+	}
+	if t, ok := chassisSystemTypes[chassisType]; ok {
+		return t
+	}
+	return "0"
+}
+
+// totalPhysicalMemory returns the total memory from /proc/meminfo, in bytes.
+func totalPhysicalMemory(root string) string {
+	f, err := os.Open(filepath.Join(root, "proc/meminfo"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       16318888 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return ""
+		}
+		return strconv.FormatUint(kb*1024, 10)
+	}
+	return ""
+}
@@ -0,0 +1,572 @@
+// Package wmi evaluates the WMI filters linked to GPOs against the local system, so that a GPO is only applied
+// to the clients it targets, as on Windows.
+//
+// WMI is not available on Linux: a subset of WQL is evaluated against a few classes of the root\CIMv2 namespace,
+// whose properties are computed from the local system. Queries outside of this subset can't be evaluated.
+//
+// The supported queries are of the form SELECT <* or properties> FROM <class> [WHERE <condition>], where conditions
+// are comparisons of a property with a string, number or boolean (=, <>, !=, <, >, <=, >=), LIKE patterns
+// (%, _, [set], [^set]) and IS [NOT] NULL tests, combined with AND, OR, NOT and parentheses.
+// String comparisons are case insensitive, as on Windows.
+package wmi
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+)
+
+// DefaultNamespace is the only supported WMI namespace.
+const DefaultNamespace = `root\CIMv2`
+
+// Filter is a WMI filter. It matches if each of its queries returns at least one instance.
+type Filter struct {
+	Name    string
+	Queries []Query
+}
+
+// Query is a WQL query in a WMI namespace.
+type Query struct {
+	Namespace string
+	WQL       string
+}
+
+// Class is a WMI class, with the names of its supported properties and its instances.
+type Class struct {
+	Properties []string
+	Instances  []Instance `yaml:",omitempty"`
+}
+
+// Instance is an instance of a WMI class, with its property values by property name.
+// Empty or missing values are NULL.
+type Instance map[string]string
+
+// Facts are the supported WMI classes, by class name.
+type Facts map[string]Class
+
+// Match returns true if each query of the filter returns at least one instance from facts.
+// An error is returned if one of the queries is not supported, as the filter can't be evaluated.
+func (f Filter) Match(facts Facts) (match bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't evaluate WMI filter %q", f.Name))
+
+	if len(f.Queries) == 0 {
+		return false, errors.New(gotext.Get("filter has no query"))
+	}
+
+	// All queries are parsed first, so that unsupported ones are reported even if another one doesn't match.
+	type query struct {
+		class Class
+		where expr
+	}
+	var queries []query
+	for _, q := range f.Queries {
+		if !strings.EqualFold(q.Namespace, DefaultNamespace) {
+			return false, errors.New(gotext.Get("namespace %q is not supported", q.Namespace))
+		}
+		class, where, err := parse(q.WQL, facts)
+		if err != nil {
+			return false, fmt.Errorf("%q: %w", q.WQL, err)
+		}
+		queries = append(queries, query{class: class, where: where})
+	}
+
+	for _, q := range queries {
+		if !slices.ContainsFunc(q.class.Instances, func(i Instance) bool { return q.where == nil || q.where.eval(i) }) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// lookup returns the class named name and its name in facts, ignoring case.
+func (facts Facts) lookup(name string) (Class, bool) {
+	for n, c := range facts {
+		if strings.EqualFold(n, name) {
+			return c, true
+		}
+	}
+	return Class{}, false
+}
+
+// property returns the name of the property of the class named name, ignoring case.
+func (c Class) property(name string) (string, bool) {
+	for _, p := range c.Properties {
+		if strings.EqualFold(p, name) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// expr is a condition of the WHERE clause.
+type expr interface {
+	eval(i Instance) bool
+}
+
+type andExpr struct{ left, right expr }
+
+func (e andExpr) eval(i Instance) bool { return e.left.eval(i) && e.right.eval(i) }
+
+type orExpr struct{ left, right expr }
+
+func (e orExpr) eval(i Instance) bool { return e.left.eval(i) || e.right.eval(i) }
+
+type notExpr struct{ e expr }
+
+func (e notExpr) eval(i Instance) bool { return !e.e.eval(i) }
+
+// comparison compares a property with a literal. Comparing a NULL property is always false.
+type comparison struct {
+	property string
+	op       string
+	value    token
+}
+
+func (e comparison) eval(i Instance) bool {
+	v := i[e.property]
+	if v == "" {
+		return false
+	}
+
+	var r int
+	if e.value.kind == numberToken {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+		// The literal was validated when parsing.
+		lit, _ := strconv.ParseFloat(e.value.text, 64)
+		switch {
+		case n < lit:
+			r = -1
+		case n > lit:
+			r = 1
+		}
+	} else {
+		r = strings.Compare(strings.ToLower(v), strings.ToLower(e.value.text))
+	}
+
+	switch e.op {
+	case "=":
+		return r == 0
+	case "<>", "!=":
+		return r != 0
+	case "<":
+		return r < 0
+	case ">":
+		return r > 0
+	case "<=":
+		return r <= 0
+	case ">=":
+		return r >= 0
+	}
+	return false
+}
+
+// like matches a property against a LIKE pattern. A NULL property never matches.
+type like struct {
+	property string
+	pattern  *regexp.Regexp
+}
+
+func (e like) eval(i Instance) bool {
+	v := i[e.property]
+	return v != "" && e.pattern.MatchString(v)
+}
+
+// isNull tests if a property is NULL.
+type isNull struct {
+	property string
+}
+
+func (e isNull) eval(i Instance) bool { return i[e.property] == "" }
+
+// parse parses the WQL query and returns the queried class from facts, with the condition of its WHERE clause.
+// The condition is nil if the query has no WHERE clause.
+func parse(wql string, facts Facts) (class Class, where expr, err error) {
+	tokens, err := tokenize(wql)
+	if err != nil {
+		return Class{}, nil, err
+	}
+	p := parser{tokens: tokens}
+
+	if !p.acceptKeyword("SELECT") {
+		return Class{}, nil, errors.New(gotext.Get("only SELECT queries are supported"))
+	}
+	var selected []string
+	if !p.accept(symbolToken, "*") {
+		for {
+			t := p.next()
+			if t.kind != identToken {
+				return Class{}, nil, errors.New(gotext.Get("expected property name, got %q", t.text))
+			}
+			selected = append(selected, t.text)
+			if !p.accept(symbolToken, ",") {
+				break
+			}
+		}
+	}
+
+	if !p.acceptKeyword("FROM") {
+		return Class{}, nil, errors.New(gotext.Get("expected FROM, got %q", p.peek().text))
+	}
+	t := p.next()
+	if t.kind != identToken {
+		return Class{}, nil, errors.New(gotext.Get("expected class name, got %q", t.text))
+	}
+	class, ok := facts.lookup(t.text)
+	if !ok {
+		return Class{}, nil, errors.New(gotext.Get("class %q is not supported", t.text))
+	}
+	p.class = class
+
+	// Querying an unknown property is an error on Windows, which prevents the filter from matching.
+	for _, s := range selected {
+		if _, ok := class.property(s); !ok {
+			return Class{}, nil, errors.New(gotext.Get("property %q is not supported", s))
+		}
+	}
+
+	if p.acceptKeyword("WHERE") {
+		if where, err = p.parseOr(); err != nil {
+			return Class{}, nil, err
+		}
+	}
+	if t := p.peek(); t.kind != eofToken {
+		return Class{}, nil, errors.New(gotext.Get("unexpected %q", t.text))
+	}
+
+	return class, where, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	class  Class
+}
+
+// peek returns the current token, without consuming it.
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// next consumes and returns the current token. The last token is always eofToken.
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != eofToken {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the current token if it is of kind and its text is text.
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if t := p.peek(); t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// acceptKeyword consumes the current token if it is the keyword kw, which is case insensitive.
+func (p *parser) acceptKeyword(kw string) bool {
+	if t := p.peek(); t.kind == identToken && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// parseOr parses: and {OR and}.
+func (p *parser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+// parseAnd parses: not {AND not}.
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+// parseNot parses: NOT not | ( or ) | condition.
+func (p *parser) parseNot() (expr, error) {
+	if p.acceptKeyword("NOT") {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+
+	if p.accept(symbolToken, "(") {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(symbolToken, ")") {
+			return nil, errors.New(gotext.Get("expected ), got %q", p.peek().text))
+		}
+		return e, nil
+	}
+
+	return p.parseCondition()
+}
+
+// parseCondition parses a comparison, in either order, a LIKE pattern or a NULL test.
+func (p *parser) parseCondition() (expr, error) {
+	left := p.next()
+
+	// <literal> <op> <property> is the same as <property> <reversed op> <literal>.
+	if left.isLiteral() {
+		op := p.next()
+		if op.kind != operatorToken {
+			return nil, errors.New(gotext.Get("expected comparison operator, got %q", op.text))
+		}
+		property, err := p.property(p.next())
+		if err != nil {
+			return nil, err
+		}
+		return comparison{property: property, op: reversedOperators[op.text], value: literal(left)}, nil
+	}
+
+	property, err := p.property(left)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("IS") {
+		not := p.acceptKeyword("NOT")
+		if !p.acceptKeyword("NULL") {
+			return nil, errors.New(gotext.Get("expected NULL, got %q", p.peek().text))
+		}
+		var e expr = isNull{property: property}
+		if not {
+			e = notExpr{e}
+		}
+		return e, nil
+	}
+
+	not := p.acceptKeyword("NOT")
+	if p.acceptKeyword("LIKE") {
+		t := p.next()
+		if t.kind != stringToken {
+			return nil, errors.New(gotext.Get("expected LIKE pattern, got %q", t.text))
+		}
+		pattern, err := likeToRegexp(t.text)
+		if err != nil {
+			return nil, err
+		}
+		var e expr = like{property: property, pattern: pattern}
+		if not {
+			e = notExpr{e}
+		}
+		return e, nil
+	}
+	if not {
+		return nil, errors.New(gotext.Get("expected LIKE, got %q", p.peek().text))
+	}
+
+	op := p.next()
+	if op.kind != operatorToken {
+		return nil, errors.New(gotext.Get("expected comparison operator, got %q", op.text))
+	}
+	value := p.next()
+	if !value.isLiteral() {
+		return nil, errors.New(gotext.Get("expected string, number or boolean, got %q", value.text))
+	}
+	return comparison{property: property, op: op.text, value: literal(value)}, nil
+}
+
+// property returns the name of the class property of t.
+func (p *parser) property(t token) (string, error) {
+	if t.kind != identToken {
+		return "", errors.New(gotext.Get("expected property name, got %q", t.text))
+	}
+	property, ok := p.class.property(t.text)
+	if !ok {
+		return "", errors.New(gotext.Get("property %q is not supported", t.text))
+	}
+	return property, nil
+}
+
+// reversedOperators maps the comparison operators to their equivalent when swapping their operands.
+var reversedOperators = map[string]string{
+	"=":  "=",
+	"<>": "<>",
+	"!=": "!=",
+	"<":  ">",
+	">":  "<",
+	"<=": ">=",
+	">=": "<=",
+}
+
+// literal returns t as a comparable value. Booleans are compared as strings.
+func literal(t token) token {
+	if t.kind == identToken {
+		return token{kind: stringToken, text: strings.ToLower(t.text)}
+	}
+	return t
+}
+
+// likeToRegexp converts a WQL LIKE pattern to a case insensitive regular expression.
+func likeToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		case '[':
+			end := -1
+			// The first character of a set can be ].
+			for j := i + 2; j < len(runes); j++ {
+				if runes[j] == ']' {
+					end = j
+					break
+				}
+			}
+			if end == -1 {
+				return nil, errors.New(gotext.Get("unterminated set in LIKE pattern %q", pattern))
+			}
+			set := string(runes[i+1 : end])
+			b.WriteString("[")
+			if strings.HasPrefix(set, "^") {
+				b.WriteString("^")
+				set = set[1:]
+			}
+			b.WriteString(regexp.QuoteMeta(set))
+			b.WriteString("]")
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
+
+type tokenKind int
+
+const (
+	eofToken tokenKind = iota
+	identToken
+	stringToken
+	numberToken
+	operatorToken
+	symbolToken
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// isLiteral returns true if the token is a string, a number or a boolean.
+func (t token) isLiteral() bool {
+	return t.kind == stringToken || t.kind == numberToken ||
+		(t.kind == identToken && (strings.EqualFold(t.text, "TRUE") || strings.EqualFold(t.text, "FALSE")))
+}
+
+// tokenize splits the WQL query in tokens, ending with an eofToken.
+func tokenize(wql string) (tokens []token, err error) {
+	runes := []rune(wql)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"' || r == '\'':
+			// Strings are quoted with " or ', and \ escapes the next character.
+			var s strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				s.WriteRune(runes[j])
+			}
+			if j == len(runes) {
+				return nil, errors.New(gotext.Get("unterminated string"))
+			}
+			tokens = append(tokens, token{kind: stringToken, text: s.String()})
+			i = j + 1
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			text := string(runes[i:j])
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, errors.New(gotext.Get("invalid number %q", text))
+			}
+			tokens = append(tokens, token{kind: numberToken, text: text})
+			i = j
+
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, token{kind: identToken, text: string(runes[i:j])})
+			i = j
+
+		case strings.ContainsRune("=<>!", r):
+			op := string(r)
+			if i+1 < len(runes) {
+				if two := string(runes[i : i+2]); two == "<>" || two == "!=" || two == "<=" || two == ">=" {
+					op = two
+				}
+			}
+			if op == "!" {
+				return nil, errors.New(gotext.Get("unexpected %q", op))
+			}
+			tokens = append(tokens, token{kind: operatorToken, text: op})
+			i += len(op)
+
+		case strings.ContainsRune("(),*", r):
+			tokens = append(tokens, token{kind: symbolToken, text: string(r)})
+			i++
+
+		default:
+			return nil, errors.New(gotext.Get("unexpected %q", string(r)))
+		}
+	}
+
+	return append(tokens, token{kind: eofToken, text: "end of query"}), nil
+}
@@ -0,0 +1,164 @@
+package wmi_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/ad/wmi"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+
+	facts := wmi.Facts{
+		"Win32_OperatingSystem": {
+			Properties: []string{"Caption", "Version", "ProductType"},
+			Instances:  []wmi.Instance{{"Caption": "Ubuntu 24.04.1 LTS", "Version": "24.04", "ProductType": "1"}},
+		},
+		"Win32_ComputerSystem": {
+			Properties: []string{"Name", "Model", "PCSystemType", "Manufacturer"},
+			Instances:  []wmi.Instance{{"Name": "laptop1", "Model": "ThinkPad X1 Carbon", "PCSystemType": "2"}},
+		},
+		"Win32_Battery": {
+			Properties: []string{"DeviceID", "Name"},
+			Instances:  []wmi.Instance{{"DeviceID": "BAT0", "Name": "5B10W13930"}, {"DeviceID": "BAT1", "Name": "01AV494"}},
+		},
+		"Win32_NoInstances": {
+			Properties: []string{"Name"},
+		},
+	}
+
+	tests := map[string]struct {
+		queries []string
+
+		want    bool
+		wantErr bool
+	}{
+		"All instances":                   {queries: []string{"SELECT * FROM Win32_OperatingSystem"}, want: true},
+		"Selected properties":             {queries: []string{"SELECT Caption, Version FROM Win32_OperatingSystem"}, want: true},
+		"Equal string":                    {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = "24.04"`}, want: true},
+		"Single quoted string":            {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = '24.04'`}, want: true},
+		"Not equal string":                {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = "22.04"`}},
+		"Strings are case insensitive":    {queries: []string{`select * from win32_operatingsystem where caption = "UBUNTU 24.04.1 lts"`}, want: true},
+		"Escaped characters in strings":   {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE Model = "ThinkPad X1 \"Carbon\""`}},
+		"Strings are compared as strings": {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version > "3"`}},
+		"Numbers are compared as numbers": {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version > 3`}, want: true},
+		"Numbers with decimals":           {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version >= 24.04 AND Version < 24.10`}, want: true},
+		"Negative numbers":                {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE ProductType > -1`}, want: true},
+		"Number compared to a string":     {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE Model > 1`}},
+		"Different operators":             {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE PCSystemType <> 1 AND PCSystemType != 3 AND PCSystemType <= 2`}, want: true},
+		"Literal before property":         {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE 1 < PCSystemType`}, want: true},
+		"Boolean":                         {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE Model = TRUE`}},
+		"LIKE with any characters":        {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Caption LIKE "%24.04%"`}, want: true},
+		"LIKE with one character":         {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version LIKE "24._4"`}, want: true},
+		"LIKE with set":                   {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE Model LIKE "[st]hinkpad%"`}, want: true},
+		"LIKE with range":                 {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE Model LIKE "[a-z]%"`}, want: true},
+		"LIKE with negated set":           {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE Model LIKE "[^t]%"`}},
+		"LIKE with regexp characters":     {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version LIKE "24.0."`}},
+		"LIKE is anchored":                {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Caption LIKE "24.04"`}},
+		"NOT LIKE":                        {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE Model NOT LIKE "Dell%"`}, want: true},
+		"IS NULL":                         {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE Manufacturer IS NULL`}, want: true},
+		"IS NOT NULL":                     {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE Manufacturer IS NOT NULL`}},
+		"Comparing NULL is false":         {queries: []string{`SELECT * FROM Win32_ComputerSystem WHERE Manufacturer <> "Dell Inc."`}},
+		"OR":                              {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = "22.04" OR Version = "24.04"`}, want: true},
+		"AND has precedence over OR":      {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = "24.04" OR Version = "22.04" AND ProductType = 3`}, want: true},
+		"Parentheses":                     {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE (Version = "24.04" OR Version = "22.04") AND ProductType = 3`}},
+		"NOT":                             {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE NOT ProductType = 3 AND NOT (Version = "22.04")`}, want: true},
+		"Multilines query":                {queries: []string{"SELECT *\n\tFROM Win32_OperatingSystem\r\n WHERE Version=\"24.04\""}, want: true},
+		"Any instance can match":          {queries: []string{`SELECT * FROM Win32_Battery WHERE DeviceID = "BAT1"`}, want: true},
+		"No instance":                     {queries: []string{`SELECT * FROM Win32_NoInstances`}},
+		"All queries match":               {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = "24.04"`, `SELECT * FROM Win32_Battery`}, want: true},
+		"One query does not match":        {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = "24.04"`, `SELECT * FROM Win32_NoInstances`}},
+
+		// Error cases
+		"Error on no query":                 {wantErr: true},
+		"Error on unsupported namespace":    {queries: []string{`root\SecurityCenter2;SELECT * FROM AntiVirusProduct`}, wantErr: true},
+		"Error on unsupported class":        {queries: []string{`SELECT * FROM Win32_Processor`}, wantErr: true},
+		"Error on unsupported property":     {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE BuildNumber > 10000`}, wantErr: true},
+		"Error on unsupported selected":     {queries: []string{`SELECT Caption, BuildNumber FROM Win32_OperatingSystem`}, wantErr: true},
+		"Error on unsupported statement":    {queries: []string{`ASSOCIATORS OF {Win32_OperatingSystem}`}, wantErr: true},
+		"Error on one unsupported query":    {queries: []string{`SELECT * FROM Win32_NoInstances`, `SELECT * FROM Win32_Processor`}, wantErr: true},
+		"Error on missing FROM":             {queries: []string{`SELECT * Win32_OperatingSystem`}, wantErr: true},
+		"Error on missing class":            {queries: []string{`SELECT * FROM`}, wantErr: true},
+		"Error on empty selection":          {queries: []string{`SELECT FROM Win32_OperatingSystem`}, wantErr: true},
+		"Error on empty WHERE":              {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE`}, wantErr: true},
+		"Error on trailing tokens":          {queries: []string{`SELECT * FROM Win32_OperatingSystem Caption`}, wantErr: true},
+		"Error on unterminated string":      {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = "24.04`}, wantErr: true},
+		"Error on unclosed parenthesis":     {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE (Version = 24.04`}, wantErr: true},
+		"Error on missing operator":         {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version "24.04"`}, wantErr: true},
+		"Error on missing literal":          {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = Caption`}, wantErr: true},
+		"Error on comparing two literals":   {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE 1 = 1`}, wantErr: true},
+		"Error on NOT without LIKE":         {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version NOT = 1`}, wantErr: true},
+		"Error on IS without NULL":          {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version IS 1`}, wantErr: true},
+		"Error on LIKE without string":      {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version LIKE 24`}, wantErr: true},
+		"Error on unterminated set in LIKE": {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version LIKE "[24"`}, wantErr: true},
+		"Error on invalid number":           {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = 24.04.1`}, wantErr: true},
+		"Error on unsupported character":    {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE Version = 24 ; DROP`}, wantErr: true},
+		"Error on unsupported ! operator":   {queries: []string{`SELECT * FROM Win32_OperatingSystem WHERE !Version`}, wantErr: true},
+		"Error on event queries":            {queries: []string{`SELECT * FROM __InstanceModificationEvent WITHIN 10`}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			f := wmi.Filter{Name: "filter"}
+			for _, q := range tc.queries {
+				namespace := wmi.DefaultNamespace
+				if ns, wql, found := cutNamespace(q); found {
+					namespace, q = ns, wql
+				}
+				f.Queries = append(f.Queries, wmi.Query{Namespace: namespace, WQL: q})
+			}
+
+			got, err := f.Match(facts)
+			if tc.wantErr {
+				require.Error(t, err, "Match should have failed but didn't")
+				require.False(t, got, "Filter should not match when it can't be evaluated")
+				return
+			}
+			require.NoError(t, err, "Match failed but shouldn't have")
+			require.Equal(t, tc.want, got, "Match returned an unexpected result")
+		})
+	}
+}
+
+func TestLocalFacts(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		rootDir string
+	}{
+		"Laptop with batteries":            {rootDir: "laptop"},
+		"Server without display manager":   {rootDir: "server"},
+		"Unmapped chassis type":            {rootDir: "unmapped_chassis"},
+		"Fallback to os-release in lib":    {rootDir: "lib_os_release"},
+		"Missing system files are NULL":    {rootDir: "empty"},
+		"Root directory does not exist":    {rootDir: "doesnotexist"},
+		"Invalid meminfo total is NULL":    {rootDir: "invalid_meminfo"},
+		"Other power supplies are ignored": {rootDir: "power_supplies"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := filepath.Join(testutils.TestFamilyPath(t), "roots", tc.rootDir)
+			got := wmi.LocalFacts("myhost", "example.com", wmi.WithRoot(root))
+
+			want := testutils.LoadWithUpdateFromGoldenYAML(t, got)
+			require.Equal(t, want, got, "LocalFacts returned unexpected facts")
+		})
+	}
+}
+
+// cutNamespace splits the namespace prefix of a test query, separated by a semicolon.
+func cutNamespace(q string) (namespace, wql string, found bool) {
+	if !strings.HasPrefix(q, `root\`) {
+		return "", q, false
+	}
+	return strings.Cut(q, ";")
+}
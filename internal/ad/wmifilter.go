@@ -0,0 +1,40 @@
+package ad
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/ubuntu/adsys/internal/ad/wmi"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies"
+)
+
+// applyWMIFilters returns the GPOs whose WMI filter, if any, matches the local system, in order, with the ones
+// filtered out. As on Windows, a GPO whose WMI filter can't be evaluated is not applied.
+func (ad *AD) applyWMIFilters(ctx context.Context, gpos []gpo) (applied []gpo, filtered []policies.FilteredGPO) {
+	var facts wmi.Facts
+	for _, g := range gpos {
+		if g.wmiFilter == nil {
+			applied = append(applied, g)
+			continue
+		}
+
+		// Facts are only computed if needed, and once for all GPOs.
+		if facts == nil {
+			facts = wmi.LocalFacts(ad.hostname, ad.configBackend.Domain(), wmi.WithRoot(ad.systemRoot))
+		}
+
+		match, err := g.wmiFilter.Match(facts)
+		if err != nil {
+			log.Warningf(ctx, "GPO %q is not applied: %v", g.name, err)
+		}
+		if !match {
+			log.Infof(ctx, "GPO %q is filtered out by its WMI filter %q", g.name, g.wmiFilter.Name)
+			filtered = append(filtered, policies.FilteredGPO{ID: filepath.Base(g.url), Name: g.name, WMIFilter: g.wmiFilter.Name})
+			continue
+		}
+		applied = append(applied, g)
+	}
+
+	return applied, filtered
+}
@@ -65,8 +65,50 @@ const (
 	DefaultApparmorDir = "/etc/apparmor.d/adsys"
 	// DefaultSystemUnitDir is the default directory for systemd unit files.
 	DefaultSystemUnitDir = "/etc/systemd/system"
+	// DefaultUserUnitDir is the default directory for systemd user unit files, shared by all users.
+	DefaultUserUnitDir = "/etc/systemd/user"
 	// DefaultGlobalTrustDir is the default directory for the global trust store.
 	DefaultGlobalTrustDir = "/usr/local/share/ca-certificates"
+	// DefaultFirewallDir is the default directory for the adsys nftables ruleset.
+	DefaultFirewallDir = "/etc/nftables.d"
+	// DefaultFirefoxPoliciesDir is the default directory for Firefox enterprise policies.
+	DefaultFirefoxPoliciesDir = "/etc/firefox/policies"
+	// DefaultChromiumPoliciesDir is the default directory for Chromium managed policies.
+	DefaultChromiumPoliciesDir = "/etc/chromium/policies/managed"
+	// DefaultChromiumSnapPoliciesDir is the default directory for the Chromium snap managed policies.
+	DefaultChromiumSnapPoliciesDir = "/etc/chromium-browser/policies/managed"
+	// DefaultEnvironmentDir is the default directory for system-wide session environment variables.
+	DefaultEnvironmentDir = "/etc/environment.d"
+	// DefaultNetworkConnectionsDir is the default directory for NetworkManager system connections.
+	DefaultNetworkConnectionsDir = "/etc/NetworkManager/system-connections"
+	// DefaultSecurityDir is the default directory for the PAM modules configuration.
+	DefaultSecurityDir = "/etc/security"
+	// DefaultPAMDir is the default directory for the PAM stack configuration.
+	DefaultPAMDir = "/etc/pam.d"
+	// DefaultSysctlDir is the default directory for the kernel parameters configuration.
+	DefaultSysctlDir = "/etc/sysctl.d"
+	// DefaultSSHDir is the default directory for the SSH server and client configuration.
+	DefaultSSHDir = "/etc/ssh"
+	// DefaultUSBGuardDir is the default directory for the usbguard configuration.
+	DefaultUSBGuardDir = "/etc/usbguard"
+	// DefaultApplicationsDir is the default directory for the application launchers deployed by adsys.
+	DefaultApplicationsDir = "/usr/local/share/applications/adsys"
+	// DefaultShortcutIconsDir is the default directory for the icons of the shortcuts deployed by adsys.
+	DefaultShortcutIconsDir = "/usr/local/share/adsys/icons"
+	// DefaultKrb5Conf is the default main Kerberos configuration file.
+	DefaultKrb5Conf = "/etc/krb5.conf"
+	// DefaultResolvedConfDir is the default directory for the systemd-resolved configuration drop-ins.
+	DefaultResolvedConfDir = "/etc/systemd/resolved.conf.d"
+	// DefaultHostsFile is the default static host name lookup table.
+	DefaultHostsFile = "/etc/hosts"
+	// DefaultTimesyncdConfDir is the default directory for the systemd-timesyncd configuration drop-ins.
+	DefaultTimesyncdConfDir = "/etc/systemd/timesyncd.conf.d"
+	// DefaultChronyDir is the default chrony configuration directory.
+	DefaultChronyDir = "/etc/chrony"
+	// DefaultIssueDir is the default directory of the login banners issue and issue.net.
+	DefaultIssueDir = "/etc"
+	// DefaultUpdateMotdDir is the default directory for the message of the day fragments.
+	DefaultUpdateMotdDir = "/etc/update-motd.d"
 )
 
 // SSSD related properties.
@@ -0,0 +1,214 @@
+// Package access is the policy manager for the logon rights of AD users and groups, like the Windows
+// "Allow log on locally" and "Deny log on through Remote Desktop Services" user rights.
+//
+// This manager only applies to computer objects.
+//
+// Each entry lists users and groups, separated by commas or new lines:
+//   - access/allow-local: only those can log on locally, on the console or a graphical session;
+//   - access/deny-local: those can't log on locally;
+//   - access/allow-remote: only those can log on remotely, like through SSH;
+//   - access/deny-remote: those can't log on remotely.
+//
+// Members are normalized the same way than the client administrators of the privilege manager:
+// domain\user becomes user@domain, and groups are prefixed with %. ALL stands for every user.
+//
+// Rights are enforced by pam_access in the account stack, through the /etc/security/access.d/adsys.conf file
+// owned by adsys. As on Windows, denying a right takes precedence over allowing it. root can always log on
+// locally, so that the machine can be recovered. Scheduled jobs, systemd --user instances and display manager
+// greeters are never restricted, and neither are the other system accounts, skipped by the PAM profile.
+//
+// The file is removed once no right is configured anymore.
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/groups"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	allowLocalKey  = "access/allow-local"
+	denyLocalKey   = "access/deny-local"
+	allowRemoteKey = "access/allow-remote"
+	denyRemoteKey  = "access/deny-remote"
+
+	// allMembers stands for every user.
+	allMembers = "ALL"
+
+	// accessConf is the pam_access configuration file owned by adsys, relative to the security directory.
+	accessConf = "access.d/adsys.conf"
+
+	// pam_access origins of local and remote logons.
+	localOrigin  = "LOCAL"
+	remoteOrigin = "ALL EXCEPT LOCAL"
+
+	// exemptServices are the PAM services which don't log users on: scheduled jobs, user service managers
+	// and display manager greeters.
+	exemptServices = "cron crond systemd-user gdm-launch-environment lightdm-greeter sddm-greeter"
+	// greeterUsers are the system users running the display manager greeters on the local seats.
+	greeterUsers = "gdm gdm-greeter lightdm sddm"
+
+	managedFileHeader = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`
+)
+
+// Manager prevents writing the pam_access configuration concurrently while applying the policy.
+type Manager struct {
+	securityDir string
+
+	mu sync.Mutex
+}
+
+type options struct {
+	securityDir string
+}
+
+// Option reprents an optional function to change the access manager.
+type Option func(*options)
+
+// WithSecurityDir overrides the default PAM security configuration directory.
+func WithSecurityDir(p string) Option {
+	return func(o *options) {
+		o.securityDir = p
+	}
+}
+
+// New returns a new manager for the access policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		securityDir: consts.DefaultSecurityDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		securityDir: args.securityDir,
+	}
+}
+
+// ApplyPolicy configures pam_access to enforce the logon rights listed in entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply access policy to %s", objectName))
+
+	// Logon rights are only supported on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying access policy to %s", objectName)
+
+	rights := make(map[string][]string)
+	for _, e := range entries {
+		if e.Err != nil {
+			return errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+		if e.Disabled {
+			continue
+		}
+		switch e.Key {
+		case allowLocalKey, denyLocalKey, allowRemoteKey, denyRemoteKey:
+		default:
+			continue
+		}
+
+		members, err := accessMembers(ctx, e.Value)
+		if err != nil {
+			return errors.New(gotext.Get("invalid value for %s: %v", e.Key, err))
+		}
+		if len(members) > 0 {
+			rights[e.Key] = members
+		}
+	}
+
+	// pam_access configuration, first match wins: permission:users:origins
+	var settings []string
+	if members, ok := rights[denyLocalKey]; ok {
+		settings = append(settings, fmt.Sprintf("-:%s EXCEPT root:%s", strings.Join(members, " "), localOrigin))
+	}
+	if members, ok := rights[denyRemoteKey]; ok {
+		settings = append(settings, fmt.Sprintf("-:%s:%s", strings.Join(members, " "), remoteOrigin))
+	}
+	if members, ok := rights[allowLocalKey]; ok && !slices.Contains(members, allMembers) {
+		settings = append(settings,
+			fmt.Sprintf("+:root %s:%s", strings.Join(members, " "), localOrigin),
+			fmt.Sprintf("-:ALL:%s", localOrigin))
+	}
+	if members, ok := rights[allowRemoteKey]; ok && !slices.Contains(members, allMembers) {
+		settings = append(settings,
+			fmt.Sprintf("+:%s:%s", strings.Join(members, " "), remoteOrigin),
+			fmt.Sprintf("-:ALL:%s", remoteOrigin))
+	}
+
+	p := filepath.Join(m.securityDir, accessConf)
+	if len(settings) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	// Services and greeters opening sessions on behalf of the system are not logons.
+	settings = append([]string{
+		fmt.Sprintf("+:ALL:%s", exemptServices),
+		fmt.Sprintf("+:%s:%s", greeterUsers, localOrigin),
+	}, settings...)
+	return writeIfChanged(p, managedFileHeader+strings.Join(settings, "\n")+"\n")
+}
+
+// accessMembers returns the members of value as pam_access users and (groups), or ALL.
+func accessMembers(ctx context.Context, value string) (members []string, err error) {
+	for _, member := range groups.SplitAndNormalizeMembers(ctx, value) {
+		if strings.EqualFold(member, allMembers) {
+			member = allMembers
+		} else if group, isGroup := strings.CutPrefix(member, "%"); isGroup {
+			member = "(" + group + ")"
+		}
+		// pam_access fields are separated by spaces.
+		if strings.ContainsAny(member, " \t") {
+			return nil, errors.New(gotext.Get("invalid member %q: names with spaces are not supported", member))
+		}
+		if !slices.Contains(members, member) {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+// writeIfChanged atomically writes content to p if it differs from the current content.
+func writeIfChanged(p, content string) error {
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return nil
+	}
+
+	// #nosec G301 - /etc/security permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// #nosec G306 - pam_access configuration is world readable.
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
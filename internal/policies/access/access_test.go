@@ -0,0 +1,89 @@
+package access_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/access"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "access/allow-local", Value: "%linux-users@example.com, EXAMPLE\\alice"},
+		{Key: "access/deny-local", Value: "bob@example.com"},
+		{Key: "access/allow-remote", Value: "%linux-admins@example.com\n%sudo"},
+		{Key: "access/deny-remote", Value: "%contractors@example.com"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		securityDirIsFile bool
+
+		wantErr bool
+	}{
+		"Apply all rights":                              {},
+		"Only allow local logons":                       {entries: []entry.Entry{{Key: "access/allow-local", Value: "alice@example.com"}}},
+		"Only deny remote logons":                       {entries: []entry.Entry{{Key: "access/deny-remote", Value: "ALL"}}},
+		"Deny local logons to everyone but root":        {entries: []entry.Entry{{Key: "access/deny-local", Value: "all"}}},
+		"Allowing everyone does not restrict logons":    {entries: []entry.Entry{{Key: "access/allow-local", Value: "alice@example.com, ALL"}, {Key: "access/allow-remote", Value: "ALL"}}},
+		"Members are normalized and deduplicated":       {entries: []entry.Entry{{Key: "access/allow-remote", Value: "EXAMPLE\\alice\n alice@example.com ,%dev*s@example.com,,"}}},
+		"Empty values are ignored":                      {entries: []entry.Entry{{Key: "access/allow-local", Value: " \n,"}, {Key: "access/deny-remote", Value: "bob@example.com"}}},
+		"Disabled entries are ignored":                  {entries: []entry.Entry{{Key: "access/allow-local", Value: "alice@example.com", Disabled: true}}, existingState: "managed"},
+		"Other keys are ignored":                        {entries: []entry.Entry{{Key: "access/other", Value: "alice@example.com"}}, existingState: "managed"},
+		"Update managed rights":                         {existingState: "managed"},
+		"Rights already up to date":                     {existingState: "up_to_date"},
+		"Remove managed rights with no entries":         {entries: []entry.Entry{}, existingState: "managed"},
+		"Other pam_access files are kept":               {entries: []entry.Entry{}, existingState: "admin_file"},
+		"No entries and no file":                        {entries: []entry.Entry{}},
+		"User objects are ignored":                      {isUser: true, existingState: "managed"},
+		"Greeters and user managers are not restricted": {entries: []entry.Entry{{Key: "access/allow-local", Value: "alice@example.com"}, {Key: "access/deny-local", Value: "ALL"}}},
+		"Deny rights take precedence over allow ones":   {entries: []entry.Entry{{Key: "access/allow-local", Value: "%linux-users@example.com"}, {Key: "access/deny-local", Value: "%linux-users@example.com"}}},
+
+		// Error cases
+		"Error on errored entry":                   {entries: []entry.Entry{{Key: "access/allow-local", Value: "alice@example.com", Err: errors.New("some error")}}, wantErr: true},
+		"Error on member with spaces":              {entries: []entry.Entry{{Key: "access/deny-remote", Value: "%domain users@example.com"}}, wantErr: true},
+		"Error on security directory being a file": {securityDirIsFile: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			securityDir := filepath.Join(rootDir, "etc", "security")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), securityDir)
+			}
+			if tc.securityDirIsFile {
+				require.NoError(t, os.MkdirAll(filepath.Dir(securityDir), 0750), "Setup: can't create parent directory")
+				testutils.WriteFile(t, securityDir, []byte("not a directory"), 0600)
+			}
+
+			m := access.New(access.WithSecurityDir(securityDir))
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
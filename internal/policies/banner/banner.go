@@ -0,0 +1,251 @@
+// Package banner is the policy manager for the login banners of the console, SSH and the message of the day.
+//
+// This manager only applies to computer objects.
+//
+// The text of the banner/text entry, with its dynamic values already expanded, is written to:
+//   - /etc/issue, displayed before the console login prompt. Backslashes are escaped, as agetty interprets them;
+//   - /etc/issue.net, which can be displayed before SSH authentication with the ssh/banner policy;
+//   - /etc/update-motd.d/00-adsys-banner, printing it first in the message of the day after login.
+//
+// /etc/issue and /etc/issue.net are shipped by the distribution: the first time the banner is applied, the
+// original files are saved in the state directory. They are restored, and the message of the day fragment is
+// removed, once the banner is not configured anymore.
+//
+// Control characters, like terminal escape sequences, are refused and prevent authentication.
+//
+// The GDM login screen banner is configured by the dconf manager.
+package banner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	textKey = "banner/text"
+
+	motdFileName = "00-adsys-banner"
+
+	motdHeader = `#!/bin/sh
+# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`
+)
+
+// issueFiles are the login banner files shipped by the distribution, relative to the issue directory.
+var issueFiles = []string{"issue", "issue.net"}
+
+// Manager prevents writing the banners concurrently while applying the policy.
+type Manager struct {
+	stateDir      string
+	issueDir      string
+	updateMotdDir string
+
+	mu sync.Mutex
+}
+
+type options struct {
+	stateDir      string
+	issueDir      string
+	updateMotdDir string
+}
+
+// Option reprents an optional function to change the banner manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) Option {
+	return func(o *options) {
+		o.stateDir = p
+	}
+}
+
+// WithIssueDir overrides the default directory of the issue and issue.net files.
+func WithIssueDir(p string) Option {
+	return func(o *options) {
+		o.issueDir = p
+	}
+}
+
+// WithUpdateMotdDir overrides the default directory of the message of the day fragments.
+func WithUpdateMotdDir(p string) Option {
+	return func(o *options) {
+		o.updateMotdDir = p
+	}
+}
+
+// New returns a new manager for the banner policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:      consts.DefaultStateDir,
+		issueDir:      consts.DefaultIssueDir,
+		updateMotdDir: consts.DefaultUpdateMotdDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:      filepath.Join(args.stateDir, "banner"),
+		issueDir:      args.issueDir,
+		updateMotdDir: args.updateMotdDir,
+	}
+}
+
+// ApplyPolicy writes the login banners and the message of the day fragment, or restores the original
+// banners if the text is not configured.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply banner policy to %s", objectName))
+
+	// Login banners are only supported on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying banner policy to %s", objectName)
+
+	var text string
+	for _, e := range entries {
+		if e.Err != nil {
+			return errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+		if e.Disabled || e.Key != textKey {
+			continue
+		}
+		text = normalize(e.Value)
+		// Terminal escape sequences could be used to hide or rewrite what is displayed on the login screen.
+		if i := strings.IndexFunc(text, func(r rune) bool { return unicode.IsControl(r) && r != '\n' && r != '\t' }); i != -1 {
+			return errors.New(gotext.Get("invalid banner: control character %q is not supported", text[i]))
+		}
+	}
+
+	if text == "" {
+		return m.restore(ctx)
+	}
+
+	if err := m.saveOriginals(); err != nil {
+		return err
+	}
+
+	// agetty interprets backslash sequences of /etc/issue, like \n for the host name.
+	issue := strings.ReplaceAll(text, `\`, `\\`) + "\n\n"
+	if err := writeIfChanged(filepath.Join(m.issueDir, "issue"), issue, 0644); err != nil {
+		return err
+	}
+	if err := writeIfChanged(filepath.Join(m.issueDir, "issue.net"), text+"\n", 0644); err != nil {
+		return err
+	}
+
+	motd := motdHeader + fmt.Sprintf("printf '%%s\\n\\n' '%s'\n", strings.ReplaceAll(text, "'", `'\''`))
+	// #nosec G301 - /etc/update-motd.d permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(m.updateMotdDir, 0755); err != nil {
+		return err
+	}
+	// #nosec G306 - update-motd.d fragments are world readable executable scripts.
+	return writeIfChanged(filepath.Join(m.updateMotdDir, motdFileName), motd, 0755)
+}
+
+// normalize returns the banner text with Windows line endings converted and surrounding blank lines removed.
+func normalize(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
+
+// saveOriginals saves the issue files shipped by the distribution, if they were not saved already.
+// The state directory existing means that the banners are managed by adsys.
+func (m *Manager) saveOriginals() (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save original banners"))
+
+	if _, err := os.Stat(m.stateDir); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(m.stateDir+".new", 0700); err != nil {
+		return err
+	}
+	for _, name := range issueFiles {
+		content, err := os.ReadFile(filepath.Join(m.issueDir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return errors.Join(err, os.RemoveAll(m.stateDir+".new"))
+		}
+		if err := os.WriteFile(filepath.Join(m.stateDir+".new", name), content, 0600); err != nil {
+			return errors.Join(err, os.RemoveAll(m.stateDir+".new"))
+		}
+	}
+	return os.Rename(m.stateDir+".new", m.stateDir)
+}
+
+// restore puts back the original issue files, or removes them if there were none, and removes the
+// message of the day fragment.
+func (m *Manager) restore(ctx context.Context) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't restore original banners"))
+
+	if err := os.Remove(filepath.Join(m.updateMotdDir, motdFileName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if _, err := os.Stat(m.stateDir); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	log.Debug(ctx, "Restoring original banners")
+	for _, name := range issueFiles {
+		p := filepath.Join(m.issueDir, name)
+		content, err := os.ReadFile(filepath.Join(m.stateDir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := writeIfChanged(p, string(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(m.stateDir)
+}
+
+// writeIfChanged atomically writes content to p if it differs from the current content.
+func writeIfChanged(p, content string, mode fs.FileMode) error {
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return nil
+	}
+
+	if err := os.WriteFile(p+".new", []byte(content), mode); err != nil {
+		return err
+	}
+	// Enforce the mode, which is restricted by the umask on creation.
+	if err := os.Chmod(p+".new", mode); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
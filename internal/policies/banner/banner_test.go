@@ -0,0 +1,93 @@
+package banner_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/banner"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "banner/text", Value: "WARNING: this system is restricted to authorized users of EXAMPLE.\nAll activity on workstation01 may be monitored."},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		wantErr bool
+	}{
+		"Apply banner on distribution files":                   {existingState: "distribution"},
+		"Apply banner without existing files":                  {},
+		"Backslashes and quotes are escaped":                   {entries: []entry.Entry{{Key: "banner/text", Value: `It's \n a 'quoted' \l banner "here"`}}, existingState: "distribution"},
+		"Line endings and surrounding blank lines are cleaned": {entries: []entry.Entry{{Key: "banner/text", Value: "\r\n\r\nWARNING: restricted  \r\n\r\nAuthorized users only\t\r\n\n"}}, existingState: "distribution"},
+		"Update existing banner keeps originals":               {existingState: "managed"},
+		"Banner already up to date":                            {existingState: "up_to_date"},
+		"Restore original files when disabled":                 {entries: []entry.Entry{{Key: "banner/text", Value: "Some text", Disabled: true}}, existingState: "managed"},
+		"Restore original files with no entries":               {entries: []entry.Entry{}, existingState: "managed"},
+		"Restore original files with empty text":               {entries: []entry.Entry{{Key: "banner/text", Value: " \n\t"}}, existingState: "managed"},
+		"Remove files without originals with no entries":       {entries: []entry.Entry{}, existingState: "managed_without_originals"},
+		"No entries and no banner":                             {entries: []entry.Entry{}, existingState: "distribution"},
+		"Unknown keys are ignored":                             {entries: []entry.Entry{{Key: "banner/unknown", Value: "something"}}, existingState: "distribution"},
+		"User objects are ignored":                             {isUser: true, existingState: "distribution"},
+
+		// Error cases
+		"Error on errored entry":                {entries: []entry.Entry{{Key: "banner/text", Err: errors.New("some error")}}, existingState: "distribution", wantErr: true},
+		"Error on control characters":           {entries: []entry.Entry{{Key: "banner/text", Value: "Authorized users only\x1b[2J"}}, existingState: "distribution", wantErr: true},
+		"Error on issue directory being a file": {existingState: "issue_dir_is_file", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := filepath.Join(t.TempDir(), "root")
+			etcDir := filepath.Join(rootDir, "etc")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), rootDir)
+			} else {
+				require.NoError(t, os.MkdirAll(etcDir, 0750), "Setup: can't create etc directory")
+			}
+
+			m := banner.New(
+				banner.WithStateDir(filepath.Join(rootDir, "var", "lib", "adsys")),
+				banner.WithIssueDir(etcDir),
+				banner.WithUpdateMotdDir(filepath.Join(etcDir, "update-motd.d")),
+			)
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			// The message of the day fragment must print the same text as issue.net.
+			motd := filepath.Join(etcDir, "update-motd.d", "00-adsys-banner")
+			if _, err := os.Stat(motd); err == nil {
+				out, err := exec.Command(motd).Output()
+				require.NoError(t, err, "Message of the day fragment should run")
+				issueNet, err := os.ReadFile(filepath.Join(etcDir, "issue.net"))
+				require.NoError(t, err, "issue.net should exist along the message of the day fragment")
+				require.Equal(t, string(issueNet)+"\n", string(out), "Message of the day fragment should print the banner")
+			}
+
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
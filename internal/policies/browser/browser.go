@@ -0,0 +1,363 @@
+// Package browser provides a manager to apply Firefox and Chromium managed policies.
+//
+// Entries keys are in the form <browser>/<PolicyName>, where browser is either firefox or chromium.
+// The entry meta is the policy value type, as declared in the browser JSON schema of admxgen:
+//   - boolean: true or false;
+//   - integer: a decimal number;
+//   - string: the value is used as is;
+//   - array: one string item per line;
+//   - json (or empty): the value is a raw JSON document.
+//
+// Browsers only read system-wide policy files, which are shared by all users: applying the policies of a user
+// would apply them to every user of the machine. The policies are thus only applied on computers, and the
+// browser policies of users are ignored with a warning.
+//
+// The policies are written to:
+//   - Firefox (deb and snap): /etc/firefox/policies/policies.json;
+//   - Chromium: /etc/chromium/policies/managed/adsys.json;
+//   - Chromium (snap): /etc/chromium-browser/policies/managed/adsys.json.
+//
+// The manager keeps a manifest of the policy files it wrote in its state directory, and only replaces or
+// removes those. Should a policy file already exist without being in the manifest, like a Firefox policy
+// file set up by the administrator, an error is returned and authentication will be prevented.
+//
+// If there are no policies for a given browser, its policy files written by adsys are removed.
+package browser
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	firefox  = "firefox"
+	chromium = "chromium"
+
+	// firefoxPoliciesFile is the name of the Firefox enterprise policies file.
+	firefoxPoliciesFile = "policies.json"
+	// chromiumPoliciesFile is the name of the adsys Chromium managed policies file.
+	chromiumPoliciesFile = "adsys.json"
+
+	// manifestFile lists the policy files written by adsys, in the state directory.
+	manifestFile = "manifest"
+)
+
+// browserPolicies are the policies to apply, indexed by browser and then by policy name.
+type browserPolicies map[string]map[string]json.RawMessage
+
+// Manager prevents rendering the policy files concurrently while applying the policy.
+type Manager struct {
+	stateDir           string
+	firefoxPoliciesDir string
+	chromiumPolicyDirs []string
+
+	mu sync.Mutex
+}
+
+type options struct {
+	stateDir           string
+	firefoxPoliciesDir string
+	chromiumPolicyDirs []string
+}
+
+// Option reprents an optional function to change the browser manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) Option {
+	return func(o *options) {
+		o.stateDir = p
+	}
+}
+
+// WithFirefoxPoliciesDir overrides the default directory of the Firefox policies file.
+func WithFirefoxPoliciesDir(p string) Option {
+	return func(o *options) {
+		o.firefoxPoliciesDir = p
+	}
+}
+
+// WithChromiumPoliciesDirs overrides the default directories of the Chromium managed policies file.
+func WithChromiumPoliciesDirs(p ...string) Option {
+	return func(o *options) {
+		o.chromiumPolicyDirs = p
+	}
+}
+
+// New returns a new manager for the browser policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:           consts.DefaultStateDir,
+		firefoxPoliciesDir: consts.DefaultFirefoxPoliciesDir,
+		chromiumPolicyDirs: []string{consts.DefaultChromiumPoliciesDir, consts.DefaultChromiumSnapPoliciesDir},
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:           filepath.Join(args.stateDir, "browser"),
+		firefoxPoliciesDir: args.firefoxPoliciesDir,
+		chromiumPolicyDirs: args.chromiumPolicyDirs,
+	}
+}
+
+// ApplyPolicy renders the browser policies to the browsers policy files.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply browser policy to %s", objectName))
+
+	// Browser policy files are system-wide, so they are only supported on computers.
+	if !isComputer {
+		var ignored []string
+		for _, e := range entries {
+			if !e.Disabled {
+				ignored = append(ignored, e.Key)
+			}
+		}
+		if len(ignored) > 0 {
+			log.Warning(ctx, gotext.Get("Browser policies are only supported on computers, ignoring the ones of %s: %s", objectName, strings.Join(ignored, ", ")))
+		}
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying browser policy to %s", objectName)
+
+	policies, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := m.readManifest()
+	if err != nil {
+		return err
+	}
+
+	// Save the manifest even on partial failures, so that we keep track of the files already written.
+	defer func() {
+		if errSave := m.saveManifest(manifest); errSave != nil {
+			err = errors.Join(err, errSave)
+		}
+	}()
+
+	// Firefox expects its policies under a "policies" key.
+	var firefoxContent any
+	if len(policies[firefox]) > 0 {
+		firefoxContent = map[string]any{"policies": policies[firefox]}
+	}
+	if err := writePolicyFile(filepath.Join(m.firefoxPoliciesDir, firefoxPoliciesFile), firefoxContent, manifest); err != nil {
+		return err
+	}
+
+	var chromiumContent any
+	if len(policies[chromium]) > 0 {
+		chromiumContent = policies[chromium]
+	}
+	for _, dir := range m.chromiumPolicyDirs {
+		if err := writePolicyFile(filepath.Join(dir, chromiumPoliciesFile), chromiumContent, manifest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseEntries converts the entries values to JSON according to their meta type.
+// Disabled entries and entries of unsupported browsers are ignored.
+func parseEntries(ctx context.Context, entries []entry.Entry) (policies browserPolicies, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse browser entries"))
+
+	policies = make(browserPolicies)
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+
+		browser, name, found := strings.Cut(e.Key, "/")
+		if !found || name == "" || (browser != firefox && browser != chromium) {
+			log.Warningf(ctx, "Unsupported browser policy key %q, ignoring", e.Key)
+			continue
+		}
+
+		if e.Err != nil {
+			return nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		v, err := toJSON(e.Meta, e.Value)
+		if err != nil {
+			return nil, errors.New(gotext.Get("invalid value for %q: %v", e.Key, err))
+		}
+
+		if policies[browser] == nil {
+			policies[browser] = make(map[string]json.RawMessage)
+		}
+		policies[browser][name] = v
+	}
+
+	return policies, nil
+}
+
+// toJSON converts a value to JSON depending on its type.
+func toJSON(valueType, value string) (json.RawMessage, error) {
+	var v any
+	switch valueType {
+	case "boolean":
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		v = b
+	case "integer":
+		i, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		v = i
+	case "string":
+		v = value
+	case "array":
+		items := []string{}
+		for _, item := range strings.Split(value, "\n") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			items = append(items, item)
+		}
+		v = items
+	case "json", "":
+		if !json.Valid([]byte(value)) {
+			return nil, errors.New(gotext.Get("value is not a valid JSON document"))
+		}
+		return json.RawMessage(strings.TrimSpace(value)), nil
+	default:
+		return nil, errors.New(gotext.Get("unsupported value type %q", valueType))
+	}
+
+	return json.Marshal(v)
+}
+
+// writePolicyFile atomically writes content as JSON to path, readable by all users.
+// The file is removed if content is nil. Only files listed in the manifest, which is updated accordingly,
+// are replaced or removed.
+func writePolicyFile(path string, content any, manifest map[string]struct{}) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write browser policy file %q", path))
+
+	_, managed := manifest[path]
+
+	if content == nil {
+		if !managed {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		delete(manifest, path)
+		return nil
+	}
+
+	if !managed {
+		if _, err := os.Lstat(path); err == nil {
+			return errors.New(gotext.Get("file already exists and was not written by adsys"))
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	// #nosec G301. Browsers run as the user and need to read their policies.
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+	// #nosec G306. Browsers run as the user and need to read their policies.
+	if err := os.WriteFile(path+".new", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".new", path); err != nil {
+		return err
+	}
+	manifest[path] = struct{}{}
+	return nil
+}
+
+// readManifest returns the policy files written by adsys.
+// A missing manifest means no policy file was written.
+func (m *Manager) readManifest() (manifest map[string]struct{}, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't read browser manifest"))
+
+	manifest = make(map[string]struct{})
+
+	f, err := os.Open(filepath.Join(m.stateDir, manifestFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return manifest, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		path := scanner.Text()
+		if path == "" {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			return nil, errors.New(gotext.Get("invalid line in browser manifest: %q", path))
+		}
+		manifest[path] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// saveManifest atomically writes the policy files written by adsys.
+// The manifest is removed if there are no files to track.
+func (m *Manager) saveManifest(manifest map[string]struct{}) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save browser manifest"))
+
+	p := filepath.Join(m.stateDir, manifestFile)
+	if len(manifest) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(manifest))
+	for path := range manifest {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	if err := os.WriteFile(p+".new", []byte(strings.Join(paths, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,119 @@
+package browser_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/browser"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "firefox/DisableTelemetry", Value: "true", Meta: "boolean"},
+		{Key: "firefox/Homepage", Value: `{"URL": "https://intranet.example.com", "Locked": true}`, Meta: "json"},
+		{Key: "chromium/HomepageLocation", Value: "https://intranet.example.com", Meta: "string"},
+		{Key: "chromium/URLBlocklist", Value: "example.org\n\n  example.net  \n", Meta: "array"},
+		{Key: "chromium/DefaultCookiesSetting", Value: "4", Meta: "integer"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		fileInPlaceOf string
+
+		wantErr bool
+	}{
+		// Machine cases
+		"Computer, all browsers and types":                              {},
+		"Computer, only firefox":                                        {entries: []entry.Entry{{Key: "firefox/DisableTelemetry", Value: "true", Meta: "boolean"}}},
+		"Computer, only chromium":                                       {entries: []entry.Entry{{Key: "chromium/HomepageLocation", Value: "https://example.com", Meta: "string"}}},
+		"Computer, value without type is JSON":                          {entries: []entry.Entry{{Key: "chromium/ProxySettings", Value: `{"ProxyMode": "direct"}`}}},
+		"Computer, unsupported browsers are ignored":                    {entries: []entry.Entry{{Key: "firefox/DisableTelemetry", Value: "true", Meta: "boolean"}, {Key: "opera/Something", Value: "true", Meta: "boolean"}}},
+		"Computer, disabled entries are ignored":                        {entries: []entry.Entry{{Key: "firefox/DisableTelemetry", Value: "true", Meta: "boolean"}, {Key: "chromium/HomepageLocation", Value: "https://example.com", Meta: "string", Disabled: true}}},
+		"Computer, no entries and no state":                             {entries: []entry.Entry{}},
+		"Computer, update policy files written by adsys":                {existingState: "managed"},
+		"Computer, no entries removes policy files written by adsys":    {entries: []entry.Entry{}, existingState: "managed"},
+		"Computer, no entries keeps existing policy files":              {entries: []entry.Entry{}, existingState: "existing_firefox_policies"},
+		"Computer, no firefox policies keeps existing firefox policies": {entries: []entry.Entry{{Key: "chromium/HomepageLocation", Value: "https://example.com", Meta: "string"}}, existingState: "existing_firefox_policies"},
+
+		// User cases
+		"User objects are ignored": {isUser: true, existingState: "managed"},
+
+		// Error cases
+		"Error on errored entry":                             {entries: []entry.Entry{{Key: "firefox/DisableTelemetry", Value: "true", Meta: "boolean", Err: errors.New("some error")}}, wantErr: true},
+		"Error on invalid boolean":                           {entries: []entry.Entry{{Key: "firefox/DisableTelemetry", Value: "maybe", Meta: "boolean"}}, wantErr: true},
+		"Error on invalid integer":                           {entries: []entry.Entry{{Key: "chromium/DefaultCookiesSetting", Value: "four", Meta: "integer"}}, wantErr: true},
+		"Error on invalid JSON":                              {entries: []entry.Entry{{Key: "firefox/Homepage", Value: `{"URL": `, Meta: "json"}}, wantErr: true},
+		"Error on unsupported value type":                    {entries: []entry.Entry{{Key: "firefox/Homepage", Value: "1.5", Meta: "number"}}, wantErr: true},
+		"Error on policies directory being a file":           {fileInPlaceOf: "etc/firefox/policies", wantErr: true},
+		"Error on existing policy file not written by adsys": {existingState: "existing_firefox_policies", wantErr: true},
+		"Error on invalid manifest":                          {existingState: "invalid_manifest", wantErr: true},
+		"Error on state directory being a file":              {fileInPlaceOf: "var/lib/adsys/browser", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			root := filepath.Join(t.TempDir(), "root")
+			stateDir := filepath.Join(root, "var", "lib", "adsys")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), root)
+				replaceInManifest(t, filepath.Join(stateDir, "browser", "manifest"), "#ROOTDIR#", root)
+			}
+			require.NoError(t, os.MkdirAll(root, 0750), "Setup: can't create root directory")
+			if tc.fileInPlaceOf != "" {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, tc.fileInPlaceOf)), 0750), "Setup: can't create parent directory")
+				testutils.WriteFile(t, filepath.Join(root, tc.fileInPlaceOf), []byte("not a directory"), 0600)
+			}
+
+			m := browser.New(
+				browser.WithStateDir(stateDir),
+				browser.WithFirefoxPoliciesDir(filepath.Join(root, "etc", "firefox", "policies")),
+				browser.WithChromiumPoliciesDirs(
+					filepath.Join(root, "etc", "chromium", "policies", "managed"),
+					filepath.Join(root, "etc", "chromium-browser", "policies", "managed"),
+				),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			replaceInManifest(t, filepath.Join(stateDir, "browser", "manifest"), root, "#ROOTDIR#")
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// replaceInManifest replaces old with new in the manifest at path, if it exists, as it contains the absolute
+// paths of the policy files.
+func replaceInManifest(t *testing.T, path, old, new string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	require.NoError(t, err, "Can't read manifest")
+	err = os.WriteFile(path, []byte(strings.ReplaceAll(string(data), old, new)), 0600)
+	require.NoError(t, err, "Can't write manifest")
+}
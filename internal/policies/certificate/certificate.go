@@ -1,8 +1,14 @@
 // Package certificate provides a manager that handles certificate
-// autoenrollment.
+// autoenrollment and trusted certificates.
 //
 // This manager only applies to computer objects.
 //
+// Trusted root and intermediate certificates of the GPO Public Key Policies are
+// decoded by the AD backend and installed in an adsys directory of the global
+// trust store, followed by a run of update-ca-certificates. Certificates which
+// are removed from the GPOs are removed from the trust store. This doesn't
+// require AD CS, nor being online as cached policies are enough.
+//
 // Provided that the AD backend is online and AD CS is set up, the manager will
 // parse the relevant GPOs and delegate to an external Python script that will
 // request Samba to enroll or un-enroll the machine for certificates.
@@ -21,8 +27,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"slices"
 	"strconv"
@@ -47,6 +55,7 @@ type Manager struct {
 	vendorPythonDir string
 	globalTrustDir  string
 	certEnrollCmd   []string
+	updateCACertCmd []string
 
 	mu sync.Mutex // Prevents multiple instances of the certificate manager from running in parallel
 }
@@ -70,8 +79,14 @@ const (
 	// See [MS-CAESO] 4.4.5.1.
 	enrollFlag   int = 0x1
 	disabledFlag int = 0x8000
+
+	// trustedCertsDirName is the directory of the global trust store where trusted certificates are installed.
+	trustedCertsDirName = "adsys"
 )
 
+// trustedCertPrefixes are the key prefixes of the trusted certificate entries.
+var trustedCertPrefixes = []string{"trusted-root/", "trusted-intermediate/"}
+
 // CertEnrollCode is the embedded Python script which requests
 // Samba to autoenroll for certificates using the given GPOs.
 //
@@ -84,6 +99,7 @@ type options struct {
 	shareDir          string
 	globalTrustDir    string
 	certAutoenrollCmd []string
+	updateCACertCmd   []string
 }
 
 // Option reprents an optional function to change the certificate manager.
@@ -124,6 +140,13 @@ func WithCertAutoenrollCmd(cmd []string) func(*options) {
 	}
 }
 
+// WithUpdateCACertificatesCmd overrides the default command refreshing the system trust store.
+func WithUpdateCACertificatesCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.updateCACertCmd = cmd
+	}
+}
+
 // New returns a new manager for the certificate policy.
 func New(domain string, opts ...Option) *Manager {
 	// defaults
@@ -133,6 +156,7 @@ func New(domain string, opts ...Option) *Manager {
 		shareDir:          consts.DefaultShareDir,
 		globalTrustDir:    consts.DefaultGlobalTrustDir,
 		certAutoenrollCmd: []string{"python3", "-c", CertEnrollCode},
+		updateCACertCmd:   []string{"update-ca-certificates"},
 	}
 	// applied options
 	for _, o := range opts {
@@ -146,10 +170,12 @@ func New(domain string, opts ...Option) *Manager {
 		vendorPythonDir: filepath.Join(args.shareDir, "python"),
 		globalTrustDir:  args.globalTrustDir,
 		certEnrollCmd:   args.certAutoenrollCmd,
+		updateCACertCmd: args.updateCACertCmd,
 	}
 }
 
-// ApplyPolicy runs the certificate autoenrollment script to enroll or un-enroll the machine.
+// ApplyPolicy installs the trusted certificates and runs the certificate autoenrollment script
+// to enroll or un-enroll the machine.
 func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer, isOnline bool, entries []entry.Entry) (err error) {
 	defer decorate.OnError(&err, gotext.Get("can't apply certificate policy"))
 
@@ -161,6 +187,18 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		return nil
 	}
 
+	var trustedCerts []entry.Entry
+	entries = slices.DeleteFunc(slices.Clone(entries), func(e entry.Entry) bool {
+		if !isTrustedCert(e.Key) {
+			return false
+		}
+		trustedCerts = append(trustedCerts, e)
+		return true
+	})
+	if err := m.applyTrustedCerts(ctx, trustedCerts); err != nil {
+		return err
+	}
+
 	if !isOnline {
 		log.Debug(ctx, gotext.Get("AD backend is offline, skipping certificate policy"))
 		return nil
@@ -233,6 +271,80 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 	return nil
 }
 
+// applyTrustedCerts installs the enabled trusted certificates in the global trust store, removes the ones
+// which are not in the policy anymore and updates the system trust store if anything changed.
+func (m *Manager) applyTrustedCerts(ctx context.Context, entries []entry.Entry) (err error) {
+	dir := filepath.Join(m.globalTrustDir, trustedCertsDirName)
+	defer decorate.OnError(&err, gotext.Get("can't apply trusted certificates to %q", dir))
+
+	certs := make(map[string]string)
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+		// Root and intermediate stores can hold the same certificate: only its thumbprint identifies it.
+		certs[path.Base(e.Key)+".crt"] = e.Value
+	}
+
+	var changed bool
+	installed, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, f := range installed {
+		if _, ok := certs[f.Name()]; ok {
+			continue
+		}
+		log.Debugf(ctx, "Removing trusted certificate %q", f.Name())
+		if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if len(certs) == 0 {
+		if err := os.Remove(dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for name, content := range certs {
+		p := filepath.Join(dir, name)
+		if cur, err := os.ReadFile(p); err == nil && string(cur) == content {
+			continue
+		}
+		log.Debugf(ctx, "Installing trusted certificate %q", name)
+		// #nosec G306 - certificates in the trust store are public
+		if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(p+".new", p); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	// #nosec G204 - We are in control of the arguments
+	cmd := exec.CommandContext(ctx, m.updateCACertCmd[0], m.updateCACertCmd[1:]...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.New(gotext.Get("failed to update system trust store: %v\n%s", err, string(out)))
+	}
+	log.Info(ctx, gotext.Get("Trusted certificates updated in %q", dir))
+
+	return nil
+}
+
+// isTrustedCert returns true if key is the key of a trusted certificate entry.
+func isTrustedCert(key string) bool {
+	return slices.ContainsFunc(trustedCertPrefixes, func(p string) bool { return strings.HasPrefix(key, p) })
+}
+
 // runScript runs the certificate autoenrollment script with the given arguments.
 func (m *Manager) runScript(ctx context.Context, action, objectName string, extraArgs ...string) error {
 	scriptArgs := []string{action, objectName, m.domain, "--state_dir", m.stateDir, "--global_trust_dir", m.globalTrustDir}
@@ -276,3 +388,14 @@ func gpoType(value string) int {
 
 	return gpoTypeString
 }
+
+// CertificatePath returns the path of the certificate enrolled as name, like "example-CA.Machine",
+// in stateDir. Root CA certificates are stored alongside enrolled certificates.
+func CertificatePath(stateDir, name string) string {
+	return filepath.Join(stateDir, "certs", name+".crt")
+}
+
+// PrivateKeyPath returns the path of the private key of the certificate enrolled as name in stateDir.
+func PrivateKeyPath(stateDir, name string) string {
+	return filepath.Join(stateDir, "private", "certs", name+".key")
+}
@@ -122,6 +122,91 @@ func TestApplyPolicy(t *testing.T) {
 	}
 }
 
+func TestApplyPolicyTrustedCertificates(t *testing.T) {
+	t.Parallel()
+
+	rootCert, err := os.ReadFile(filepath.Join(testutils.TestFamilyPath(t), "root.pem"))
+	require.NoError(t, err, "Setup: failed to read root certificate")
+	intermediateCert, err := os.ReadFile(filepath.Join(testutils.TestFamilyPath(t), "intermediate.pem"))
+	require.NoError(t, err, "Setup: failed to read intermediate certificate")
+
+	rootEntry := entry.Entry{Key: "trusted-root/9344e5268d3440fdeca7cee223986340c17f2b4e", Value: string(rootCert)}
+	intermediateEntry := entry.Entry{Key: "trusted-intermediate/0707ac4e2a9e2560703ce4992de115db6bce6681", Value: string(intermediateCert)}
+	defaultEntries := []entry.Entry{rootEntry, intermediateEntry}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		existingState string
+
+		isUser    bool
+		isOffline bool
+
+		updateCACertificatesError bool
+
+		wantUpdateCACertificates bool
+		wantErr                  bool
+	}{
+		"Install trusted certificates":                      {wantUpdateCACertificates: true},
+		"Install trusted certificates when offline":         {isOffline: true, wantUpdateCACertificates: true},
+		"Trusted certificates already installed":            {existingState: "installed"},
+		"Update modified trusted certificate":               {existingState: "modified", wantUpdateCACertificates: true},
+		"Remove certificates not trusted anymore":           {entries: []entry.Entry{rootEntry}, existingState: "installed", wantUpdateCACertificates: true},
+		"Remove all certificates without trusted ones":      {entries: []entry.Entry{}, existingState: "installed", wantUpdateCACertificates: true},
+		"Disabled certificates are not trusted":             {entries: []entry.Entry{{Key: rootEntry.Key, Disabled: true}, intermediateEntry}, existingState: "installed", wantUpdateCACertificates: true},
+		"Same certificate in both stores is installed once": {entries: []entry.Entry{rootEntry, {Key: "trusted-intermediate/9344e5268d3440fdeca7cee223986340c17f2b4e", Value: string(rootCert)}}, wantUpdateCACertificates: true},
+		"No trusted certificates and none installed":        {entries: []entry.Entry{}},
+		"Autoenrollment entries are not installed":          {entries: []entry.Entry{{Key: "autoenroll", Value: disabledValue}, rootEntry}, wantUpdateCACertificates: true},
+		"User, trusted certificates not supported":          {isUser: true},
+
+		// Error cases
+		"Error on update-ca-certificates failure":        {updateCACertificatesError: true, wantErr: true},
+		"Error on trusted certificates dir being a file": {existingState: "dir_is_file", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			tmpdir := t.TempDir()
+			globalTrustDir := filepath.Join(tmpdir, "ca-certificates")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), globalTrustDir)
+			}
+
+			updateCACertificatesOutputFile := filepath.Join(tmpdir, "update-ca-certificates-output")
+			updateCACertificatesCmd := []string{"touch", updateCACertificatesOutputFile}
+			if tc.updateCACertificatesError {
+				updateCACertificatesCmd = []string{"false"}
+			}
+
+			m := certificate.New(
+				"example.com",
+				certificate.WithStateDir(filepath.Join(tmpdir, "statedir")),
+				certificate.WithRunDir(filepath.Join(tmpdir, "rundir")),
+				certificate.WithShareDir(filepath.Join(tmpdir, "sharedir")),
+				certificate.WithGlobalTrustDir(globalTrustDir),
+				certificate.WithCertAutoenrollCmd([]string{"false"}),
+				certificate.WithUpdateCACertificatesCmd(updateCACertificatesCmd),
+			)
+
+			err = m.ApplyPolicy(context.Background(), "keypress", !tc.isUser, !tc.isOffline, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should fail")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy should succeed")
+
+			_, err = os.Stat(updateCACertificatesOutputFile)
+			require.Equal(t, tc.wantUpdateCACertificates, err == nil, "update-ca-certificates should only run when trusted certificates change")
+			testutils.CompareTreesWithFiltering(t, globalTrustDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
 func mockAutoenrollScript(t *testing.T, scriptOutputFile string, autoenrollScriptError bool) []string {
 	t.Helper()
 
@@ -13,6 +13,9 @@ type Entry struct {
 	// Strategy are overlay rules for the same keys between multiple GPOs.
 	// Default (empty or unknown value) means "override".
 	Strategy string `yaml:",omitempty"`
+	// Target is a targeting expression restricting the clients and users the entry applies to.
+	// Empty means that the entry applies everywhere.
+	Target string `yaml:",omitempty"`
 	// Err is set if there was an error parsing the entry. It is ignored if the
 	// underlying key is not supported by adsys.
 	Err error `yaml:"-"`
@@ -27,3 +30,25 @@ const (
 	StrategyAppend = "append"
 	// This can be extended to support prepend but it is implemented yet as there is no real world cases.
 )
+
+// KeepClosest returns items without duplicates, as identified by key.
+// Values of the append strategy list the furthest GPO first, so the last occurrence of a key, from the closest GPO,
+// is kept, at the position of the first one. overridden is called, if not nil, for each discarded occurrence.
+func KeepClosest[T any, K comparable](items []T, key func(T) K, overridden func(further, closest T)) []T {
+	var r []T
+	index := make(map[K]int)
+	for _, item := range items {
+		k := key(item)
+		i, exists := index[k]
+		if !exists {
+			index[k] = len(r)
+			r = append(r, item)
+			continue
+		}
+		if overridden != nil {
+			overridden(r[i], item)
+		}
+		r[i] = item
+	}
+	return r
+}
@@ -0,0 +1,47 @@
+package entry_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+)
+
+func TestKeepClosest(t *testing.T) {
+	t.Parallel()
+
+	type item struct{ key, value string }
+
+	tests := map[string]struct {
+		items []item
+
+		want           []item
+		wantOverridden []string
+	}{
+		"No items":      {},
+		"No duplicates": {items: []item{{"a", "1"}, {"b", "2"}}, want: []item{{"a", "1"}, {"b", "2"}}},
+		"Last occurrence is kept at the first position": {
+			items:          []item{{"a", "furthest"}, {"b", "2"}, {"a", "closest"}},
+			want:           []item{{"a", "closest"}, {"b", "2"}},
+			wantOverridden: []string{"furthest>closest"},
+		},
+		"Multiple occurrences": {
+			items:          []item{{"a", "furthest"}, {"a", "middle"}, {"a", "closest"}},
+			want:           []item{{"a", "closest"}},
+			wantOverridden: []string{"furthest>middle", "middle>closest"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var overridden []string
+			got := entry.KeepClosest(tc.items, func(i item) string { return i.key }, func(further, closest item) {
+				overridden = append(overridden, further.value+">"+closest.value)
+			})
+			require.Equal(t, tc.want, got, "KeepClosest returned unexpected items")
+			require.Equal(t, tc.wantOverridden, overridden, "KeepClosest reported unexpected overridden items")
+		})
+	}
+}
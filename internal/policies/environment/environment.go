@@ -0,0 +1,325 @@
+// Package environment is the policy manager for session environment variables.
+//
+// Variables are defined per computer (environment/variables-machine) or per user (environment/variables-user),
+// one per line, in the form NAME=value.
+// They are written in the environment.d format, read by the systemd user manager when starting a session:
+//   - machine: /etc/environment.d/99-adsys.conf;
+//   - user: ~/.config/environment.d/99-adsys-user.conf.
+//
+// The user file is processed after the machine one, so user variables can override or extend
+// machine variables.
+//
+// Values from multiple GPOs are appended, from the furthest GPO to the closest one. When a variable is
+// set multiple times with NAME=value, the last value, from the closest GPO, wins. The NAME+=value form composes PATH-like variables
+// instead: all values are joined with ":", after the value set with NAME=value if any, or after
+// the value the variable already has in the session otherwise.
+//
+// Dynamic values, like ${USER}, are expanded before the entries reach this manager. Other variables
+// can be referenced with the $NAME form, which is left as is and expanded by systemd.
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	machineVariablesKey = "environment/variables-machine"
+	userVariablesKey    = "environment/variables-user"
+
+	machineFileName = "99-adsys.conf"
+	// userFileName sorts after machineFileName, so that user variables are processed last.
+	userFileName = "99-adsys-user.conf"
+)
+
+// userEnvironmentDir is the environment.d directory relative to the user home directory.
+var userEnvironmentDir = filepath.Join(".config", "environment.d")
+
+// variableNameRegexp matches valid environment variable names.
+var variableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Manager prevents writing the environment files concurrently while applying the policy.
+type Manager struct {
+	environmentDir string
+
+	userLookup func(string) (*user.User, error)
+
+	mu sync.Mutex
+}
+
+type options struct {
+	environmentDir string
+	userLookup     func(string) (*user.User, error)
+}
+
+// Option reprents an optional function to change the environment manager.
+type Option func(*options)
+
+// WithEnvironmentDir overrides the default system-wide environment.d directory.
+func WithEnvironmentDir(p string) Option {
+	return func(o *options) {
+		o.environmentDir = p
+	}
+}
+
+// New returns a new manager for the environment policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		environmentDir: consts.DefaultEnvironmentDir,
+		userLookup:     user.Lookup,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		environmentDir: args.environmentDir,
+		userLookup:     args.userLookup,
+	}
+}
+
+// ApplyPolicy writes the environment variables of the object, or removes its environment file
+// if there are no variables to set.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply environment policy to %s", objectName))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying environment policy to %s", objectName)
+
+	key := machineVariablesKey
+	if !isComputer {
+		key = userVariablesKey
+	}
+	content, err := parseEntries(entries, key)
+	if err != nil {
+		return err
+	}
+
+	if isComputer {
+		return writeOrRemove(filepath.Join(m.environmentDir, machineFileName), content, -1, -1)
+	}
+
+	u, err := m.userLookup(objectName)
+	if err != nil {
+		return errors.New(gotext.Get("couldn't retrieve user for %q: %v", objectName, err))
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return errors.New(gotext.Get("couldn't convert %q to a valid uid for %q", u.Uid, objectName))
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return errors.New(gotext.Get("couldn't convert %q to a valid gid for %q", u.Gid, objectName))
+	}
+
+	// The home directory is created on first login: nothing to clean up, and the variables will be
+	// set on next refresh.
+	if _, err := os.Stat(u.HomeDir); errors.Is(err, fs.ErrNotExist) {
+		if content != "" {
+			log.Warning(ctx, gotext.Get("Home directory %q of %q doesn't exist yet, environment variables will be set on next refresh", u.HomeDir, objectName))
+		}
+		return nil
+	}
+
+	userDir := filepath.Join(u.HomeDir, userEnvironmentDir)
+	if content == "" {
+		return writeOrRemove(filepath.Join(userDir, userFileName), "", uid, gid)
+	}
+
+	// Create the directories owned by the user, and refuse to follow symlinks the user could have
+	// planted in their home directory.
+	for _, d := range []string{filepath.Dir(userDir), userDir} {
+		if err := mkdirAsUser(d, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	return writeOrRemove(filepath.Join(userDir, userFileName), content, uid, gid)
+}
+
+type variable struct {
+	name     string
+	value    string
+	hasValue bool
+	appended []string
+}
+
+// parseEntries returns the content of the environment.d file for the entries matching key.
+// It is empty if there is no variable to set.
+func parseEntries(entries []entry.Entry, key string) (content string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse environment entries"))
+
+	var variables []*variable
+	for _, e := range entries {
+		if e.Disabled || e.Key != key {
+			continue
+		}
+		if e.Err != nil {
+			return "", errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		for _, line := range strings.Split(e.Value, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			name, value, found := strings.Cut(line, "=")
+			if !found {
+				return "", errors.New(gotext.Get("invalid environment variable %q: expected NAME=value or NAME+=value", line))
+			}
+			name, appending := strings.CutSuffix(name, "+")
+			name = strings.TrimSpace(name)
+			value = strings.TrimSpace(value)
+			if !variableNameRegexp.MatchString(name) {
+				return "", errors.New(gotext.Get("invalid environment variable name %q", name))
+			}
+
+			i := slices.IndexFunc(variables, func(v *variable) bool { return v.name == name })
+			if i == -1 {
+				variables = append(variables, &variable{name: name})
+				i = len(variables) - 1
+			}
+			v := variables[i]
+
+			if appending {
+				if value != "" && !slices.Contains(v.appended, value) {
+					v.appended = append(v.appended, value)
+				}
+				continue
+			}
+			// Values are listed from the furthest GPO to the closest one: the last value wins.
+			v.value, v.hasValue = value, true
+		}
+	}
+
+	if len(variables) == 0 {
+		return "", nil
+	}
+
+	var b strings.Builder
+	b.WriteString(`# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`)
+	for _, v := range variables {
+		value := v.value
+		if len(v.appended) > 0 {
+			switch {
+			case !v.hasValue:
+				// Extend the value the variable already has in the session, if any.
+				value = fmt.Sprintf("${%s:+$%s:}%s", v.name, v.name, strings.Join(v.appended, ":"))
+			case value == "":
+				value = strings.Join(v.appended, ":")
+			default:
+				value = strings.Join(append([]string{value}, v.appended...), ":")
+			}
+		}
+		fmt.Fprintf(&b, "%s=%s\n", v.name, value)
+	}
+
+	return b.String(), nil
+}
+
+// mkdirAsUser creates the directory p owned by uid and gid if it doesn't exist.
+// It errors out if p exists and is not a directory, including if it is a symlink.
+func mkdirAsUser(p string, uid, gid int) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't create directory %q", p))
+
+	fi, err := os.Lstat(p)
+	if err == nil {
+		if !fi.IsDir() {
+			return errors.New(gotext.Get("%q is not a directory", p))
+		}
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := os.Mkdir(p, 0700); err != nil {
+		return err
+	}
+	return chown(p, nil, uid, gid)
+}
+
+// writeOrRemove atomically writes content to p, owned by uid and gid, or removes p if content is empty.
+func writeOrRemove(p, content string, uid, gid int) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't update environment file %q", p))
+
+	if content == "" {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	perm := os.FileMode(0600)
+	if uid == -1 {
+		// The machine file needs to be read by the user manager of every user.
+		// #nosec G301 - /etc/environment.d permissions are 0755, so we should keep the same pattern.
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		perm = 0644
+	}
+
+	// Remove any leftover, which could be a symlink in the user directory.
+	if err := os.Remove(p + ".new"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(p+".new", os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		return err
+	}
+	if err := chown(p+".new", f, uid, gid); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(p+".new", p)
+}
+
+// chown either chown the file descriptor attached, or the path if this one is null to uid and gid.
+// It will know if we should skip chown for tests.
+func chown(p string, f *os.File, uid, gid int) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't chown %q", p))
+
+	if os.Getenv("ADSYS_SKIP_ROOT_CALLS") != "" {
+		uid = -1
+		gid = -1
+	}
+
+	if f == nil {
+		// Ensure that if p is a symlink, we only change the symlink itself, not what was pointed by it.
+		return os.Lchown(p, uid, gid)
+	}
+
+	return f.Chown(uid, gid)
+}
@@ -0,0 +1,161 @@
+package environment_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/environment"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "environment/variables-machine", Value: "JAVA_HOME=/usr/lib/jvm/default-java\nhttp_proxy=http://proxy.example.com:3128\nPATH+=/opt/corp/bin"},
+	}
+
+	defaultUserEntries := []entry.Entry{
+		{Key: "environment/variables-user", Value: "JAVA_HOME=/usr/lib/jvm/default-java\nhttp_proxy=http://proxy.example.com:3128\nPATH+=/opt/corp/bin"},
+	}
+
+	tests := map[string]struct {
+		entries      []entry.Entry
+		isUser       bool
+		existingDirs string
+
+		noHome          bool
+		userLookupError bool
+		userReturnedUID string
+		userReturnedGID string
+		fileInPlaceOf   string
+		symlinkInPlace  string
+
+		wantErr bool
+	}{
+		// Machine cases
+		"Computer, set variables": {},
+		"Computer, closest GPO value wins": {entries: uniqueEntries(
+			[]entry.Entry{{Key: "environment/variables-machine", Value: "EDITOR=vim", Strategy: entry.StrategyAppend}},
+			[]entry.Entry{{Key: "environment/variables-machine", Value: "EDITOR=nano\nPAGER=less", Strategy: entry.StrategyAppend}},
+		)},
+		"Computer, appended values are joined":                   {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "PATH+=/opt/corp/bin\nPATH+=/opt/tools/bin\nPATH+=/opt/corp/bin"}}},
+		"Computer, appended values extend the set value":         {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "PATH+=/opt/corp/bin\nPATH=/usr/bin:/bin\nPATH+=/opt/tools/bin"}}},
+		"Computer, appended values to an empty value":            {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "XDG_DATA_DIRS=\nXDG_DATA_DIRS+=/opt/share"}}},
+		"Computer, empty values are kept":                        {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "EMPTY="}}},
+		"Computer, references to other variables are kept":       {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "CORP_HOME=/opt/corp\nCORP_BIN=$CORP_HOME/bin"}}},
+		"Computer, spaces, comments and empty lines are ignored": {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "# Java\n\n  JAVA_HOME = /usr/lib/jvm/default-java  \n"}}},
+		"Computer, disabled entries are ignored":                 {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "EDITOR=vim", Disabled: true}}},
+		"Computer, unknown keys are ignored":                     {entries: []entry.Entry{{Key: "environment/unknown", Value: "EDITOR=vim"}}},
+		"Computer, user entries are ignored":                     {entries: defaultUserEntries},
+		"Computer, replaces existing file":                       {existingDirs: "existing"},
+		"Computer, no entries removes existing file":             {entries: []entry.Entry{}, existingDirs: "existing"},
+		"Computer, no entries and no file":                       {entries: []entry.Entry{}},
+
+		// User cases
+		"User, set variables":                               {isUser: true},
+		"User, replaces existing file":                      {isUser: true, existingDirs: "existing"},
+		"User, no entries removes existing file":            {isUser: true, entries: []entry.Entry{}, existingDirs: "existing"},
+		"User, no entries and no file":                      {isUser: true, entries: []entry.Entry{}},
+		"User, home directory doesn't exist yet is skipped": {isUser: true, noHome: true},
+		"User, machine entries are ignored":                 {isUser: true, entries: defaultEntries},
+
+		// Error cases
+		"Error on errored entry":                              {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "EDITOR=vim", Err: errors.New("some error")}}, wantErr: true},
+		"Error on missing equal sign":                         {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "EDITOR"}}, wantErr: true},
+		"Error on invalid variable name":                      {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "1EDITOR=vim"}}, wantErr: true},
+		"Error on empty variable name":                        {entries: []entry.Entry{{Key: "environment/variables-machine", Value: "=vim"}}, wantErr: true},
+		"Error on environment directory being a file":         {fileInPlaceOf: "etc/environment.d", wantErr: true},
+		"Error on user lookup failing":                        {isUser: true, userLookupError: true, wantErr: true},
+		"Error on invalid uid":                                {isUser: true, userReturnedUID: "invalid", wantErr: true},
+		"Error on invalid gid":                                {isUser: true, userReturnedGID: "invalid", wantErr: true},
+		"Error on user config directory being a file":         {isUser: true, fileInPlaceOf: "home/ubuntu/.config", wantErr: true},
+		"Error on user environment directory being a symlink": {isUser: true, symlinkInPlace: "home/ubuntu/.config/environment.d", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+				if tc.isUser {
+					tc.entries = defaultUserEntries
+				}
+			}
+
+			rootDir := t.TempDir()
+			homeDir := filepath.Join(rootDir, "home", "ubuntu")
+			if tc.existingDirs != "" {
+				for _, d := range []string{"etc", "home"} {
+					testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), tc.existingDirs, d), filepath.Join(rootDir, d))
+				}
+			}
+			if !tc.noHome {
+				require.NoError(t, os.MkdirAll(homeDir, 0750), "Setup: can't create home directory")
+			}
+			if tc.fileInPlaceOf != "" {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(rootDir, tc.fileInPlaceOf)), 0750), "Setup: can't create parent directory")
+				testutils.WriteFile(t, filepath.Join(rootDir, tc.fileInPlaceOf), []byte("not a directory"), 0600)
+			}
+			if tc.symlinkInPlace != "" {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(rootDir, tc.symlinkInPlace)), 0750), "Setup: can't create parent directory")
+				require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "elsewhere"), 0750), "Setup: can't create symlink target")
+				require.NoError(t, os.Symlink(filepath.Join(rootDir, "elsewhere"), filepath.Join(rootDir, tc.symlinkInPlace)), "Setup: can't create symlink")
+			}
+
+			u, err := user.Current()
+			require.NoError(t, err, "Setup: can't get current user")
+			if tc.userReturnedUID == "" {
+				tc.userReturnedUID = u.Uid
+			}
+			if tc.userReturnedGID == "" {
+				tc.userReturnedGID = u.Gid
+			}
+			userLookup := func(string) (*user.User, error) {
+				return &user.User{Uid: tc.userReturnedUID, Gid: tc.userReturnedGID, HomeDir: homeDir}, nil
+			}
+			if tc.userLookupError {
+				userLookup = func(string) (*user.User, error) {
+					return nil, errors.New("User error requested")
+				}
+			}
+
+			m := environment.New(
+				environment.WithEnvironmentDir(filepath.Join(rootDir, "etc", "environment.d")),
+				environment.WithUserLookup(userLookup),
+			)
+
+			err = m.ApplyPolicy(context.Background(), "ubuntu@example.com", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// uniqueEntries returns the environment entries of GPOs, listed from the closest to the furthest, as merged
+// by the policies manager.
+func uniqueEntries(gposEntries ...[]entry.Entry) []entry.Entry {
+	var pols policies.Policies
+	for i, entries := range gposEntries {
+		pols.GPOs = append(pols.GPOs, policies.GPO{
+			ID:    fmt.Sprintf("{GPO%d}", i),
+			Name:  fmt.Sprintf("GPO%d", i),
+			Rules: map[string][]entry.Entry{"environment": entries},
+		})
+	}
+	return pols.GetUniqueRules()["environment"]
+}
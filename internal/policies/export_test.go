@@ -4,6 +4,7 @@ import (
 	"github.com/ubuntu/adsys/internal/policies/dynamicvalues"
 	"github.com/ubuntu/adsys/internal/policies/entry"
 	"github.com/ubuntu/adsys/internal/policies/gdm"
+	"github.com/ubuntu/adsys/internal/policies/targeting"
 )
 
 const (
@@ -24,6 +25,14 @@ func WithGDM(m *gdm.Manager) Option {
 	}
 }
 
+// WithTargetingOptions specifies personalized options to compute the facts of targeting expressions.
+func WithTargetingOptions(opts ...targeting.Option) Option {
+	return func(o *options) error {
+		o.targetingOpts = opts
+		return nil
+	}
+}
+
 func (pols Policies) HasAssets() bool {
 	return pols.assets != nil
 }
@@ -0,0 +1,26 @@
+package files
+
+import (
+	"os/user"
+)
+
+// WithRootDir allows to deploy files relative to a root directory.
+func WithRootDir(p string) Option {
+	return func(o *options) {
+		o.rootDir = p
+	}
+}
+
+// WithUserLookup allows to mock system user lookup.
+func WithUserLookup(userLookup func(string) (*user.User, error)) Option {
+	return func(o *options) {
+		o.userLookup = userLookup
+	}
+}
+
+// WithGroupLookup allows to mock system group lookup.
+func WithGroupLookup(groupLookup func(string) (*user.Group, error)) Option {
+	return func(o *options) {
+		o.groupLookup = groupLookup
+	}
+}
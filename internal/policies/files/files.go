@@ -0,0 +1,519 @@
+// Package files is the policy manager deploying files from SYSVOL to the client, like GPP Files.
+//
+// This manager only applies to computer objects.
+//
+// Each line of the files/deploy entry is a file to deploy, in the form:
+//
+//	<source> <target> [owner=<user>[:<group>]] [mode=<octal mode>]
+//
+// The source is relative to the SYSVOL files/ subdirectory and the target is an absolute path on the client.
+// Files are owned by root with mode 0644 by default. If a target is listed multiple times, the closest GPO wins.
+//
+// The manager keeps a manifest of the deployed files in its state directory. The first time a target which
+// already exists is deployed, the original file is saved next to the manifest. Once the target is not
+// referenced by the policy anymore, the original file is restored, or the deployed file is removed if there
+// was none.
+//
+// Should a source be missing or a file fail to be deployed, an error is returned and authentication
+// will be prevented.
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	deployKey = "files/deploy"
+
+	manifestFile = "manifest"
+	backupDir    = "backup"
+	assetsDir    = "assets"
+
+	// Manifest markers telling whether a target replaced an existing file.
+	withBackup    = "backup"
+	withoutBackup = "new"
+
+	defaultMode = fs.FileMode(0644)
+)
+
+// modeRegexp matches octal file modes.
+var modeRegexp = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
+// Manager prevents deploying files concurrently while applying the policy.
+type Manager struct {
+	stateDir string
+	rootDir  string
+
+	userLookup  func(string) (*user.User, error)
+	groupLookup func(string) (*user.Group, error)
+
+	mu sync.Mutex
+}
+
+type options struct {
+	stateDir string
+	rootDir  string
+
+	userLookup  func(string) (*user.User, error)
+	groupLookup func(string) (*user.Group, error)
+}
+
+// Option reprents an optional function to change the files manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) Option {
+	return func(o *options) {
+		o.stateDir = p
+	}
+}
+
+// file is a file to deploy.
+type file struct {
+	source string
+	target string
+	uid    int
+	gid    int
+	mode   fs.FileMode
+}
+
+// New returns a new manager for the files policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:    consts.DefaultStateDir,
+		rootDir:     "/",
+		userLookup:  user.Lookup,
+		groupLookup: user.LookupGroup,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:    filepath.Join(args.stateDir, "files"),
+		rootDir:     args.rootDir,
+		userLookup:  args.userLookup,
+		groupLookup: args.groupLookup,
+	}
+}
+
+// ApplyPolicy deploys the files listed in entries from the SYSVOL assets.
+// Files previously deployed by adsys which are not referenced anymore are restored or removed.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply files policy to %s", objectName))
+
+	// Files are only deployed on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying files policy to %s", objectName)
+
+	files, err := m.parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := m.readManifest()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to deploy and nothing to restore.
+	if len(files) == 0 && len(manifest) == 0 {
+		return nil
+	}
+
+	// Save the manifest even on partial failures, so that we can restore what was already deployed.
+	defer func() {
+		if errSave := m.saveManifest(manifest); errSave != nil {
+			err = errors.Join(err, errSave)
+		}
+	}()
+
+	var targets []string
+	if len(files) > 0 {
+		assetsPath := filepath.Join(m.stateDir, assetsDir)
+		if err := os.RemoveAll(assetsPath); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+			return err
+		}
+		defer os.RemoveAll(assetsPath)
+
+		if err := assetsDumper(ctx, "files/", assetsPath, -1, -1); err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if err := m.deploy(ctx, assetsPath, f, manifest); err != nil {
+				return err
+			}
+			targets = append(targets, f.target)
+		}
+	}
+
+	for _, target := range sortedKeys(manifest) {
+		if slices.Contains(targets, target) {
+			continue
+		}
+		if err := m.restore(ctx, target, manifest[target]); err != nil {
+			return err
+		}
+		delete(manifest, target)
+	}
+
+	return nil
+}
+
+// parseEntries returns the files to deploy from the entries.
+// When a target is listed multiple times, the closest GPO wins. Disabled entries are ignored.
+func (m *Manager) parseEntries(ctx context.Context, entries []entry.Entry) (files []file, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse files entries"))
+
+	for _, e := range entries {
+		if e.Err != nil {
+			return nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+		if e.Disabled || e.Key != deployKey {
+			continue
+		}
+
+		for _, line := range strings.Split(e.Value, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			f, err := m.parseFile(line)
+			if err != nil {
+				return nil, err
+			}
+
+			files = append(files, f)
+		}
+	}
+
+	return entry.KeepClosest(files, func(f file) string { return f.target }, func(further, closest file) {
+		if further != closest {
+			log.Warning(ctx, gotext.Get("Target %q is deployed multiple times. The file %q of the closest GPO will be used instead of %q.", closest.target, closest.source, further.source))
+		}
+	}), nil
+}
+
+// parseFile parses a file line, in the form <source> <target> [owner=<user>[:<group>]] [mode=<octal mode>].
+func (m *Manager) parseFile(line string) (f file, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return file{}, errors.New(gotext.Get("invalid line %q: expected <source> <target> [owner=<user>[:<group>]] [mode=<octal mode>]", line))
+	}
+
+	f = file{
+		source: filepath.Clean(fields[0]),
+		target: filepath.Clean(fields[1]),
+		uid:    -1,
+		gid:    -1,
+		mode:   defaultMode,
+	}
+	if !filepath.IsLocal(f.source) {
+		return file{}, errors.New(gotext.Get("invalid source %q: expected a path relative to the SYSVOL files/ subdirectory", fields[0]))
+	}
+	if !filepath.IsAbs(f.target) || f.target == "/" {
+		return file{}, errors.New(gotext.Get("invalid target %q: expected an absolute file path", fields[1]))
+	}
+
+	for _, opt := range fields[2:] {
+		k, v, _ := strings.Cut(opt, "=")
+		switch k {
+		case "owner":
+			if f.uid, f.gid, err = m.lookupOwner(v); err != nil {
+				return file{}, err
+			}
+		case "mode":
+			if !modeRegexp.MatchString(v) {
+				return file{}, errors.New(gotext.Get("invalid mode %q: expected an octal mode like 0644", v))
+			}
+			mode, _ := strconv.ParseUint(v, 8, 32)
+			f.mode = fs.FileMode(mode)
+		default:
+			return file{}, errors.New(gotext.Get("unknown option %q for %q: expected owner or mode", opt, f.target))
+		}
+	}
+
+	return f, nil
+}
+
+// lookupOwner returns the uid and gid of owner, in the form <user>[:<group>].
+// The primary group of the user is used if no group is given.
+func (m *Manager) lookupOwner(owner string) (uid, gid int, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid owner %q", owner))
+
+	name, group, withGroup := strings.Cut(owner, ":")
+	u, err := m.userLookup(name)
+	if err != nil {
+		return -1, -1, err
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return -1, -1, errors.New(gotext.Get("couldn't convert %q to a valid uid", u.Uid))
+	}
+
+	gidStr := u.Gid
+	if withGroup {
+		g, err := m.groupLookup(group)
+		if err != nil {
+			return -1, -1, err
+		}
+		gidStr = g.Gid
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		return -1, -1, errors.New(gotext.Get("couldn't convert %q to a valid gid", gidStr))
+	}
+
+	return uid, gid, nil
+}
+
+// deploy copies the source of f from assetsPath to its target, saving the original target first if
+// it is not already managed. The manifest is updated accordingly.
+func (m *Manager) deploy(ctx context.Context, assetsPath string, f file, manifest map[string]string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't deploy %q to %q", f.source, f.target))
+
+	content, err := readRegularFile(filepath.Join(assetsPath, f.source))
+	if errors.Is(err, fs.ErrNotExist) {
+		return errors.New(gotext.Get("source %q doesn't exist in SYSVOL files/ subdirectory", f.source))
+	} else if err != nil {
+		return err
+	}
+
+	target := filepath.Join(m.rootDir, f.target)
+	if _, managed := manifest[f.target]; !managed {
+		// Save the original file, if any, before replacing it.
+		manifest[f.target] = withoutBackup
+		err := copyFile(target, filepath.Join(m.stateDir, backupDir, f.target))
+		if err == nil {
+			manifest[f.target] = withBackup
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			delete(manifest, f.target)
+			return err
+		}
+	}
+
+	if upToDate(target, content, f) {
+		return nil
+	}
+
+	log.Debugf(ctx, "Deploying %q to %q", f.source, f.target)
+	//nolint:gosec // G301 - parent directories of deployed files are world-readable, like /etc.
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return writeFile(target, content, f.mode, f.uid, f.gid)
+}
+
+// restore puts back the original file of target if it was saved, or removes target otherwise.
+func (m *Manager) restore(ctx context.Context, target, backup string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't restore %q", target))
+
+	p := filepath.Join(m.rootDir, target)
+	if backup != withBackup {
+		log.Debugf(ctx, "Removing deployed file %q", target)
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	log.Debugf(ctx, "Restoring original file %q", target)
+	backupPath := filepath.Join(m.stateDir, backupDir, target)
+	if err := copyFile(backupPath, p); err != nil {
+		return err
+	}
+	if err := os.Remove(backupPath); err != nil {
+		return err
+	}
+
+	// Clean up empty backup directories.
+	for dir := filepath.Dir(backupPath); dir != m.stateDir; dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// readRegularFile returns the content of p, which must be a regular file.
+func readRegularFile(p string) ([]byte, error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.New(gotext.Get("%q is not a regular file", p))
+	}
+	return os.ReadFile(p)
+}
+
+// upToDate returns true if p already has the content, mode and ownership of f.
+func upToDate(p string, content []byte, f file) bool {
+	info, err := os.Lstat(p)
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm() != f.mode {
+		return false
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && os.Getenv("ADSYS_SKIP_ROOT_CALLS") == "" {
+		if (f.uid != -1 && int(st.Uid) != f.uid) || (f.gid != -1 && int(st.Gid) != f.gid) {
+			return false
+		}
+	}
+	current, err := os.ReadFile(p)
+	return err == nil && bytes.Equal(current, content)
+}
+
+// copyFile copies the regular file src to dst, preserving its mode and ownership.
+func copyFile(src, dst string) error {
+	content, err := readRegularFile(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	uid, gid := -1, -1
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(st.Uid), int(st.Gid)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return writeFile(dst, content, info.Mode().Perm(), uid, gid)
+}
+
+// writeFile atomically writes content to p with the given mode and ownership.
+func writeFile(p string, content []byte, mode fs.FileMode, uid, gid int) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write %q", p))
+
+	if err := os.WriteFile(p+".new", content, mode); err != nil {
+		return err
+	}
+	// Enforce the mode, which is restricted by the umask on creation.
+	if err := os.Chmod(p+".new", mode); err != nil {
+		return err
+	}
+	if err := chown(p+".new", uid, gid); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// chown changes the ownership of p to uid and gid.
+// It will know if we should skip chown for tests.
+func chown(p string, uid, gid int) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't chown %q", p))
+
+	if os.Getenv("ADSYS_SKIP_ROOT_CALLS") != "" {
+		uid = -1
+		gid = -1
+	}
+
+	// Ensure that if p is a symlink, we only change the symlink itself, not what was pointed by it.
+	return os.Lchown(p, uid, gid)
+}
+
+// readManifest returns the targets deployed by adsys, and whether their original file was saved.
+// A missing manifest means no file is deployed.
+func (m *Manager) readManifest() (manifest map[string]string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't read files manifest"))
+
+	manifest = make(map[string]string)
+
+	f, err := os.Open(filepath.Join(m.stateDir, manifestFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return manifest, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		backup, target, found := strings.Cut(line, " ")
+		if !found || (backup != withBackup && backup != withoutBackup) || !filepath.IsAbs(target) {
+			return nil, errors.New(gotext.Get("invalid line in files manifest: %q", line))
+		}
+		manifest[target] = backup
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// saveManifest atomically writes the targets deployed by adsys.
+// The manifest is removed if there are no files to track.
+func (m *Manager) saveManifest(manifest map[string]string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save files manifest"))
+
+	p := filepath.Join(m.stateDir, manifestFile)
+	if len(manifest) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	for _, target := range sortedKeys(manifest) {
+		fmt.Fprintf(&content, "%s %s\n", manifest[target], target)
+	}
+	if err := os.WriteFile(p+".new", []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// sortedKeys returns the keys of the map, sorted.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,141 @@
+package files_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/files"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "files/deploy", Value: `krb5/corp.conf /etc/krb5.conf.d/corp.conf
+wallpaper.png /usr/share/backgrounds/corp.png owner=root:root mode=0644
+app.desktop /etc/skel/Desktop/app.desktop mode=0755`},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		saveAssetsError bool
+
+		wantErr bool
+	}{
+		"Deploy files":                             {},
+		"Replacing an existing file saves it":      {existingState: "distribution"},
+		"Update deployed files":                    {existingState: "managed"},
+		"Files already up to date":                 {existingState: "up_to_date"},
+		"Remove deployed files with no entries":    {entries: []entry.Entry{}, existingState: "managed"},
+		"No entries and no deployed files":         {entries: []entry.Entry{}},
+		"Owner without group uses its primary one": {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png /usr/share/backgrounds/corp.png owner=root"}}},
+		"Comments and empty lines are ignored":     {entries: []entry.Entry{{Key: "files/deploy", Value: "# Kerberos\n\n  krb5/corp.conf   /etc/krb5.conf.d/corp.conf  \n"}}},
+		"Closest GPO file deployed to a target wins": {entries: uniqueEntries(
+			[]entry.Entry{{Key: "files/deploy", Value: "wallpaper.png /etc/corp", Strategy: entry.StrategyAppend}},
+			[]entry.Entry{{Key: "files/deploy", Value: "app.desktop /etc/corp\nkrb5/corp.conf /etc/krb5.conf.d/corp.conf", Strategy: entry.StrategyAppend}},
+		)},
+		"Paths are cleaned":                         {entries: []entry.Entry{{Key: "files/deploy", Value: "./krb5//corp.conf /etc//krb5.conf.d/../krb5.conf.d/corp.conf"}}},
+		"Disabled entries are ignored":              {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png /etc/corp", Disabled: true}}, existingState: "managed"},
+		"Other keys are ignored":                    {entries: []entry.Entry{{Key: "files/other", Value: "wallpaper.png /etc/corp"}}},
+		"User objects are ignored":                  {isUser: true, existingState: "managed"},
+		"Removing a restored file cleans its state": {entries: []entry.Entry{{Key: "files/deploy", Value: "app.desktop /etc/skel/Desktop/app.desktop"}}, existingState: "managed"},
+
+		// Error cases
+		"Error on errored entry":              {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png /etc/corp", Err: errors.New("some error")}}, wantErr: true},
+		"Error on missing target":             {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png"}}, wantErr: true},
+		"Error on relative target":            {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png etc/corp"}}, wantErr: true},
+		"Error on root target":                {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png /"}}, wantErr: true},
+		"Error on source outside of files":    {entries: []entry.Entry{{Key: "files/deploy", Value: "../wallpaper.png /etc/corp"}}, wantErr: true},
+		"Error on unknown option":             {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png /etc/corp group=root"}}, wantErr: true},
+		"Error on invalid mode":               {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png /etc/corp mode=4755"}}, wantErr: true},
+		"Error on unknown owner":              {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png /etc/corp owner=unknown"}}, wantErr: true},
+		"Error on unknown group":              {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png /etc/corp owner=root:unknown"}}, wantErr: true},
+		"Error on missing source":             {entries: []entry.Entry{{Key: "files/deploy", Value: "missing.conf /etc/corp"}}, wantErr: true},
+		"Error on source being a directory":   {entries: []entry.Entry{{Key: "files/deploy", Value: "folder /etc/corp"}}, wantErr: true},
+		"Error on target being a directory":   {entries: []entry.Entry{{Key: "files/deploy", Value: "wallpaper.png /etc/krb5.conf.d"}}, existingState: "distribution", wantErr: true},
+		"Error on failing to download assets": {saveAssetsError: true, wantErr: true},
+		"Error on invalid manifest":           {existingState: "invalid_manifest", wantErr: true},
+		"Error on state directory being file": {existingState: "state_dir_is_file", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), filepath.Join(rootDir, "root"))
+			}
+
+			m := files.New(
+				files.WithStateDir(filepath.Join(rootDir, "root", "var", "lib", "adsys")),
+				files.WithRootDir(filepath.Join(rootDir, "root")),
+				files.WithUserLookup(mockUserLookup),
+				files.WithGroupLookup(mockGroupLookup),
+			)
+
+			mockAssetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.saveAssetsError, Path: "files/"}
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries, mockAssetsDumper.SaveAssetsTo)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, filepath.Join(rootDir, "root"), testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockUserLookup returns the current user for any user but "unknown", so that files can be chowned without root.
+func mockUserLookup(name string) (*user.User, error) {
+	if name == "unknown" {
+		return nil, user.UnknownUserError(name)
+	}
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	return &user.User{Username: name, Uid: u.Uid, Gid: u.Gid}, nil
+}
+
+// mockGroupLookup returns the primary group of the current user for any group but "unknown".
+func mockGroupLookup(name string) (*user.Group, error) {
+	if name == "unknown" {
+		return nil, user.UnknownGroupError(name)
+	}
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	return &user.Group{Name: name, Gid: u.Gid}, nil
+}
+
+// uniqueEntries returns the files entries of GPOs, listed from the closest to the furthest, as merged
+// by the policies manager.
+func uniqueEntries(gposEntries ...[]entry.Entry) []entry.Entry {
+	var pols policies.Policies
+	for i, entries := range gposEntries {
+		pols.GPOs = append(pols.GPOs, policies.GPO{
+			ID:    fmt.Sprintf("{GPO%d}", i),
+			Name:  fmt.Sprintf("GPO%d", i),
+			Rules: map[string][]entry.Entry{"files": entries},
+		})
+	}
+	return pols.GetUniqueRules()["files"]
+}
@@ -0,0 +1,441 @@
+// Package firewall provides a manager to apply host firewall rules with nftables.
+//
+// This manager only applies to computer objects.
+//
+// The rules are rendered in an adsys-owned nftables table (inet adsys), stored in a single file
+// in the firewall directory. Other tables on the system are left untouched.
+//
+// The policy manager first checks if nft is available and proceeds differently if it is not,
+// depending on whether there are configured entries in the GPO:
+// - no entries: a warning is logged and the manager returns without error
+// - entries: the manager returns an error if nft is not found
+//
+// Applying the ruleset is done atomically:
+//  1. The new ruleset is written to adsys.nft.new and checked with nft -c.
+//  2. The current ruleset file is moved to adsys.nft.old and the new one takes its place.
+//  3. The ruleset is loaded with nft -f, in a single transaction.
+//  4. If loading fails, the previous ruleset file is restored and reloaded (or the adsys table
+//     is deleted if there was no previous ruleset) before returning an error.
+//
+// If there are no entries, the adsys table is deleted and the ruleset file is removed.
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/smbsafe"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// rulesetFileName is the name of the file containing the adsys nftables ruleset.
+	rulesetFileName = "adsys.nft"
+
+	// tableName is the nftables table owned by adsys.
+	tableName = "inet adsys"
+
+	defaultInboundPolicyKey = "firewall/default-inbound-policy"
+	allowInboundKey         = "firewall/allow-inbound"
+	denyInboundKey          = "firewall/deny-inbound"
+	denyOutboundKey         = "firewall/deny-outbound"
+)
+
+// deleteTableRuleset deletes the adsys table, without failing if it does not exist.
+var deleteTableRuleset = fmt.Sprintf("table %s\ndelete table %s\n", tableName, tableName)
+
+// essentialInboundRules are always accepted before the configured rules, so that a drop policy does not break
+// the network: ICMP errors and echo, IPv6 neighbour and router discovery, and DHCPv6 replies.
+var essentialInboundRules = []string{
+	"icmp type { echo-request, destination-unreachable, time-exceeded, parameter-problem } accept",
+	"icmpv6 type { echo-request, destination-unreachable, packet-too-big, time-exceeded, parameter-problem, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept",
+	"ip6 daddr fe80::/64 udp sport 547 udp dport 546 accept",
+}
+
+// Manager prevents running multiple nft operations in parallel while applying the policy.
+type Manager struct {
+	firewallDir string
+	nftCmd      []string
+
+	mu sync.Mutex // Prevents multiple instances of nft from running concurrently
+}
+
+type options struct {
+	firewallDir string
+	nftCmd      []string
+}
+
+// Option reprents an optional function to change the firewall manager.
+type Option func(*options)
+
+// WithFirewallDir overrides the default directory where the nftables ruleset is stored.
+func WithFirewallDir(p string) Option {
+	return func(o *options) {
+		o.firewallDir = p
+	}
+}
+
+// WithNftCmd overrides the default nft command.
+func WithNftCmd(cmd []string) Option {
+	return func(o *options) {
+		o.nftCmd = cmd
+	}
+}
+
+// New returns a new manager for the firewall policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		firewallDir: consts.DefaultFirewallDir,
+		nftCmd:      []string{"nft"},
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		firewallDir: args.firewallDir,
+		nftCmd:      args.nftCmd,
+	}
+}
+
+// ApplyPolicy generates and loads the adsys nftables ruleset based on a list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply firewall policy to %s", objectName))
+
+	// Firewall rules are only supported on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Only keep enabled entries
+	var enabledEntries []entry.Entry
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+		enabledEntries = append(enabledEntries, e)
+	}
+
+	// No point in continuing if nftables isn't available
+	if _, err := exec.LookPath(m.nftCmd[0]); err != nil {
+		// If we do have entries to apply we should explicitly fail
+		if len(enabledEntries) > 0 {
+			return errors.New(gotext.Get("nftables is not available on this system: %v", err))
+		}
+		// Otherwise, just let the user know
+		log.Warning(ctx, gotext.Get("nftables is not available on this system: %v", err))
+		return nil
+	}
+
+	rulesetPath := filepath.Join(m.firewallDir, rulesetFileName)
+
+	if len(enabledEntries) == 0 {
+		return m.unloadRules(ctx, rulesetPath)
+	}
+
+	log.Debugf(ctx, "Applying firewall policy to %s", objectName)
+
+	ruleset, err := renderRuleset(enabledEntries)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.firewallDir, 0750); err != nil {
+		return errors.New(gotext.Get("can't create firewall directory %q: %v", m.firewallDir, err))
+	}
+
+	// Write and check the new ruleset before replacing the current one.
+	newRulesetPath := rulesetPath + ".new"
+	// #nosec G306 - nftables rulesets are world-readable
+	if err := os.WriteFile(newRulesetPath, []byte(ruleset), 0644); err != nil {
+		return errors.New(gotext.Get("can't write new firewall ruleset: %v", err))
+	}
+	if err := m.runNft(ctx, "", "-c", "-f", newRulesetPath); err != nil {
+		if errRemove := os.Remove(newRulesetPath); errRemove != nil {
+			log.Warningf(ctx, "Can't remove invalid firewall ruleset %q: %v", newRulesetPath, errRemove)
+		}
+		return errors.New(gotext.Get("invalid firewall ruleset: %v", err))
+	}
+
+	// Keep the previous ruleset, if any, to be able to restore it.
+	oldRulesetPath := rulesetPath + ".old"
+	hasOldRuleset := true
+	if err := os.Rename(rulesetPath, oldRulesetPath); errors.Is(err, fs.ErrNotExist) {
+		hasOldRuleset = false
+	} else if err != nil {
+		return errors.New(gotext.Get("can't save previous firewall ruleset: %v", err))
+	}
+	if err := os.Rename(newRulesetPath, rulesetPath); err != nil {
+		return errors.Join(errors.New(gotext.Get("can't install new firewall ruleset: %v", err)),
+			m.restore(ctx, rulesetPath, oldRulesetPath, hasOldRuleset))
+	}
+
+	if err := m.runNft(ctx, "", "-f", rulesetPath); err != nil {
+		return errors.Join(errors.New(gotext.Get("failed to load firewall ruleset: %v", err)),
+			m.restore(ctx, rulesetPath, oldRulesetPath, hasOldRuleset))
+	}
+
+	// Loading rules succeeded, remove old ruleset
+	if err := os.Remove(oldRulesetPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.New(gotext.Get("can't remove previous firewall ruleset: %v", err))
+	}
+
+	return nil
+}
+
+// restore puts back the previous ruleset file and reloads it. If there was no previous ruleset,
+// the failing one is removed and the adsys table is deleted.
+func (m *Manager) restore(ctx context.Context, rulesetPath, oldRulesetPath string, hasOldRuleset bool) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't restore previous firewall ruleset"))
+
+	log.Warning(ctx, gotext.Get("Restoring previous firewall ruleset"))
+
+	if !hasOldRuleset {
+		if err := os.Remove(rulesetPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return m.runNft(ctx, deleteTableRuleset, "-f", "-")
+	}
+
+	if err := os.Rename(oldRulesetPath, rulesetPath); err != nil {
+		return err
+	}
+	return m.runNft(ctx, "", "-f", rulesetPath)
+}
+
+// unloadRules deletes the adsys table and removes the ruleset file.
+// No action is taken if there is no ruleset file.
+func (m *Manager) unloadRules(ctx context.Context, rulesetPath string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't unload firewall rules"))
+
+	if _, err := os.Stat(rulesetPath); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	log.Debug(ctx, "Removing adsys firewall rules")
+
+	if err := m.runNft(ctx, deleteTableRuleset, "-f", "-"); err != nil {
+		return err
+	}
+
+	return os.Remove(rulesetPath)
+}
+
+// runNft executes nft with the given arguments, optionally feeding stdin.
+func (m *Manager) runNft(ctx context.Context, stdin string, args ...string) error {
+	if os.Getenv("ADSYS_SKIP_ROOT_CALLS") != "" {
+		return nil
+	}
+
+	nftCmd := slices.Concat(m.nftCmd, args)
+	// #nosec G204 - We are in control of the arguments
+	cmd := exec.CommandContext(ctx, nftCmd[0], nftCmd[1:]...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	smbsafe.WaitExec()
+	out, err := cmd.CombinedOutput()
+	smbsafe.DoneExec()
+	if err != nil {
+		return fmt.Errorf("%w\n%s", err, string(out))
+	}
+	return nil
+}
+
+// renderRuleset returns the nftables ruleset matching the given entries.
+func renderRuleset(entries []entry.Entry) (ruleset string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't generate firewall ruleset"))
+
+	inboundPolicy := "accept"
+	var allowInbound, denyInbound, denyOutbound []string
+	for _, e := range entries {
+		if e.Err != nil {
+			return "", errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		switch e.Key {
+		case defaultInboundPolicyKey:
+			v := strings.TrimSpace(e.Value)
+			if v != "accept" && v != "drop" {
+				return "", errors.New(gotext.Get("invalid default inbound policy %q: expected accept or drop", v))
+			}
+			inboundPolicy = v
+		case allowInboundKey:
+			if allowInbound, err = appendRules(allowInbound, e.Value, "saddr", "accept"); err != nil {
+				return "", err
+			}
+		case denyInboundKey:
+			if denyInbound, err = appendRules(denyInbound, e.Value, "saddr", "drop"); err != nil {
+				return "", err
+			}
+		case denyOutboundKey:
+			if denyOutbound, err = appendRules(denyOutbound, e.Value, "daddr", "drop"); err != nil {
+				return "", err
+			}
+		default:
+			log.Debugf(context.Background(), "Ignoring unknown firewall key %q", e.Key)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`)
+	// Declaring then deleting the table makes the load idempotent in a single transaction.
+	b.WriteString(deleteTableRuleset)
+	fmt.Fprintf(&b, "\ntable %s {\n", tableName)
+
+	b.WriteString("\tchain input {\n")
+	fmt.Fprintf(&b, "\t\ttype filter hook input priority filter; policy %s;\n", inboundPolicy)
+	b.WriteString("\t\tct state established,related accept\n")
+	b.WriteString("\t\tiif lo accept\n")
+	for _, r := range slices.Concat(essentialInboundRules, denyInbound, allowInbound) {
+		fmt.Fprintf(&b, "\t\t%s\n", r)
+	}
+	b.WriteString("\t}\n")
+
+	if len(denyOutbound) > 0 {
+		b.WriteString("\n\tchain output {\n")
+		b.WriteString("\t\ttype filter hook output priority filter; policy accept;\n")
+		for _, r := range denyOutbound {
+			fmt.Fprintf(&b, "\t\t%s\n", r)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+
+	return b.String(), nil
+}
+
+// appendRules parses each line of value as a rule and appends the corresponding nftables
+// statements to rules, skipping duplicates.
+//
+// A rule is in the form: <tcp|udp|any>[/<port>[-<port>]] [from|to <address>[/<prefix>]]
+// For instance: tcp/22, udp/5000-5100 from 10.0.0.0/8 or any to 192.168.1.1.
+func appendRules(rules []string, value, addrDirection, verdict string) ([]string, error) {
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		r, err := parseRule(line, addrDirection, verdict)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(rules, r) {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseRule converts a single rule line to a nftables statement.
+func parseRule(line, addrDirection, verdict string) (string, error) {
+	invalidRule := func(reason string) error {
+		return errors.New(gotext.Get("invalid firewall rule %q: %s", line, reason))
+	}
+
+	fields := strings.Fields(line)
+	var statement []string
+
+	// Optional address part
+	if len(fields) == 3 {
+		keyword := "from"
+		if addrDirection == "daddr" {
+			keyword = "to"
+		}
+		if fields[1] != keyword {
+			return "", invalidRule(gotext.Get("expected %q before the address", keyword))
+		}
+		family, err := addressFamily(fields[2])
+		if err != nil {
+			return "", invalidRule(err.Error())
+		}
+		statement = append(statement, family, addrDirection, fields[2])
+	} else if len(fields) != 1 {
+		return "", invalidRule(gotext.Get("unexpected number of fields"))
+	}
+
+	proto, ports, hasPorts := strings.Cut(fields[0], "/")
+	switch proto {
+	case "tcp", "udp":
+	case "any":
+		if hasPorts {
+			return "", invalidRule(gotext.Get("ports can only be used with tcp or udp"))
+		}
+		if len(statement) == 0 {
+			return "", invalidRule(gotext.Get("any requires an address"))
+		}
+	default:
+		return "", invalidRule(gotext.Get("unsupported protocol %q", proto))
+	}
+
+	if hasPorts {
+		if err := validatePorts(ports); err != nil {
+			return "", invalidRule(err.Error())
+		}
+		statement = append(statement, proto, "dport", ports)
+	} else if proto != "any" {
+		statement = append(statement, "meta", "l4proto", proto)
+	}
+
+	return strings.Join(append(statement, verdict), " "), nil
+}
+
+// addressFamily returns the nftables address family of an IP address or network.
+func addressFamily(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(addr); err != nil {
+			return "", errors.New(gotext.Get("invalid address %q", addr))
+		}
+	}
+	if ip.To4() != nil {
+		return "ip", nil
+	}
+	return "ip6", nil
+}
+
+// validatePorts checks that ports is a valid port or port range.
+func validatePorts(ports string) error {
+	first, last, isRange := strings.Cut(ports, "-")
+	start, err := strconv.ParseUint(first, 10, 16)
+	if err != nil || start == 0 {
+		return errors.New(gotext.Get("invalid port %q", first))
+	}
+	if !isRange {
+		return nil
+	}
+	end, err := strconv.ParseUint(last, 10, 16)
+	if err != nil || end == 0 {
+		return errors.New(gotext.Get("invalid port %q", last))
+	}
+	if end <= start {
+		return errors.New(gotext.Get("invalid port range %q", ports))
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package firewall_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/firewall"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "firewall/default-inbound-policy", Value: "drop"},
+		{Key: "firewall/allow-inbound", Value: "tcp/22\nudp/53 from 10.0.0.0/8"},
+		{Key: "firewall/deny-inbound", Value: "tcp/23"},
+		{Key: "firewall/deny-outbound", Value: "any to 192.0.2.1"},
+	}
+
+	tests := map[string]struct {
+		entries []entry.Entry
+		isUser  bool
+
+		existingRuleset bool
+		noNft           bool
+		nftError        string
+
+		wantErr bool
+	}{
+		// Computer cases
+		"Computer, all rule types":                         {},
+		"Computer, only default inbound policy":            {entries: []entry.Entry{{Key: "firewall/default-inbound-policy", Value: "drop"}}},
+		"Computer, only allowed inbound rules":             {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/80\ntcp/443"}}},
+		"Computer, drop policy with allowed inbound rules": {entries: []entry.Entry{{Key: "firewall/default-inbound-policy", Value: "drop"}, {Key: "firewall/allow-inbound", Value: "tcp/22 from 10.0.0.0/8"}}},
+		"Computer, port ranges":                            {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/8000-8080\nudp/60000-61000 from 10.0.0.1"}}},
+		"Computer, IPv6 addresses":                         {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/22 from 2001:db8::/32"}, {Key: "firewall/deny-outbound", Value: "any to ::1"}}},
+		"Computer, protocol without port":                  {entries: []entry.Entry{{Key: "firewall/deny-inbound", Value: "udp\ntcp from 192.0.2.0/24"}}},
+		"Computer, duplicated rules and blank lines":       {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/22\n\n  tcp/22  \ntcp/80\n"}}},
+		"Computer, unknown keys are ignored":               {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/22"}, {Key: "firewall/unknown", Value: "something"}}},
+		"Computer, disabled entries are ignored":           {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/22"}, {Key: "firewall/deny-inbound", Value: "tcp/23", Disabled: true}}},
+		"Computer, existing ruleset is replaced":           {existingRuleset: true},
+		"Computer, no entries removes ruleset":             {entries: []entry.Entry{}, existingRuleset: true},
+		"Computer, only disabled entries removes rules":    {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/22", Disabled: true}}, existingRuleset: true},
+		"Computer, no entries and no ruleset":              {entries: []entry.Entry{}},
+
+		// User cases
+		"User, entries are ignored": {isUser: true},
+
+		// Other edge cases
+		"No nft and no entries": {entries: []entry.Entry{}, existingRuleset: true, noNft: true},
+
+		// Error cases
+		"Error on no nft and entries":                     {noNft: true, wantErr: true},
+		"Error on errored entry":                          {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/22", Err: fmt.Errorf("some error")}}, wantErr: true},
+		"Error on invalid default inbound policy":         {entries: []entry.Entry{{Key: "firewall/default-inbound-policy", Value: "reject"}}, wantErr: true},
+		"Error on unsupported protocol":                   {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "sctp/22"}}, wantErr: true},
+		"Error on invalid port":                           {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/ssh"}}, wantErr: true},
+		"Error on out of range port":                      {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/70000"}}, wantErr: true},
+		"Error on port zero":                              {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/0"}}, wantErr: true},
+		"Error on invalid port range":                     {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/100-10"}}, wantErr: true},
+		"Error on port with any protocol":                 {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "any/22 from 10.0.0.1"}}, wantErr: true},
+		"Error on any protocol without address":           {entries: []entry.Entry{{Key: "firewall/deny-inbound", Value: "any"}}, wantErr: true},
+		"Error on invalid address":                        {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/22 from example.com"}}, wantErr: true},
+		"Error on wrong address keyword":                  {entries: []entry.Entry{{Key: "firewall/deny-outbound", Value: "tcp/22 from 10.0.0.1"}}, wantErr: true},
+		"Error on unexpected number of fields":            {entries: []entry.Entry{{Key: "firewall/allow-inbound", Value: "tcp/22 from"}}, wantErr: true},
+		"Error on ruleset check failing":                  {existingRuleset: true, nftError: "check", wantErr: true},
+		"Error on loading, previous ruleset is restored":  {existingRuleset: true, nftError: "load-once", wantErr: true},
+		"Error on loading, no previous ruleset":           {nftError: "load-once", wantErr: true},
+		"Error on loading and restoring previous ruleset": {existingRuleset: true, nftError: "load", wantErr: true},
+		"Error on deleting adsys table":                   {entries: []entry.Entry{}, existingRuleset: true, nftError: "delete", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			firewallDir := filepath.Join(t.TempDir(), "nftables.d")
+			nftOutputFile := filepath.Join(t.TempDir(), "nft-output")
+
+			if tc.existingRuleset {
+				require.NoError(t, os.MkdirAll(firewallDir, 0750), "Setup: can't create firewall directory")
+				content, err := os.ReadFile(filepath.Join(testutils.TestFamilyPath(t), "adsys.nft"))
+				require.NoError(t, err, "Setup: can't read existing ruleset")
+				err = os.WriteFile(filepath.Join(firewallDir, "adsys.nft"), content, 0600)
+				require.NoError(t, err, "Setup: can't write existing ruleset")
+			}
+
+			nftCmd := mockNftCmd(t, nftOutputFile, tc.nftError)
+			if tc.noNft {
+				nftCmd = []string{"this-definitely-does-not-exist"}
+			}
+
+			m := firewall.New(firewall.WithFirewallDir(firewallDir), firewall.WithNftCmd(nftCmd))
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				// We don't return here as we want to check that the firewall
+				// dir is in the expected state even in error cases
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			testutils.CompareTreesWithFiltering(t, firewallDir, filepath.Join(testutils.GoldenPath(t), "etc", "nftables.d"), testutils.UpdateEnabled())
+
+			// Check that nft was called with the expected arguments
+			got, err := os.ReadFile(nftOutputFile)
+			if err != nil {
+				got = []byte("nft was not called\n")
+			}
+			gotOutput := strings.ReplaceAll(string(got), firewallDir, "#FIREWALLDIR#")
+			want := testutils.LoadWithUpdateFromGolden(t, gotOutput, testutils.WithGoldenPath(filepath.Join(testutils.GoldenPath(t), "nft_calls")))
+			require.Equal(t, want, gotOutput, "nft calls don't match")
+		})
+	}
+}
+
+func mockNftCmd(t *testing.T, outputFile, failOn string) []string {
+	t.Helper()
+
+	if failOn == "" {
+		failOn = "none"
+	}
+	return []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockNft", "--", outputFile, failOn}
+}
+
+// TestMockNft records the nft calls in the output file, including the ruleset passed on stdin.
+// It can fail on:
+// - check: nft -c calls;
+// - load: nft -f <file> calls;
+// - load-once: the first nft -f <file> call only;
+// - delete: nft -f - calls.
+func TestMockNft(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] != "--" {
+			args = args[1:]
+			continue
+		}
+		args = args[1:]
+		break
+	}
+	outputFile, failOn, args := args[0], args[1], args[2:]
+
+	previousCalls, err := os.ReadFile(outputFile)
+	if err != nil && !os.IsNotExist(err) {
+		require.NoError(t, err, "Setup: can't read output file")
+	}
+
+	call := strings.Join(args, " ") + "\n"
+	var action string
+	switch {
+	case args[0] == "-c":
+		action = "check"
+	case args[len(args)-1] == "-":
+		action = "delete"
+		stdin, err := io.ReadAll(os.Stdin)
+		require.NoError(t, err, "Setup: can't read stdin")
+		call += string(stdin)
+	default:
+		action = "load"
+	}
+
+	f, err := os.OpenFile(outputFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	require.NoError(t, err, "Setup: can't open output file")
+	defer f.Close()
+	_, err = f.WriteString(call)
+	require.NoError(t, err, "Setup: can't write output file")
+
+	shouldFail := failOn == action
+	if failOn == "load-once" && action == "load" && !strings.Contains(string(previousCalls), "\n-f /") && !strings.HasPrefix(string(previousCalls), "-f /") {
+		shouldFail = true
+	}
+	if shouldFail {
+		fmt.Fprintln(os.Stderr, "EXIT 1 requested in mock")
+		os.Exit(1)
+	}
+}
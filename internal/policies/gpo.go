@@ -18,7 +18,23 @@ type GPO struct {
 	Rules map[string][]entry.Entry
 }
 
-// Format write to w a formatted GPO. overridden entries are prepended with -.
+// FilteredGPO is a GPO which is not applied, as the client doesn't match its WMI filter.
+type FilteredGPO struct {
+	ID        string
+	Name      string
+	WMIFilter string
+}
+
+// Format write to w a formatted filtered GPO, with the name of its WMI filter if withDetails is true.
+func (g FilteredGPO) Format(w io.Writer, withDetails bool) {
+	fmt.Fprintf(w, "* %s (%s)\n", g.Name, g.ID)
+	if withDetails {
+		fmt.Fprintf(w, "** WMI filter: %s\n", g.WMIFilter)
+	}
+}
+
+// Format write to w a formatted GPO. overridden entries are prepended with -, and targeted ones are followed
+// by their targeting expression.
 func (g GPO) Format(w io.Writer, withRules, withOverridden bool, alreadyProcessedRules map[string]struct{}) map[string]struct{} {
 	fmt.Fprintf(w, "* %s (%s)\n", g.Name, g.ID)
 
@@ -50,15 +66,20 @@ func (g GPO) Format(w io.Writer, withRules, withOverridden bool, alreadyProcesse
 			}
 			// Trim EOL \n and replace them all with \n in text to keep each value printed in one single line
 			v := strings.ReplaceAll(strings.TrimSpace(r.Value), "\n", `\n`)
+			var target string
+			if r.Target != "" {
+				target = fmt.Sprintf(" [target: %s]", strings.Join(strings.Fields(r.Target), " "))
+			}
 			if r.Disabled {
 				prefix += "+"
-				fmt.Fprintf(w, "%s %s\n", prefix, r.Key)
+				fmt.Fprintf(w, "%s %s%s\n", prefix, r.Key, target)
 			} else {
-				fmt.Fprintf(w, "%s %s: %s\n", prefix, r.Key, v)
+				fmt.Fprintf(w, "%s %s: %s%s\n", prefix, r.Key, v, target)
 			}
 
 			// Do not add non overridable key to the alreadyProcessedRules override detection map.
-			if r.Strategy == "append" {
+			// Targeted keys don't override further ones on clients they don't target.
+			if r.Strategy == "append" || r.Target != "" {
 				continue
 			}
 			alreadyProcessedRules[k] = struct{}{}
@@ -79,6 +79,12 @@ func TestFormat(t *testing.T) {
 				"dconf/path/to/key2":   {},
 				"scripts/path/to/key3": {},
 			}},
+
+		// targeting cases
+		"GPO with targeted rules do not add to processed rules": {
+			cachedPoliciesSrc:         "targeted",
+			withRules:                 true,
+			wantAlreadyProcessedRules: map[string]struct{}{}},
 	}
 
 	for name, tc := range tests {
@@ -0,0 +1,264 @@
+// Package groups is the policy manager for local group membership of AD users and groups,
+// like Windows Restricted Groups.
+//
+// This manager only applies to computer objects.
+//
+// Each line of the groups/members entry adds members to a local group, in the form:
+//
+//	<local group>: <member>, <member>…
+//
+// Members are normalized the same way than the client administrators of the privilege manager:
+// domain\user becomes user@domain, and groups are prefixed with %. Members of the same local group
+// from multiple lines and GPOs are merged.
+//
+// Membership is granted by pam_group when users log in, through a block delimited by adsys markers at the
+// end of /etc/security/group.conf, so that the local group files are never modified. Local groups granting
+// administrative privileges can't be managed by this policy, which is the role of the privilege policy.
+//
+// pam_group only grants the groups to PAM sessions running the auth stack (pam_setcred): sessions opened without
+// authenticating, like systemd --user instances or services started by root, don't get them.
+//
+// The block is removed once no membership is configured anymore, and so is the file if nothing else is left.
+package groups
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/privilege"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	membersKey = "groups/members"
+
+	// groupConf is the pam_group configuration file, relative to the security directory.
+	groupConf = "group.conf"
+
+	// blockBegin and blockEnd delimit the settings managed by adsys in the pam_group configuration.
+	blockBegin = "# BEGIN adsys managed settings. Do not edit: any changes will be overwritten."
+	blockEnd   = "# END adsys managed settings"
+)
+
+var (
+	// localGroupRegexp matches valid local group names.
+	localGroupRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]*\$?$`)
+
+	// privilegedGroups are the local groups granting administrative privileges, managed by the privilege policy.
+	privilegedGroups = []string{"root", "sudo", "admin", "wheel"}
+)
+
+// Manager prevents writing the pam_group configuration concurrently while applying the policy.
+type Manager struct {
+	securityDir string
+
+	mu sync.Mutex
+}
+
+type options struct {
+	securityDir string
+}
+
+// Option reprents an optional function to change the groups manager.
+type Option func(*options)
+
+// WithSecurityDir overrides the default PAM security configuration directory.
+func WithSecurityDir(p string) Option {
+	return func(o *options) {
+		o.securityDir = p
+	}
+}
+
+// New returns a new manager for the groups policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		securityDir: consts.DefaultSecurityDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		securityDir: args.securityDir,
+	}
+}
+
+// ApplyPolicy configures pam_group to add the members listed in entries to their local groups.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply groups policy to %s", objectName))
+
+	// Local groups are only managed on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying groups policy to %s", objectName)
+
+	memberships, groups, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	// pam_group configuration: services;ttys;users;times;groups
+	var settings []string
+	for _, g := range groups {
+		settings = append(settings, fmt.Sprintf("*;*;%s;Al0000-2400;%s", strings.Join(memberships[g], "|"), g))
+	}
+
+	return updateManagedBlock(filepath.Join(m.securityDir, groupConf), settings)
+}
+
+// parseEntries returns the members of each local group, and the local groups in the order they were referenced.
+// Disabled entries are ignored.
+func parseEntries(ctx context.Context, entries []entry.Entry) (memberships map[string][]string, groups []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse groups entries"))
+
+	memberships = make(map[string][]string)
+	for _, e := range entries {
+		if e.Err != nil {
+			return nil, nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+		if e.Disabled || e.Key != membersKey {
+			continue
+		}
+
+		for _, line := range strings.Split(e.Value, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			group, members, found := strings.Cut(line, ":")
+			group = strings.TrimSpace(group)
+			if !found || group == "" {
+				return nil, nil, errors.New(gotext.Get("invalid line %q: expected <local group>: <member>, <member>…", line))
+			}
+			if !localGroupRegexp.MatchString(group) {
+				return nil, nil, errors.New(gotext.Get("invalid local group name %q", group))
+			}
+			if slices.Contains(privilegedGroups, group) {
+				return nil, nil, errors.New(gotext.Get("local group %q grants administrative privileges: use the client administrators policy instead", group))
+			}
+
+			for _, member := range SplitAndNormalizeMembers(ctx, members) {
+				// pam_group fields can't contain spaces.
+				if strings.ContainsAny(member, " \t") {
+					return nil, nil, errors.New(gotext.Get("invalid member %q of %q: names with spaces are not supported", member, group))
+				}
+				if _, ok := memberships[group]; !ok {
+					groups = append(groups, group)
+				}
+				if !slices.Contains(memberships[group], member) {
+					memberships[group] = append(memberships[group], member)
+				}
+			}
+		}
+	}
+
+	return memberships, groups, nil
+}
+
+// SplitAndNormalizeMembers returns the members listed in value, separated by commas or lines, normalized like the
+// client administrators of the privilege manager. Spaces around the separators are ignored.
+func SplitAndNormalizeMembers(ctx context.Context, value string) []string {
+	members := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' })
+	for i, m := range members {
+		members[i] = strings.TrimSpace(m)
+	}
+	return privilege.SplitAndNormalizeUsersAndGroups(ctx, strings.Join(members, ","))
+}
+
+// updateManagedBlock replaces the block managed by adsys at the end of the configuration file p with settings.
+// The block is removed if there are no settings, and so is the file if nothing else is left.
+func updateManagedBlock(p string, settings []string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't update %q", p))
+
+	mode := fs.FileMode(0644)
+	var lines []string
+	f, err := os.Open(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+
+		var inBlock bool
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			l := scanner.Text()
+			switch {
+			case l == blockBegin:
+				inBlock = true
+			case l == blockEnd:
+				inBlock = false
+			case !inBlock:
+				lines = append(lines, l)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		if inBlock {
+			return errors.New(gotext.Get("missing end marker of the adsys managed block"))
+		}
+		f.Close()
+	}
+
+	// Remove the empty lines we added before the block.
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(settings) > 0 {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, blockBegin)
+		lines = append(lines, settings...)
+		lines = append(lines, blockEnd)
+	}
+
+	if len(lines) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return nil
+	}
+
+	// #nosec G301 - /etc/security permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", []byte(content), mode); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
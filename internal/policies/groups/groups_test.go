@@ -0,0 +1,90 @@
+package groups_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/groups"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "groups/members", Value: `docker: %developers@example.com, alice@example.com
+lpadmin: EXAMPLE\bob
+dialout: %developers@example.com`},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		securityDirIsFile bool
+
+		wantErr bool
+	}{
+		"Add members to local groups":                        {},
+		"Add members on distribution file":                   {existingState: "distribution"},
+		"Update managed memberships":                         {existingState: "managed"},
+		"Members of the same group are merged":               {entries: []entry.Entry{{Key: "groups/members", Value: "docker: alice@example.com\nlpadmin: bob@example.com\ndocker: carol@example.com, alice@example.com"}}},
+		"Members are normalized":                             {entries: []entry.Entry{{Key: "groups/members", Value: "docker: EXAMPLE\\alice\n  plugdev :%dev*s@example.com\ndialout: carol@example.com"}}},
+		"Comments and empty lines are ignored":               {entries: []entry.Entry{{Key: "groups/members", Value: "# Development\n\ndocker: alice@example.com\n"}}},
+		"Groups without members are ignored":                 {entries: []entry.Entry{{Key: "groups/members", Value: "docker:\nlpadmin: ,\ndialout: alice@example.com"}}},
+		"Disabled entries are ignored":                       {entries: []entry.Entry{{Key: "groups/members", Value: "docker: alice@example.com", Disabled: true}}, existingState: "managed"},
+		"Other keys are ignored":                             {entries: []entry.Entry{{Key: "groups/other", Value: "docker: alice@example.com"}}, existingState: "managed"},
+		"Remove managed memberships with no entries":         {entries: []entry.Entry{}, existingState: "managed"},
+		"Remove file only containing managed memberships":    {entries: []entry.Entry{}, existingState: "only_managed"},
+		"Keep distribution file untouched with no entries":   {entries: []entry.Entry{}, existingState: "distribution"},
+		"No entries and no file":                             {entries: []entry.Entry{}},
+		"User objects are ignored":                           {isUser: true, existingState: "managed"},
+		"Local group names with dollar suffix are supported": {entries: []entry.Entry{{Key: "groups/members", Value: "machines$: alice@example.com"}}},
+
+		// Error cases
+		"Error on errored entry":                   {entries: []entry.Entry{{Key: "groups/members", Value: "docker: alice@example.com", Err: errors.New("some error")}}, wantErr: true},
+		"Error on line without group":              {entries: []entry.Entry{{Key: "groups/members", Value: ": alice@example.com"}}, wantErr: true},
+		"Error on invalid local group name":        {entries: []entry.Entry{{Key: "groups/members", Value: "Docker Users: alice@example.com"}}, wantErr: true},
+		"Error on privileged local group":          {entries: []entry.Entry{{Key: "groups/members", Value: "sudo: alice@example.com"}}, wantErr: true},
+		"Error on member with spaces":              {entries: []entry.Entry{{Key: "groups/members", Value: "docker: %domain users@example.com"}}, wantErr: true},
+		"Error on missing managed block end":       {existingState: "missing_end_marker", wantErr: true},
+		"Error on security directory being a file": {securityDirIsFile: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			securityDir := filepath.Join(rootDir, "etc", "security")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), securityDir)
+			}
+			if tc.securityDirIsFile {
+				require.NoError(t, os.MkdirAll(filepath.Dir(securityDir), 0750), "Setup: can't create parent directory")
+				testutils.WriteFile(t, securityDir, []byte("not a directory"), 0600)
+			}
+
+			m := groups.New(groups.WithSecurityDir(securityDir))
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
@@ -0,0 +1,310 @@
+// Package kerberos is the policy manager for the Kerberos client configuration.
+//
+// This manager only applies to computer objects.
+//
+// Settings are written to the [libdefaults] section of /etc/krb5.conf.d/50-adsys.conf. The main
+// /etc/krb5.conf must include this directory with an includedir directive, before its own [libdefaults]
+// section for those settings to take precedence, as the first value found is used by the Kerberos library.
+// A warning is printed if the directory is not included.
+//
+// As a bad Kerberos configuration can prevent every AD user from logging in, following the policy manager
+// guidelines:
+//   - invalid values prevent authentication and keep the current configuration. This includes encryption
+//     types lists without any type supported by AD (AES or RC4), and credential caches which are not files,
+//     as adsys shares user tickets with the daemon by their path;
+//   - the configuration is only replaced once all values are validated.
+//
+// The file is removed once no setting is configured anymore.
+package kerberos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	dnsCanonicalizeHostnameKey = "kerberos/dns-canonicalize-hostname"
+	rdnsKey                    = "kerberos/rdns"
+	permittedEnctypesKey       = "kerberos/permitted-enctypes"
+	defaultTktEnctypesKey      = "kerberos/default-tkt-enctypes"
+	defaultTgsEnctypesKey      = "kerberos/default-tgs-enctypes"
+	defaultCCacheNameKey       = "kerberos/default-ccache-name"
+
+	configFileName = "50-adsys.conf"
+
+	managedFileHeader = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+[libdefaults]
+`
+)
+
+var (
+	// settingKeys are the keys of the settings, in the order they are written.
+	settingKeys = []string{dnsCanonicalizeHostnameKey, rdnsKey, permittedEnctypesKey, defaultTktEnctypesKey, defaultTgsEnctypesKey, defaultCCacheNameKey}
+
+	// relations are the krb5.conf relations of the settings.
+	relations = map[string]string{
+		dnsCanonicalizeHostnameKey: "dns_canonicalize_hostname",
+		rdnsKey:                    "rdns",
+		permittedEnctypesKey:       "permitted_enctypes",
+		defaultTktEnctypesKey:      "default_tkt_enctypes",
+		defaultTgsEnctypesKey:      "default_tgs_enctypes",
+		defaultCCacheNameKey:       "default_ccache_name",
+	}
+
+	// dnsCanonicalizeHostnameValues are the supported values of the hostname canonicalization.
+	dnsCanonicalizeHostnameValues = []string{"true", "false", "fallback"}
+
+	// adEnctypes are the encryption types and families supported by AD domain controllers.
+	adEnctypes = []string{
+		"DEFAULT", "aes", "rc4",
+		"aes256-cts-hmac-sha1-96", "aes256-cts", "aes256-sha1",
+		"aes128-cts-hmac-sha1-96", "aes128-cts", "aes128-sha1",
+		"arcfour-hmac", "rc4-hmac", "arcfour-hmac-md5",
+	}
+	// otherEnctypes are the other encryption types and families known by the Kerberos library.
+	otherEnctypes = []string{
+		"des", "des3", "camellia",
+		"aes256-cts-hmac-sha384-192", "aes256-sha2",
+		"aes128-cts-hmac-sha256-128", "aes128-sha2",
+		"des3-cbc-sha1", "des3-hmac-sha1", "des3-cbc-sha1-kd",
+		"arcfour-hmac-exp", "rc4-hmac-exp", "arcfour-hmac-md5-exp",
+		"camellia256-cts-cmac", "camellia256-cts", "camellia128-cts-cmac", "camellia128-cts",
+		"des-cbc-crc", "des-cbc-md4", "des-cbc-md5", "des-cbc-raw", "des3-cbc-raw", "des-hmac-sha1",
+	}
+
+	// ccacheTokenRegexp matches the parameter expansions supported in credential cache names.
+	ccacheTokenRegexp = regexp.MustCompile(`%{[^}]*}`)
+	// ccacheTokens are the supported parameter expansions of credential cache names.
+	ccacheTokens = []string{"%{TEMP}", "%{uid}", "%{euid}", "%{USERID}", "%{username}", "%{null}", "%{LIBDIR}", "%{BINDIR}", "%{SBINDIR}"}
+)
+
+// Manager prevents writing the Kerberos configuration concurrently while applying the policy.
+type Manager struct {
+	krb5Conf string
+
+	mu sync.Mutex
+}
+
+type options struct {
+	krb5Conf string
+}
+
+// Option reprents an optional function to change the kerberos manager.
+type Option func(*options)
+
+// WithKrb5Conf overrides the default main Kerberos configuration file.
+// The adsys configuration is written in its .d directory.
+func WithKrb5Conf(p string) Option {
+	return func(o *options) {
+		o.krb5Conf = p
+	}
+}
+
+// New returns a new manager for the kerberos policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		krb5Conf: consts.DefaultKrb5Conf,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		krb5Conf: args.krb5Conf,
+	}
+}
+
+// ApplyPolicy writes the Kerberos client configuration, or removes it if there are no settings.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply kerberos policy to %s", objectName))
+
+	// Kerberos configuration is only supported on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying kerberos policy to %s", objectName)
+
+	settings, err := parseEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	confDir := m.krb5Conf + ".d"
+	p := filepath.Join(confDir, configFileName)
+	if len(settings) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if !m.includesConfDir(confDir) {
+		log.Warning(ctx, gotext.Get("%s doesn't include %s: Kerberos settings won't be used until an \"includedir %s\" line is added to it", m.krb5Conf, confDir, confDir))
+	}
+
+	content := managedFileHeader
+	for _, k := range settingKeys {
+		if v, ok := settings[k]; ok {
+			content += fmt.Sprintf("    %s = %s\n", relations[k], v)
+		}
+	}
+
+	return writeIfChanged(p, content)
+}
+
+// parseEntries returns the validated values to write per key.
+// Disabled rdns is set to false, while other disabled settings are ignored.
+func parseEntries(entries []entry.Entry) (settings map[string]string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse kerberos entries"))
+
+	settings = make(map[string]string)
+	for _, e := range entries {
+		if e.Err != nil {
+			return nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		if e.Key == rdnsKey {
+			settings[e.Key] = fmt.Sprint(!e.Disabled)
+		}
+		if e.Disabled {
+			continue
+		}
+
+		v := strings.TrimSpace(e.Value)
+		switch e.Key {
+		case dnsCanonicalizeHostnameKey:
+			if !slices.Contains(dnsCanonicalizeHostnameValues, v) {
+				return nil, errors.New(gotext.Get("invalid hostname canonicalization %q: expected one of %s", v, strings.Join(dnsCanonicalizeHostnameValues, ", ")))
+			}
+			settings[e.Key] = v
+		case permittedEnctypesKey, defaultTktEnctypesKey, defaultTgsEnctypesKey:
+			enctypes, err := parseEnctypes(v)
+			if err != nil {
+				return nil, errors.New(gotext.Get("invalid %s: %v", relations[e.Key], err))
+			}
+			if enctypes != "" {
+				settings[e.Key] = enctypes
+			}
+		case defaultCCacheNameKey:
+			if v == "" {
+				continue
+			}
+			if err := checkCCacheName(v); err != nil {
+				return nil, err
+			}
+			settings[e.Key] = v
+		}
+	}
+
+	return settings, nil
+}
+
+// parseEnctypes returns the encryption types of v, separated by spaces or commas, as a krb5.conf list.
+// The list must enable at least one encryption type supported by AD for users to still get tickets.
+func parseEnctypes(v string) (string, error) {
+	var enctypes []string
+	var adSupported bool
+	for _, enctype := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+		// Families and types can be removed from the list with a - prefix, and explicitly added with +.
+		name := strings.TrimLeft(enctype, "+-")
+		// Encryption type names are case insensitive.
+		isIn := func(names []string) bool {
+			return slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, name) })
+		}
+		if !isIn(adEnctypes) && !isIn(otherEnctypes) {
+			return "", errors.New(gotext.Get("unknown encryption type %q", enctype))
+		}
+		if !strings.HasPrefix(enctype, "-") && isIn(adEnctypes) {
+			adSupported = true
+		}
+		enctypes = append(enctypes, enctype)
+	}
+	if len(enctypes) == 0 {
+		return "", nil
+	}
+	if !adSupported {
+		return "", errors.New(gotext.Get("%q doesn't enable any encryption type supported by AD (AES or RC4)", v))
+	}
+	return strings.Join(enctypes, " "), nil
+}
+
+// checkCCacheName checks that the credential cache name is an absolute file path, optionally prefixed
+// by FILE:, so that user tickets can still be found and shared with the daemon.
+func checkCCacheName(v string) error {
+	path := strings.TrimPrefix(v, "FILE:")
+	if ccType, _, found := strings.Cut(path, ":"); found {
+		return errors.New(gotext.Get("invalid credential cache %q: type %s is not supported, only FILE caches are", v, ccType))
+	}
+	for _, token := range ccacheTokenRegexp.FindAllString(path, -1) {
+		if !slices.Contains(ccacheTokens, token) {
+			return errors.New(gotext.Get("invalid credential cache %q: unknown parameter %s", v, token))
+		}
+	}
+	if !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "%{TEMP}/") {
+		return errors.New(gotext.Get("invalid credential cache %q: expected an absolute path", v))
+	}
+	if strings.ContainsAny(path, " \t\n") {
+		return errors.New(gotext.Get("invalid credential cache %q: spaces are not supported", v))
+	}
+	return nil
+}
+
+// includesConfDir returns true if the main configuration includes confDir.
+func (m *Manager) includesConfDir(confDir string) bool {
+	data, err := os.ReadFile(m.krb5Conf)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		dir, found := strings.CutPrefix(strings.TrimSpace(line), "includedir")
+		if !found {
+			continue
+		}
+		if filepath.Clean(strings.TrimSpace(dir)) == filepath.Clean(confDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeIfChanged atomically writes content to p if it differs from the current content.
+func writeIfChanged(p, content string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write kerberos configuration %q", p))
+
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return nil
+	}
+
+	// #nosec G301 - /etc/krb5.conf.d permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// #nosec G306 - /etc/krb5.conf.d files are world readable, as the Kerberos library reads them as the user.
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,98 @@
+package kerberos_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/kerberos"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "kerberos/dns-canonicalize-hostname", Value: "fallback"},
+		{Key: "kerberos/rdns", Disabled: true},
+		{Key: "kerberos/permitted-enctypes", Value: "aes256-cts-hmac-sha1-96 aes128-cts-hmac-sha1-96"},
+		{Key: "kerberos/default-tkt-enctypes", Value: "aes256-cts-hmac-sha1-96,aes128-cts-hmac-sha1-96"},
+		{Key: "kerberos/default-tgs-enctypes", Value: "aes256-cts-hmac-sha1-96\naes128-cts-hmac-sha1-96"},
+		{Key: "kerberos/default-ccache-name", Value: "FILE:/tmp/krb5cc_%{uid}"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		wantErr bool
+	}{
+		"Apply all settings":                         {},
+		"Apply all settings with included directory": {existingState: "included"},
+		"Enabled rdns is set to true":                {entries: []entry.Entry{{Key: "kerberos/rdns"}}},
+		"Disabled settings with values are ignored":  {entries: []entry.Entry{{Key: "kerberos/permitted-enctypes", Value: "aes", Disabled: true}, {Key: "kerberos/default-ccache-name", Value: "/tmp/krb5cc_%{uid}", Disabled: true}, {Key: "kerberos/rdns", Disabled: true}}},
+		"Encryption types families and removals":     {entries: []entry.Entry{{Key: "kerberos/permitted-enctypes", Value: "DEFAULT -rc4 -des3 +camellia"}}},
+		"Encryption types are case insensitive":      {entries: []entry.Entry{{Key: "kerberos/permitted-enctypes", Value: "AES256-CTS-HMAC-SHA1-96 default"}}},
+		"Credential cache without FILE prefix":       {entries: []entry.Entry{{Key: "kerberos/default-ccache-name", Value: "%{TEMP}/krb5cc_%{uid}"}}},
+		"Empty values are ignored":                   {entries: []entry.Entry{{Key: "kerberos/permitted-enctypes", Value: " ,\n"}, {Key: "kerberos/default-ccache-name", Value: " "}}},
+		"Unknown keys are ignored":                   {entries: []entry.Entry{{Key: "kerberos/unknown", Value: "something"}, {Key: "kerberos/rdns"}}},
+		"Update existing configuration":              {existingState: "managed"},
+		"Configuration already up to date":           {existingState: "up_to_date"},
+		"Remove configuration with no entries":       {entries: []entry.Entry{}, existingState: "managed"},
+		"No entries and no configuration":            {entries: []entry.Entry{}},
+		"User objects are ignored":                   {isUser: true, existingState: "managed"},
+
+		// Error cases
+		"Error on errored entry":                         {entries: []entry.Entry{{Key: "kerberos/rdns", Err: errors.New("some error")}}, wantErr: true},
+		"Error on invalid hostname canonicalization":     {entries: []entry.Entry{{Key: "kerberos/dns-canonicalize-hostname", Value: "yes"}}, wantErr: true},
+		"Error on unknown encryption type":               {entries: []entry.Entry{{Key: "kerberos/default-tkt-enctypes", Value: "aes256-cts-hmac-sha1-96 unknown"}}, wantErr: true},
+		"Error on encryption types not supported by AD":  {entries: []entry.Entry{{Key: "kerberos/permitted-enctypes", Value: "camellia256-cts-cmac des3-cbc-sha1"}}, wantErr: true},
+		"Error on encryption types removing all AD ones": {entries: []entry.Entry{{Key: "kerberos/default-tgs-enctypes", Value: "-aes -rc4"}}, wantErr: true},
+		"Error on non-file credential cache":             {entries: []entry.Entry{{Key: "kerberos/default-ccache-name", Value: "KEYRING:persistent:%{uid}"}}, wantErr: true},
+		"Error on relative credential cache":             {entries: []entry.Entry{{Key: "kerberos/default-ccache-name", Value: "FILE:krb5cc_%{uid}"}}, wantErr: true},
+		"Error on unknown credential cache parameter":    {entries: []entry.Entry{{Key: "kerberos/default-ccache-name", Value: "/tmp/krb5cc_%{unknown}"}}, wantErr: true},
+		"Error on credential cache with spaces":          {entries: []entry.Entry{{Key: "kerberos/default-ccache-name", Value: "/tmp/krb5 cc"}}, wantErr: true},
+		"Error on invalid value keeps existing config":   {entries: []entry.Entry{{Key: "kerberos/permitted-enctypes", Value: "des"}}, existingState: "managed", wantErr: true},
+		"Error on configuration directory being a file":  {existingState: "conf_dir_is_file", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), filepath.Join(rootDir, "etc"))
+			}
+
+			m := kerberos.New(kerberos.WithKrb5Conf(filepath.Join(rootDir, "etc", "krb5.conf")))
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				if tc.existingState != "managed" {
+					return
+				}
+				// The current configuration must be kept on errors.
+				got, err := os.ReadFile(filepath.Join(rootDir, "etc", "krb5.conf.d", "50-adsys.conf"))
+				require.NoError(t, err, "Existing configuration should be kept")
+				want, err := os.ReadFile(filepath.Join(testutils.TestFamilyPath(t), "states", "managed", "krb5.conf.d", "50-adsys.conf"))
+				require.NoError(t, err, "Setup: can't read existing configuration")
+				require.Equal(t, string(want), string(got), "Existing configuration should not be modified")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, filepath.Join(rootDir, "etc"), testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
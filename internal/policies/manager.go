@@ -27,6 +27,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"slices"
@@ -39,16 +41,37 @@ import (
 	"github.com/ubuntu/adsys/internal/ad/backends"
 	"github.com/ubuntu/adsys/internal/consts"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/access"
 	"github.com/ubuntu/adsys/internal/policies/apparmor"
+	"github.com/ubuntu/adsys/internal/policies/banner"
+	"github.com/ubuntu/adsys/internal/policies/browser"
 	"github.com/ubuntu/adsys/internal/policies/certificate"
 	"github.com/ubuntu/adsys/internal/policies/dconf"
 	"github.com/ubuntu/adsys/internal/policies/dynamicvalues"
 	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/environment"
+	"github.com/ubuntu/adsys/internal/policies/files"
+	"github.com/ubuntu/adsys/internal/policies/firewall"
 	"github.com/ubuntu/adsys/internal/policies/gdm"
+	"github.com/ubuntu/adsys/internal/policies/groups"
+	"github.com/ubuntu/adsys/internal/policies/kerberos"
 	"github.com/ubuntu/adsys/internal/policies/mount"
+	"github.com/ubuntu/adsys/internal/policies/network"
+	"github.com/ubuntu/adsys/internal/policies/packages"
+	"github.com/ubuntu/adsys/internal/policies/password"
+	"github.com/ubuntu/adsys/internal/policies/printers"
 	"github.com/ubuntu/adsys/internal/policies/privilege"
 	"github.com/ubuntu/adsys/internal/policies/proxy"
+	"github.com/ubuntu/adsys/internal/policies/resolver"
 	"github.com/ubuntu/adsys/internal/policies/scripts"
+	"github.com/ubuntu/adsys/internal/policies/services"
+	"github.com/ubuntu/adsys/internal/policies/shortcuts"
+	"github.com/ubuntu/adsys/internal/policies/ssh"
+	"github.com/ubuntu/adsys/internal/policies/sysctl"
+	"github.com/ubuntu/adsys/internal/policies/targeting"
+	"github.com/ubuntu/adsys/internal/policies/tasks"
+	"github.com/ubuntu/adsys/internal/policies/timesync"
+	"github.com/ubuntu/adsys/internal/policies/usbguard"
 	"github.com/ubuntu/adsys/internal/systemd"
 	"github.com/ubuntu/decorate"
 	"golang.org/x/sync/errgroup"
@@ -56,7 +79,7 @@ import (
 
 // ProOnlyRules are the rules that are only available for Pro subscribers. They
 // will be filtered otherwise.
-var ProOnlyRules = []string{"privilege", "scripts", "mount", "apparmor", "proxy", "certificate"}
+var ProOnlyRules = []string{"privilege", "scripts", "mount", "apparmor", "proxy", "certificate", "install", "firewall", "services", "browser", "printers", "environment", "network", "password", "sysctl", "ssh", "usbguard", "groups", "tasks", "files", "shortcuts", "kerberos", "resolver", "time", "banner", "access"}
 
 // Manager handles all managers for various policy handlers.
 type Manager struct {
@@ -73,9 +96,32 @@ type Manager struct {
 	apparmor    *apparmor.Manager
 	proxy       *proxy.Manager
 	certificate *certificate.Manager
+	packages    *packages.Manager
+	firewall    *firewall.Manager
+	services    *services.Manager
+	browser     *browser.Manager
+	printers    *printers.Manager
+	environment *environment.Manager
+	network     *network.Manager
+	password    *password.Manager
+	sysctl      *sysctl.Manager
+	ssh         *ssh.Manager
+	usbguard    *usbguard.Manager
+	groups      *groups.Manager
+	tasks       *tasks.Manager
+	files       *files.Manager
+	shortcuts   *shortcuts.Manager
+	kerberos    *kerberos.Manager
+	resolver    *resolver.Manager
+	timesync    *timesync.Manager
+	banner      *banner.Manager
+	access      *access.Manager
 
 	subscriptionDbus dbus.BusObject
 
+	// targetingOpts are the options to compute the facts the targeting expressions are evaluated against.
+	targetingOpts []targeting.Option
+
 	// muMu protects the objectMu mutex.
 	muMu *sync.Mutex
 	// objectMu prevents applying multiple policies concurrently for the same object.
@@ -86,10 +132,16 @@ type Manager struct {
 type systemdCaller interface {
 	StartUnit(context.Context, string) error
 	StopUnit(context.Context, string) error
+	ReloadUnit(context.Context, string) error
+	TryRestartUnit(context.Context, string) error
 
 	EnableUnit(context.Context, string) error
 	DisableUnit(context.Context, string) error
 
+	MaskUnit(context.Context, string) error
+	UnmaskUnit(context.Context, string) error
+	UnitFileState(context.Context, string) (string, error)
+
 	DaemonReload(context.Context) error
 }
 
@@ -105,13 +157,46 @@ type options struct {
 	apparmorDir        string
 	apparmorFsDir      string
 	systemUnitDir      string
+	userUnitDir        string
 	globalTrustDir     string
+	firewallDir        string
+	firefoxDir         string
+	chromiumDirs       []string
+	environmentDir     string
+	networkDir         string
+	securityDir        string
+	pamDir             string
+	sysctlDir          string
+	procSysDir         string
+	sshDir             string
+	usbguardDir        string
+	applicationsDir    string
+	shortcutIconsDir   string
+	krb5Conf           string
+	resolvedConfDir    string
+	hostsFile          string
+	timesyncdConfDir   string
+	chronyDir          string
+	issueDir           string
+	updateMotdDir      string
 	proxyApplier       proxy.Caller
+	printersCaller     printers.Caller
+	networkCaller      network.Caller
+	timedateCaller     timesync.Caller
 	systemdCaller      systemdCaller
 	gdm                *gdm.Manager
+	targetingOpts      []targeting.Option
 
 	apparmorParserCmd []string
 	certAutoenrollCmd []string
+	updateCACertCmd   []string
+	aptGetCmd         []string
+	aptMarkCmd        []string
+	dpkgQueryCmd      []string
+	nftCmd            []string
+	lpadminCmd        []string
+	lpstatCmd         []string
+	sshdCmd           []string
 }
 
 // Option reprents an optional function to change Policies behavior.
@@ -214,6 +299,14 @@ func WithSystemUnitDir(p string) Option {
 	}
 }
 
+// WithUserUnitDir specifies a personalized unit directory for adsys user task units.
+func WithUserUnitDir(p string) Option {
+	return func(o *options) error {
+		o.userUnitDir = p
+		return nil
+	}
+}
+
 // WithGlobalTrustDir specifies a personalized global trust directory for use
 // with the certificate manager.
 func WithGlobalTrustDir(p string) Option {
@@ -223,6 +316,166 @@ func WithGlobalTrustDir(p string) Option {
 	}
 }
 
+// WithFirewallDir specifies a personalized directory for the adsys nftables ruleset.
+func WithFirewallDir(p string) Option {
+	return func(o *options) error {
+		o.firewallDir = p
+		return nil
+	}
+}
+
+// WithFirefoxPoliciesDir specifies a personalized directory for the Firefox policies file.
+func WithFirefoxPoliciesDir(p string) Option {
+	return func(o *options) error {
+		o.firefoxDir = p
+		return nil
+	}
+}
+
+// WithChromiumPoliciesDirs specifies personalized directories for the Chromium managed policies file.
+func WithChromiumPoliciesDirs(p ...string) Option {
+	return func(o *options) error {
+		o.chromiumDirs = p
+		return nil
+	}
+}
+
+// WithEnvironmentDir specifies a personalized directory for the system-wide session environment variables.
+func WithEnvironmentDir(p string) Option {
+	return func(o *options) error {
+		o.environmentDir = p
+		return nil
+	}
+}
+
+// WithNetworkConnectionsDir specifies a personalized directory for the NetworkManager system connections.
+func WithNetworkConnectionsDir(p string) Option {
+	return func(o *options) error {
+		o.networkDir = p
+		return nil
+	}
+}
+
+// WithSecurityDir specifies a personalized directory for the PAM modules configuration.
+func WithSecurityDir(p string) Option {
+	return func(o *options) error {
+		o.securityDir = p
+		return nil
+	}
+}
+
+// WithPAMDir specifies a personalized directory for the PAM stack configuration.
+func WithPAMDir(p string) Option {
+	return func(o *options) error {
+		o.pamDir = p
+		return nil
+	}
+}
+
+// WithSysctlDir specifies a personalized directory for the kernel parameters configuration.
+func WithSysctlDir(p string) Option {
+	return func(o *options) error {
+		o.sysctlDir = p
+		return nil
+	}
+}
+
+// WithProcSysDir specifies a personalized directory for the kernel parameters.
+func WithProcSysDir(p string) Option {
+	return func(o *options) error {
+		o.procSysDir = p
+		return nil
+	}
+}
+
+// WithSSHDir specifies a personalized directory for the SSH server and client configuration.
+func WithSSHDir(p string) Option {
+	return func(o *options) error {
+		o.sshDir = p
+		return nil
+	}
+}
+
+// WithUSBGuardDir specifies a personalized directory for the usbguard configuration.
+func WithUSBGuardDir(p string) Option {
+	return func(o *options) error {
+		o.usbguardDir = p
+		return nil
+	}
+}
+
+// WithApplicationsDir specifies a personalized directory for the application launchers.
+func WithApplicationsDir(p string) Option {
+	return func(o *options) error {
+		o.applicationsDir = p
+		return nil
+	}
+}
+
+// WithShortcutIconsDir specifies a personalized directory for the icons of the shortcuts.
+func WithShortcutIconsDir(p string) Option {
+	return func(o *options) error {
+		o.shortcutIconsDir = p
+		return nil
+	}
+}
+
+// WithKrb5Conf specifies a personalized main Kerberos configuration file.
+func WithKrb5Conf(p string) Option {
+	return func(o *options) error {
+		o.krb5Conf = p
+		return nil
+	}
+}
+
+// WithResolvedConfDir specifies a personalized directory for the systemd-resolved configuration drop-ins.
+func WithResolvedConfDir(p string) Option {
+	return func(o *options) error {
+		o.resolvedConfDir = p
+		return nil
+	}
+}
+
+// WithHostsFile specifies a personalized hosts file.
+func WithHostsFile(p string) Option {
+	return func(o *options) error {
+		o.hostsFile = p
+		return nil
+	}
+}
+
+// WithTimesyncdConfDir specifies a personalized directory for the systemd-timesyncd configuration drop-ins.
+func WithTimesyncdConfDir(p string) Option {
+	return func(o *options) error {
+		o.timesyncdConfDir = p
+		return nil
+	}
+}
+
+// WithChronyDir specifies a personalized chrony configuration directory.
+func WithChronyDir(p string) Option {
+	return func(o *options) error {
+		o.chronyDir = p
+		return nil
+	}
+}
+
+// WithIssueDir specifies a personalized directory for the issue and issue.net login banners.
+func WithIssueDir(p string) Option {
+	return func(o *options) error {
+		o.issueDir = p
+		return nil
+	}
+}
+
+// WithUpdateMotdDir specifies a personalized directory for the message of the day fragments.
+func WithUpdateMotdDir(p string) Option {
+	return func(o *options) error {
+		o.updateMotdDir = p
+		return nil
+	}
+}
+
 // WithProxyApplier specifies a personalized proxy applier for the proxy policy manager.
 func WithProxyApplier(p proxy.Caller) Option {
 	return func(o *options) error {
@@ -231,6 +484,30 @@ func WithProxyApplier(p proxy.Caller) Option {
 	}
 }
 
+// WithPrintersCaller specifies a personalized CUPS caller for the printers policy manager.
+func WithPrintersCaller(p printers.Caller) Option {
+	return func(o *options) error {
+		o.printersCaller = p
+		return nil
+	}
+}
+
+// WithNetworkSettingsCaller specifies a personalized NetworkManager settings caller for the network policy manager.
+func WithNetworkSettingsCaller(p network.Caller) Option {
+	return func(o *options) error {
+		o.networkCaller = p
+		return nil
+	}
+}
+
+// WithTimedateCaller specifies a personalized systemd-timedated caller for the time policy manager.
+func WithTimedateCaller(p timesync.Caller) Option {
+	return func(o *options) error {
+		o.timedateCaller = p
+		return nil
+	}
+}
+
 // WithSystemdCaller specifies a personalized systemd caller for the policy managers.
 func WithSystemdCaller(p systemdCaller) Option {
 	return func(o *options) error {
@@ -247,6 +524,70 @@ func WithCertAutoenrollCmd(cmd []string) Option {
 	}
 }
 
+// WithUpdateCACertificatesCmd specifies a personalized update-ca-certificates command for the certificate manager.
+func WithUpdateCACertificatesCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.updateCACertCmd = cmd
+		return nil
+	}
+}
+
+// WithAptGetCmd specifies a personalized apt-get command for the packages manager.
+func WithAptGetCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.aptGetCmd = cmd
+		return nil
+	}
+}
+
+// WithAptMarkCmd specifies a personalized apt-mark command for the packages manager.
+func WithAptMarkCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.aptMarkCmd = cmd
+		return nil
+	}
+}
+
+// WithDpkgQueryCmd specifies a personalized dpkg-query command for the packages manager.
+func WithDpkgQueryCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.dpkgQueryCmd = cmd
+		return nil
+	}
+}
+
+// WithNftCmd specifies a personalized nft command for the firewall manager.
+func WithNftCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.nftCmd = cmd
+		return nil
+	}
+}
+
+// WithLpadminCmd specifies a personalized lpadmin command for the printers manager.
+func WithLpadminCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.lpadminCmd = cmd
+		return nil
+	}
+}
+
+// WithLpstatCmd specifies a personalized lpstat command for the printers manager.
+func WithLpstatCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.lpstatCmd = cmd
+		return nil
+	}
+}
+
+// WithSshdCmd specifies a personalized sshd command for the ssh manager.
+func WithSshdCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.sshdCmd = cmd
+		return nil
+	}
+}
+
 // NewManager returns a new manager with all default policy handlers.
 func NewManager(bus *dbus.Conn, hostname string, backend backends.Backend, opts ...Option) (m *Manager, err error) {
 	defer decorate.OnError(&err, gotext.Get("can't create a new policy handlers manager"))
@@ -265,6 +606,7 @@ func NewManager(bus *dbus.Conn, hostname string, backend backends.Backend, opts
 		apparmorDir:        consts.DefaultApparmorDir,
 		systemUnitDir:      consts.DefaultSystemUnitDir,
 		globalTrustDir:     consts.DefaultGlobalTrustDir,
+		firewallDir:        consts.DefaultFirewallDir,
 		policyKitSystemDir: consts.DefaultPolicyKitSystemDir,
 		systemdCaller:      defaultSystemdCaller,
 		gdm:                nil,
@@ -323,8 +665,185 @@ func NewManager(bus *dbus.Conn, hostname string, backend backends.Backend, opts
 	if args.certAutoenrollCmd != nil {
 		certificateOpts = append(certificateOpts, certificate.WithCertAutoenrollCmd(args.certAutoenrollCmd))
 	}
+	if args.updateCACertCmd != nil {
+		certificateOpts = append(certificateOpts, certificate.WithUpdateCACertificatesCmd(args.updateCACertCmd))
+	}
 	certificateManager := certificate.New(backend.Domain(), certificateOpts...)
 
+	// packages manager
+	packagesOpts := []packages.Option{packages.WithStateDir(args.stateDir)}
+	if args.aptGetCmd != nil {
+		packagesOpts = append(packagesOpts, packages.WithAptGetCmd(args.aptGetCmd))
+	}
+	if args.aptMarkCmd != nil {
+		packagesOpts = append(packagesOpts, packages.WithAptMarkCmd(args.aptMarkCmd))
+	}
+	if args.dpkgQueryCmd != nil {
+		packagesOpts = append(packagesOpts, packages.WithDpkgQueryCmd(args.dpkgQueryCmd))
+	}
+	packagesManager := packages.New(packagesOpts...)
+
+	// firewall manager
+	firewallOpts := []firewall.Option{firewall.WithFirewallDir(args.firewallDir)}
+	if args.nftCmd != nil {
+		firewallOpts = append(firewallOpts, firewall.WithNftCmd(args.nftCmd))
+	}
+	firewallManager := firewall.New(firewallOpts...)
+
+	// services manager
+	servicesManager := services.New(args.systemdCaller, services.WithStateDir(args.stateDir))
+
+	// browser manager
+	browserOpts := []browser.Option{browser.WithStateDir(args.stateDir)}
+	if args.firefoxDir != "" {
+		browserOpts = append(browserOpts, browser.WithFirefoxPoliciesDir(args.firefoxDir))
+	}
+	if args.chromiumDirs != nil {
+		browserOpts = append(browserOpts, browser.WithChromiumPoliciesDirs(args.chromiumDirs...))
+	}
+	browserManager := browser.New(browserOpts...)
+
+	// printers manager
+	printersOpts := []printers.Option{printers.WithStateDir(args.stateDir)}
+	if args.lpadminCmd != nil {
+		printersOpts = append(printersOpts, printers.WithLpadminCmd(args.lpadminCmd))
+	}
+	if args.lpstatCmd != nil {
+		printersOpts = append(printersOpts, printers.WithLpstatCmd(args.lpstatCmd))
+	}
+	if args.printersCaller != nil {
+		printersOpts = append(printersOpts, printers.WithCaller(args.printersCaller))
+	}
+	printersManager := printers.New(printersOpts...)
+
+	// environment manager
+	var environmentOpts []environment.Option
+	if args.environmentDir != "" {
+		environmentOpts = append(environmentOpts, environment.WithEnvironmentDir(args.environmentDir))
+	}
+	environmentManager := environment.New(environmentOpts...)
+
+	// network manager
+	networkOpts := []network.Option{network.WithStateDir(args.stateDir)}
+	if args.networkDir != "" {
+		networkOpts = append(networkOpts, network.WithConnectionsDir(args.networkDir))
+	}
+	if args.networkCaller != nil {
+		networkOpts = append(networkOpts, network.WithSettingsCaller(args.networkCaller))
+	}
+	networkManager := network.New(bus, networkOpts...)
+
+	// password manager
+	var passwordOpts []password.Option
+	if args.securityDir != "" {
+		passwordOpts = append(passwordOpts, password.WithSecurityDir(args.securityDir))
+	}
+	if args.pamDir != "" {
+		passwordOpts = append(passwordOpts, password.WithPAMDir(args.pamDir))
+	}
+	passwordManager := password.New(passwordOpts...)
+
+	// sysctl manager
+	var sysctlOpts []sysctl.Option
+	if args.sysctlDir != "" {
+		sysctlOpts = append(sysctlOpts, sysctl.WithSysctlDir(args.sysctlDir))
+	}
+	if args.procSysDir != "" {
+		sysctlOpts = append(sysctlOpts, sysctl.WithProcSysDir(args.procSysDir))
+	}
+	sysctlManager := sysctl.New(sysctlOpts...)
+
+	// ssh manager
+	var sshOpts []ssh.Option
+	if args.sshDir != "" {
+		sshOpts = append(sshOpts, ssh.WithSSHDir(args.sshDir))
+	}
+	if args.sshdCmd != nil {
+		sshOpts = append(sshOpts, ssh.WithSshdCmd(args.sshdCmd))
+	}
+	sshManager := ssh.New(args.systemdCaller, sshOpts...)
+
+	// usbguard manager
+	var usbguardOpts []usbguard.Option
+	if args.usbguardDir != "" {
+		usbguardOpts = append(usbguardOpts, usbguard.WithUSBGuardDir(args.usbguardDir))
+	}
+	usbguardManager := usbguard.New(args.systemdCaller, usbguardOpts...)
+
+	// groups manager
+	var groupsOpts []groups.Option
+	if args.securityDir != "" {
+		groupsOpts = append(groupsOpts, groups.WithSecurityDir(args.securityDir))
+	}
+	groupsManager := groups.New(groupsOpts...)
+
+	// tasks manager
+	var tasksOpts []tasks.Option
+	if args.userUnitDir != "" {
+		tasksOpts = append(tasksOpts, tasks.WithUserUnitDir(args.userUnitDir))
+	}
+	tasksManager := tasks.New(args.runDir, args.systemUnitDir, args.systemdCaller, tasksOpts...)
+
+	// files manager
+	filesManager := files.New(files.WithStateDir(args.stateDir))
+
+	// shortcuts manager
+	var shortcutsOpts []shortcuts.Option
+	if args.applicationsDir != "" {
+		shortcutsOpts = append(shortcutsOpts, shortcuts.WithApplicationsDir(args.applicationsDir))
+	}
+	if args.shortcutIconsDir != "" {
+		shortcutsOpts = append(shortcutsOpts, shortcuts.WithIconsDir(args.shortcutIconsDir))
+	}
+	shortcutsManager := shortcuts.New(shortcutsOpts...)
+
+	// kerberos manager
+	var kerberosOpts []kerberos.Option
+	if args.krb5Conf != "" {
+		kerberosOpts = append(kerberosOpts, kerberos.WithKrb5Conf(args.krb5Conf))
+	}
+	kerberosManager := kerberos.New(kerberosOpts...)
+
+	// resolver manager
+	var resolverOpts []resolver.Option
+	if args.resolvedConfDir != "" {
+		resolverOpts = append(resolverOpts, resolver.WithResolvedConfDir(args.resolvedConfDir))
+	}
+	if args.hostsFile != "" {
+		resolverOpts = append(resolverOpts, resolver.WithHostsFile(args.hostsFile))
+	}
+	resolverManager := resolver.New(args.systemdCaller, resolverOpts...)
+
+	// time manager
+	var timesyncOpts []timesync.Option
+	if args.timesyncdConfDir != "" {
+		timesyncOpts = append(timesyncOpts, timesync.WithTimesyncdConfDir(args.timesyncdConfDir))
+	}
+	if args.chronyDir != "" {
+		timesyncOpts = append(timesyncOpts, timesync.WithChronyDir(args.chronyDir))
+	}
+	if args.timedateCaller != nil {
+		timesyncOpts = append(timesyncOpts, timesync.WithTimedateCaller(args.timedateCaller))
+	}
+	timesyncManager := timesync.New(bus, backend, args.systemdCaller, timesyncOpts...)
+
+	// banner manager
+	bannerOpts := []banner.Option{banner.WithStateDir(args.stateDir)}
+	if args.issueDir != "" {
+		bannerOpts = append(bannerOpts, banner.WithIssueDir(args.issueDir))
+	}
+	if args.updateMotdDir != "" {
+		bannerOpts = append(bannerOpts, banner.WithUpdateMotdDir(args.updateMotdDir))
+	}
+	bannerManager := banner.New(bannerOpts...)
+
+	// access manager
+	var accessOpts []access.Option
+	if args.securityDir != "" {
+		accessOpts = append(accessOpts, access.WithSecurityDir(args.securityDir))
+	}
+	accessManager := access.New(accessOpts...)
+
 	// inject applied dconf mangager if we need to build a gdm manager
 	if args.gdm == nil {
 		if args.gdm, err = gdm.New(gdm.WithDconf(dconfManager)); err != nil {
@@ -351,10 +870,32 @@ func NewManager(bus *dbus.Conn, hostname string, backend backends.Backend, opts
 		apparmor:         apparmorManager,
 		proxy:            proxyManager,
 		certificate:      certificateManager,
+		packages:         packagesManager,
+		firewall:         firewallManager,
+		services:         servicesManager,
+		browser:          browserManager,
+		printers:         printersManager,
+		environment:      environmentManager,
+		network:          networkManager,
+		password:         passwordManager,
+		sysctl:           sysctlManager,
+		ssh:              sshManager,
+		usbguard:         usbguardManager,
+		groups:           groupsManager,
+		tasks:            tasksManager,
+		files:            filesManager,
+		shortcuts:        shortcutsManager,
+		kerberos:         kerberosManager,
+		resolver:         resolverManager,
+		timesync:         timesyncManager,
+		banner:           bannerManager,
+		access:           accessManager,
 		gdm:              args.gdm,
 
 		subscriptionDbus: subscriptionDbus,
 
+		targetingOpts: args.targetingOpts,
+
 		muMu:     &sync.Mutex{},
 		objectMu: make(map[string]*sync.Mutex),
 	}, nil
@@ -374,7 +915,9 @@ func (m *Manager) ApplyPolicies(ctx context.Context, objectName string, isComput
 	defer m.objectMu[objectName].Unlock()
 	m.muMu.Unlock()
 
-	rules := pols.GetUniqueRules()
+	// Entries not targeting this client or user are dropped before computing the unique rules, so that the value
+	// of a further GPO still applies.
+	rules := m.targetedPolicies(ctx, objectName, isComputer, *pols).GetUniqueRules()
 	action := gotext.Get("Applying")
 	if len(rules) == 0 {
 		action = gotext.Get("Unloading")
@@ -390,6 +933,12 @@ func (m *Manager) ApplyPolicies(ctx context.Context, objectName string, isComput
 		}
 	}
 
+	// Refuse the whole policy if a remaining entry is errored, as applying the other ones could grant more than
+	// intended.
+	if err := checkErroredEntries(rules); err != nil {
+		return err
+	}
+
 	// Expand dynamic values (${USER}, ${HOSTNAME}, ...) in the remaining rules
 	// before starting any manager goroutine, so an invalid template fails closed
 	// before any partial policy write can occur.
@@ -401,6 +950,12 @@ func (m *Manager) ApplyPolicies(ctx context.Context, objectName string, isComput
 		return err
 	}
 
+	// Application launchers are pinned through the machine dconf database, which is applied
+	// concurrently with the shortcuts: merge them before dispatching.
+	if isComputer {
+		rules["dconf"] = shortcuts.PinFavoriteApps(rules["dconf"], rules["shortcuts"])
+	}
+
 	var g errgroup.Group
 	g.Go(func() error {
 		return m.dconf.ApplyPolicy(ctx, objectName, isComputer, rules["dconf"])
@@ -426,6 +981,66 @@ func (m *Manager) ApplyPolicies(ctx context.Context, objectName string, isComput
 		isOnline, _ := m.backend.IsOnline()
 		return m.certificate.ApplyPolicy(ctx, objectName, isComputer, isOnline, rules["certificate"])
 	})
+	g.Go(func() error {
+		return m.packages.ApplyPolicy(ctx, objectName, isComputer, rules["install"])
+	})
+	g.Go(func() error {
+		return m.firewall.ApplyPolicy(ctx, objectName, isComputer, rules["firewall"])
+	})
+	g.Go(func() error {
+		return m.services.ApplyPolicy(ctx, objectName, isComputer, rules["services"])
+	})
+	g.Go(func() error {
+		return m.browser.ApplyPolicy(ctx, objectName, isComputer, rules["browser"])
+	})
+	g.Go(func() error {
+		return m.printers.ApplyPolicy(ctx, objectName, isComputer, rules["printers"])
+	})
+	g.Go(func() error {
+		return m.environment.ApplyPolicy(ctx, objectName, isComputer, rules["environment"])
+	})
+	g.Go(func() error {
+		return m.network.ApplyPolicy(ctx, objectName, isComputer, rules["network"])
+	})
+	g.Go(func() error {
+		return m.password.ApplyPolicy(ctx, objectName, isComputer, rules["password"])
+	})
+	g.Go(func() error {
+		return m.sysctl.ApplyPolicy(ctx, objectName, isComputer, rules["sysctl"])
+	})
+	g.Go(func() error {
+		return m.ssh.ApplyPolicy(ctx, objectName, isComputer, rules["ssh"])
+	})
+	g.Go(func() error {
+		return m.usbguard.ApplyPolicy(ctx, objectName, isComputer, rules["usbguard"])
+	})
+	g.Go(func() error {
+		return m.groups.ApplyPolicy(ctx, objectName, isComputer, rules["groups"])
+	})
+	g.Go(func() error {
+		return m.tasks.ApplyPolicy(ctx, objectName, isComputer, rules["tasks"], pols.SaveAssetsTo)
+	})
+	g.Go(func() error {
+		return m.files.ApplyPolicy(ctx, objectName, isComputer, rules["files"], pols.SaveAssetsTo)
+	})
+	g.Go(func() error {
+		return m.shortcuts.ApplyPolicy(ctx, objectName, isComputer, rules["shortcuts"], pols.SaveAssetsTo)
+	})
+	g.Go(func() error {
+		return m.kerberos.ApplyPolicy(ctx, objectName, isComputer, rules["kerberos"])
+	})
+	g.Go(func() error {
+		return m.resolver.ApplyPolicy(ctx, objectName, isComputer, rules["resolver"])
+	})
+	g.Go(func() error {
+		return m.timesync.ApplyPolicy(ctx, objectName, isComputer, rules["time"])
+	})
+	g.Go(func() error {
+		return m.banner.ApplyPolicy(ctx, objectName, isComputer, rules["banner"])
+	})
+	g.Go(func() error {
+		return m.access.ApplyPolicy(ctx, objectName, isComputer, rules["access"])
+	})
 	if err := g.Wait(); err != nil {
 		return err
 	}
@@ -460,7 +1075,7 @@ func (m *Manager) DumpPolicies(ctx context.Context, objectName string, computerO
 		for _, g := range policiesHost.GPOs {
 			alreadyProcessedRules = g.Format(&out, withRules, withOverridden, alreadyProcessedRules)
 		}
-		fmt.Fprintln(&out, gotext.Get("Policies from user configuration:"))
+		formatFilteredGPOs(&out, gotext.Get("Machine GPOs filtered out by their WMI filter:"), policiesHost.FilteredGPOs, withRules)
 	}
 
 	// Load target policies
@@ -469,13 +1084,36 @@ func (m *Manager) DumpPolicies(ctx context.Context, objectName string, computerO
 		log.Info(ctx, gotext.Get("User %q not found on cache.", objectName))
 		return "", errors.New(gotext.Get("no policy applied for %q: %v", objectName, err))
 	}
+	if !computerOnly {
+		if policiesTarget.Loopback != "" {
+			fmt.Fprintln(&out, gotext.Get("Policies from user configuration, with loopback processing in %s mode:", policiesTarget.Loopback))
+		} else {
+			fmt.Fprintln(&out, gotext.Get("Policies from user configuration:"))
+		}
+	}
 	for _, g := range policiesTarget.GPOs {
 		alreadyProcessedRules = g.Format(&out, withRules, withOverridden, alreadyProcessedRules)
 	}
+	filteredHeader := gotext.Get("User GPOs filtered out by their WMI filter:")
+	if computerOnly {
+		filteredHeader = gotext.Get("Machine GPOs filtered out by their WMI filter:")
+	}
+	formatFilteredGPOs(&out, filteredHeader, policiesTarget.FilteredGPOs, withRules)
 
 	return out.String(), nil
 }
 
+// formatFilteredGPOs writes to w the GPOs filtered out by their WMI filter, if any, under header.
+func formatFilteredGPOs(w io.Writer, header string, gpos []FilteredGPO, withDetails bool) {
+	if len(gpos) == 0 {
+		return
+	}
+	fmt.Fprintln(w, header)
+	for _, g := range gpos {
+		g.Format(w, withDetails)
+	}
+}
+
 // LastUpdateFor returns the last update time for object or current machine.
 func (m *Manager) LastUpdateFor(ctx context.Context, objectName string, isMachine bool) (t time.Time, err error) {
 	defer decorate.OnError(&err, gotext.Get("failed to get policy last update time %q (machine: %v)", objectName, isMachine))
@@ -606,3 +1244,77 @@ func expandDynamicValues(rules map[string][]entry.Entry, dynCtx dynamicvalues.Co
 
 	return nil
 }
+
+// checkErroredEntries returns an error listing the errored entries of rules, if any.
+func checkErroredEntries(rules map[string][]entry.Entry) error {
+	var errs []error
+	for _, t := range slices.Sorted(maps.Keys(rules)) {
+		for _, e := range rules[t] {
+			if e.Err == nil {
+				continue
+			}
+			errs = append(errs, errors.New(gotext.Get("entry %s/%s is errored: %v", t, e.Key, e.Err)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// targetedPolicies returns a copy of pols without the entries whose targeting expression doesn't match the client,
+// or the user objectName for user policies. Entries whose expression is invalid, or relies on facts which couldn't
+// be computed, are kept, but errored.
+func (m *Manager) targetedPolicies(ctx context.Context, objectName string, isComputer bool, pols Policies) Policies {
+	// Facts are only computed if there is at least one targeted entry.
+	var facts *targeting.Facts
+
+	gpos := make([]GPO, 0, len(pols.GPOs))
+	for _, g := range pols.GPOs {
+		rules := make(map[string][]entry.Entry, len(g.Rules))
+		for t, entries := range g.Rules {
+			for _, e := range entries {
+				if e.Target == "" {
+					rules[t] = append(rules[t], e)
+					continue
+				}
+
+				if facts == nil {
+					f := m.targetingFacts(ctx, objectName, isComputer)
+					facts = &f
+				}
+				match, err := targeting.Match(e.Target, *facts)
+				if err != nil {
+					// Fail closed: we can't know if the entry should apply.
+					e.Err = errors.New(gotext.Get("can't target entry of GPO %q: %v", g.Name, err))
+					rules[t] = append(rules[t], e)
+					continue
+				}
+				if !match {
+					log.Debugf(ctx, "%s/%s from GPO %q doesn't target %s", t, e.Key, g.Name, objectName)
+					continue
+				}
+				rules[t] = append(rules[t], e)
+			}
+		}
+		g.Rules = rules
+		gpos = append(gpos, g)
+	}
+	pols.GPOs = gpos
+
+	return pols
+}
+
+// targetingFacts returns the facts of the client, and of the user objectName for user policies.
+func (m *Manager) targetingFacts(ctx context.Context, objectName string, isComputer bool) targeting.Facts {
+	hostnames := []string{m.hostname}
+	if short, _, found := strings.Cut(m.hostname, "."); found {
+		hostnames = append(hostnames, short)
+	} else if domain := m.backend.Domain(); domain != "" {
+		hostnames = append(hostnames, m.hostname+"."+domain)
+	}
+
+	var username string
+	if !isComputer {
+		username = objectName
+	}
+
+	return targeting.LocalFacts(ctx, hostnames, username, m.targetingOpts...)
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,6 +20,7 @@ import (
 	"github.com/termie/go-shutil"
 	"github.com/ubuntu/adsys/internal/consts"
 	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/targeting"
 	"github.com/ubuntu/adsys/internal/testutils"
 )
 
@@ -42,6 +44,7 @@ func TestApplyPolicies(t *testing.T) {
 		secondCallWithNoSubscription    bool
 		noUbuntuProxyManager            bool
 		backendOfflineError             bool
+		interfaceAddrsError             bool
 
 		wantErr bool
 	}{
@@ -58,6 +61,9 @@ func TestApplyPolicies(t *testing.T) {
 		// dynamic values
 		"Dynamic values are expanded before applying": {policiesDir: "dynamic_values"},
 
+		// targeting
+		"Entries not targeting the client are not applied": {policiesDir: "targeted"},
+
 		// Error cases
 		"Error when applying dconf policy":       {policiesDir: "dconf_failing", wantErr: true},
 		"Error when applying privilege policy":   {makeDirReadOnly: "etc/sudoers.d", policiesDir: "all_entry_types", wantErr: true},
@@ -66,10 +72,34 @@ func TestApplyPolicies(t *testing.T) {
 		"Error when applying mount policy":       {makeDirReadOnly: "etc/systemd/system", policiesDir: "all_entry_types", wantErr: true},
 		"Error when applying proxy policy":       {noUbuntuProxyManager: true, policiesDir: "all_entry_types", wantErr: true},
 		"Error when applying certificate policy": {policiesDir: "certificate_failing", wantErr: true},
+		"Error when applying packages policy":    {policiesDir: "packages_failing", wantErr: true},
+		"Error when applying firewall policy":    {policiesDir: "firewall_failing", wantErr: true},
+		"Error when applying services policy":    {policiesDir: "services_failing", wantErr: true},
+		"Error when applying browser policy":     {policiesDir: "browser_failing", wantErr: true},
+		"Error when applying printers policy":    {policiesDir: "printers_failing", wantErr: true},
+		"Error when applying environment policy": {policiesDir: "environment_failing", wantErr: true},
+		"Error when applying network policy":     {policiesDir: "network_failing", wantErr: true},
+		"Error when applying password policy":    {policiesDir: "password_failing", wantErr: true},
+		"Error when applying sysctl policy":      {policiesDir: "sysctl_failing", wantErr: true},
+		"Error when applying ssh policy":         {policiesDir: "ssh_failing", wantErr: true},
+		"Error when applying usbguard policy":    {policiesDir: "usbguard_failing", wantErr: true},
+		"Error when applying groups policy":      {policiesDir: "groups_failing", wantErr: true},
+		"Error when applying tasks policy":       {policiesDir: "tasks_failing", wantErr: true},
+		"Error when applying files policy":       {policiesDir: "files_failing", wantErr: true},
+		"Error when applying shortcuts policy":   {policiesDir: "shortcuts_failing", wantErr: true},
+		"Error when applying kerberos policy":    {policiesDir: "kerberos_failing", wantErr: true},
+		"Error when applying resolver policy":    {policiesDir: "resolver_failing", wantErr: true},
+		"Error when applying time policy":        {policiesDir: "time_failing", wantErr: true},
+		"Error when applying banner policy":      {policiesDir: "banner_failing", wantErr: true},
+		"Error when applying access policy":      {policiesDir: "access_failing", wantErr: true},
 
 		// dynamic values error cases
 		"Error on unknown dynamic value":                {policiesDir: "dynamic_values_unknown", wantErr: true},
 		"Error on user dynamic value in machine policy": {policiesDir: "dynamic_values_user_in_machine", wantErr: true},
+
+		// targeting error cases
+		"Error on invalid targeting expression":       {policiesDir: "targeted_invalid", wantErr: true},
+		"Error on targeting facts that can't be read": {policiesDir: "targeted", interfaceAddrsError: true, wantErr: true},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -89,14 +119,48 @@ func TestApplyPolicies(t *testing.T) {
 			sudoersDir := filepath.Join(fakeRootDir, "etc", "sudoers.d")
 			apparmorDir := filepath.Join(fakeRootDir, "etc", "apparmor.d", "adsys")
 			systemUnitDir := filepath.Join(fakeRootDir, "etc", "systemd", "system")
+			userUnitDir := filepath.Join(fakeRootDir, "etc", "systemd", "user")
 			stateDir := filepath.Join(fakeRootDir, "var", "lib", "adsys")
 			shareDir := filepath.Join(fakeRootDir, "usr", "share", "adsys")
+			firewallDir := filepath.Join(fakeRootDir, "etc", "nftables.d")
+			firefoxDir := filepath.Join(fakeRootDir, "etc", "firefox", "policies")
+			chromiumDir := filepath.Join(fakeRootDir, "etc", "chromium", "policies", "managed")
+			environmentDir := filepath.Join(fakeRootDir, "etc", "environment.d")
+			networkDir := filepath.Join(fakeRootDir, "etc", "NetworkManager", "system-connections")
+			securityDir := filepath.Join(fakeRootDir, "etc", "security")
+			pamDir := filepath.Join(fakeRootDir, "etc", "pam.d")
+			sysctlDir := filepath.Join(fakeRootDir, "etc", "sysctl.d")
+			procSysDir := filepath.Join(fakeRootDir, "proc", "sys")
+			sshDir := filepath.Join(fakeRootDir, "etc", "ssh")
+			usbguardDir := filepath.Join(fakeRootDir, "etc", "usbguard")
+			applicationsDir := filepath.Join(fakeRootDir, "usr", "local", "share", "applications", "adsys")
+			shortcutIconsDir := filepath.Join(fakeRootDir, "usr", "local", "share", "adsys", "icons")
+			globalTrustDir := filepath.Join(fakeRootDir, "usr", "local", "share", "ca-certificates")
+			krb5Conf := filepath.Join(fakeRootDir, "etc", "krb5.conf")
+			resolvedConfDir := filepath.Join(fakeRootDir, "etc", "systemd", "resolved.conf.d")
+			hostsFile := filepath.Join(fakeRootDir, "etc", "hosts")
+			timesyncdConfDir := filepath.Join(fakeRootDir, "etc", "systemd", "timesyncd.conf.d")
+			chronyDir := filepath.Join(fakeRootDir, "etc", "chrony")
+			issueDir := filepath.Join(fakeRootDir, "etc")
+			updateMotdDir := filepath.Join(fakeRootDir, "etc", "update-motd.d")
 			loadedPoliciesFile := filepath.Join(fakeRootDir, "sys", "kernel", "security", "apparmor", "profiles")
 
 			err = os.MkdirAll(filepath.Dir(loadedPoliciesFile), 0700)
 			require.NoError(t, err, "Setup: can not create loadedPoliciesFile dir")
 			err = os.WriteFile(loadedPoliciesFile, []byte("someprofile (enforce)\n"), 0600)
 			require.NoError(t, err, "Setup: can not create loadedPoliciesFile")
+			err = os.MkdirAll(filepath.Join(procSysDir, "kernel"), 0700)
+			require.NoError(t, err, "Setup: can not create kernel parameters dir")
+			err = os.WriteFile(filepath.Join(procSysDir, "kernel", "kptr_restrict"), []byte("0\n"), 0600)
+			require.NoError(t, err, "Setup: can not create kernel parameter")
+			err = os.MkdirAll(usbguardDir, 0700)
+			require.NoError(t, err, "Setup: can not create usbguard dir")
+			err = os.MkdirAll(pamDir, 0700)
+			require.NoError(t, err, "Setup: can not create PAM dir")
+			err = os.WriteFile(filepath.Join(pamDir, "common-auth"), []byte("auth requisite pam_faillock.so preauth\n"), 0600)
+			require.NoError(t, err, "Setup: can not create PAM auth stack")
+			err = os.WriteFile(filepath.Join(pamDir, "common-password"), []byte("password requisite pam_pwquality.so\npassword requisite pam_pwhistory.so\n"), 0600)
+			require.NoError(t, err, "Setup: can not create PAM password stack")
 
 			status := !tc.isNotSubscribed
 			require.NoError(t, subscriptionDbus.SetProperty(consts.SubscriptionDbusInterface+".Attached", status), "Setup: can not set subscription status to %q", status)
@@ -119,9 +183,50 @@ func TestApplyPolicies(t *testing.T) {
 				policies.WithApparmorFsDir(filepath.Dir(loadedPoliciesFile)),
 				policies.WithApparmorParserCmd([]string{"/bin/true"}),
 				policies.WithCertAutoenrollCmd([]string{"/bin/true"}),
+				policies.WithGlobalTrustDir(globalTrustDir),
+				policies.WithUpdateCACertificatesCmd([]string{"/bin/true"}),
+				policies.WithAptGetCmd([]string{"/bin/true"}),
+				policies.WithAptMarkCmd([]string{"/bin/true"}),
+				policies.WithDpkgQueryCmd([]string{"/bin/true"}),
+				policies.WithFirewallDir(firewallDir),
+				policies.WithNftCmd([]string{"/bin/true"}),
+				policies.WithFirefoxPoliciesDir(firefoxDir),
+				policies.WithChromiumPoliciesDirs(chromiumDir),
+				policies.WithLpadminCmd([]string{"/bin/true"}),
+				policies.WithLpstatCmd([]string{"/bin/true"}),
+				policies.WithEnvironmentDir(environmentDir),
+				policies.WithNetworkConnectionsDir(networkDir),
+				policies.WithNetworkSettingsCaller(mockNetworkSettings{}),
+				policies.WithSecurityDir(securityDir),
+				policies.WithPAMDir(pamDir),
+				policies.WithSysctlDir(sysctlDir),
+				policies.WithProcSysDir(procSysDir),
+				policies.WithSSHDir(sshDir),
+				policies.WithSshdCmd([]string{"/bin/true"}),
+				policies.WithUSBGuardDir(usbguardDir),
+				policies.WithApplicationsDir(applicationsDir),
+				policies.WithShortcutIconsDir(shortcutIconsDir),
+				policies.WithKrb5Conf(krb5Conf),
+				policies.WithResolvedConfDir(resolvedConfDir),
+				policies.WithHostsFile(hostsFile),
+				policies.WithTimesyncdConfDir(timesyncdConfDir),
+				policies.WithChronyDir(chronyDir),
+				policies.WithTimedateCaller(mockTimedate{}),
+				policies.WithIssueDir(issueDir),
+				policies.WithUpdateMotdDir(updateMotdDir),
 				policies.WithSystemUnitDir(systemUnitDir),
+				policies.WithUserUnitDir(userUnitDir),
 				policies.WithProxyApplier(&mockProxyApplier{wantApplyError: tc.noUbuntuProxyManager}),
 				policies.WithSystemdCaller(&testutils.MockSystemdCaller{}),
+				policies.WithTargetingOptions(
+					targeting.WithRoot(filepath.Join("testdata", "targeting_root")),
+					targeting.WithInterfaceAddrs(func() ([]net.Addr, error) {
+						if tc.interfaceAddrsError {
+							return nil, errors.New("interface addresses error")
+						}
+						return []net.Addr{&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(16, 32)}}, nil
+					}),
+				),
 			)
 			require.NoError(t, err, "Setup: couldn’t get a new policy manager")
 
@@ -183,6 +288,13 @@ func TestApplyPolicies(t *testing.T) {
 				require.NoError(t, err, "ApplyPolicy should return no error but got one")
 			}
 
+			// The browser manifest lists the absolute paths of the policy files, which depend on the temporary root.
+			browserManifest := filepath.Join(stateDir, "browser", "manifest")
+			if data, err := os.ReadFile(browserManifest); err == nil {
+				err = os.WriteFile(browserManifest, []byte(strings.ReplaceAll(string(data), fakeRootDir, "#ROOTDIR#")), 0600)
+				require.NoError(t, err, "Teardown: can't normalize browser manifest")
+			}
+
 			testutils.CompareTreesWithFiltering(t, fakeRootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
 		})
 	}
@@ -247,6 +359,12 @@ func TestDumpPolicies(t *testing.T) {
 			withOverridden:    true,
 		},
 
+		"Targeted rules are shown with their target": {
+			cachePoliciesUser: "targeted",
+			withRules:         true,
+			withOverridden:    true,
+		},
+
 		// machine and user GPO with overrides between machine and user
 		"Overrides between machine and user GPOs, hidden": {
 			cachePoliciesUser:  "one_gpo",
@@ -276,6 +394,25 @@ func TestDumpPolicies(t *testing.T) {
 			withRules:          true,
 			withOverridden:     true,
 		},
+		"User GPOs with loopback processing": {
+			cachePoliciesUser:  "loopback_merge",
+			cachePolicyMachine: "loopback_machine",
+			withRules:          true,
+		},
+		"GPOs filtered out by their WMI filter": {
+			cachePoliciesUser:  "wmi_filtered",
+			cachePolicyMachine: "wmi_filtered_machine",
+		},
+		"GPOs filtered out by their WMI filter with rules": {
+			cachePoliciesUser:  "wmi_filtered",
+			cachePolicyMachine: "wmi_filtered_machine",
+			withRules:          true,
+		},
+		"Machine GPOs filtered out by their WMI filter": {
+			cachePolicyMachine: "wmi_filtered_machine",
+			target:             hostname,
+			computerOnly:       true,
+		},
 
 		// Error cases
 		"Error on missing target cache": {
@@ -443,6 +580,22 @@ func (d *mockProxyApplier) Call(_ string, _ dbus.Flags, _ ...interface{}) *dbus.
 	return &dbus.Call{Err: errApply}
 }
 
+// mockNetworkSettings is a mock for the NetworkManager settings object.
+type mockNetworkSettings struct{}
+
+// Call mocks the NetworkManager settings calls.
+func (mockNetworkSettings) Call(_ string, _ dbus.Flags, _ ...interface{}) *dbus.Call {
+	return &dbus.Call{}
+}
+
+// mockTimedate is a mock for the systemd-timedated object.
+type mockTimedate struct{}
+
+// Call mocks the systemd-timedated calls.
+func (mockTimedate) Call(_ string, _ dbus.Flags, _ ...interface{}) *dbus.Call {
+	return &dbus.Call{}
+}
+
 // mockBackend is a mock for the backend object.
 type mockBackend struct {
 	wantOnlineErr bool
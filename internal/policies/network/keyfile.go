@@ -0,0 +1,327 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/policies/certificate"
+)
+
+// uuidNamespace is the namespace of the connection UUIDs, which are derived from the owner and
+// name of the connection so that they are stable across policy updates.
+var uuidNamespace = uuid.MustParse("5a0b6ee4-1c7e-4b8e-9f1e-6f0f6b0e3a51")
+
+var (
+	// connectionNameRegexp matches valid connection names, which are used in file names.
+	connectionNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	// settingRegexp matches valid keyfile section and key names.
+	settingRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+// connectionTypes are the supported connection types.
+var connectionTypes = []string{"wifi", "ethernet", "vpn"}
+
+// securityTypes are the supported security types. The last ones are 802.1X methods.
+var securityTypes = []string{"none", "wpa-psk", "eap-tls", "peap", "ttls"}
+
+// reservedSettings are managed by adsys and can't be overridden.
+var reservedSettings = []string{"connection.uuid", "connection.type", "connection.permissions"}
+
+// keyfile is an ordered NetworkManager keyfile.
+type keyfile struct {
+	sections []section
+}
+
+type section struct {
+	name     string
+	settings [][2]string
+}
+
+// set sets key to value in the section, keeping the order of insertion.
+func (k *keyfile) set(name, key, value string) {
+	i := slices.IndexFunc(k.sections, func(s section) bool { return s.name == name })
+	if i == -1 {
+		k.sections = append(k.sections, section{name: name})
+		i = len(k.sections) - 1
+	}
+	s := &k.sections[i]
+	if j := slices.IndexFunc(s.settings, func(kv [2]string) bool { return kv[0] == key }); j != -1 {
+		s.settings[j][1] = value
+		return
+	}
+	s.settings = append(s.settings, [2]string{key, value})
+}
+
+// String returns the content of the keyfile.
+func (k keyfile) String() string {
+	var b strings.Builder
+	b.WriteString(`# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`)
+	for _, s := range k.sections {
+		fmt.Fprintf(&b, "\n[%s]\n", s.name)
+		for _, kv := range s.settings {
+			fmt.Fprintf(&b, "%s=%s\n", kv[0], escapeValue(kv[1]))
+		}
+	}
+	return b.String()
+}
+
+// escapeValue escapes a value as expected by the keyfile format.
+func escapeValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	if strings.HasPrefix(v, " ") {
+		v = `\s` + v[1:]
+	}
+	return v
+}
+
+// connection is a connection profile to deploy.
+type connection struct {
+	name    string
+	content string
+}
+
+// parseConnection parses a line in the form <name> <type> [<option>=<value>...] to a keyfile.
+// owner is the user the connection is restricted to, empty for machine connections.
+func parseConnection(line, owner, stateDir string) (c connection, err error) {
+	fields, err := splitFields(line)
+	if err != nil {
+		return c, err
+	}
+	if len(fields) < 2 {
+		return c, errors.New(gotext.Get("invalid connection %q: expected <name> <type> [<option>=<value>...]", line))
+	}
+
+	name, connType := fields[0], fields[1]
+	if !connectionNameRegexp.MatchString(name) {
+		return c, errors.New(gotext.Get("invalid connection name %q", name))
+	}
+	if !slices.Contains(connectionTypes, connType) {
+		return c, errors.New(gotext.Get("unsupported type %q for connection %q: expected one of %s", connType, name, strings.Join(connectionTypes, ", ")))
+	}
+
+	options := make(map[string]string)
+	var raw [][2]string
+	for _, f := range fields[2:] {
+		k, v, found := strings.Cut(f, "=")
+		if !found || k == "" {
+			return c, errors.New(gotext.Get("invalid option %q for connection %q: expected <option>=<value>", f, name))
+		}
+		if strings.Contains(k, ".") {
+			raw = append(raw, [2]string{k, v})
+			continue
+		}
+		options[k] = v
+	}
+
+	kf := keyfile{}
+	kf.set("connection", "id", name)
+	kf.set("connection", "uuid", uuid.NewSHA1(uuidNamespace, []byte(owner+"/"+name)).String())
+	kf.set("connection", "type", connType)
+	if v, ok := options["autoconnect"]; ok {
+		if v != "true" && v != "false" {
+			return c, errors.New(gotext.Get("invalid autoconnect value %q for connection %q: expected true or false", v, name))
+		}
+		kf.set("connection", "autoconnect", v)
+		delete(options, "autoconnect")
+	}
+	if owner != "" {
+		kf.set("connection", "permissions", "user:"+owner+";")
+	}
+
+	if err := setConnectionType(&kf, name, connType, options); err != nil {
+		return c, err
+	}
+	if err := setSecurity(&kf, name, connType, options, stateDir); err != nil {
+		return c, err
+	}
+
+	if len(options) > 0 {
+		return c, errors.New(gotext.Get("unsupported option %q for connection %q", slices.Sorted(maps.Keys(options))[0], name))
+	}
+
+	if connType != "vpn" {
+		kf.set("ipv4", "method", "auto")
+		kf.set("ipv6", "method", "auto")
+	}
+
+	// Raw settings are applied last, to override the generated ones.
+	for _, kv := range raw {
+		sectionName, key, _ := strings.Cut(kv[0], ".")
+		if !settingRegexp.MatchString(sectionName) || !settingRegexp.MatchString(key) {
+			return c, errors.New(gotext.Get("invalid setting %q for connection %q", kv[0], name))
+		}
+		if slices.Contains(reservedSettings, kv[0]) {
+			return c, errors.New(gotext.Get("setting %q of connection %q is managed by adsys and can't be overridden", kv[0], name))
+		}
+		kf.set(sectionName, key, kv[1])
+	}
+
+	return connection{name: name, content: kf.String()}, nil
+}
+
+// setConnectionType sets the settings specific to the connection type and consumes the related options.
+func setConnectionType(kf *keyfile, name, connType string, options map[string]string) error {
+	switch connType {
+	case "wifi":
+		ssid := options["ssid"]
+		if ssid == "" {
+			return errors.New(gotext.Get("missing ssid for wifi connection %q", name))
+		}
+		kf.set("wifi", "mode", "infrastructure")
+		kf.set("wifi", "ssid", ssid)
+		if v, ok := options["hidden"]; ok {
+			if v != "true" && v != "false" {
+				return errors.New(gotext.Get("invalid hidden value %q for connection %q: expected true or false", v, name))
+			}
+			kf.set("wifi", "hidden", v)
+		}
+		delete(options, "ssid")
+		delete(options, "hidden")
+	case "vpn":
+		service := options["service"]
+		if service == "" {
+			return errors.New(gotext.Get("missing service for vpn connection %q", name))
+		}
+		// Short plugin names, like openvpn, are expanded to the D-Bus service name.
+		if !strings.Contains(service, ".") {
+			service = "org.freedesktop.NetworkManager." + service
+		}
+		kf.set("vpn", "service-type", service)
+		delete(options, "service")
+	}
+	return nil
+}
+
+// setSecurity sets the wifi-security and 802-1x settings and consumes the related options.
+// Certificates can reference certificates enrolled by the certificate manager by name, or be absolute paths.
+func setSecurity(kf *keyfile, name, connType string, options map[string]string, stateDir string) error {
+	security := options["security"]
+	delete(options, "security")
+	if security == "" {
+		security = "none"
+	}
+	if !slices.Contains(securityTypes, security) {
+		return errors.New(gotext.Get("unsupported security %q for connection %q: expected one of %s", security, name, strings.Join(securityTypes, ", ")))
+	}
+	if security != "none" && connType == "vpn" {
+		return errors.New(gotext.Get("security %q is not supported for vpn connection %q", security, name))
+	}
+
+	switch security {
+	case "none":
+		return nil
+	case "wpa-psk":
+		if connType != "wifi" {
+			return errors.New(gotext.Get("security %q is only supported for wifi connections, got %q for %q", security, connType, name))
+		}
+		psk := options["psk"]
+		if len(psk) < 8 || len(psk) > 64 {
+			return errors.New(gotext.Get("invalid psk for connection %q: expected 8 to 64 characters", name))
+		}
+		kf.set("wifi-security", "key-mgmt", "wpa-psk")
+		kf.set("wifi-security", "psk", psk)
+		delete(options, "psk")
+		return nil
+	}
+
+	// 802.1X methods
+	if connType == "wifi" {
+		kf.set("wifi-security", "key-mgmt", "wpa-eap")
+	}
+
+	identity := options["identity"]
+	if identity == "" {
+		return errors.New(gotext.Get("missing identity for 802.1X connection %q", name))
+	}
+	kf.set("802-1x", "eap", strings.TrimPrefix(security, "eap-")+";")
+	kf.set("802-1x", "identity", identity)
+	delete(options, "identity")
+
+	if ca := options["ca-cert"]; ca != "" {
+		kf.set("802-1x", "ca-cert", certPath(ca, stateDir))
+	}
+	if v := options["domain-suffix-match"]; v != "" {
+		kf.set("802-1x", "domain-suffix-match", v)
+	}
+	delete(options, "ca-cert")
+	delete(options, "domain-suffix-match")
+
+	if security == "eap-tls" {
+		clientCert := options["client-cert"]
+		if clientCert == "" {
+			return errors.New(gotext.Get("missing client-cert for eap-tls connection %q", name))
+		}
+		kf.set("802-1x", "client-cert", certPath(clientCert, stateDir))
+		privateKey := options["private-key"]
+		if privateKey == "" && !filepath.IsAbs(clientCert) {
+			privateKey = certificate.PrivateKeyPath(stateDir, clientCert)
+		}
+		if privateKey == "" {
+			return errors.New(gotext.Get("missing private-key for eap-tls connection %q", name))
+		}
+		kf.set("802-1x", "private-key", privateKey)
+		// Enrolled private keys are not encrypted.
+		kf.set("802-1x", "private-key-password-flags", "4")
+		delete(options, "client-cert")
+		delete(options, "private-key")
+		return nil
+	}
+
+	// PEAP and TTLS use MSCHAPv2 as the inner authentication.
+	password := options["password"]
+	if password == "" {
+		return errors.New(gotext.Get("missing password for %s connection %q", security, name))
+	}
+	kf.set("802-1x", "phase2-auth", "mschapv2")
+	kf.set("802-1x", "password", password)
+	delete(options, "password")
+	return nil
+}
+
+// certPath returns the path of a certificate, which is either an absolute path or the name of a
+// certificate enrolled by the certificate manager.
+func certPath(cert, stateDir string) string {
+	if filepath.IsAbs(cert) {
+		return cert
+	}
+	return certificate.CertificatePath(stateDir, cert)
+}
+
+// splitFields splits a line on whitespaces. Double quotes can be used to include whitespaces in a field.
+func splitFields(line string) (fields []string, err error) {
+	var b strings.Builder
+	var inQuotes, inField bool
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inField = true
+		case !inQuotes && (r == ' ' || r == '\t'):
+			if inField {
+				fields = append(fields, b.String())
+				b.Reset()
+				inField = false
+			}
+		default:
+			b.WriteRune(r)
+			inField = true
+		}
+	}
+	if inQuotes {
+		return nil, errors.New(gotext.Get("unterminated quote in %q", line))
+	}
+	if inField {
+		fields = append(fields, b.String())
+	}
+	return fields, nil
+}
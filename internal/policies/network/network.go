@@ -0,0 +1,329 @@
+// Package network provides a manager to deploy NetworkManager connection profiles.
+//
+// Connections are deployed per computer (network/connections-machine) or per user
+// (network/connections-user). Each line of the entry describes a connection in the form:
+//
+//	<name> <type> [<option>=<value>...]
+//
+// Supported types are wifi, ethernet and vpn. Values containing spaces can be enclosed in double quotes.
+// Supported options are:
+//   - autoconnect: true or false;
+//   - ssid and hidden, for wifi connections;
+//   - service, the VPN plugin, like openvpn, for vpn connections;
+//   - security: none, wpa-psk (with psk), or the 802.1X methods eap-tls, peap and ttls (with identity,
+//     ca-cert, domain-suffix-match, client-cert and private-key for eap-tls, password for peap and ttls).
+//
+// Certificates can be the name of a certificate enrolled by the certificate manager, like
+// "example-CA.Machine", or an absolute path. The private key of an enrolled client certificate is found
+// automatically.
+// Any other keyfile setting can be set with <section>.<key>=<value>, like ipv4.dns-search=example.com
+// or vpn.remote=vpn.example.com.
+//
+// Connections are written as NetworkManager keyfiles in the system connections directory. User
+// connections are restricted to the user they are deployed for.
+//
+// The connections created by adsys are tracked per object in the state directory, so that only those are
+// removed once they are not referenced anymore. NetworkManager is asked to reload its connections over
+// D-Bus when they changed.
+package network
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+// Caller is the interface to call a method on a D-Bus object.
+type Caller interface {
+	Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call
+}
+
+const (
+	machineConnectionsKey = "network/connections-machine"
+	userConnectionsKey    = "network/connections-user"
+
+	// machineStateFile is the state file name of the connections deployed for the computer.
+	machineStateFile = "machine"
+	// usersStateDir is the state directory of the connections deployed for users.
+	usersStateDir = "users"
+
+	// errDBusServiceUnknownName is the error name returned by D-Bus when NetworkManager is not running.
+	errDBusServiceUnknownName = "org.freedesktop.DBus.Error.ServiceUnknown"
+)
+
+// Manager prevents writing connections concurrently while applying the policy.
+type Manager struct {
+	stateDir       string
+	certsStateDir  string
+	connectionsDir string
+	settings       Caller
+
+	mu sync.Mutex
+}
+
+type options struct {
+	stateDir       string
+	connectionsDir string
+	settings       Caller
+}
+
+// Option reprents an optional function to change the network manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) Option {
+	return func(o *options) {
+		o.stateDir = p
+	}
+}
+
+// WithConnectionsDir overrides the default NetworkManager system connections directory.
+func WithConnectionsDir(p string) Option {
+	return func(o *options) {
+		o.connectionsDir = p
+	}
+}
+
+// WithSettingsCaller overrides the default NetworkManager settings D-Bus object.
+func WithSettingsCaller(c Caller) Option {
+	return func(o *options) {
+		o.settings = c
+	}
+}
+
+// New returns a new manager for the network policy.
+func New(bus *dbus.Conn, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:       consts.DefaultStateDir,
+		connectionsDir: consts.DefaultNetworkConnectionsDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	if args.settings == nil {
+		args.settings = bus.Object("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager/Settings")
+	}
+
+	return &Manager{
+		stateDir:       filepath.Join(args.stateDir, "network"),
+		certsStateDir:  args.stateDir,
+		connectionsDir: args.connectionsDir,
+		settings:       args.settings,
+	}
+}
+
+// ApplyPolicy writes the connections of the object, removes the ones previously deployed for it
+// and not referenced anymore, and reloads NetworkManager connections if anything changed.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply network policy to %s", objectName))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying network policy to %s", objectName)
+
+	key, owner, prefix := machineConnectionsKey, "", "adsys-machine-"
+	statePath := filepath.Join(m.stateDir, machineStateFile)
+	if !isComputer {
+		key, owner, prefix = userConnectionsKey, objectName, fmt.Sprintf("adsys-%s-", objectName)
+		statePath = filepath.Join(m.stateDir, usersStateDir, objectName)
+	}
+
+	connections, err := m.parseEntries(entries, key, owner)
+	if err != nil {
+		return err
+	}
+
+	owned, err := readState(statePath)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to deploy and nothing to remove.
+	if len(connections) == 0 && len(owned) == 0 {
+		return nil
+	}
+
+	// Always save the connections we own, even on partial failure, so that they can be removed later on.
+	state := slices.Clone(owned)
+	defer func() {
+		if errSave := saveState(statePath, state); errSave != nil {
+			err = errors.Join(err, errSave)
+		}
+	}()
+
+	var changed bool
+	var wanted []string
+	for _, c := range connections {
+		fileName := prefix + c.name + ".nmconnection"
+		if !slices.Contains(state, fileName) {
+			state = append(state, fileName)
+		}
+		wanted = append(wanted, fileName)
+
+		updated, err := writeIfChanged(filepath.Join(m.connectionsDir, fileName), c.content)
+		if err != nil {
+			return err
+		}
+		if updated {
+			log.Infof(ctx, "Deploying network connection %q", c.name)
+			changed = true
+		}
+	}
+
+	for _, fileName := range owned {
+		if slices.Contains(wanted, fileName) {
+			continue
+		}
+		log.Infof(ctx, "Removing network connection file %q", fileName)
+		if err := os.Remove(filepath.Join(m.connectionsDir, fileName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		state = slices.DeleteFunc(state, func(n string) bool { return n == fileName })
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return m.reload(ctx)
+}
+
+// parseEntries returns the connections to deploy from the entries matching key.
+// When a connection is defined multiple times, the closest GPO wins. Disabled entries are ignored.
+func (m *Manager) parseEntries(entries []entry.Entry, key, owner string) (connections []connection, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse network entries"))
+
+	for _, e := range entries {
+		if e.Disabled || e.Key != key {
+			continue
+		}
+		if e.Err != nil {
+			return nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		for _, line := range strings.Split(e.Value, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			c, err := parseConnection(line, owner, m.certsStateDir)
+			if err != nil {
+				return nil, err
+			}
+			connections = append(connections, c)
+		}
+	}
+
+	return entry.KeepClosest(connections, func(c connection) string { return c.name }, nil), nil
+}
+
+// reload asks NetworkManager to reload the connections from disk.
+// It only warns if NetworkManager is not running.
+func (m *Manager) reload(ctx context.Context) error {
+	log.Debug(ctx, "Reloading NetworkManager connections")
+
+	if err := m.settings.Call("org.freedesktop.NetworkManager.Settings.ReloadConnections", 0).Err; err != nil {
+		var dbusErr dbus.Error
+		if errors.As(err, &dbusErr) && dbusErr.Name == errDBusServiceUnknownName {
+			log.Warning(ctx, gotext.Get("Not reloading network connections as NetworkManager is not running: %s", dbusErr.Error()))
+			return nil
+		}
+		return errors.New(gotext.Get("failed to reload NetworkManager connections: %v", err))
+	}
+	return nil
+}
+
+// writeIfChanged atomically writes content to p if it differs from the current content.
+// It returns true if the file was written.
+func writeIfChanged(p, content string) (changed bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write connection file %q", p))
+
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return false, nil
+	}
+
+	// #nosec G301 - /etc/NetworkManager/system-connections permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	// NetworkManager ignores connection files readable by other users, and they can contain secrets.
+	if err := os.WriteFile(p+".new", []byte(content), 0600); err != nil {
+		return false, err
+	}
+	if err := os.Rename(p+".new", p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readState returns the connection files listed in the state file.
+// A missing state file means no connection is owned.
+func readState(p string) (names []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't read network state %q", p))
+
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if n := strings.TrimSpace(scanner.Text()); n != "" {
+			names = append(names, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// saveState atomically writes the connection files owned by an object.
+// The state file is removed if there are no connections to track.
+func saveState(p string, names []string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save network state %q", p))
+
+	if len(names) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	names = slices.Clone(names)
+	slices.Sort(names)
+	var content strings.Builder
+	for _, n := range names {
+		fmt.Fprintln(&content, n)
+	}
+	if err := os.WriteFile(p+".new", []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,202 @@
+package network_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/network"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultMachineEntries := []entry.Entry{
+		{Key: "network/connections-machine", Value: `corp-wifi wifi ssid="Corp WiFi" security=eap-tls identity=host/workstation.example.com ca-cert=example-CA.1 client-cert=example-CA.Machine
+corp-wired ethernet security=eap-tls identity=host/workstation.example.com ca-cert=/etc/ssl/certs/corp-ca.pem client-cert=/etc/ssl/certs/host.pem private-key=/etc/ssl/private/host.key autoconnect=true`},
+	}
+	defaultUserEntries := []entry.Entry{
+		{Key: "network/connections-user", Value: "corp-vpn vpn service=openvpn vpn.remote=vpn.example.com vpn.connection-type=tls autoconnect=false"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		fileInPlaceOf string
+		reloadError   string
+
+		wantReload bool
+		wantErr    bool
+	}{
+		// Machine cases
+		"Computer, deploy connections":                   {wantReload: true},
+		"Computer, wpa-psk wifi connection":              {entries: []entry.Entry{{Key: "network/connections-machine", Value: "guest wifi ssid=Guest security=wpa-psk psk=guestpassword hidden=true"}}, wantReload: true},
+		"Computer, peap wifi connection":                 {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp-peap wifi ssid=Corp security=peap identity=bob password=secret ca-cert=example-CA.1 domain-suffix-match=radius.example.com"}}, wantReload: true},
+		"Computer, ttls wired connection":                {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp-ttls ethernet security=ttls identity=bob password=secret"}}, wantReload: true},
+		"Computer, open connection":                      {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open wifi ssid=Open security=none"}}, wantReload: true},
+		"Computer, vpn with full service name":           {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp-vpn vpn service=org.freedesktop.NetworkManager.wireguard"}}, wantReload: true},
+		"Computer, raw settings override generated ones": {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp-wired ethernet ipv4.method=manual ipv4.address1=10.0.0.2/24 connection.id=\"Corp wired\""}}, wantReload: true},
+		"Computer, closest GPO definition wins": {entries: uniqueEntries(
+			[]entry.Entry{{Key: "network/connections-machine", Value: "open wifi ssid=Closest", Strategy: entry.StrategyAppend}},
+			[]entry.Entry{{Key: "network/connections-machine", Value: "open wifi ssid=Furthest\n\n  guest wifi ssid=Guest security=none", Strategy: entry.StrategyAppend}},
+		), wantReload: true},
+		"Computer, disabled entries are ignored":            {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open wifi ssid=Open", Disabled: true}}},
+		"Computer, user entries are ignored":                {entries: defaultUserEntries},
+		"Computer, remove connections not deployed anymore": {existingState: "machine", wantReload: true},
+		"Computer, no entries removes deployed connections": {entries: []entry.Entry{}, existingState: "machine", wantReload: true},
+		"Computer, unchanged connections don't reload":      {existingState: "machine_up_to_date"},
+		"Computer, no entries and no state":                 {entries: []entry.Entry{}},
+		"Computer, NetworkManager not running only warns":   {reloadError: "no service", wantReload: true},
+		"Computer, user connections are kept":               {existingState: "user", wantReload: true},
+
+		// User cases
+		"User, deploy connections":                      {isUser: true, wantReload: true},
+		"User, machine entries are ignored":             {isUser: true, entries: defaultMachineEntries},
+		"User, no entries removes deployed connections": {isUser: true, entries: []entry.Entry{}, existingState: "user", wantReload: true},
+		"User, machine connections are kept":            {isUser: true, existingState: "machine", wantReload: true},
+
+		// Error cases
+		"Error on errored entry":                              {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open wifi ssid=Open", Err: errors.New("some error")}}, wantErr: true},
+		"Error on missing type":                               {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open"}}, wantErr: true},
+		"Error on invalid connection name":                    {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open/1 wifi ssid=Open"}}, wantErr: true},
+		"Error on unsupported type":                           {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open bluetooth"}}, wantErr: true},
+		"Error on unterminated quote":                         {entries: []entry.Entry{{Key: "network/connections-machine", Value: `open wifi ssid="Open`}}, wantErr: true},
+		"Error on option without value":                       {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open wifi ssid"}}, wantErr: true},
+		"Error on unsupported option":                         {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open wifi ssid=Open channel=6"}}, wantErr: true},
+		"Error on invalid autoconnect":                        {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open wifi ssid=Open autoconnect=maybe"}}, wantErr: true},
+		"Error on invalid hidden":                             {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open wifi ssid=Open hidden=maybe"}}, wantErr: true},
+		"Error on missing ssid":                               {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open wifi"}}, wantErr: true},
+		"Error on missing vpn service":                        {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp-vpn vpn"}}, wantErr: true},
+		"Error on unsupported security":                       {entries: []entry.Entry{{Key: "network/connections-machine", Value: "open wifi ssid=Open security=wep"}}, wantErr: true},
+		"Error on security for vpn":                           {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp-vpn vpn service=openvpn security=peap"}}, wantErr: true},
+		"Error on wpa-psk for ethernet":                       {entries: []entry.Entry{{Key: "network/connections-machine", Value: "wired ethernet security=wpa-psk psk=guestpassword"}}, wantErr: true},
+		"Error on too short psk":                              {entries: []entry.Entry{{Key: "network/connections-machine", Value: "guest wifi ssid=Guest security=wpa-psk psk=short"}}, wantErr: true},
+		"Error on missing identity":                           {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp wifi ssid=Corp security=peap password=secret"}}, wantErr: true},
+		"Error on missing client certificate":                 {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp wifi ssid=Corp security=eap-tls identity=host"}}, wantErr: true},
+		"Error on missing private key with client cert path":  {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp wifi ssid=Corp security=eap-tls identity=host client-cert=/etc/ssl/certs/host.pem"}}, wantErr: true},
+		"Error on missing password":                           {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp wifi ssid=Corp security=ttls identity=bob"}}, wantErr: true},
+		"Error on invalid raw setting":                        {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp-vpn vpn service=openvpn vpn.re/mote=vpn.example.com"}}, wantErr: true},
+		"Error on reserved raw setting":                       {entries: []entry.Entry{{Key: "network/connections-machine", Value: "corp-vpn vpn service=openvpn connection.permissions=user:bob;"}}, wantErr: true},
+		"Error on reload failing, state is kept":              {reloadError: "failed", wantReload: true, wantErr: true},
+		"Error on connections directory being a file":         {fileInPlaceOf: "etc/NetworkManager/system-connections", wantErr: true},
+		"Error on state directory being a file":               {fileInPlaceOf: "var/lib/adsys/network", wantErr: true},
+		"Error on connections file to remove being directory": {entries: []entry.Entry{}, existingState: "machine_remove_fails", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultMachineEntries
+				if tc.isUser {
+					tc.entries = defaultUserEntries
+				}
+			}
+
+			rootDir := t.TempDir()
+			stateDir := filepath.Join(rootDir, "var", "lib", "adsys")
+			connectionsDir := filepath.Join(rootDir, "etc", "NetworkManager", "system-connections")
+
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState, "state"), filepath.Join(stateDir, "network"))
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState, "connections"), connectionsDir)
+				replaceInConnections(t, connectionsDir, "#STATEDIR#", stateDir)
+			}
+			if tc.fileInPlaceOf != "" {
+				require.NoError(t, os.RemoveAll(filepath.Join(rootDir, tc.fileInPlaceOf)), "Setup: can't remove existing file")
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(rootDir, tc.fileInPlaceOf)), 0750), "Setup: can't create parent directory")
+				testutils.WriteFile(t, filepath.Join(rootDir, tc.fileInPlaceOf), []byte("not a directory"), 0600)
+			}
+
+			settings := &mockSettings{reloadError: tc.reloadError}
+			m := network.New(nil,
+				network.WithStateDir(stateDir),
+				network.WithConnectionsDir(connectionsDir),
+				network.WithSettingsCaller(settings),
+			)
+
+			err := m.ApplyPolicy(context.Background(), "bob@example.com", !tc.isUser, tc.entries)
+			require.Equal(t, tc.wantReload, settings.reloaded, "NetworkManager connections reload should match")
+			if tc.wantErr {
+				// We don't return here as we want to check that the state
+				// is saved even in error cases.
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				if tc.fileInPlaceOf != "" {
+					return
+				}
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			// Replace the state directory with a placeholder to avoid non-deterministic test failures
+			replaceInConnections(t, connectionsDir, stateDir, "#STATEDIR#")
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// replaceInConnections replaces old with new in all connection files of dir.
+func replaceInConnections(t *testing.T, dir, old, new string) {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.nmconnection"))
+	require.NoError(t, err, "Setup: can't list connection files")
+	for _, f := range files {
+		if info, err := os.Stat(f); err != nil || info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(f)
+		require.NoError(t, err, "Setup: can't read connection file")
+		err = os.WriteFile(f, []byte(strings.ReplaceAll(string(data), old, new)), 0600)
+		require.NoError(t, err, "Setup: can't write connection file")
+	}
+}
+
+// mockSettings is a mock for the NetworkManager settings object.
+type mockSettings struct {
+	reloadError string
+
+	reloaded bool
+}
+
+// Call mocks the ReloadConnections call.
+func (s *mockSettings) Call(method string, _ dbus.Flags, _ ...interface{}) *dbus.Call {
+	if method != "org.freedesktop.NetworkManager.Settings.ReloadConnections" {
+		return &dbus.Call{Err: errors.New("unexpected method " + method)}
+	}
+	s.reloaded = true
+
+	switch s.reloadError {
+	case "failed":
+		return &dbus.Call{Err: dbus.MakeFailedError(errors.New("reload error"))}
+	case "no service":
+		return &dbus.Call{Err: dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown", Body: []interface{}{"The name org.freedesktop.NetworkManager was not provided by any .service files"}}}
+	}
+	return &dbus.Call{}
+}
+
+// uniqueEntries returns the network entries of GPOs, listed from the closest to the furthest, as merged
+// by the policies manager.
+func uniqueEntries(gposEntries ...[]entry.Entry) []entry.Entry {
+	var pols policies.Policies
+	for i, entries := range gposEntries {
+		pols.GPOs = append(pols.GPOs, policies.GPO{
+			ID:    fmt.Sprintf("{GPO%d}", i),
+			Name:  fmt.Sprintf("GPO%d", i),
+			Rules: map[string][]entry.Entry{"network": entries},
+		})
+	}
+	return pols.GetUniqueRules()["network"]
+}
@@ -0,0 +1,410 @@
+// Package packages provides a manager to install, remove and hold Debian packages on the client.
+//
+// This manager only applies to computer objects.
+//
+// The policy is made of 3 lists of packages:
+//   - install-packages: packages to install if they are not already installed;
+//   - remove-packages: packages to remove if they are installed;
+//   - hold-packages: packages to mark as held, so that they are not upgraded.
+//
+// The manager keeps track, in its state directory, of the packages that it installed and held itself.
+// When a package is no longer referenced by the policy, only the packages installed or held by adsys
+// are reverted (removed or unheld). Packages which were already installed or held by the local
+// administrator are never touched on revert. Removed packages are not reinstalled when the policy is unset.
+//
+// Should the package manager binaries be missing while there are entries to apply, or should any
+// package operation fail, an error is returned and authentication will be prevented.
+package packages
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/smbsafe"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	installKey = "install-packages"
+	removeKey  = "remove-packages"
+	holdKey    = "hold-packages"
+
+	installedStateFile = "installed"
+	heldStateFile      = "held"
+)
+
+// packageNameRegexp matches valid Debian package names, with an optional architecture qualifier.
+var packageNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+(:[a-z0-9-]+)?$`)
+
+// Manager prevents running multiple package operations in parallel while applying the policy.
+type Manager struct {
+	stateDir     string
+	aptGetCmd    []string
+	aptMarkCmd   []string
+	dpkgQueryCmd []string
+
+	mu sync.Mutex // Prevents multiple instances of the package manager from running concurrently
+}
+
+type options struct {
+	stateDir     string
+	aptGetCmd    []string
+	aptMarkCmd   []string
+	dpkgQueryCmd []string
+}
+
+// Option reprents an optional function to change the packages manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) Option {
+	return func(o *options) {
+		o.stateDir = p
+	}
+}
+
+// WithAptGetCmd overrides the default apt-get command.
+func WithAptGetCmd(cmd []string) Option {
+	return func(o *options) {
+		o.aptGetCmd = cmd
+	}
+}
+
+// WithAptMarkCmd overrides the default apt-mark command.
+func WithAptMarkCmd(cmd []string) Option {
+	return func(o *options) {
+		o.aptMarkCmd = cmd
+	}
+}
+
+// WithDpkgQueryCmd overrides the default dpkg-query command.
+func WithDpkgQueryCmd(cmd []string) Option {
+	return func(o *options) {
+		o.dpkgQueryCmd = cmd
+	}
+}
+
+// New returns a new manager for the packages policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:     consts.DefaultStateDir,
+		aptGetCmd:    []string{"apt-get"},
+		aptMarkCmd:   []string{"apt-mark"},
+		dpkgQueryCmd: []string{"dpkg-query"},
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:     filepath.Join(args.stateDir, "packages"),
+		aptGetCmd:    args.aptGetCmd,
+		aptMarkCmd:   args.aptMarkCmd,
+		dpkgQueryCmd: args.dpkgQueryCmd,
+	}
+}
+
+// ApplyPolicy installs, removes and holds the packages listed in entries.
+// Packages previously installed or held by adsys which are not referenced anymore are reverted.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply packages policy to %s", objectName))
+
+	// Package management is only supported on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying packages policy to %s", objectName)
+
+	wanted, err := parseEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	managedInstalled, err := m.readState(installedStateFile)
+	if err != nil {
+		return err
+	}
+	managedHeld, err := m.readState(heldStateFile)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply and nothing to revert.
+	if len(wanted[installKey]) == 0 && len(wanted[removeKey]) == 0 && len(wanted[holdKey]) == 0 &&
+		len(managedInstalled) == 0 && len(managedHeld) == 0 {
+		return nil
+	}
+
+	// No point in continuing if the package manager isn't available.
+	for _, cmd := range [][]string{m.aptGetCmd, m.aptMarkCmd, m.dpkgQueryCmd} {
+		if _, err := exec.LookPath(cmd[0]); err != nil {
+			return errors.New(gotext.Get("package manager is not available on this system: %v", err))
+		}
+	}
+
+	// Always save what we managed to do, even partially, so that we can revert it later on.
+	defer func() {
+		if errSave := m.saveState(installedStateFile, managedInstalled); errSave != nil {
+			err = errors.Join(err, errSave)
+		}
+		if errSave := m.saveState(heldStateFile, managedHeld); errSave != nil {
+			err = errors.Join(err, errSave)
+		}
+	}()
+
+	// Unhold first the packages we held but that are not requested anymore, so that they can be
+	// removed or upgraded afterwards.
+	toUnhold := difference(managedHeld, wanted[holdKey])
+	if len(toUnhold) > 0 {
+		log.Infof(ctx, "Unholding packages: %s", strings.Join(toUnhold, ", "))
+		if err := m.run(ctx, slices.Concat(m.aptMarkCmd, []string{"unhold"}, toUnhold)); err != nil {
+			return err
+		}
+		managedHeld = difference(managedHeld, toUnhold)
+	}
+
+	// Remove packages we installed and that are not requested anymore, and packages requested to be removed.
+	toRemove := difference(managedInstalled, wanted[installKey])
+	for _, p := range wanted[removeKey] {
+		if slices.Contains(toRemove, p) {
+			continue
+		}
+		installed, err := m.isInstalled(ctx, p)
+		if err != nil {
+			return err
+		}
+		if !installed {
+			continue
+		}
+		toRemove = append(toRemove, p)
+	}
+	if len(toRemove) > 0 {
+		log.Infof(ctx, "Removing packages: %s", strings.Join(toRemove, ", "))
+		if err := m.run(ctx, slices.Concat(m.aptGetCmd, []string{"remove", "-y", "-q"}, toRemove)); err != nil {
+			return err
+		}
+		managedInstalled = difference(managedInstalled, toRemove)
+	}
+
+	// Install missing packages, only tracking the ones we installed ourselves.
+	var toInstall []string
+	for _, p := range wanted[installKey] {
+		if slices.Contains(managedInstalled, p) {
+			continue
+		}
+		installed, err := m.isInstalled(ctx, p)
+		if err != nil {
+			return err
+		}
+		if installed {
+			log.Debugf(ctx, "Package %q is already installed on the system, not managing it", p)
+			continue
+		}
+		toInstall = append(toInstall, p)
+	}
+	if len(toInstall) > 0 {
+		log.Infof(ctx, "Installing packages: %s", strings.Join(toInstall, ", "))
+		if err := m.run(ctx, slices.Concat(m.aptGetCmd, []string{"install", "-y", "-q"}, toInstall)); err != nil {
+			return err
+		}
+		managedInstalled = append(managedInstalled, toInstall...)
+	}
+
+	// Hold packages, only tracking the ones that were not already held on the system.
+	alreadyHeld, err := m.heldPackages(ctx)
+	if err != nil {
+		return err
+	}
+	var toHold []string
+	for _, p := range wanted[holdKey] {
+		if slices.Contains(managedHeld, p) || slices.Contains(alreadyHeld, p) {
+			continue
+		}
+		toHold = append(toHold, p)
+	}
+	if len(toHold) > 0 {
+		log.Infof(ctx, "Holding packages: %s", strings.Join(toHold, ", "))
+		if err := m.run(ctx, slices.Concat(m.aptMarkCmd, []string{"hold"}, toHold)); err != nil {
+			return err
+		}
+		managedHeld = append(managedHeld, toHold...)
+	}
+
+	return nil
+}
+
+// parseEntries returns the list of packages for each supported key, deduplicated and validated.
+// Disabled entries are ignored.
+func parseEntries(entries []entry.Entry) (wanted map[string][]string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse packages entries"))
+
+	wanted = make(map[string][]string)
+	for _, e := range entries {
+		if !slices.Contains([]string{installKey, removeKey, holdKey}, e.Key) {
+			continue
+		}
+		if e.Disabled {
+			continue
+		}
+		if e.Err != nil {
+			return nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		for _, p := range strings.FieldsFunc(e.Value, func(r rune) bool { return r == '\n' || r == ',' || r == ' ' }) {
+			if !packageNameRegexp.MatchString(p) {
+				return nil, errors.New(gotext.Get("invalid package name %q", p))
+			}
+			if slices.Contains(wanted[e.Key], p) {
+				continue
+			}
+			wanted[e.Key] = append(wanted[e.Key], p)
+		}
+	}
+
+	for _, p := range wanted[installKey] {
+		if slices.Contains(wanted[removeKey], p) {
+			return nil, errors.New(gotext.Get("package %q is requested to be both installed and removed", p))
+		}
+	}
+
+	return wanted, nil
+}
+
+// isInstalled returns if the given package is installed on the system.
+func (m *Manager) isInstalled(ctx context.Context, pkg string) (bool, error) {
+	args := slices.Concat(m.dpkgQueryCmd, []string{"-W", "-f=${db:Status-Abbrev}", pkg})
+	// #nosec G204 - We are in control of the arguments
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	smbsafe.WaitExec()
+	out, err := cmd.Output()
+	smbsafe.DoneExec()
+	if err != nil {
+		var exitErr *exec.ExitError
+		// dpkg-query exits with 1 when the package is unknown.
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return false, nil
+		}
+		return false, errors.New(gotext.Get("failed to query status of package %q: %v", pkg, err))
+	}
+
+	// The first character is the desired action, like hold or reinstall: only the second one is the package status.
+	status := string(out)
+	return len(status) >= 2 && status[1] == 'i', nil
+}
+
+// heldPackages returns the list of packages currently held on the system.
+func (m *Manager) heldPackages(ctx context.Context) ([]string, error) {
+	args := slices.Concat(m.aptMarkCmd, []string{"showhold"})
+	// #nosec G204 - We are in control of the arguments
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	smbsafe.WaitExec()
+	out, err := cmd.Output()
+	smbsafe.DoneExec()
+	if err != nil {
+		return nil, errors.New(gotext.Get("failed to list held packages: %v", err))
+	}
+
+	return strings.Fields(string(out)), nil
+}
+
+// run executes the given package manager command non interactively.
+func (m *Manager) run(ctx context.Context, args []string) error {
+	if os.Getenv("ADSYS_SKIP_ROOT_CALLS") != "" {
+		return nil
+	}
+
+	// #nosec G204 - We are in control of the arguments
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+	smbsafe.WaitExec()
+	out, err := cmd.CombinedOutput()
+	smbsafe.DoneExec()
+	if err != nil {
+		return errors.New(gotext.Get("failed to run %q: %v\n%s", strings.Join(args, " "), err, string(out)))
+	}
+	return nil
+}
+
+// readState returns the list of packages stored in the given state file.
+// A missing state file means no package is managed.
+func (m *Manager) readState(name string) (pkgs []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't read packages state %q", name))
+
+	f, err := os.Open(filepath.Join(m.stateDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p := strings.TrimSpace(scanner.Text())
+		if p == "" {
+			continue
+		}
+		pkgs = append(pkgs, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return pkgs, nil
+}
+
+// saveState atomically writes the list of packages to the given state file.
+// The state file is removed if there are no packages to track.
+func (m *Manager) saveState(name string, pkgs []string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save packages state %q", name))
+
+	p := filepath.Join(m.stateDir, name)
+	if len(pkgs) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+
+	pkgs = slices.Clone(pkgs)
+	slices.Sort(pkgs)
+	if err := os.WriteFile(p+".new", []byte(fmt.Sprintf("%s\n", strings.Join(pkgs, "\n"))), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// difference returns the elements in `a` that aren't in `b`.
+func difference(a, b []string) []string {
+	var diff []string
+	for _, x := range a {
+		if slices.Contains(b, x) {
+			continue
+		}
+		diff = append(diff, x)
+	}
+	return diff
+}
@@ -0,0 +1,235 @@
+package packages_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/packages"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "install-packages", Value: "vim\nhtop"},
+		{Key: "remove-packages", Value: "telnet"},
+		{Key: "hold-packages", Value: "firefox"},
+	}
+
+	tests := map[string]struct {
+		entries []entry.Entry
+		isUser  bool
+
+		systemInstalled []string
+		systemHeld      []string
+		stateInstalled  []string
+		stateHeld       []string
+
+		noPackageManager bool
+		cmdError         string
+
+		wantErr bool
+	}{
+		"Computer, install, remove and hold packages":                             {systemInstalled: []string{"telnet", "firefox"}},
+		"Computer, already installed packages are not tracked":                    {systemInstalled: []string{"vim", "firefox"}},
+		"Computer, already held packages are not tracked":                         {systemInstalled: []string{"firefox"}, systemHeld: []string{"firefox"}},
+		"Computer, packages to remove are not installed":                          {entries: []entry.Entry{{Key: "remove-packages", Value: "telnet\nnano"}}},
+		"Computer, duplicated and whitespace separated packages":                  {entries: []entry.Entry{{Key: "install-packages", Value: " vim\n\nvim htop,curl "}}},
+		"Computer, package with architecture qualifier":                           {entries: []entry.Entry{{Key: "install-packages", Value: "libc6:i386"}}},
+		"Computer, disabled entries are ignored":                                  {entries: []entry.Entry{{Key: "install-packages", Value: "vim", Disabled: true}}},
+		"Computer, unknown keys are ignored":                                      {entries: []entry.Entry{{Key: "upgrade", Value: "vim"}}},
+		"Computer, previously installed packages still requested":                 {systemInstalled: []string{"vim", "htop", "telnet"}, stateInstalled: []string{"vim", "htop"}},
+		"Computer, previously installed packages no longer requested":             {entries: []entry.Entry{{Key: "install-packages", Value: "vim"}}, systemInstalled: []string{"vim", "htop"}, stateInstalled: []string{"vim", "htop"}},
+		"Computer, previously held packages no longer requested":                  {entries: []entry.Entry{}, systemInstalled: []string{"firefox"}, systemHeld: []string{"firefox"}, stateHeld: []string{"firefox"}},
+		"Computer, no entries reverts everything managed by adsys":                {entries: []entry.Entry{}, systemInstalled: []string{"vim", "htop", "firefox"}, systemHeld: []string{"firefox", "snapd"}, stateInstalled: []string{"vim", "htop"}, stateHeld: []string{"firefox"}},
+		"Computer, no entries and no state":                                       {entries: []entry.Entry{}},
+		"Computer, no entries, no state and no package manager":                   {entries: []entry.Entry{}, noPackageManager: true},
+		"Computer, packages held by the admin are installed":                      {systemInstalled: []string{"vim=hi", "telnet=hi"}},
+		"Computer, packages with only their configuration left are not installed": {systemInstalled: []string{"vim=rc", "telnet=rc"}},
+
+		// User cases
+		"User, entries are ignored": {isUser: true},
+
+		// Error cases
+		"Error on invalid package name":                        {entries: []entry.Entry{{Key: "install-packages", Value: "vim\nInvalid_Name"}}, wantErr: true},
+		"Error on package to install and remove":               {entries: []entry.Entry{{Key: "install-packages", Value: "vim"}, {Key: "remove-packages", Value: "vim"}}, wantErr: true},
+		"Error on errored entry":                               {entries: []entry.Entry{{Key: "install-packages", Value: "vim", Err: fmt.Errorf("some error")}}, wantErr: true},
+		"Error on missing package manager with entries":        {noPackageManager: true, wantErr: true},
+		"Error on missing package manager with state to clean": {entries: []entry.Entry{}, stateInstalled: []string{"vim"}, noPackageManager: true, wantErr: true},
+		"Error on install failing, state is kept":              {systemInstalled: []string{"vim", "telnet", "curl"}, stateInstalled: []string{"vim", "curl"}, cmdError: "install", wantErr: true},
+		"Error on remove failing":                              {systemInstalled: []string{"telnet"}, cmdError: "remove", wantErr: true},
+		"Error on hold failing":                                {systemInstalled: []string{"telnet"}, cmdError: "hold", wantErr: true},
+		"Error on unhold failing":                              {entries: []entry.Entry{}, systemHeld: []string{"firefox"}, stateHeld: []string{"firefox"}, cmdError: "unhold", wantErr: true},
+		"Error on listing held packages failing":               {cmdError: "showhold", wantErr: true},
+		"Error on querying package status failing":             {cmdError: "-W", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			stateDir := filepath.Join(rootDir, "var", "lib", "adsys")
+			systemDir := filepath.Join(rootDir, "system")
+
+			writeList(t, filepath.Join(systemDir, "installed"), tc.systemInstalled)
+			writeList(t, filepath.Join(systemDir, "held"), tc.systemHeld)
+			writeList(t, filepath.Join(stateDir, "packages", "installed"), tc.stateInstalled)
+			writeList(t, filepath.Join(stateDir, "packages", "held"), tc.stateHeld)
+
+			aptGetCmd := mockPackageCmd(t, systemDir, "apt-get", tc.cmdError)
+			aptMarkCmd := mockPackageCmd(t, systemDir, "apt-mark", tc.cmdError)
+			dpkgQueryCmd := mockPackageCmd(t, systemDir, "dpkg-query", tc.cmdError)
+			if tc.noPackageManager {
+				aptGetCmd = []string{"this-definitely-does-not-exist"}
+			}
+
+			m := packages.New(
+				packages.WithStateDir(stateDir),
+				packages.WithAptGetCmd(aptGetCmd),
+				packages.WithAptMarkCmd(aptMarkCmd),
+				packages.WithDpkgQueryCmd(dpkgQueryCmd),
+			)
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				// We don't return here as we want to check that the state
+				// is saved even in error cases.
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func writeList(t *testing.T, path string, content []string) {
+	t.Helper()
+
+	if content == nil {
+		return
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700), "Setup: can't create parent directory")
+	err := os.WriteFile(path, []byte(strings.Join(content, "\n")+"\n"), 0600)
+	require.NoError(t, err, "Setup: can't write list file")
+}
+
+func mockPackageCmd(t *testing.T, systemDir, name, failOn string) []string {
+	t.Helper()
+
+	if failOn == "" {
+		failOn = "none"
+	}
+	return []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockPackageCmd", "--", systemDir, name, failOn}
+}
+
+// TestMockPackageCmd simulates apt-get, apt-mark and dpkg-query.
+// The installed and held packages of the system are stored in files of the system directory.
+// Every modifying call is recorded in the calls file of the system directory.
+func TestMockPackageCmd(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] != "--" {
+			args = args[1:]
+			continue
+		}
+		args = args[1:]
+		break
+	}
+	systemDir, name, failOn, args := args[0], args[1], args[2], args[3:]
+
+	if args[0] == failOn {
+		// dpkg-query exits with 1 on unknown packages, so use a different exit code for errors.
+		fmt.Fprintln(os.Stderr, "EXIT 2 requested in mock")
+		os.Exit(2)
+	}
+
+	installedFile := filepath.Join(systemDir, "installed")
+	heldFile := filepath.Join(systemDir, "held")
+	installed := readList(t, installedFile)
+	held := readList(t, heldFile)
+
+	switch name + " " + args[0] {
+	case "dpkg-query -W":
+		i := slices.IndexFunc(installed, func(p string) bool { return packageName(p) == args[len(args)-1] })
+		if i < 0 {
+			os.Exit(1)
+		}
+		status := "ii"
+		if _, s, ok := strings.Cut(installed[i], "="); ok {
+			status = s
+		}
+		fmt.Print(status + " ")
+		return
+	case "apt-mark showhold":
+		for _, p := range held {
+			fmt.Println(p)
+		}
+		return
+	case "apt-get install":
+		installed = slices.DeleteFunc(installed, func(p string) bool { return slices.Contains(args[3:], packageName(p)) })
+		installed = append(installed, args[3:]...)
+	case "apt-get remove":
+		installed = slices.DeleteFunc(installed, func(p string) bool { return slices.Contains(args[3:], packageName(p)) })
+	case "apt-mark hold":
+		held = append(held, args[1:]...)
+	case "apt-mark unhold":
+		held = slices.DeleteFunc(held, func(p string) bool { return slices.Contains(args[1:], p) })
+	default:
+		fmt.Fprintf(os.Stderr, "unexpected call: %s %s\n", name, strings.Join(args, " "))
+		os.Exit(2)
+	}
+
+	if os.Getenv("DEBIAN_FRONTEND") != "noninteractive" {
+		fmt.Fprintln(os.Stderr, "DEBIAN_FRONTEND is not set to noninteractive")
+		os.Exit(2)
+	}
+
+	slices.Sort(installed)
+	slices.Sort(held)
+	writeList(t, installedFile, installed)
+	writeList(t, heldFile, held)
+
+	f, err := os.OpenFile(filepath.Join(systemDir, "calls"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	require.NoError(t, err, "Setup: can't open calls file")
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s\n", name, strings.Join(args, " "))
+	require.NoError(t, err, "Setup: can't write calls file")
+}
+
+// packageName returns the name of a package of the installed list, which can be suffixed by =<status abbreviation>.
+func packageName(p string) string {
+	name, _, _ := strings.Cut(p, "=")
+	return name
+}
+
+func readList(t *testing.T, path string) []string {
+	t.Helper()
+
+	d, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err, "Setup: can't read list file")
+	return strings.Fields(string(d))
+}
@@ -0,0 +1,349 @@
+// Package password is the policy manager for password quality and account lockout of local accounts.
+//
+// This manager only applies to computer objects.
+//
+// The policy is defined either by the Ubuntu keys (password/...) or by the "Password Policy" and
+// "Account Lockout Policy" of the GPO security template. Ubuntu keys take precedence over the
+// security template of the same GPO.
+//
+// Settings are mapped to the PAM modules configuration:
+//   - minimum length and complexity: pam_pwquality, in pwquality.conf.d/99-adsys.conf;
+//   - password history: pam_pwhistory, in pwhistory.conf;
+//   - lockout threshold, duration and reset delay: pam_faillock, in faillock.conf.
+//
+// pwhistory.conf and faillock.conf are shipped by the distribution: only a block delimited by adsys
+// markers at the end of the file is managed, which takes precedence over the previous settings.
+// Files and blocks are removed once no setting is configured anymore.
+//
+// Settings are never silently unenforced: the policy fails if a setting is configured while the corresponding
+// module is not in the PAM stack. pam_pwquality is enabled by installing libpam-pwquality. pam_pwhistory and
+// pam_faillock are not enabled by default on Ubuntu: adsys ships the adsys-password and adsys-password-authfail
+// pam-auth-update profiles to enable them.
+package password
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	minLengthKey        = "password/min-length"
+	complexityKey       = "password/complexity"
+	historyKey          = "password/history"
+	lockoutThresholdKey = "password/lockout-threshold"
+	lockoutDurationKey  = "password/lockout-duration"
+	lockoutResetKey     = "password/lockout-reset"
+
+	pwqualityFileName = "99-adsys.conf"
+
+	// blockBegin and blockEnd delimit the settings managed by adsys in configuration files shipped by the distribution.
+	blockBegin = "# BEGIN adsys managed settings. Do not edit: any changes will be overwritten."
+	blockEnd   = "# END adsys managed settings"
+)
+
+var (
+	// pwqualityDir is the pam_pwquality configuration directory, relative to the security directory.
+	pwqualityDir = "pwquality.conf.d"
+	// pwhistoryConf is the pam_pwhistory configuration file, relative to the security directory.
+	pwhistoryConf = "pwhistory.conf"
+	// faillockConf is the pam_faillock configuration file, relative to the security directory.
+	faillockConf = "faillock.conf"
+
+	// commonAuth and commonPassword are the PAM stacks of pam_faillock and pam_pwhistory, relative to the PAM directory.
+	commonAuth     = "common-auth"
+	commonPassword = "common-password"
+)
+
+// Manager prevents writing the PAM configuration concurrently while applying the policy.
+type Manager struct {
+	securityDir string
+	pamDir      string
+
+	mu sync.Mutex
+}
+
+type options struct {
+	securityDir string
+	pamDir      string
+}
+
+// Option reprents an optional function to change the password manager.
+type Option func(*options)
+
+// WithSecurityDir overrides the default PAM security configuration directory.
+func WithSecurityDir(p string) Option {
+	return func(o *options) {
+		o.securityDir = p
+	}
+}
+
+// WithPAMDir overrides the default PAM stack configuration directory.
+func WithPAMDir(p string) Option {
+	return func(o *options) {
+		o.pamDir = p
+	}
+}
+
+// New returns a new manager for the password policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		securityDir: consts.DefaultSecurityDir,
+		pamDir:      consts.DefaultPAMDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		securityDir: args.securityDir,
+		pamDir:      args.pamDir,
+	}
+}
+
+// ApplyPolicy configures password quality, history and account lockout of local accounts.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply password policy to %s", objectName))
+
+	// Password policies are only supported on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying password policy to %s", objectName)
+
+	var pwquality, pwhistory, faillock []string
+	var lockout bool
+	for _, e := range entries {
+		if e.Err != nil {
+			return errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+		if e.Disabled {
+			continue
+		}
+
+		switch e.Key {
+		case complexityKey:
+			// Windows complexity requires 3 character classes out of 4 and the password not to contain the user name.
+			pwquality = append(pwquality, "minclass = 3", "usercheck = 1")
+			continue
+		case minLengthKey, historyKey, lockoutThresholdKey, lockoutDurationKey, lockoutResetKey:
+		default:
+			continue
+		}
+
+		n, err := parseValue(e)
+		if err != nil {
+			return err
+		}
+		switch e.Key {
+		case minLengthKey:
+			if n > 0 {
+				pwquality = append(pwquality, fmt.Sprintf("minlen = %d", n))
+			}
+		case historyKey:
+			if n > 0 {
+				pwhistory = append(pwhistory, fmt.Sprintf("remember = %d", n))
+			}
+		case lockoutThresholdKey:
+			// 0 means that accounts are never locked out, for both Windows and pam_faillock.
+			faillock = append(faillock, fmt.Sprintf("deny = %d", n))
+			lockout = n > 0
+		case lockoutDurationKey:
+			// 0 means that accounts are locked until an administrator unlocks them.
+			unlockTime := "never"
+			if n > 0 {
+				unlockTime = strconv.Itoa(n * 60)
+			}
+			faillock = append(faillock, "unlock_time = "+unlockTime)
+		case lockoutResetKey:
+			faillock = append(faillock, fmt.Sprintf("fail_interval = %d", n*60))
+		}
+	}
+
+	// Settings would silently not be enforced if their module is not enabled.
+	adsysProfilesHint := gotext.Get("enable the adsys-password and adsys-password-authfail pam-auth-update profiles")
+	if len(pwquality) > 0 {
+		if err := checkPAMModule(filepath.Join(m.pamDir, commonPassword), "pam_pwquality.so", gotext.Get("install the libpam-pwquality package")); err != nil {
+			return err
+		}
+	}
+	if len(pwhistory) > 0 {
+		if err := checkPAMModule(filepath.Join(m.pamDir, commonPassword), "pam_pwhistory.so", adsysProfilesHint); err != nil {
+			return err
+		}
+	}
+	if lockout {
+		if err := checkPAMModule(filepath.Join(m.pamDir, commonAuth), "pam_faillock.so", adsysProfilesHint); err != nil {
+			return err
+		}
+	}
+
+	if err := writePwquality(filepath.Join(m.securityDir, pwqualityDir, pwqualityFileName), pwquality); err != nil {
+		return err
+	}
+	if err := updateManagedBlock(filepath.Join(m.securityDir, pwhistoryConf), pwhistory); err != nil {
+		return err
+	}
+	return updateManagedBlock(filepath.Join(m.securityDir, faillockConf), faillock)
+}
+
+// parseValue returns the value of the entry as a positive number of characters, passwords, attempts or minutes.
+func parseValue(e entry.Entry) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(e.Value))
+	if err != nil || n < 0 {
+		return 0, errors.New(gotext.Get("invalid value %q for %q: expected a positive number", e.Value, e.Key))
+	}
+	return n, nil
+}
+
+// checkPAMModule returns an error if module is not enabled in the PAM stack p, with hint explaining how to enable it.
+func checkPAMModule(p, module, hint string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("%s is not enabled in %q, %s", module, p, hint))
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		for _, field := range strings.Fields(l) {
+			if filepath.Base(field) == module {
+				return nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New(gotext.Get("module not found in the PAM stack"))
+}
+
+// writePwquality writes the pwquality configuration file, or removes it if there are no settings.
+func writePwquality(p string, settings []string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't update %q", p))
+
+	if len(settings) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	content := `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+` + strings.Join(settings, "\n") + "\n"
+
+	// #nosec G301 - /etc/security/pwquality.conf.d permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeIfChanged(p, content, 0644)
+}
+
+// updateManagedBlock replaces the block managed by adsys at the end of the configuration file p with settings.
+// The block is removed if there are no settings, and so is the file if nothing else is left.
+func updateManagedBlock(p string, settings []string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't update %q", p))
+
+	mode := fs.FileMode(0644)
+	var lines []string
+	f, err := os.Open(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+
+		var inBlock bool
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			l := scanner.Text()
+			switch {
+			case l == blockBegin:
+				inBlock = true
+			case l == blockEnd:
+				inBlock = false
+			case !inBlock:
+				lines = append(lines, l)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		if inBlock {
+			return errors.New(gotext.Get("missing end marker of the adsys managed block"))
+		}
+		f.Close()
+	}
+
+	// Remove the empty lines we added before the block.
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(settings) > 0 {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, blockBegin)
+		lines = append(lines, settings...)
+		lines = append(lines, blockEnd)
+	}
+
+	if len(lines) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	// #nosec G301 - /etc/security permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeIfChanged(p, strings.Join(lines, "\n")+"\n", mode)
+}
+
+// writeIfChanged atomically writes content to p if it differs from the current content.
+func writeIfChanged(p, content string, mode fs.FileMode) error {
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return nil
+	}
+
+	if err := os.WriteFile(p+".new", []byte(content), mode); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,99 @@
+package password_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/password"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "password/min-length", Value: "12"},
+		{Key: "password/complexity"},
+		{Key: "password/history", Value: "24"},
+		{Key: "password/lockout-threshold", Value: "5"},
+		{Key: "password/lockout-duration", Value: "30"},
+		{Key: "password/lockout-reset", Value: "15"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+		pamStack      string
+
+		securityDirIsFile bool
+
+		wantErr bool
+	}{
+		"Apply all settings":                                {},
+		"Apply all settings on distribution files":          {existingState: "distribution"},
+		"Update managed settings":                           {existingState: "managed"},
+		"Only password quality settings":                    {entries: []entry.Entry{{Key: "password/min-length", Value: "10"}}, existingState: "managed"},
+		"Only account lockout settings":                     {entries: []entry.Entry{{Key: "password/lockout-threshold", Value: "3"}}, existingState: "managed"},
+		"Zero values":                                       {entries: []entry.Entry{{Key: "password/min-length", Value: "0"}, {Key: "password/history", Value: "0"}, {Key: "password/lockout-threshold", Value: "0"}, {Key: "password/lockout-duration", Value: "0"}, {Key: "password/lockout-reset", Value: "0"}}},
+		"Disabled entries are ignored":                      {entries: []entry.Entry{{Key: "password/complexity", Disabled: true}, {Key: "password/min-length", Value: "12", Disabled: true}, {Key: "password/history", Value: "24"}}},
+		"Unknown keys are ignored":                          {entries: []entry.Entry{{Key: "password/unknown", Value: "something"}, {Key: "password/history", Value: "24"}}},
+		"Values with spaces are trimmed":                    {entries: []entry.Entry{{Key: "password/min-length", Value: " 12\n"}}},
+		"Remove managed settings with no entries":           {entries: []entry.Entry{}, existingState: "managed"},
+		"Remove files only containing managed settings":     {entries: []entry.Entry{}, existingState: "only_managed"},
+		"Keep distribution files untouched with no entries": {entries: []entry.Entry{}, existingState: "distribution"},
+		"No entries and no files":                           {entries: []entry.Entry{}},
+		"User objects are ignored":                          {isUser: true, existingState: "managed"},
+		"PAM modules are only required by their settings":   {entries: []entry.Entry{{Key: "password/min-length", Value: "0"}, {Key: "password/history", Value: "0"}, {Key: "password/lockout-threshold", Value: "0"}, {Key: "password/lockout-duration", Value: "30"}}, pamStack: "disabled"},
+
+		// Error cases
+		"Error on errored entry":                {entries: []entry.Entry{{Key: "password/min-length", Value: "12", Err: errors.New("some error")}}, wantErr: true},
+		"Error on invalid value":                {entries: []entry.Entry{{Key: "password/min-length", Value: "twelve"}}, wantErr: true},
+		"Error on negative value":               {entries: []entry.Entry{{Key: "password/lockout-threshold", Value: "-1"}}, wantErr: true},
+		"Error on missing managed block end":    {existingState: "missing_end_marker", wantErr: true},
+		"Error on security directory is a file": {securityDirIsFile: true, wantErr: true},
+		"Error on pam_pwquality not enabled":    {entries: []entry.Entry{{Key: "password/complexity"}}, pamStack: "disabled", wantErr: true},
+		"Error on pam_pwhistory not enabled":    {entries: []entry.Entry{{Key: "password/history", Value: "24"}}, pamStack: "disabled", wantErr: true},
+		"Error on pam_faillock not enabled":     {entries: []entry.Entry{{Key: "password/lockout-threshold", Value: "5"}}, pamStack: "disabled", wantErr: true},
+		"Error on missing PAM stack":            {pamStack: "doesnotexist", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+			if tc.pamStack == "" {
+				tc.pamStack = "enabled"
+			}
+
+			rootDir := t.TempDir()
+			securityDir := filepath.Join(rootDir, "etc", "security")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), securityDir)
+			}
+			if tc.securityDirIsFile {
+				require.NoError(t, os.MkdirAll(filepath.Dir(securityDir), 0750), "Setup: can't create parent directory")
+				testutils.WriteFile(t, securityDir, []byte("not a directory"), 0600)
+			}
+
+			m := password.New(password.WithSecurityDir(securityDir), password.WithPAMDir(filepath.Join(testutils.TestFamilyPath(t), "pam", tc.pamStack)))
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
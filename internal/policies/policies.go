@@ -39,8 +39,12 @@ type assetsFromMMAP struct {
 
 // Policies is the list of GPOs applied to a particular object, with the global data cache.
 type Policies struct {
-	GPOs   []GPO
-	assets *assetsFromMMAP `yaml:"-"`
+	GPOs []GPO
+	// Loopback is the loopback processing mode which added the computer GPOs to the user ones, if any.
+	Loopback string `yaml:",omitempty"`
+	// FilteredGPOs are the GPOs which are not applied, as the client doesn't match their WMI filter.
+	FilteredGPOs []FilteredGPO   `yaml:",omitempty"`
+	assets       *assetsFromMMAP `yaml:"-"`
 }
 
 // New returns new policies with GPOs and assets loaded from DB.
@@ -473,6 +477,8 @@ func (pols Policies) GetUniqueRules() map[string][]entry.Entry {
 						e.Value = e.Value + "\n" + dedup[t][e.Key].Value
 						// Keep closest meta value.
 						e.Meta = dedup[t][e.Key].Meta
+						// An errored part makes the whole value errored.
+						e.Err = errors.Join(e.Err, dedup[t][e.Key].Err)
 					}
 					dedup[t][e.Key] = e
 					if keyAlreadySeen {
@@ -148,6 +148,12 @@ func TestSave(t *testing.T) {
 		"With assets": {
 			cacheSrc: "with_assets",
 		},
+		"With loopback processing mode": {
+			cacheSrc: "loopback_merge",
+		},
+		"With GPOs filtered out by their WMI filter": {
+			cacheSrc: "wmi_filtered",
+		},
 
 		// Refresh existing directory
 		"Existing policies cache is refreshed": {
@@ -661,6 +667,7 @@ func TestGetUniqueRules(t *testing.T) {
 			{Key: "B", Value: "standardB"},
 			{Key: "C", Value: "standardC"},
 		}}}
+	errEntry := errors.New("errored entry")
 
 	tests := map[string]struct {
 		gpos []policies.GPO
@@ -970,6 +977,38 @@ func TestGetUniqueRules(t *testing.T) {
 					{Key: "A", Value: "furthest value\nclosest value", Meta: "closest meta", Strategy: entry.StrategyAppend},
 				},
 			}},
+		"Append policy entry, errored closest entry makes the value errored": {
+			gpos: []policies.GPO{
+				{ID: "closest", Name: "closest-name", Rules: map[string][]entry.Entry{
+					"domain": {
+						{Key: "A", Value: "closest value", Strategy: entry.StrategyAppend, Err: errEntry},
+					}}},
+				{ID: "furthest", Name: "furthest-name", Rules: map[string][]entry.Entry{
+					"domain": {
+						{Key: "A", Value: "furthest value", Strategy: entry.StrategyAppend},
+					}}},
+			},
+			want: map[string][]entry.Entry{
+				"domain": {
+					{Key: "A", Value: "furthest value\nclosest value", Strategy: entry.StrategyAppend, Err: errors.Join(errEntry)},
+				},
+			}},
+		"Append policy entry, errored furthest entry makes the value errored": {
+			gpos: []policies.GPO{
+				{ID: "closest", Name: "closest-name", Rules: map[string][]entry.Entry{
+					"domain": {
+						{Key: "A", Value: "closest value", Strategy: entry.StrategyAppend},
+					}}},
+				{ID: "furthest", Name: "furthest-name", Rules: map[string][]entry.Entry{
+					"domain": {
+						{Key: "A", Value: "furthest value", Strategy: entry.StrategyAppend, Err: errEntry},
+					}}},
+			},
+			want: map[string][]entry.Entry{
+				"domain": {
+					{Key: "A", Value: "furthest value\nclosest value", Strategy: entry.StrategyAppend, Err: errors.Join(errEntry)},
+				},
+			}},
 
 		// Mix append and override: closest win
 		"Mix meta on GPOs, furthest policy entry is append, closest is override": {
@@ -0,0 +1,109 @@
+package printers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/smbsafe"
+)
+
+// lpadmin manages CUPS queues by calling the lpadmin command, and lists them with the lpstat command.
+type lpadmin struct {
+	cmd       []string
+	lpstatCmd []string
+}
+
+// AddPrinter creates or updates the queue, enables it and restricts it to the given users.
+func (l lpadmin) AddPrinter(ctx context.Context, name, uri, model string, users []string) error {
+	_, err := l.run(ctx, l.cmd, "-p", name, "-E", "-v", uri, "-m", model, "-o", "printer-is-shared=false", "-u", allowList(users))
+	return err
+}
+
+// RemovePrinter deletes the queue.
+func (l lpadmin) RemovePrinter(ctx context.Context, name string) error {
+	_, err := l.run(ctx, l.cmd, "-x", name)
+	return err
+}
+
+// SetUsers restricts the queue to the given users.
+func (l lpadmin) SetUsers(ctx context.Context, name string, users []string) error {
+	_, err := l.run(ctx, l.cmd, "-p", name, "-u", allowList(users))
+	return err
+}
+
+// SetDefault sets the queue as the system-wide default destination.
+func (l lpadmin) SetDefault(ctx context.Context, name string) error {
+	_, err := l.run(ctx, l.cmd, "-d", name)
+	return err
+}
+
+// Default returns the system-wide default destination, or an empty string if there is none.
+func (l lpadmin) Default(ctx context.Context) (string, error) {
+	out, err := l.run(ctx, l.lpstatCmd, "-d")
+	if err != nil {
+		return "", err
+	}
+
+	// The output is either "system default destination: <name>" or "no system default destination".
+	_, name, _ := strings.Cut(strings.TrimSpace(out), "system default destination: ")
+	return name, nil
+}
+
+// Printers returns the names of the queues created on the system.
+func (l lpadmin) Printers(ctx context.Context) ([]string, error) {
+	out, err := l.run(ctx, l.lpstatCmd, "-v")
+	// lpstat fails when there is no queue at all.
+	if err != nil && !strings.Contains(out, "No destinations added") {
+		return nil, err
+	}
+
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		// Lines are in the form "device for <name>: <uri>".
+		device, found := strings.CutPrefix(line, "device for ")
+		if !found {
+			continue
+		}
+		if name, _, found := strings.Cut(device, ":"); found {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// allowList returns the lpadmin access list for the users. No users means all users are allowed.
+func allowList(users []string) string {
+	if len(users) == 0 {
+		return "allow:all"
+	}
+	return "allow:" + strings.Join(users, ",")
+}
+
+// run executes cmd with args, in the C locale so that its output can be parsed, and returns its output.
+func (l lpadmin) run(ctx context.Context, cmd []string, args ...string) (string, error) {
+	if os.Getenv("ADSYS_SKIP_ROOT_CALLS") != "" {
+		return "", nil
+	}
+
+	if _, err := exec.LookPath(cmd[0]); err != nil {
+		return "", errors.New(gotext.Get("%s is not available on this system: %v", filepath.Base(cmd[0]), err))
+	}
+
+	args = slices.Concat(cmd, args)
+	// #nosec G204 - We are in control of the arguments
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	c.Env = append(os.Environ(), "LC_ALL=C")
+	smbsafe.WaitExec()
+	out, err := c.CombinedOutput()
+	smbsafe.DoneExec()
+	if err != nil {
+		return string(out), errors.New(gotext.Get("failed to run %q: %v\n%s", strings.Join(args, " "), err, string(out)))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,506 @@
+// Package printers provides a manager to deploy CUPS print queues.
+//
+// Printers are deployed per computer (printers/deployed-machine) or per user (printers/deployed-user).
+// Each line of the entry describes a queue in the form:
+//
+//	<name> <uri> [<model>]
+//
+// Supported URIs are ipp://, ipps:// and smb://. Windows UNC paths (\\server\printer) are converted
+// to smb:// URIs. For ipp:// and ipps:// URIs, the model defaults to "everywhere", which uses IPP Everywhere
+// driverless printing. Other printers are not driverless: their model is required.
+//
+// Queues deployed for a computer are available to all users. Queues deployed for a user are only
+// available to the users they were deployed for, unless the same queue is also deployed for the computer.
+//
+// The system-wide default printer can be set for computers with printers/default. The previous default
+// printer is saved in the state directory, and restored once printers/default is not set anymore.
+//
+// The queues created by adsys are tracked per object in the state directory, so that only those are
+// removed once they are not referenced anymore by any object. Queues created outside of adsys are
+// never modified nor removed: deploying a queue with the same name is skipped.
+//
+// CUPS is managed through a Caller, which by default calls lpadmin and lpstat.
+package printers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+// Caller is the interface to manage CUPS queues.
+type Caller interface {
+	AddPrinter(ctx context.Context, name, uri, model string, users []string) error
+	RemovePrinter(ctx context.Context, name string) error
+	SetUsers(ctx context.Context, name string, users []string) error
+	SetDefault(ctx context.Context, name string) error
+	Default(ctx context.Context) (string, error)
+	Printers(ctx context.Context) ([]string, error)
+}
+
+const (
+	machinePrintersKey = "printers/deployed-machine"
+	userPrintersKey    = "printers/deployed-user"
+	defaultPrinterKey  = "printers/default"
+
+	defaultModel = "everywhere"
+
+	// machineStateFile is the state file name of the queues deployed for the computer.
+	machineStateFile = "machine"
+	// usersStateDir is the state directory of the queues deployed for users.
+	usersStateDir = "users"
+	// defaultStateFile is the state file name of the default printer set before adsys managed it.
+	defaultStateFile = "default"
+)
+
+// queueNameRegexp matches valid CUPS queue names.
+var queueNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// supportedSchemes are the URI schemes of the queues that can be deployed.
+var supportedSchemes = []string{"ipp", "ipps", "smb"}
+
+// driverlessSchemes are the URI schemes of the queues which can use the driverless default model.
+var driverlessSchemes = []string{"ipp", "ipps"}
+
+type printer struct {
+	name  string
+	uri   string
+	model string
+}
+
+// Manager prevents changing CUPS queues concurrently while applying the policy.
+type Manager struct {
+	stateDir string
+	caller   Caller
+
+	mu sync.Mutex
+}
+
+type options struct {
+	stateDir   string
+	lpadminCmd []string
+	lpstatCmd  []string
+	caller     Caller
+}
+
+// Option reprents an optional function to change the printers manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) Option {
+	return func(o *options) {
+		o.stateDir = p
+	}
+}
+
+// WithLpadminCmd overrides the default lpadmin command used by the default caller.
+func WithLpadminCmd(cmd []string) Option {
+	return func(o *options) {
+		o.lpadminCmd = cmd
+	}
+}
+
+// WithLpstatCmd overrides the default lpstat command used by the default caller.
+func WithLpstatCmd(cmd []string) Option {
+	return func(o *options) {
+		o.lpstatCmd = cmd
+	}
+}
+
+// WithCaller overrides the default caller managing the CUPS queues.
+func WithCaller(c Caller) Option {
+	return func(o *options) {
+		o.caller = c
+	}
+}
+
+// New returns a new manager for the printers policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:   consts.DefaultStateDir,
+		lpadminCmd: []string{"lpadmin"},
+		lpstatCmd:  []string{"lpstat"},
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	caller := args.caller
+	if caller == nil {
+		caller = lpadmin{cmd: args.lpadminCmd, lpstatCmd: args.lpstatCmd}
+	}
+
+	return &Manager{
+		stateDir: filepath.Join(args.stateDir, "printers"),
+		caller:   caller,
+	}
+}
+
+// ApplyPolicy deploys the printers listed in entries for the object and removes the ones
+// previously deployed for it and not referenced anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply printers policy to %s", objectName))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying printers policy to %s", objectName)
+
+	printers, defaultPrinter, err := parseEntries(ctx, entries, isComputer)
+	if err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(m.stateDir, machineStateFile)
+	if !isComputer {
+		statePath = filepath.Join(m.stateDir, usersStateDir, objectName)
+	}
+
+	owned, err := readState(statePath)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to deploy and nothing to remove.
+	if len(printers) == 0 && len(owned) == 0 {
+		if !isComputer {
+			return nil
+		}
+		return m.applyDefault(ctx, defaultPrinter)
+	}
+
+	otherOwners, err := m.otherOwners(statePath)
+	if err != nil {
+		return err
+	}
+
+	// Always save the queues we own, even on partial failure, so that they can be removed later on.
+	state := slices.Clone(owned)
+	defer func() {
+		if errSave := saveState(statePath, state); errSave != nil {
+			err = errors.Join(err, errSave)
+		}
+	}()
+
+	var existing []string
+	if len(printers) > 0 {
+		if existing, err = m.caller.Printers(ctx); err != nil {
+			return err
+		}
+	}
+
+	var wanted []string
+	for _, p := range printers {
+		// Never take over a queue created outside of adsys.
+		if !slices.Contains(owned, p.name) && len(otherOwners[p.name]) == 0 && slices.Contains(existing, p.name) {
+			log.Warning(ctx, gotext.Get("Printer %q already exists and was not deployed by adsys, skipping", p.name))
+			continue
+		}
+
+		users := allowedUsers(append(slices.Clone(otherOwners[p.name]), owner(objectName, isComputer)))
+		log.Infof(ctx, "Deploying printer %q (%s)", p.name, p.uri)
+		if err := m.caller.AddPrinter(ctx, p.name, p.uri, p.model, users); err != nil {
+			return err
+		}
+		wanted = append(wanted, p.name)
+		if !slices.Contains(state, p.name) {
+			state = append(state, p.name)
+		}
+	}
+
+	for _, name := range owned {
+		if slices.Contains(wanted, name) {
+			continue
+		}
+
+		// The queue is still deployed for other objects: only update who can access it.
+		if owners := otherOwners[name]; len(owners) > 0 {
+			if err := m.caller.SetUsers(ctx, name, allowedUsers(owners)); err != nil {
+				return err
+			}
+		} else {
+			log.Infof(ctx, "Removing printer %q", name)
+			if err := m.caller.RemovePrinter(ctx, name); err != nil {
+				return err
+			}
+		}
+		state = slices.DeleteFunc(state, func(n string) bool { return n == name })
+	}
+
+	if !isComputer {
+		return nil
+	}
+	return m.applyDefault(ctx, defaultPrinter)
+}
+
+// applyDefault sets name as the system-wide default printer. The previous default printer is saved the
+// first time, and restored once name is empty.
+func (m *Manager) applyDefault(ctx context.Context, name string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply default printer"))
+
+	p := filepath.Join(m.stateDir, defaultStateFile)
+	data, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	managed := err == nil
+
+	if name == "" {
+		if !managed {
+			return nil
+		}
+		if previous := strings.TrimSpace(string(data)); previous != "" {
+			existing, err := m.caller.Printers(ctx)
+			if err != nil {
+				return err
+			}
+			if slices.Contains(existing, previous) {
+				log.Infof(ctx, "Restoring default printer %q", previous)
+				if err := m.caller.SetDefault(ctx, previous); err != nil {
+					return err
+				}
+			} else {
+				log.Warning(ctx, gotext.Get("Previous default printer %q doesn't exist anymore, not restoring it", previous))
+			}
+		}
+		return os.Remove(p)
+	}
+
+	if !managed {
+		previous, err := m.caller.Default(ctx)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, []byte(previous+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+
+	return m.caller.SetDefault(ctx, name)
+}
+
+// parseEntries returns the printers to deploy for the object scope and the default printer.
+// Disabled entries are ignored.
+func parseEntries(ctx context.Context, entries []entry.Entry, isComputer bool) (printers []printer, defaultPrinter string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse printers entries"))
+
+	printersKey := machinePrintersKey
+	if !isComputer {
+		printersKey = userPrintersKey
+	}
+
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+		if e.Key != printersKey && e.Key != defaultPrinterKey {
+			continue
+		}
+		if e.Err != nil {
+			return nil, "", errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		if e.Key == defaultPrinterKey {
+			if !isComputer {
+				log.Warning(ctx, gotext.Get("The default printer can only be set for computers, ignoring"))
+				continue
+			}
+			defaultPrinter = strings.TrimSpace(e.Value)
+			if defaultPrinter != "" && !queueNameRegexp.MatchString(defaultPrinter) {
+				return nil, "", errors.New(gotext.Get("invalid default printer name %q", defaultPrinter))
+			}
+			continue
+		}
+
+		for _, line := range strings.Split(e.Value, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			p, err := parsePrinter(line)
+			if err != nil {
+				return nil, "", err
+			}
+			if i := slices.IndexFunc(printers, func(o printer) bool { return o.name == p.name }); i != -1 {
+				if printers[i] != p {
+					return nil, "", errors.New(gotext.Get("printer %q is declared multiple times with different settings", p.name))
+				}
+				continue
+			}
+			printers = append(printers, p)
+		}
+	}
+
+	return printers, defaultPrinter, nil
+}
+
+// parsePrinter parses a line in the form <name> <uri> [<model>].
+func parsePrinter(line string) (p printer, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return p, errors.New(gotext.Get("invalid printer %q: expected <name> <uri> [<model>]", line))
+	}
+
+	p.name, p.uri = fields[0], fields[1]
+	if len(fields) == 3 {
+		p.model = fields[2]
+	}
+
+	if !queueNameRegexp.MatchString(p.name) {
+		return p, errors.New(gotext.Get("invalid printer name %q", p.name))
+	}
+
+	// Convert Windows UNC paths to smb URIs.
+	if strings.HasPrefix(p.uri, `\\`) {
+		p.uri = "smb://" + strings.ReplaceAll(strings.TrimPrefix(p.uri, `\\`), `\`, "/")
+	}
+
+	u, err := url.Parse(p.uri)
+	if err != nil {
+		return p, errors.New(gotext.Get("invalid URI for printer %q: %v", p.name, err))
+	}
+	if !slices.Contains(supportedSchemes, u.Scheme) || u.Host == "" {
+		return p, errors.New(gotext.Get("unsupported URI %q for printer %q: expected one of %s with a host", p.uri, p.name, strings.Join(supportedSchemes, ", ")))
+	}
+
+	// lpadmin rejects the driverless model for printers which are not IPP ones.
+	if !slices.Contains(driverlessSchemes, u.Scheme) {
+		if p.model == "" || p.model == defaultModel {
+			return p, errors.New(gotext.Get("printer %q with URI %q needs a model: only %s printers can be driverless", p.name, p.uri, strings.Join(driverlessSchemes, ", ")))
+		}
+	}
+	if p.model == "" {
+		p.model = defaultModel
+	}
+
+	return p, nil
+}
+
+// owner returns the owner name stored for the object. An empty owner is the computer.
+func owner(objectName string, isComputer bool) string {
+	if isComputer {
+		return ""
+	}
+	return objectName
+}
+
+// allowedUsers returns the users allowed to access a queue deployed for the given owners.
+// No users means that the queue is available to everyone.
+func allowedUsers(owners []string) []string {
+	if slices.Contains(owners, "") {
+		return nil
+	}
+	users := slices.Clone(owners)
+	slices.Sort(users)
+	return slices.Compact(users)
+}
+
+// otherOwners returns the owners of each queue deployed by adsys, excluding the state file at
+// statePath. The computer is represented by an empty owner.
+func (m *Manager) otherOwners(statePath string) (owners map[string][]string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't list printers deployed for other objects"))
+
+	owners = make(map[string][]string)
+	add := func(p, o string) error {
+		if p == statePath {
+			return nil
+		}
+		names, err := readState(p)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			owners[n] = append(owners[n], o)
+		}
+		return nil
+	}
+
+	if err := add(filepath.Join(m.stateDir, machineStateFile), ""); err != nil {
+		return nil, err
+	}
+
+	users, err := os.ReadDir(filepath.Join(m.stateDir, usersStateDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, u := range users {
+		if err := add(filepath.Join(m.stateDir, usersStateDir, u.Name()), u.Name()); err != nil {
+			return nil, err
+		}
+	}
+
+	return owners, nil
+}
+
+// readState returns the queues listed in the state file.
+// A missing state file means no queue is owned.
+func readState(p string) (names []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't read printers state %q", p))
+
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if n := strings.TrimSpace(scanner.Text()); n != "" {
+			names = append(names, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// saveState atomically writes the queues owned by an object.
+// The state file is removed if there are no queues to track.
+func saveState(p string, names []string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save printers state %q", p))
+
+	if len(names) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	names = slices.Clone(names)
+	slices.Sort(names)
+	var content strings.Builder
+	for _, n := range names {
+		fmt.Fprintln(&content, n)
+	}
+	if err := os.WriteFile(p+".new", []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
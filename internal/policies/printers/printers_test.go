@@ -0,0 +1,250 @@
+package printers_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/printers"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultMachineEntries := []entry.Entry{
+		{Key: "printers/deployed-machine", Value: "office ipp://print.example.com/ipp/print\nlab ipps://lab.example.com:631/printers/lab drv:///sample.drv/generic.ppd\nlegacy \\\\printsrv\\legacy drv:///sample.drv/generic.ppd"},
+		{Key: "printers/default", Value: "office"},
+	}
+	defaultUserEntries := []entry.Entry{
+		{Key: "printers/deployed-user", Value: "shared ipp://print.example.com/ipp/shared"},
+	}
+
+	tests := map[string]struct {
+		entries        []entry.Entry
+		isUser         bool
+		existingState  string
+		existingQueues []string
+		systemDefault  string
+
+		fileInPlaceOf string
+		failOn        string
+
+		wantErr bool
+	}{
+		// Machine cases
+		"Computer, deploy printers and set default":                   {},
+		"Computer, duplicated identical printers are deployed once":   {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "office ipp://print.example.com/ipp/print\n\n  office   ipp://print.example.com/ipp/print  \n"}}},
+		"Computer, disabled entries are ignored":                      {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "office ipp://print.example.com/ipp/print"}, {Key: "printers/default", Value: "office", Disabled: true}}},
+		"Computer, user entries are ignored":                          {entries: defaultUserEntries},
+		"Computer, remove printers not deployed anymore":              {existingState: "machine_only"},
+		"Computer, printer still deployed for users is kept":          {entries: []entry.Entry{}, existingState: "machine_and_users"},
+		"Computer, printer deployed for users is opened to all":       {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "shared ipp://print.example.com/ipp/shared"}}, existingState: "users_only"},
+		"Computer, no entries removes all deployed printers":          {entries: []entry.Entry{}, existingState: "machine_only"},
+		"Computer, no entries and no state":                           {entries: []entry.Entry{}},
+		"Computer, existing printer not deployed by adsys is skipped": {existingQueues: []string{"office", "other"}},
+		"Computer, existing printer deployed by adsys is updated":     {existingQueues: []string{"office", "old"}, existingState: "machine_only"},
+		"Computer, existing printer deployed for users is updated":    {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "shared ipp://print.example.com/ipp/shared"}}, existingQueues: []string{"shared"}, existingState: "users_only"},
+		"Computer, previous default printer is saved":                 {existingQueues: []string{"mine"}, systemDefault: "mine"},
+		"Computer, previous default printer is only saved once":       {existingQueues: []string{"mine"}, systemDefault: "office", existingState: "default_managed"},
+		"Computer, previous default printer is restored":              {entries: []entry.Entry{}, existingQueues: []string{"mine"}, existingState: "default_managed"},
+		"Computer, previous default printer removed is not restored":  {entries: []entry.Entry{}, existingState: "default_managed"},
+		"Computer, no previous default printer to restore":            {entries: []entry.Entry{}, existingState: "default_managed_without_previous"},
+
+		// User cases
+		"User, deploy printers":                                   {isUser: true},
+		"User, printer deployed for computer stays open":          {isUser: true, existingState: "machine_and_users"},
+		"User, printer shared with other users":                   {isUser: true, existingState: "users_only"},
+		"User, default printer is ignored":                        {isUser: true, entries: append(slices.Clone(defaultUserEntries), entry.Entry{Key: "printers/default", Value: "shared"})},
+		"User, machine entries are ignored":                       {isUser: true, entries: defaultMachineEntries},
+		"User, printer removed only for this user":                {isUser: true, entries: []entry.Entry{}, existingState: "users_only"},
+		"User, printer not deployed anymore is removed":           {isUser: true, entries: []entry.Entry{}, existingState: "user_alone"},
+		"User, no entries and no state":                           {isUser: true, entries: []entry.Entry{}},
+		"User, printer still deployed for computer is kept":       {isUser: true, entries: []entry.Entry{}, existingState: "machine_and_users_ubuntu"},
+		"User, existing printer not deployed by adsys is skipped": {isUser: true, existingQueues: []string{"shared"}},
+		"User, previous default printer is not restored":          {isUser: true, entries: []entry.Entry{}, existingQueues: []string{"mine"}, existingState: "default_managed"},
+
+		// Error cases
+		"Error on errored entry":                         {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "office ipp://print.example.com/ipp/print", Err: errors.New("some error")}}, wantErr: true},
+		"Error on missing URI":                           {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "office"}}, wantErr: true},
+		"Error on too many fields":                       {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "office ipp://print.example.com/ipp/print everywhere extra"}}, wantErr: true},
+		"Error on invalid printer name":                  {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "office/1 ipp://print.example.com/ipp/print"}}, wantErr: true},
+		"Error on unsupported URI scheme":                {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "office lpd://print.example.com/queue"}}, wantErr: true},
+		"Error on SMB printer without model":             {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "legacy smb://printsrv/legacy"}}, wantErr: true},
+		"Error on SMB printer with driverless model":     {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "legacy \\\\printsrv\\legacy everywhere"}}, wantErr: true},
+		"Error on URI without host":                      {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "office ipp:///ipp/print"}}, wantErr: true},
+		"Error on invalid URI":                           {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "office ipp://print.example.com:port/ipp/print"}}, wantErr: true},
+		"Error on same printer with different settings":  {entries: []entry.Entry{{Key: "printers/deployed-machine", Value: "office ipp://print.example.com/ipp/print\noffice ipp://other.example.com/ipp/print"}}, wantErr: true},
+		"Error on invalid default printer name":          {entries: []entry.Entry{{Key: "printers/default", Value: "office/1"}}, wantErr: true},
+		"Error on adding printer failing, state is kept": {existingState: "machine_only", failOn: "add", wantErr: true},
+		"Error on removing printer failing":              {existingState: "machine_only", failOn: "remove", wantErr: true},
+		"Error on updating users failing":                {entries: []entry.Entry{}, existingState: "machine_and_users", failOn: "users", wantErr: true},
+		"Error on setting default printer failing":       {failOn: "default", wantErr: true},
+		"Error on listing printers failing":              {failOn: "printers", wantErr: true},
+		"Error on getting default printer failing":       {failOn: "getdefault", wantErr: true},
+		"Error on state directory being a file":          {fileInPlaceOf: "var/lib/adsys/printers", wantErr: true},
+		"Error on users state directory being a file":    {fileInPlaceOf: "var/lib/adsys/printers/users", isUser: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultMachineEntries
+				if tc.isUser {
+					tc.entries = defaultUserEntries
+				}
+			}
+
+			rootDir := t.TempDir()
+			stateDir := filepath.Join(rootDir, "var", "lib", "adsys")
+			systemDir := filepath.Join(rootDir, "system")
+			require.NoError(t, os.MkdirAll(systemDir, 0700), "Setup: can't create system directory")
+
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), filepath.Join(stateDir, "printers"))
+			}
+			if tc.fileInPlaceOf != "" {
+				require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(rootDir, tc.fileInPlaceOf)), 0750), "Setup: can't create parent directory")
+				testutils.WriteFile(t, filepath.Join(rootDir, tc.fileInPlaceOf), []byte("not a directory"), 0600)
+			}
+
+			m := printers.New(
+				printers.WithStateDir(stateDir),
+				printers.WithLpadminCmd(mockLpadminCmd(t, systemDir, tc.failOn)),
+				printers.WithLpstatCmd(mockLpstatCmd(t, tc.existingQueues, tc.systemDefault, tc.failOn)),
+			)
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				// We don't return here as we want to check that the state
+				// is saved even in error cases.
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func mockLpadminCmd(t *testing.T, systemDir, failOn string) []string {
+	t.Helper()
+
+	if failOn == "" {
+		failOn = "none"
+	}
+	return []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockLpadmin", "--", systemDir, failOn}
+}
+
+func mockLpstatCmd(t *testing.T, queues []string, systemDefault, failOn string) []string {
+	t.Helper()
+
+	if failOn == "" {
+		failOn = "none"
+	}
+	return []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockLpstat", "--", failOn, strings.Join(queues, ","), systemDefault}
+}
+
+// TestMockLpadmin simulates lpadmin.
+// Every call is recorded in the lpadmin_calls file of the system directory.
+func TestMockLpadmin(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] != "--" {
+			args = args[1:]
+			continue
+		}
+		args = args[1:]
+		break
+	}
+	systemDir, failOn, args := args[0], args[1], args[2:]
+
+	var action string
+	switch args[0] {
+	case "-p":
+		action = "users"
+		if slices.Contains(args, "-v") {
+			action = "add"
+		}
+	case "-x":
+		action = "remove"
+	case "-d":
+		action = "default"
+	default:
+		fmt.Fprintf(os.Stderr, "unexpected call: lpadmin %s\n", strings.Join(args, " "))
+		os.Exit(1)
+	}
+
+	if action == failOn {
+		fmt.Fprintln(os.Stderr, "EXIT 1 requested in mock")
+		os.Exit(1)
+	}
+
+	f, err := os.OpenFile(filepath.Join(systemDir, "lpadmin_calls"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	require.NoError(t, err, "Setup: can't open calls file")
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "lpadmin %s\n", strings.Join(args, " "))
+	require.NoError(t, err, "Setup: can't write calls file")
+}
+
+// TestMockLpstat simulates lpstat, with the queues passed as a comma separated list and the default queue.
+func TestMockLpstat(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] != "--" {
+			args = args[1:]
+			continue
+		}
+		args = args[1:]
+		break
+	}
+	failOn, queues, systemDefault, args := args[0], args[1], args[2], args[3:]
+
+	switch args[0] {
+	case "-v":
+		if failOn == "printers" {
+			fmt.Fprintln(os.Stderr, "EXIT 1 requested in mock")
+			os.Exit(1)
+		}
+		if queues == "" {
+			fmt.Fprintln(os.Stderr, "lpstat: No destinations added.")
+			os.Exit(1)
+		}
+		for _, q := range strings.Split(queues, ",") {
+			fmt.Printf("device for %s: ipp://print.example.com/ipp/%s\n", q, q)
+		}
+	case "-d":
+		if failOn == "getdefault" {
+			fmt.Fprintln(os.Stderr, "EXIT 1 requested in mock")
+			os.Exit(1)
+		}
+		if systemDefault == "" {
+			fmt.Println("no system default destination")
+			return
+		}
+		fmt.Printf("system default destination: %s\n", systemDefault)
+	default:
+		fmt.Fprintf(os.Stderr, "unexpected call: lpstat %s\n", strings.Join(args, " "))
+		os.Exit(1)
+	}
+}
@@ -58,8 +58,8 @@ func TestSplitAndNormalizeUsersAndGroups(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
-			got := splitAndNormalizeUsersAndGroups(context.Background(), tc.input)
-			assert.Equal(t, tc.want, got, "splitAndNormalizeUsersAndGroups returned expected value")
+			got := SplitAndNormalizeUsersAndGroups(context.Background(), tc.input)
+			assert.Equal(t, tc.want, got, "SplitAndNormalizeUsersAndGroups returned expected value")
 		})
 	}
 }
@@ -197,7 +197,7 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 			}
 
 			var polkitElem []string
-			for _, e := range splitAndNormalizeUsersAndGroups(ctx, entry.Value) {
+			for _, e := range SplitAndNormalizeUsersAndGroups(ctx, entry.Value) {
 				contentSudo += fmt.Sprintf("\"%s\"	ALL=(ALL:ALL) ALL\n", e)
 				polkitID := fmt.Sprintf("unix-user:%s", e)
 				if strings.HasPrefix(e, "%") {
@@ -275,10 +275,11 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 	return nil
 }
 
-// splitAndNormalizeUsersAndGroups allow splitting on lines and ,.
+// SplitAndNormalizeUsersAndGroups allow splitting on lines and ,.
 // We remove any invalid characters and empty elements.
 // All will have the form of user@domain.
-func splitAndNormalizeUsersAndGroups(ctx context.Context, v string) []string {
+// It is exported so that other managers referencing AD users and groups share the same normalization.
+func SplitAndNormalizeUsersAndGroups(ctx context.Context, v string) []string {
 	var elems []string
 	elems = append(elems, strings.Split(v, "\n")...)
 	v = strings.Join(elems, ",")
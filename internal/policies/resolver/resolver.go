@@ -0,0 +1,407 @@
+// Package resolver is the policy manager for the DNS resolver and static host entries.
+//
+// This manager only applies to computer objects.
+//
+// DNS servers, search domains and DNS-over-TLS are written to the [Resolve] section of
+// /etc/systemd/resolved.conf.d/adsys.conf. systemd-resolved is then reloaded, or restarted if it doesn't
+// support reloading, and failing to do so only warns the user.
+//
+// Static host entries are written in a block delimited by adsys markers at the end of /etc/hosts. Lines
+// outside of this block are owned by the administrator and are never modified.
+//
+// Following the policy manager guidelines:
+//   - invalid addresses, domains or host entries prevent authentication;
+//   - the configuration is only replaced once all values are validated.
+//
+// The drop-in and the block are removed once no setting is configured anymore.
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	dnsServersKey    = "resolver/dns-servers"
+	searchDomainsKey = "resolver/search-domains"
+	dnsOverTLSKey    = "resolver/dns-over-tls"
+	hostsKey         = "resolver/hosts"
+
+	configFileName = "adsys.conf"
+	resolvedUnit   = "systemd-resolved.service"
+
+	managedFileHeader = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+[Resolve]
+`
+
+	// blockBegin and blockEnd delimit the host entries managed by adsys in the hosts file.
+	blockBegin = "# BEGIN adsys managed settings. Do not edit: any changes will be overwritten."
+	blockEnd   = "# END adsys managed settings"
+)
+
+var (
+	// resolvedKeys are the keys of the systemd-resolved settings, in the order they are written.
+	resolvedKeys = []string{dnsServersKey, searchDomainsKey, dnsOverTLSKey}
+
+	// dnsOverTLSValues are the supported values of DNS-over-TLS.
+	dnsOverTLSValues = []string{"yes", "opportunistic", "no"}
+)
+
+type systemdCaller interface {
+	ReloadUnit(context.Context, string) error
+	TryRestartUnit(context.Context, string) error
+}
+
+// Manager prevents writing the resolver configuration concurrently while applying the policy.
+type Manager struct {
+	resolvedConfDir string
+	hostsFile       string
+	systemdCaller   systemdCaller
+
+	mu sync.Mutex
+}
+
+type options struct {
+	resolvedConfDir string
+	hostsFile       string
+}
+
+// Option reprents an optional function to change the resolver manager.
+type Option func(*options)
+
+// WithResolvedConfDir overrides the default systemd-resolved configuration drop-in directory.
+func WithResolvedConfDir(p string) Option {
+	return func(o *options) {
+		o.resolvedConfDir = p
+	}
+}
+
+// WithHostsFile overrides the default hosts file.
+func WithHostsFile(p string) Option {
+	return func(o *options) {
+		o.hostsFile = p
+	}
+}
+
+// New returns a new manager for the resolver policy.
+func New(systemdCaller systemdCaller, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		resolvedConfDir: consts.DefaultResolvedConfDir,
+		hostsFile:       consts.DefaultHostsFile,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		resolvedConfDir: args.resolvedConfDir,
+		hostsFile:       args.hostsFile,
+		systemdCaller:   systemdCaller,
+	}
+}
+
+// ApplyPolicy writes the systemd-resolved configuration and the static host entries, or removes them if there are no settings.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply resolver policy to %s", objectName))
+
+	// Resolver configuration is only supported on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying resolver policy to %s", objectName)
+
+	settings, hosts, err := parseEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	var resolved []string
+	for _, k := range resolvedKeys {
+		if s, ok := settings[k]; ok {
+			resolved = append(resolved, s)
+		}
+	}
+
+	if err := m.applyResolvedConfig(ctx, resolved); err != nil {
+		return err
+	}
+	return updateManagedBlock(m.hostsFile, hosts)
+}
+
+// parseEntries returns the validated systemd-resolved configuration lines per key and the host entries.
+// Disabled settings are ignored.
+func parseEntries(entries []entry.Entry) (settings map[string]string, hosts []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse resolver entries"))
+
+	settings = make(map[string]string)
+	for _, e := range entries {
+		if e.Err != nil {
+			return nil, nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+		if e.Disabled {
+			continue
+		}
+
+		switch e.Key {
+		case dnsServersKey:
+			var servers []string
+			for _, s := range splitList(e.Value) {
+				if err := checkDNSServer(s); err != nil {
+					return nil, nil, err
+				}
+				if !slices.Contains(servers, s) {
+					servers = append(servers, s)
+				}
+			}
+			if len(servers) > 0 {
+				settings[e.Key] = "DNS=" + strings.Join(servers, " ")
+			}
+		case searchDomainsKey:
+			var domains []string
+			for _, d := range splitList(e.Value) {
+				// A ~ prefix makes the domain a routing-only domain, and ~. routes all queries.
+				if d != "~." && !isValidHostname(strings.TrimPrefix(d, "~")) {
+					return nil, nil, errors.New(gotext.Get("invalid search domain %q", d))
+				}
+				if !slices.Contains(domains, d) {
+					domains = append(domains, d)
+				}
+			}
+			if len(domains) > 0 {
+				settings[e.Key] = "Domains=" + strings.Join(domains, " ")
+			}
+		case dnsOverTLSKey:
+			v := strings.TrimSpace(e.Value)
+			if !slices.Contains(dnsOverTLSValues, v) {
+				return nil, nil, errors.New(gotext.Get("invalid DNS-over-TLS mode %q: expected one of %s", v, strings.Join(dnsOverTLSValues, ", ")))
+			}
+			settings[e.Key] = "DNSOverTLS=" + v
+		case hostsKey:
+			if hosts, err = parseHosts(e.Value); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return settings, hosts, nil
+}
+
+// splitList returns the non empty elements of v, separated by spaces, commas or line breaks.
+func splitList(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' })
+}
+
+// checkDNSServer checks that s is a DNS server address as read by systemd-resolved:
+// an IP address, optionally with a port, followed by the server name used for DNS-over-TLS after a #.
+func checkDNSServer(s string) error {
+	addr, name, found := strings.Cut(s, "#")
+	if found && !isValidHostname(name) {
+		return errors.New(gotext.Get("invalid DNS server %q: invalid server name %q", s, name))
+	}
+	if _, err := netip.ParseAddr(addr); err == nil {
+		return nil
+	}
+	if _, err := netip.ParseAddrPort(addr); err != nil {
+		return errors.New(gotext.Get("invalid DNS server %q: expected an IP address, optionally followed by a port", s))
+	}
+	return nil
+}
+
+// parseHosts returns the normalized host entries of v, one per line, in the form "address hostname [aliases...]".
+// Empty lines and comments are ignored.
+func parseHosts(v string) (hosts []string, err error) {
+	for _, l := range strings.Split(v, "\n") {
+		l, _, _ = strings.Cut(l, "#")
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, errors.New(gotext.Get("invalid host entry %q: expected an address followed by host names", strings.TrimSpace(l)))
+		}
+		if _, err := netip.ParseAddr(fields[0]); err != nil {
+			return nil, errors.New(gotext.Get("invalid host entry %q: %q is not an IP address", strings.TrimSpace(l), fields[0]))
+		}
+		for _, name := range fields[1:] {
+			if !isValidHostname(name) {
+				return nil, errors.New(gotext.Get("invalid host entry %q: invalid host name %q", strings.TrimSpace(l), name))
+			}
+		}
+		hosts = append(hosts, strings.Join(fields, " "))
+	}
+	return hosts, nil
+}
+
+// isValidHostname returns true if name is a valid host or domain name, optionally fully qualified.
+// Underscores are accepted, as they are used in service records.
+func isValidHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// applyResolvedConfig writes the systemd-resolved configuration, or removes it if there are no settings.
+// systemd-resolved is reloaded on any change.
+func (m *Manager) applyResolvedConfig(ctx context.Context, settings []string) (err error) {
+	p := filepath.Join(m.resolvedConfDir, configFileName)
+	defer decorate.OnError(&err, gotext.Get("can't update %q", p))
+
+	if len(settings) == 0 {
+		if err := os.Remove(p); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		m.reloadResolved(ctx)
+		return nil
+	}
+
+	content := managedFileHeader + strings.Join(settings, "\n") + "\n"
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return nil
+	}
+
+	// #nosec G301 - /etc/systemd/resolved.conf.d permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// #nosec G306 - /etc/systemd/resolved.conf.d files are world readable.
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(p+".new", p); err != nil {
+		return err
+	}
+
+	m.reloadResolved(ctx)
+	return nil
+}
+
+// reloadResolved reloads systemd-resolved so that it uses the new configuration.
+// Versions of systemd-resolved not supporting reload are restarted if running. Failures only warn.
+func (m *Manager) reloadResolved(ctx context.Context) {
+	err := m.systemdCaller.ReloadUnit(ctx, resolvedUnit)
+	if err == nil {
+		return
+	}
+	log.Debugf(ctx, "Can't reload %s, restarting it: %v", resolvedUnit, err)
+	if err := m.systemdCaller.TryRestartUnit(ctx, resolvedUnit); err != nil {
+		log.Warning(ctx, gotext.Get("Can't reload %s, the new configuration will be used on its next start: %v", resolvedUnit, err))
+	}
+}
+
+// updateManagedBlock replaces the block managed by adsys at the end of the hosts file p with hosts.
+// The block is removed if there are no host entries, and so is the file if nothing else is left.
+func updateManagedBlock(p string, hosts []string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't update %q", p))
+
+	mode := fs.FileMode(0644)
+	var lines []string
+	f, err := os.Open(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+
+		var inBlock bool
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			l := scanner.Text()
+			switch {
+			case l == blockBegin:
+				inBlock = true
+			case l == blockEnd:
+				inBlock = false
+			case !inBlock:
+				lines = append(lines, l)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		if inBlock {
+			return errors.New(gotext.Get("missing end marker of the adsys managed block"))
+		}
+		f.Close()
+	}
+
+	// Remove the empty lines we added before the block.
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(hosts) > 0 {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, blockBegin)
+		lines = append(lines, hosts...)
+		lines = append(lines, blockEnd)
+	}
+
+	if len(lines) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	// #nosec G301 - /etc permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeIfChanged(p, strings.Join(lines, "\n")+"\n", mode)
+}
+
+// writeIfChanged atomically writes content to p if it differs from the current content.
+func writeIfChanged(p, content string, mode fs.FileMode) error {
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return nil
+	}
+
+	if err := os.WriteFile(p+".new", []byte(content), mode); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,159 @@
+package resolver_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/resolver"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "resolver/dns-servers", Value: "10.0.0.1#dns.example.com\n2001:db8::1,10.0.0.2:5353"},
+		{Key: "resolver/search-domains", Value: "example.com corp.example.com\n~internal.example.com"},
+		{Key: "resolver/dns-over-tls", Value: "opportunistic"},
+		{Key: "resolver/hosts", Value: "10.0.0.10 intranet.example.com intranet\n\n# Monitoring\n2001:db8::10\tmonitoring.example.com  # IPv6 only"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		reloadFails  bool
+		restartFails bool
+
+		wantReload  bool
+		wantRestart bool
+		wantErr     bool
+	}{
+		"Apply all settings":                             {wantReload: true},
+		"Apply all settings keeps administrator hosts":   {existingState: "admin_hosts", wantReload: true},
+		"Only resolved settings":                         {entries: []entry.Entry{{Key: "resolver/dns-over-tls", Value: "yes"}}, wantReload: true},
+		"Only host entries":                              {entries: []entry.Entry{{Key: "resolver/hosts", Value: "10.0.0.10 intranet"}}, existingState: "admin_hosts"},
+		"Routing all queries to the DNS servers":         {entries: []entry.Entry{{Key: "resolver/search-domains", Value: "~."}}, wantReload: true},
+		"Duplicated servers and domains are ignored":     {entries: []entry.Entry{{Key: "resolver/dns-servers", Value: "10.0.0.1 10.0.0.1"}, {Key: "resolver/search-domains", Value: "example.com,example.com"}}, wantReload: true},
+		"Disabled settings are ignored":                  {entries: []entry.Entry{{Key: "resolver/dns-servers", Value: "10.0.0.1", Disabled: true}, {Key: "resolver/hosts", Value: "10.0.0.10 intranet", Disabled: true}, {Key: "resolver/dns-over-tls", Value: "yes"}}, wantReload: true},
+		"Empty values are ignored":                       {entries: []entry.Entry{{Key: "resolver/dns-servers", Value: " \n,"}, {Key: "resolver/search-domains", Value: ""}, {Key: "resolver/hosts", Value: "\n# only a comment\n"}}},
+		"Unknown keys are ignored":                       {entries: []entry.Entry{{Key: "resolver/unknown", Value: "something"}, {Key: "resolver/dns-over-tls", Value: "no"}}, wantReload: true},
+		"Update existing configuration":                  {existingState: "managed", wantReload: true},
+		"Configuration already up to date":               {existingState: "up_to_date"},
+		"Remove configuration with no entries":           {entries: []entry.Entry{}, existingState: "managed", wantReload: true},
+		"Remove hosts file only containing entries":      {entries: []entry.Entry{}, existingState: "hosts_only_managed"},
+		"No entries and no configuration":                {entries: []entry.Entry{}},
+		"No entries keeps administrator hosts untouched": {entries: []entry.Entry{}, existingState: "admin_hosts"},
+		"User objects are ignored":                       {isUser: true, existingState: "managed"},
+		"Restart resolved if it can't be reloaded":       {reloadFails: true, wantReload: true, wantRestart: true},
+		"Failing to restart resolved only warns":         {reloadFails: true, restartFails: true, wantReload: true, wantRestart: true},
+
+		// Error cases
+		"Error on errored entry":                        {entries: []entry.Entry{{Key: "resolver/hosts", Err: errors.New("some error")}}, wantErr: true},
+		"Error on invalid DNS server":                   {entries: []entry.Entry{{Key: "resolver/dns-servers", Value: "10.0.0.1 dns.example.com"}}, wantErr: true},
+		"Error on invalid DNS server name":              {entries: []entry.Entry{{Key: "resolver/dns-servers", Value: "10.0.0.1#-dns.example.com"}}, wantErr: true},
+		"Error on invalid search domain":                {entries: []entry.Entry{{Key: "resolver/search-domains", Value: "-example.com"}}, wantErr: true},
+		"Error on invalid DNS-over-TLS mode":            {entries: []entry.Entry{{Key: "resolver/dns-over-tls", Value: "true"}}, wantErr: true},
+		"Error on host entry without host name":         {entries: []entry.Entry{{Key: "resolver/hosts", Value: "10.0.0.10"}}, wantErr: true},
+		"Error on host entry with invalid address":      {entries: []entry.Entry{{Key: "resolver/hosts", Value: "intranet 10.0.0.10"}}, wantErr: true},
+		"Error on host entry with invalid host name":    {entries: []entry.Entry{{Key: "resolver/hosts", Value: "10.0.0.10 intra/net"}}, wantErr: true},
+		"Error on invalid value keeps existing config":  {entries: []entry.Entry{{Key: "resolver/dns-over-tls", Value: "always"}}, existingState: "managed", wantErr: true},
+		"Error on missing end marker of the hosts file": {existingState: "missing_end_marker", wantReload: true, wantErr: true},
+		"Error on configuration directory being a file": {existingState: "conf_dir_is_file", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			etcDir := filepath.Join(rootDir, "etc")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), etcDir)
+			}
+
+			systemd := &mockSystemdCaller{reloadFails: tc.reloadFails, restartFails: tc.restartFails}
+			m := resolver.New(systemd,
+				resolver.WithResolvedConfDir(filepath.Join(etcDir, "systemd", "resolved.conf.d")),
+				resolver.WithHostsFile(filepath.Join(etcDir, "hosts")),
+			)
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+
+			var wantReloads, wantRestarts []string
+			if tc.wantReload {
+				wantReloads = []string{"systemd-resolved.service"}
+			}
+			if tc.wantRestart {
+				wantRestarts = []string{"systemd-resolved.service"}
+			}
+			require.Equal(t, wantReloads, systemd.reloads, "Reloaded units don't match expectations")
+			require.Equal(t, wantRestarts, systemd.restarts, "Restarted units don't match expectations")
+
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				if tc.existingState != "managed" {
+					return
+				}
+				// The current configuration must be kept on errors.
+				for _, p := range []string{filepath.Join("systemd", "resolved.conf.d", "adsys.conf"), "hosts"} {
+					got, err := os.ReadFile(filepath.Join(etcDir, p))
+					require.NoError(t, err, "Existing configuration should be kept")
+					want, err := os.ReadFile(filepath.Join(testutils.TestFamilyPath(t), "states", "managed", p))
+					require.NoError(t, err, "Setup: can't read existing configuration")
+					require.Equal(t, string(want), string(got), "Existing configuration should not be modified")
+				}
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, etcDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockSystemdCaller records if systemd-resolved was reloaded or restarted, and can fail to do so.
+type mockSystemdCaller struct {
+	testutils.MockSystemdCaller
+
+	reloadFails  bool
+	restartFails bool
+
+	mu       sync.Mutex
+	reloads  []string
+	restarts []string
+}
+
+func (s *mockSystemdCaller) ReloadUnit(_ context.Context, unit string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reloads = append(s.reloads, unit)
+	if s.reloadFails {
+		return fmt.Errorf("reload of %s failed as requested", unit)
+	}
+	return nil
+}
+
+func (s *mockSystemdCaller) TryRestartUnit(_ context.Context, unit string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.restarts = append(s.restarts, unit)
+	if s.restartFails {
+		return fmt.Errorf("restart of %s failed as requested", unit)
+	}
+	return nil
+}
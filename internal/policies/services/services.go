@@ -0,0 +1,395 @@
+// Package services provides a manager to enable, disable and mask systemd units.
+//
+// This manager only applies to computer objects.
+//
+// The policy is made of 3 lists of units:
+//   - services/enable: units to enable and start;
+//   - services/disable: units to stop and disable;
+//   - services/mask: units to stop and mask.
+//
+// Units without a known systemd suffix are considered to be services.
+//
+// The first time a unit is managed, its original unit file state (enabled, disabled, masked…) is
+// saved in the state directory. Once the unit is no longer referenced by the policy, this original
+// state is restored. A masked unit to enable or disable is unmasked first, with a warning.
+//
+// Should the manager fail to query or change a unit file state, an error is returned and
+// authentication will be prevented. Failing to start or stop a unit only logs a warning.
+package services
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	actionEnable  = "enable"
+	actionDisable = "disable"
+	actionMask    = "mask"
+
+	stateFile = "units"
+)
+
+// unitNameRegexp matches valid systemd unit names.
+var unitNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9:_.\\@-]+$`)
+
+// unitSuffixes are the systemd unit types that can be managed.
+var unitSuffixes = []string{".service", ".socket", ".timer", ".path", ".target", ".mount", ".automount", ".swap"}
+
+type systemdCaller interface {
+	StartUnit(context.Context, string) error
+	StopUnit(context.Context, string) error
+	EnableUnit(context.Context, string) error
+	DisableUnit(context.Context, string) error
+	MaskUnit(context.Context, string) error
+	UnmaskUnit(context.Context, string) error
+	UnitFileState(context.Context, string) (string, error)
+	DaemonReload(context.Context) error
+}
+
+// unitState is the state of a unit managed by adsys.
+type unitState struct {
+	// original is the unit file state before adsys managed the unit.
+	original string
+	// applied is the last action applied by adsys on the unit.
+	applied string
+}
+
+// Manager prevents changing unit states concurrently while applying the policy.
+type Manager struct {
+	stateDir      string
+	systemdCaller systemdCaller
+
+	mu sync.Mutex
+}
+
+type options struct {
+	stateDir string
+}
+
+// Option reprents an optional function to change the services manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) Option {
+	return func(o *options) {
+		o.stateDir = p
+	}
+}
+
+// New returns a new manager for the services policy.
+func New(systemdCaller systemdCaller, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir: consts.DefaultStateDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:      filepath.Join(args.stateDir, "services"),
+		systemdCaller: systemdCaller,
+	}
+}
+
+// ApplyPolicy enables, disables or masks the units listed in entries.
+// Units previously managed by adsys which are not referenced anymore are restored to their original state.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply services policy to %s", objectName))
+
+	// Units are only managed on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying services policy to %s", objectName)
+
+	wanted, err := parseEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	states, err := m.readState()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply and nothing to restore.
+	if len(wanted) == 0 && len(states) == 0 {
+		return nil
+	}
+
+	// Always save the original states we know about, even on partial failure, so that they can be restored later on.
+	defer func() {
+		if errSave := m.saveState(states); errSave != nil {
+			err = errors.Join(err, errSave)
+		}
+	}()
+
+	var unitsToStart []string
+
+	// Restore units that are not referenced anymore.
+	for _, unit := range sortedKeys(states) {
+		if _, ok := wanted[unit]; ok {
+			continue
+		}
+		start, err := m.restore(ctx, unit, states[unit])
+		if err != nil {
+			return err
+		}
+		if start {
+			unitsToStart = append(unitsToStart, unit)
+		}
+		delete(states, unit)
+	}
+
+	// Apply requested actions.
+	for _, unit := range sortedKeys(wanted) {
+		action := wanted[unit]
+		st, ok := states[unit]
+		if !ok {
+			original, err := m.systemdCaller.UnitFileState(ctx, unit)
+			if err != nil {
+				return err
+			}
+			st = unitState{original: original}
+		}
+		previous := st.applied
+
+		// Record the state before changing the unit so that it can be restored even if the action partially failed.
+		st.applied = action
+		states[unit] = st
+
+		// A unit we masked needs to be unmasked before changing its state.
+		// So does a unit masked before adsys managed it: its original state is masked again on restore.
+		if action != actionMask && (previous == actionMask || (previous == "" && st.original == "masked")) {
+			if previous != actionMask {
+				log.Warning(ctx, gotext.Get("Unit %q is masked: unmasking it to %s it. It will be masked again once it is not referenced by the policy anymore.", unit, action))
+			}
+			if err := m.systemdCaller.UnmaskUnit(ctx, unit); err != nil {
+				return err
+			}
+		}
+
+		switch action {
+		case actionEnable:
+			if err := m.systemdCaller.EnableUnit(ctx, unit); err != nil {
+				return err
+			}
+			unitsToStart = append(unitsToStart, unit)
+		case actionDisable:
+			m.stopUnit(ctx, unit)
+			if err := m.systemdCaller.DisableUnit(ctx, unit); err != nil {
+				return err
+			}
+		case actionMask:
+			m.stopUnit(ctx, unit)
+			if err := m.systemdCaller.MaskUnit(ctx, unit); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Reload systemd to take unit file changes into account.
+	if err := m.systemdCaller.DaemonReload(ctx); err != nil {
+		return err
+	}
+
+	for _, unit := range unitsToStart {
+		if err := m.systemdCaller.StartUnit(ctx, unit); err != nil {
+			log.Warning(ctx, gotext.Get("Failed to start unit %q: %v", unit, err))
+		}
+	}
+
+	return nil
+}
+
+// restore reverts the action applied by adsys on the unit to its original state.
+// It returns true if the unit needs to be started once systemd is reloaded.
+func (m *Manager) restore(ctx context.Context, unit string, st unitState) (start bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't restore original state of unit %s", unit))
+
+	log.Debugf(ctx, "Restoring unit %q to its original %q state", unit, st.original)
+
+	if st.applied == actionMask && st.original != "masked" {
+		if err := m.systemdCaller.UnmaskUnit(ctx, unit); err != nil {
+			return false, err
+		}
+	}
+
+	switch st.original {
+	case "enabled":
+		if st.applied == actionEnable {
+			return false, nil
+		}
+		if err := m.systemdCaller.EnableUnit(ctx, unit); err != nil {
+			return false, err
+		}
+		return true, nil
+	case "disabled":
+		if st.applied != actionEnable {
+			return false, nil
+		}
+		m.stopUnit(ctx, unit)
+		if err := m.systemdCaller.DisableUnit(ctx, unit); err != nil {
+			return false, err
+		}
+	case "masked":
+		if st.applied == actionMask {
+			return false, nil
+		}
+		m.stopUnit(ctx, unit)
+		if err := m.systemdCaller.MaskUnit(ctx, unit); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// stopUnit stops the unit, only warning on failure.
+func (m *Manager) stopUnit(ctx context.Context, unit string) {
+	if err := m.systemdCaller.StopUnit(ctx, unit); err != nil {
+		log.Warning(ctx, gotext.Get("Failed to stop unit %q: %v", unit, err))
+	}
+}
+
+// parseEntries returns the requested action for each unit.
+// Disabled entries are ignored.
+func parseEntries(entries []entry.Entry) (wanted map[string]string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse services entries"))
+
+	wanted = make(map[string]string)
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+
+		var action string
+		switch e.Key {
+		case "services/enable":
+			action = actionEnable
+		case "services/disable":
+			action = actionDisable
+		case "services/mask":
+			action = actionMask
+		default:
+			continue
+		}
+
+		if e.Err != nil {
+			return nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		for _, unit := range strings.Split(e.Value, "\n") {
+			unit = strings.TrimSpace(unit)
+			if unit == "" {
+				continue
+			}
+			if !unitNameRegexp.MatchString(unit) {
+				return nil, errors.New(gotext.Get("invalid unit name %q", unit))
+			}
+			if !slices.Contains(unitSuffixes, filepath.Ext(unit)) {
+				unit += ".service"
+			}
+
+			if prev, ok := wanted[unit]; ok && prev != action {
+				return nil, errors.New(gotext.Get("unit %q is requested to be both %sd and %sed", unit, prev, action))
+			}
+			wanted[unit] = action
+		}
+	}
+
+	return wanted, nil
+}
+
+// readState returns the states of the units managed by adsys.
+// A missing state file means no unit is managed.
+func (m *Manager) readState() (states map[string]unitState, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't read services state"))
+
+	states = make(map[string]unitState)
+
+	f, err := os.Open(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// Unit files without a state are saved with an empty original state.
+		fields := strings.Split(line, " ")
+		if len(fields) != 3 {
+			return nil, errors.New(gotext.Get("invalid line in services state: %q", line))
+		}
+		states[fields[0]] = unitState{original: fields[1], applied: fields[2]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// saveState atomically writes the states of the units managed by adsys.
+// The state file is removed if there are no units to track.
+func (m *Manager) saveState(states map[string]unitState) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save services state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(states) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	for _, unit := range sortedKeys(states) {
+		fmt.Fprintf(&content, "%s %s %s\n", unit, states[unit].original, states[unit].applied)
+	}
+	if err := os.WriteFile(p+".new", []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// sortedKeys returns the keys of the map, sorted.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,180 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/services"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "services/enable", Value: "ssh\ncups.socket"},
+		{Key: "services/disable", Value: "bluetooth.service"},
+		{Key: "services/mask", Value: "avahi-daemon"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		unitFileStates map[string]string
+		failOn         map[string]string
+
+		wantErr bool
+	}{
+		// Computer cases
+		"Computer, all actions":                                      {},
+		"Computer, only enable":                                      {entries: []entry.Entry{{Key: "services/enable", Value: "ssh"}}},
+		"Computer, unit types are kept":                              {entries: []entry.Entry{{Key: "services/enable", Value: "cups.socket\nfstrim.timer\nmnt-data.mount"}}},
+		"Computer, template units":                                   {entries: []entry.Entry{{Key: "services/enable", Value: "getty@tty2"}}},
+		"Computer, duplicated units and blank lines":                 {entries: []entry.Entry{{Key: "services/mask", Value: "avahi-daemon\n\n  avahi-daemon.service  \n"}}},
+		"Computer, unknown keys are ignored":                         {entries: []entry.Entry{{Key: "services/enable", Value: "ssh"}, {Key: "services/unknown", Value: "cups"}}},
+		"Computer, disabled entries are ignored":                     {entries: []entry.Entry{{Key: "services/enable", Value: "ssh"}, {Key: "services/mask", Value: "cups", Disabled: true}}},
+		"Computer, no entries and no state":                          {entries: []entry.Entry{}},
+		"Computer, originally masked unit is unmasked to be enabled": {entries: []entry.Entry{{Key: "services/enable", Value: "ssh"}}, unitFileStates: map[string]string{"ssh.service": "masked"}},
+
+		// State restoration cases
+		"Computer, already managed units keep their original state": {existingState: "managed"},
+		"Computer, unreferenced units are restored":                 {entries: []entry.Entry{}, existingState: "managed"},
+		"Computer, only disabled entries restores units":            {entries: []entry.Entry{{Key: "services/enable", Value: "ssh", Disabled: true}}, existingState: "managed"},
+		"Computer, masked unit changed to enabled is unmasked":      {entries: []entry.Entry{{Key: "services/enable", Value: "avahi-daemon"}}, existingState: "managed"},
+		"Computer, originally masked units are masked again":        {entries: []entry.Entry{}, existingState: "originally_masked"},
+
+		// User cases
+		"User, entries are ignored": {isUser: true},
+
+		// Other edge cases
+		"Computer, failing to start or stop units is not an error": {failOn: map[string]string{"start": "ssh.service", "stop": "bluetooth.service"}},
+
+		// Error cases
+		"Error on errored entry":                 {entries: []entry.Entry{{Key: "services/enable", Value: "ssh", Err: errors.New("some error")}}, wantErr: true},
+		"Error on invalid unit name":             {entries: []entry.Entry{{Key: "services/enable", Value: "ssh;reboot"}}, wantErr: true},
+		"Error on unit in multiple lists":        {entries: []entry.Entry{{Key: "services/enable", Value: "ssh"}, {Key: "services/mask", Value: "ssh.service"}}, wantErr: true},
+		"Error on invalid state file":            {existingState: "invalid", wantErr: true},
+		"Error on querying unit file state":      {failOn: map[string]string{"state": "bluetooth.service"}, wantErr: true},
+		"Error on enabling unit, state is saved": {failOn: map[string]string{"enable": "ssh.service"}, wantErr: true},
+		"Error on disabling unit":                {failOn: map[string]string{"disable": "bluetooth.service"}, wantErr: true},
+		"Error on masking unit":                  {failOn: map[string]string{"mask": "avahi-daemon.service"}, wantErr: true},
+		"Error on unmasking unit":                {entries: []entry.Entry{{Key: "services/enable", Value: "avahi-daemon"}}, existingState: "managed", failOn: map[string]string{"unmask": "avahi-daemon.service"}, wantErr: true},
+		"Error on restoring unit, state is kept": {entries: []entry.Entry{}, existingState: "managed", failOn: map[string]string{"enable": "bluetooth.service"}, wantErr: true},
+		"Error on daemon reload":                 {failOn: map[string]string{"reload": ""}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+			if tc.unitFileStates == nil {
+				tc.unitFileStates = map[string]string{
+					"ssh.service":          "disabled",
+					"cups.socket":          "enabled",
+					"bluetooth.service":    "enabled",
+					"avahi-daemon.service": "enabled",
+				}
+			}
+
+			stateDir := t.TempDir()
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), filepath.Join(stateDir, "services"))
+			}
+
+			systemd := &mockSystemdCaller{unitFileStates: tc.unitFileStates, failOn: tc.failOn}
+
+			m := services.New(systemd, services.WithStateDir(stateDir))
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				// We don't return here as we want to check that the state
+				// is saved even in error cases.
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			testutils.CompareTreesWithFiltering(t, filepath.Join(stateDir, "services"), filepath.Join(testutils.GoldenPath(t), "services"), testutils.UpdateEnabled())
+
+			got := systemd.String()
+			want := testutils.LoadWithUpdateFromGolden(t, got, testutils.WithGoldenPath(filepath.Join(testutils.GoldenPath(t), "systemd_calls")))
+			require.Equal(t, want, got, "systemd calls don't match")
+		})
+	}
+}
+
+// mockSystemdCaller records the calls made to systemd and can fail on a given action for a given unit.
+type mockSystemdCaller struct {
+	unitFileStates map[string]string
+	failOn         map[string]string
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (s *mockSystemdCaller) call(action, unit string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls = append(s.calls, strings.TrimSpace(fmt.Sprintf("%s %s", action, unit)))
+	if u, ok := s.failOn[action]; ok && u == unit {
+		return fmt.Errorf("%s failed on %q as requested", action, unit)
+	}
+	return nil
+}
+
+func (s *mockSystemdCaller) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.calls) == 0 {
+		return "systemd was not called\n"
+	}
+	return strings.Join(s.calls, "\n") + "\n"
+}
+
+func (s *mockSystemdCaller) StartUnit(_ context.Context, unit string) error {
+	return s.call("start", unit)
+}
+
+func (s *mockSystemdCaller) StopUnit(_ context.Context, unit string) error {
+	return s.call("stop", unit)
+}
+
+func (s *mockSystemdCaller) EnableUnit(_ context.Context, unit string) error {
+	return s.call("enable", unit)
+}
+
+func (s *mockSystemdCaller) DisableUnit(_ context.Context, unit string) error {
+	return s.call("disable", unit)
+}
+
+func (s *mockSystemdCaller) MaskUnit(_ context.Context, unit string) error {
+	return s.call("mask", unit)
+}
+
+func (s *mockSystemdCaller) UnmaskUnit(_ context.Context, unit string) error {
+	return s.call("unmask", unit)
+}
+
+func (s *mockSystemdCaller) UnitFileState(_ context.Context, unit string) (string, error) {
+	if err := s.call("state", unit); err != nil {
+		return "", err
+	}
+	return s.unitFileStates[unit], nil
+}
+
+func (s *mockSystemdCaller) DaemonReload(_ context.Context) error {
+	return s.call("reload", "")
+}
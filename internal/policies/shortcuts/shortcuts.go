@@ -0,0 +1,607 @@
+// Package shortcuts is the policy manager for desktop shortcuts and application launchers.
+//
+// Shortcuts are defined one per line, in the form:
+//
+//	<id> | <name> | <command> [| icon=<icon>] [| categories=<category>;<category>...] [| pin]
+//
+// They are written as .desktop files, depending on the key of the entry:
+//   - shortcuts/applications (computer): launchers in the application grid, written in
+//     /usr/local/share/applications/adsys/<id>.desktop, which gives them the adsys-<id>.desktop desktop file ID.
+//     Those launchers can be pinned with the pin flag, which adds them to the org/gnome/shell/favorite-apps
+//     dconf key of the machine;
+//   - shortcuts/autostart (user): applications started on login, in ~/.config/autostart/adsys-<id>.desktop;
+//   - shortcuts/desktop (user): shortcuts on the desktop, in the XDG desktop directory of the user.
+//
+// The icon is either an icon name from the icon theme, or an image (.png, .svg, .svgz or .xpm) relative to
+// the SYSVOL icons/ subdirectory. Images are copied to /usr/local/share/adsys/icons/.
+//
+// If an id is listed multiple times, the closest GPO wins. Shortcuts which are not referenced anymore are removed.
+package shortcuts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	applicationsKey = "shortcuts/applications"
+	autostartKey    = "shortcuts/autostart"
+	desktopKey      = "shortcuts/desktop"
+
+	// favoriteAppsKey is the dconf key of the applications pinned to the dash.
+	favoriteAppsKey = "org/gnome/shell/favorite-apps"
+
+	// filePrefix is the prefix of the shortcuts written in the user directories.
+	filePrefix = "adsys-"
+)
+
+var (
+	// userAutostartDir is the autostart directory relative to the user home directory.
+	userAutostartDir = filepath.Join(".config", "autostart")
+	// userDirsFile is the XDG user directories configuration, relative to the user home directory.
+	userDirsFile = filepath.Join(".config", "user-dirs.dirs")
+	// defaultDesktopDir is the desktop directory relative to the user home directory, when not configured.
+	defaultDesktopDir = "Desktop"
+)
+
+var (
+	idRegexp       = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	iconNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+	categoryRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+	// iconExtensions are the image formats supported for icons shipped in SYSVOL.
+	iconExtensions = []string{".png", ".svg", ".svgz", ".xpm"}
+)
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
+// Manager prevents writing the shortcuts concurrently while applying the policy.
+type Manager struct {
+	applicationsDir string
+	iconsDir        string
+
+	userLookup func(string) (*user.User, error)
+
+	mu sync.Mutex
+}
+
+type options struct {
+	applicationsDir string
+	iconsDir        string
+	userLookup      func(string) (*user.User, error)
+}
+
+// Option reprents an optional function to change the shortcuts manager.
+type Option func(*options)
+
+// WithApplicationsDir overrides the default directory of the application launchers.
+func WithApplicationsDir(p string) Option {
+	return func(o *options) {
+		o.applicationsDir = p
+	}
+}
+
+// WithIconsDir overrides the default directory of the shortcut icons.
+func WithIconsDir(p string) Option {
+	return func(o *options) {
+		o.iconsDir = p
+	}
+}
+
+// shortcut is a .desktop file to write.
+type shortcut struct {
+	id         string
+	name       string
+	exec       string
+	icon       string
+	iconAsset  bool
+	categories string
+	pin        bool
+}
+
+// New returns a new manager for the shortcuts policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		applicationsDir: consts.DefaultApplicationsDir,
+		iconsDir:        consts.DefaultShortcutIconsDir,
+		userLookup:      user.Lookup,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		applicationsDir: args.applicationsDir,
+		iconsDir:        args.iconsDir,
+		userLookup:      args.userLookup,
+	}
+}
+
+// ApplyPolicy writes the shortcuts of the object, and removes the ones which are not referenced anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply shortcuts policy to %s", objectName))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying shortcuts policy to %s", objectName)
+
+	if isComputer {
+		applications, err := parseEntries(entries, applicationsKey)
+		if err != nil {
+			return err
+		}
+		iconsDir := filepath.Join(m.iconsDir, "machine")
+		if err := m.saveIcons(ctx, iconsDir, applications, assetsDumper); err != nil {
+			return err
+		}
+		return writeApplications(m.applicationsDir, iconsDir, applications)
+	}
+
+	autostart, err := parseEntries(entries, autostartKey)
+	if err != nil {
+		return err
+	}
+	desktop, err := parseEntries(entries, desktopKey)
+	if err != nil {
+		return err
+	}
+
+	u, err := m.userLookup(objectName)
+	if err != nil {
+		return errors.New(gotext.Get("couldn't retrieve user for %q: %v", objectName, err))
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return errors.New(gotext.Get("couldn't convert %q to a valid uid for %q", u.Uid, objectName))
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return errors.New(gotext.Get("couldn't convert %q to a valid gid for %q", u.Gid, objectName))
+	}
+
+	iconsDir := filepath.Join(m.iconsDir, objectName)
+	if err := m.saveIcons(ctx, iconsDir, slices.Concat(autostart, desktop), assetsDumper); err != nil {
+		return err
+	}
+
+	// The home directory is created on first login: nothing to clean up, and the shortcuts will be
+	// written on next refresh.
+	if _, err := os.Stat(u.HomeDir); errors.Is(err, fs.ErrNotExist) {
+		if len(autostart) > 0 || len(desktop) > 0 {
+			log.Warning(ctx, gotext.Get("Home directory %q of %q doesn't exist yet, shortcuts will be created on next refresh", u.HomeDir, objectName))
+		}
+		return nil
+	}
+
+	if err := writeUserShortcuts(u.HomeDir, userAutostartDir, iconsDir, autostart, 0600, uid, gid); err != nil {
+		return err
+	}
+	// Desktop shortcuts need to be executable to be launched from the desktop.
+	return writeUserShortcuts(u.HomeDir, desktopDir(u.HomeDir), iconsDir, desktop, 0700, uid, gid)
+}
+
+// PinFavoriteApps returns the machine dconf entries, with the application launchers pinned in entries
+// added to the favorite applications.
+// If the favorite applications are explicitly reset to the system default, they are left untouched.
+// Errors in entries are ignored here, as they are reported when applying the policy.
+func PinFavoriteApps(dconfEntries, entries []entry.Entry) []entry.Entry {
+	applications, err := parseEntries(entries, applicationsKey)
+	if err != nil {
+		return dconfEntries
+	}
+	var pinned []string
+	for _, s := range applications {
+		if s.pin {
+			pinned = append(pinned, filePrefix+s.id+".desktop")
+		}
+	}
+	if len(pinned) == 0 {
+		return dconfEntries
+	}
+
+	r := slices.Clone(dconfEntries)
+	i := slices.IndexFunc(r, func(e entry.Entry) bool { return e.Key == favoriteAppsKey })
+	if i == -1 {
+		return append(r, entry.Entry{Key: favoriteAppsKey, Value: strings.Join(pinned, "\n"), Meta: "as"})
+	}
+	if r[i].Disabled {
+		return r
+	}
+
+	// Strip the list delimiters, and follow the quoting of the existing values, so that the
+	// dconf manager can normalize the result.
+	v := strings.TrimSpace(r[i].Value)
+	if strings.HasPrefix(v, "[") {
+		v = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(v, "["), "]"))
+	}
+	for _, id := range pinned {
+		if strings.Contains(v, id) {
+			continue
+		}
+		if strings.Contains(v, "'") {
+			id = fmt.Sprintf("'%s'", id)
+		}
+		v = strings.TrimPrefix(v+"\n"+id, "\n")
+	}
+	r[i].Value = v
+	return r
+}
+
+// parseEntries returns the shortcuts from the entries matching key.
+// When an id is listed multiple times, the closest GPO wins. Disabled entries are ignored.
+func parseEntries(entries []entry.Entry, key string) (shortcuts []shortcut, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse shortcuts entries"))
+
+	for _, e := range entries {
+		if e.Disabled || e.Key != key {
+			continue
+		}
+		if e.Err != nil {
+			return nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		for _, line := range strings.Split(e.Value, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			s, err := parseLine(line, key)
+			if err != nil {
+				return nil, err
+			}
+			shortcuts = append(shortcuts, s)
+		}
+	}
+
+	return entry.KeepClosest(shortcuts, func(s shortcut) string { return s.id }, nil), nil
+}
+
+// parseLine returns the shortcut defined by line for key.
+func parseLine(line, key string) (s shortcut, err error) {
+	fields := strings.Split(line, "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) < 3 {
+		return s, errors.New(gotext.Get("invalid shortcut %q: expected <id> | <name> | <command>", line))
+	}
+
+	s = shortcut{id: fields[0], name: fields[1], exec: fields[2]}
+	if !idRegexp.MatchString(s.id) {
+		return s, errors.New(gotext.Get("invalid shortcut id %q", s.id))
+	}
+	if s.name == "" {
+		return s, errors.New(gotext.Get("shortcut %q has no name", s.id))
+	}
+	if s.exec == "" {
+		return s, errors.New(gotext.Get("shortcut %q has no command", s.id))
+	}
+
+	for _, opt := range fields[3:] {
+		name, value, _ := strings.Cut(opt, "=")
+		switch strings.TrimSpace(name) {
+		case "icon":
+			if err := s.setIcon(strings.TrimSpace(value)); err != nil {
+				return s, err
+			}
+		case "categories":
+			var categories []string
+			for _, c := range strings.Split(value, ";") {
+				c = strings.TrimSpace(c)
+				if c == "" {
+					continue
+				}
+				if !categoryRegexp.MatchString(c) {
+					return s, errors.New(gotext.Get("invalid category %q for shortcut %q", c, s.id))
+				}
+				categories = append(categories, c+";")
+			}
+			s.categories = strings.Join(categories, "")
+		case "pin":
+			if key != applicationsKey {
+				return s, errors.New(gotext.Get("shortcut %q can't be pinned: only application launchers can be pinned", s.id))
+			}
+			s.pin = true
+		default:
+			return s, errors.New(gotext.Get("unknown option %q for shortcut %q", opt, s.id))
+		}
+	}
+
+	return s, nil
+}
+
+// setIcon sets the icon of s, which is either an image in SYSVOL or an icon name.
+func (s *shortcut) setIcon(icon string) error {
+	if slices.Contains(iconExtensions, strings.ToLower(filepath.Ext(icon))) {
+		icon = filepath.Clean(icon)
+		if !filepath.IsLocal(icon) {
+			return errors.New(gotext.Get("icon %q of shortcut %q is not in SYSVOL icons/ subdirectory", icon, s.id))
+		}
+		s.icon, s.iconAsset = icon, true
+		return nil
+	}
+
+	if !iconNameRegexp.MatchString(icon) {
+		return errors.New(gotext.Get("invalid icon %q for shortcut %q", icon, s.id))
+	}
+	s.icon = icon
+	return nil
+}
+
+// saveIcons dumps the SYSVOL icons to dir if any shortcut references one, and removes dir otherwise.
+func (m *Manager) saveIcons(ctx context.Context, dir string, shortcuts []shortcut, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save shortcut icons"))
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(shortcuts, func(s shortcut) bool { return s.iconAsset }) {
+		return nil
+	}
+
+	// #nosec G301 - icons are displayed in the session of every user.
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	if err := assetsDumper(ctx, "icons/", dir, -1, -1); err != nil {
+		return err
+	}
+
+	// Assets are only readable by root once dumped.
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		mode := fs.FileMode(0644)
+		if d.IsDir() {
+			mode = 0755
+		}
+		return os.Chmod(p, mode)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range shortcuts {
+		if !s.iconAsset {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(dir, s.icon))
+		if errors.Is(err, fs.ErrNotExist) {
+			return errors.New(gotext.Get("icon %q of shortcut %q doesn't exist in SYSVOL icons/ subdirectory", s.icon, s.id))
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return errors.New(gotext.Get("icon %q of shortcut %q is not a regular file", s.icon, s.id))
+		}
+	}
+
+	return nil
+}
+
+// writeApplications writes the application launchers to dir, which is fully managed by adsys.
+func writeApplications(dir, iconsDir string, shortcuts []shortcut) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write application launchers"))
+
+	if len(shortcuts) == 0 {
+		return os.RemoveAll(dir)
+	}
+
+	// #nosec G301 - launchers are displayed in the session of every user.
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var names []string
+	for _, s := range shortcuts {
+		name := s.id + ".desktop"
+		if err := writeFile(filepath.Join(dir, name), s.desktopFile(iconsDir), 0644, -1, -1); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+
+	return removeStale(dir, names, func(string) bool { return true })
+}
+
+// writeUserShortcuts writes the shortcuts to the directory relDir of home, owned by uid and gid.
+// Shortcuts previously written by adsys in this directory are removed if not referenced anymore.
+func writeUserShortcuts(home, relDir, iconsDir string, shortcuts []shortcut, mode fs.FileMode, uid, gid int) (err error) {
+	dir := filepath.Join(home, relDir)
+	defer decorate.OnError(&err, gotext.Get("can't write shortcuts to %q", dir))
+
+	if len(shortcuts) > 0 {
+		// Create the directories owned by the user, and refuse to follow symlinks the user could have
+		// planted in their home directory.
+		p := home
+		for _, d := range strings.Split(relDir, string(filepath.Separator)) {
+			p = filepath.Join(p, d)
+			if err := mkdirAsUser(p, uid, gid); err != nil {
+				return err
+			}
+		}
+	} else if fi, err := os.Lstat(dir); err != nil || !fi.IsDir() {
+		// Nothing to write, and nothing we could have written.
+		return nil
+	}
+
+	var names []string
+	for _, s := range shortcuts {
+		name := filePrefix + s.id + ".desktop"
+		if err := writeFile(filepath.Join(dir, name), s.desktopFile(iconsDir), mode, uid, gid); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+
+	return removeStale(dir, names, func(name string) bool { return strings.HasPrefix(name, filePrefix) })
+}
+
+// removeStale removes the .desktop files of dir matching isManaged which are not in names.
+func removeStale(dir string, names []string, isManaged func(string) bool) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirEntries {
+		name := d.Name()
+		if d.IsDir() || filepath.Ext(name) != ".desktop" || !isManaged(name) || slices.Contains(names, name) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// desktopFile returns the content of the .desktop file of s. Icons from SYSVOL are looked up in iconsDir.
+func (s shortcut) desktopFile(iconsDir string) []byte {
+	var b bytes.Buffer
+	b.WriteString(`# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+[Desktop Entry]
+Type=Application
+`)
+	fmt.Fprintf(&b, "Name=%s\n", strings.ReplaceAll(s.name, `\`, `\\`))
+	fmt.Fprintf(&b, "Exec=%s\n", s.exec)
+	if s.icon != "" {
+		icon := s.icon
+		if s.iconAsset {
+			icon = filepath.Join(iconsDir, s.icon)
+		}
+		fmt.Fprintf(&b, "Icon=%s\n", icon)
+	}
+	if s.categories != "" {
+		fmt.Fprintf(&b, "Categories=%s\n", s.categories)
+	}
+	return b.Bytes()
+}
+
+// desktopDir returns the XDG desktop directory relative to home.
+// It falls back to ~/Desktop if it is not configured or is not inside home.
+func desktopDir(home string) string {
+	p := filepath.Join(home, userDirsFile)
+	if fi, err := os.Lstat(p); err != nil || !fi.Mode().IsRegular() {
+		return defaultDesktopDir
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return defaultDesktopDir
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		v, found := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "XDG_DESKTOP_DIR=")
+		if !found {
+			continue
+		}
+		v = strings.Trim(v, `"`)
+		if rel, found := strings.CutPrefix(v, "$HOME/"); found {
+			v = filepath.Join(home, rel)
+		}
+		rel, err := filepath.Rel(home, filepath.Clean(v))
+		if err != nil || rel == "." || !filepath.IsLocal(rel) {
+			return defaultDesktopDir
+		}
+		return rel
+	}
+
+	return defaultDesktopDir
+}
+
+// mkdirAsUser creates the directory p owned by uid and gid if it doesn't exist.
+// It errors out if p exists and is not a directory, including if it is a symlink.
+func mkdirAsUser(p string, uid, gid int) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't create directory %q", p))
+
+	fi, err := os.Lstat(p)
+	if err == nil {
+		if !fi.IsDir() {
+			return errors.New(gotext.Get("%q is not a directory", p))
+		}
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := os.Mkdir(p, 0700); err != nil {
+		return err
+	}
+	return chown(p, nil, uid, gid)
+}
+
+// writeFile atomically writes content to p with the given mode, owned by uid and gid.
+func writeFile(p string, content []byte, mode fs.FileMode, uid, gid int) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write %q", p))
+
+	// Remove any leftover, which could be a symlink in the user directory.
+	if err := os.Remove(p + ".new"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(p+".new", os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(content); err != nil {
+		return err
+	}
+	// Enforce the mode, which is restricted by the umask on creation.
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+	if err := chown(p+".new", f, uid, gid); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(p+".new", p)
+}
+
+// chown either chown the file descriptor attached, or the path if this one is null to uid and gid.
+// It will know if we should skip chown for tests.
+func chown(p string, f *os.File, uid, gid int) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't chown %q", p))
+
+	if os.Getenv("ADSYS_SKIP_ROOT_CALLS") != "" {
+		uid = -1
+		gid = -1
+	}
+
+	if f == nil {
+		// Ensure that if p is a symlink, we only change the symlink itself, not what was pointed by it.
+		return os.Lchown(p, uid, gid)
+	}
+
+	return f.Chown(uid, gid)
+}
@@ -0,0 +1,249 @@
+package shortcuts_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/shortcuts"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "shortcuts/applications", Value: `portal | Corporate portal | xdg-open https://portal.example.com | icon=portal.png | categories=Network;WebBrowser | pin
+support | IT support | /opt/corp/bin/support --ticket | icon=apps/support.svg
+terminal | Terminal | gnome-terminal | icon=org.gnome.Terminal | categories=System;`},
+		{Key: "shortcuts/autostart", Value: "sync | Document sync | /opt/corp/bin/sync --background"},
+		{Key: "shortcuts/desktop", Value: "portal | Corporate portal | xdg-open https://portal.example.com | icon=portal.png\nhelp | Help desk | xdg-open https://help.example.com"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		objectName    string
+		existingState string
+
+		saveAssetsError bool
+
+		wantErr bool
+	}{
+		"Machine application launchers":            {},
+		"User autostart and desktop shortcuts":     {isUser: true},
+		"Update machine launchers":                 {existingState: "managed_machine"},
+		"Update user shortcuts":                    {isUser: true, existingState: "managed_user"},
+		"Remove machine launchers with no entries": {entries: []entry.Entry{}, existingState: "managed_machine"},
+		"Remove user shortcuts with no entries":    {entries: []entry.Entry{}, isUser: true, existingState: "managed_user"},
+		"No entries and no shortcuts":              {entries: []entry.Entry{}},
+		"No entries and no user shortcuts":         {entries: []entry.Entry{}, isUser: true},
+		"Desktop shortcuts follow XDG desktop dir": {isUser: true, existingState: "user_dirs"},
+		"Desktop dir outside of home falls back":   {isUser: true, existingState: "user_dirs_outside_home"},
+		"Home directory not created yet":           {isUser: true, objectName: "nohome@example.com"},
+		"Closest GPO shortcut with the same id wins": {entries: uniqueEntries(
+			[]entry.Entry{{Key: "shortcuts/applications", Value: "portal | Corporate portal | xdg-open https://portal.example.com", Strategy: entry.StrategyAppend}},
+			[]entry.Entry{{Key: "shortcuts/applications", Value: "portal | Other | other\nterminal | Terminal | gnome-terminal", Strategy: entry.StrategyAppend}},
+		)},
+		"Comments and empty lines are ignored":     {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "# Corporate tools\n\n  terminal | Terminal | gnome-terminal  \n"}}},
+		"Categories are normalized":                {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal | categories= System ;;Utility"}}},
+		"Disabled entries are ignored":             {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal", Disabled: true}}, existingState: "managed_machine"},
+		"User keys are ignored for machines":       {entries: []entry.Entry{{Key: "shortcuts/desktop", Value: "terminal | Terminal | gnome-terminal"}}},
+		"Machine keys are ignored for users":       {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal"}}, isUser: true},
+		"Icons are not dumped if none is an asset": {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal | icon=utilities-terminal"}}, saveAssetsError: true},
+		"Backslashes in names are escaped":         {entries: []entry.Entry{{Key: "shortcuts/applications", Value: `share | \\server\share | nautilus smb://server/share`}}},
+
+		// Error cases
+		"Error on errored entry":                {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal", Err: errors.New("some error")}}, wantErr: true},
+		"Error on missing command":              {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal"}}, wantErr: true},
+		"Error on empty name":                   {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal |  | gnome-terminal"}}, wantErr: true},
+		"Error on empty command":                {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | "}}, wantErr: true},
+		"Error on invalid id":                   {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "../terminal | Terminal | gnome-terminal"}}, wantErr: true},
+		"Error on unknown option":               {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal | comment=Shell"}}, wantErr: true},
+		"Error on invalid category":             {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal | categories=System Tools"}}, wantErr: true},
+		"Error on invalid icon name":            {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal | icon=/usr/share/icons/terminal"}}, wantErr: true},
+		"Error on icon outside of icons":        {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal | icon=../terminal.png"}}, wantErr: true},
+		"Error on missing icon":                 {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal | icon=missing.png"}}, wantErr: true},
+		"Error on icon being a directory":       {entries: []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal | icon=folder.png"}}, wantErr: true},
+		"Error on pinning autostart shortcut":   {entries: []entry.Entry{{Key: "shortcuts/autostart", Value: "sync | Sync | sync | pin"}}, isUser: true, wantErr: true},
+		"Error on failing to download icons":    {saveAssetsError: true, wantErr: true},
+		"Error on unknown user":                 {isUser: true, objectName: "unknown@example.com", wantErr: true},
+		"Error on user directory being a file":  {isUser: true, existingState: "autostart_is_file", wantErr: true},
+		"Error on user directory being symlink": {isUser: true, existingState: "autostart_is_symlink", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+			if tc.objectName == "" {
+				tc.objectName = "ubuntu"
+				if tc.isUser {
+					tc.objectName = "user@example.com"
+				}
+			}
+
+			rootDir := t.TempDir()
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), filepath.Join(rootDir, "root"))
+			}
+			require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "root", "home", "user"), 0750), "Setup: can't create home directory")
+
+			m := shortcuts.New(
+				shortcuts.WithApplicationsDir(filepath.Join(rootDir, "root", "usr", "local", "share", "applications", "adsys")),
+				shortcuts.WithIconsDir(filepath.Join(rootDir, "root", "usr", "local", "share", "adsys", "icons")),
+				shortcuts.WithUserLookup(mockUserLookup(filepath.Join(rootDir, "root", "home"))),
+			)
+
+			mockAssetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.saveAssetsError, Path: "icons/"}
+			err := m.ApplyPolicy(context.Background(), tc.objectName, !tc.isUser, tc.entries, mockAssetsDumper.SaveAssetsTo)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			replaceInTree(t, rootDir, rootDir, "#ROOTDIR#")
+			testutils.CompareTreesWithFiltering(t, filepath.Join(rootDir, "root"), testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestPinFavoriteApps(t *testing.T) {
+	t.Parallel()
+
+	pinned := []entry.Entry{{Key: "shortcuts/applications", Value: "portal | Corporate portal | xdg-open https://portal.example.com | pin\nterminal | Terminal | gnome-terminal\nsupport | IT support | support | pin"}}
+	otherDconf := entry.Entry{Key: "org/gnome/desktop/interface/clock-format", Value: "24h", Meta: "s"}
+
+	tests := map[string]struct {
+		dconfEntries []entry.Entry
+		entries      []entry.Entry
+
+		want []entry.Entry
+	}{
+		"Add favorite applications": {
+			dconfEntries: []entry.Entry{otherDconf},
+			entries:      pinned,
+			want:         []entry.Entry{otherDconf, {Key: "org/gnome/shell/favorite-apps", Value: "adsys-portal.desktop\nadsys-support.desktop", Meta: "as"}},
+		},
+		"Append to existing favorite applications": {
+			dconfEntries: []entry.Entry{{Key: "org/gnome/shell/favorite-apps", Value: "firefox.desktop\nyelp.desktop\n", Meta: "as"}},
+			entries:      pinned,
+			want:         []entry.Entry{{Key: "org/gnome/shell/favorite-apps", Value: "firefox.desktop\nyelp.desktop\nadsys-portal.desktop\nadsys-support.desktop", Meta: "as"}},
+		},
+		"Append to existing quoted list": {
+			dconfEntries: []entry.Entry{{Key: "org/gnome/shell/favorite-apps", Value: "['firefox.desktop', 'yelp.desktop']", Meta: "as"}},
+			entries:      pinned,
+			want:         []entry.Entry{{Key: "org/gnome/shell/favorite-apps", Value: "'firefox.desktop', 'yelp.desktop'\n'adsys-portal.desktop'\n'adsys-support.desktop'", Meta: "as"}},
+		},
+		"Already favorite applications are not duplicated": {
+			dconfEntries: []entry.Entry{{Key: "org/gnome/shell/favorite-apps", Value: "adsys-portal.desktop\nfirefox.desktop", Meta: "as"}},
+			entries:      pinned,
+			want:         []entry.Entry{{Key: "org/gnome/shell/favorite-apps", Value: "adsys-portal.desktop\nfirefox.desktop\nadsys-support.desktop", Meta: "as"}},
+		},
+		"Empty favorite applications": {
+			dconfEntries: []entry.Entry{{Key: "org/gnome/shell/favorite-apps", Value: "", Meta: "as"}},
+			entries:      pinned,
+			want:         []entry.Entry{{Key: "org/gnome/shell/favorite-apps", Value: "adsys-portal.desktop\nadsys-support.desktop", Meta: "as"}},
+		},
+		"Favorite applications reset to default are kept": {
+			dconfEntries: []entry.Entry{{Key: "org/gnome/shell/favorite-apps", Disabled: true, Meta: "as"}},
+			entries:      pinned,
+			want:         []entry.Entry{{Key: "org/gnome/shell/favorite-apps", Disabled: true, Meta: "as"}},
+		},
+		"No pinned launchers": {
+			dconfEntries: []entry.Entry{otherDconf},
+			entries:      []entry.Entry{{Key: "shortcuts/applications", Value: "terminal | Terminal | gnome-terminal"}},
+			want:         []entry.Entry{otherDconf},
+		},
+		"Disabled launchers are not pinned": {
+			dconfEntries: []entry.Entry{otherDconf},
+			entries:      []entry.Entry{{Key: "shortcuts/applications", Value: "portal | Portal | portal | pin", Disabled: true}},
+			want:         []entry.Entry{otherDconf},
+		},
+		"Invalid launchers are not pinned": {
+			dconfEntries: []entry.Entry{otherDconf},
+			entries:      []entry.Entry{{Key: "shortcuts/applications", Value: "portal | Portal | portal | pin\ninvalid"}},
+			want:         []entry.Entry{otherDconf},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got := shortcuts.PinFavoriteApps(tc.dconfEntries, tc.entries)
+			require.Equal(t, tc.want, got, "PinFavoriteApps returned unexpected entries")
+		})
+	}
+}
+
+// replaceInTree replaces from with to in all regular files of dir, so that shortcuts referencing the
+// temporary root directory can be compared to golden files.
+func replaceInTree(t *testing.T, dir, from, to string) {
+	t.Helper()
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(strings.ReplaceAll(string(content), from, to)), info.Mode().Perm())
+	})
+	require.NoError(t, err, "Setup: can't replace root directory in tree")
+}
+
+// mockUserLookup returns the current user with a home directory in homes for any user but "unknown",
+// so that files can be chowned without root.
+func mockUserLookup(homes string) func(string) (*user.User, error) {
+	return func(name string) (*user.User, error) {
+		if name == "unknown@example.com" {
+			return nil, user.UnknownUserError(name)
+		}
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		home := filepath.Join(homes, "user")
+		if name == "nohome@example.com" {
+			home = filepath.Join(homes, "nohome")
+		}
+		return &user.User{Username: name, Uid: u.Uid, Gid: u.Gid, HomeDir: home}, nil
+	}
+}
+
+// uniqueEntries returns the shortcuts entries of GPOs, listed from the closest to the furthest, as merged
+// by the policies manager.
+func uniqueEntries(gposEntries ...[]entry.Entry) []entry.Entry {
+	var pols policies.Policies
+	for i, entries := range gposEntries {
+		pols.GPOs = append(pols.GPOs, policies.GPO{
+			ID:    fmt.Sprintf("{GPO%d}", i),
+			Name:  fmt.Sprintf("GPO%d", i),
+			Rules: map[string][]entry.Entry{"shortcuts": entries},
+		})
+	}
+	return pols.GetUniqueRules()["shortcuts"]
+}
@@ -0,0 +1,383 @@
+// Package ssh is the policy manager for the SSH server and client configuration.
+//
+// This manager only applies to computer objects.
+//
+// Server settings are written to /etc/ssh/sshd_config.d/50-adsys.conf and client settings to
+// /etc/ssh/ssh_config.d/50-adsys.conf. As the first obtained value of a setting is used by OpenSSH,
+// those files take precedence over the main configuration files and the drop-ins sorted after them.
+//
+// Users and groups allowed to log in with SSH are normalized the same way than the client administrators
+// of the privilege manager: domain\user becomes user@domain. As sshd reads the part after the last @ of
+// an AllowUsers pattern as the client host, @* is appended to account names containing a domain.
+//
+// Following the policy manager guidelines:
+//   - invalid values prevent authentication;
+//   - the new server configuration is validated with sshd -t before replacing the current one, and
+//     an invalid configuration or a missing sshd binary prevents authentication, keeping the current one;
+//   - the ssh unit is then reloaded, and failing to reload it only warns the user.
+//
+// Files are removed once no setting is configured anymore.
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/privilege"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	passwordAuthenticationKey      = "ssh/password-authentication"
+	gssapiAuthenticationKey        = "ssh/gssapi-authentication"
+	allowUsersKey                  = "ssh/allow-users"
+	allowGroupsKey                 = "ssh/allow-groups"
+	bannerKey                      = "ssh/banner"
+	clientGSSAPIAuthenticationKey  = "ssh/client-gssapi-authentication"
+	clientStrictHostKeyCheckingKey = "ssh/client-strict-host-key-checking"
+
+	configFileName = "50-adsys.conf"
+	sshdUnit       = "ssh.service"
+
+	managedFileHeader = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`
+)
+
+var (
+	// serverKeys are the keys of the server settings, in the order they are written.
+	serverKeys = []string{passwordAuthenticationKey, gssapiAuthenticationKey, allowUsersKey, allowGroupsKey, bannerKey}
+	// clientKeys are the keys of the client settings, in the order they are written.
+	clientKeys = []string{clientGSSAPIAuthenticationKey, clientStrictHostKeyCheckingKey}
+
+	// strictHostKeyCheckingValues are the supported values of the client host key checking.
+	strictHostKeyCheckingValues = []string{"yes", "accept-new", "ask"}
+)
+
+type systemdCaller interface {
+	ReloadUnit(context.Context, string) error
+}
+
+// Manager prevents writing the SSH configuration concurrently while applying the policy.
+type Manager struct {
+	sshDir        string
+	sshdCmd       []string
+	systemdCaller systemdCaller
+
+	mu sync.Mutex
+}
+
+type options struct {
+	sshDir  string
+	sshdCmd []string
+}
+
+// Option reprents an optional function to change the ssh manager.
+type Option func(*options)
+
+// WithSSHDir overrides the default SSH configuration directory.
+func WithSSHDir(p string) Option {
+	return func(o *options) {
+		o.sshDir = p
+	}
+}
+
+// WithSshdCmd overrides the default sshd command used to validate the server configuration.
+func WithSshdCmd(cmd []string) Option {
+	return func(o *options) {
+		o.sshdCmd = cmd
+	}
+}
+
+// New returns a new manager for the ssh policy.
+func New(systemdCaller systemdCaller, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		sshDir:  consts.DefaultSSHDir,
+		sshdCmd: []string{"sshd"},
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		sshDir:        args.sshDir,
+		sshdCmd:       args.sshdCmd,
+		systemdCaller: systemdCaller,
+	}
+}
+
+// ApplyPolicy writes the SSH server and client configuration, or removes them if there are no settings.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply ssh policy to %s", objectName))
+
+	// SSH configuration is only supported on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying ssh policy to %s", objectName)
+
+	settings, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	var server, client []string
+	for _, k := range serverKeys {
+		if s, ok := settings[k]; ok {
+			server = append(server, s)
+		}
+	}
+	for _, k := range clientKeys {
+		if s, ok := settings[k]; ok {
+			client = append(client, s)
+		}
+	}
+
+	if err := m.applyServerConfig(ctx, server); err != nil {
+		return err
+	}
+	return m.applyClientConfig(client)
+}
+
+// parseEntries returns the configuration lines to write per key.
+// Disabled boolean settings are set to no, while other disabled settings are ignored.
+func parseEntries(ctx context.Context, entries []entry.Entry) (settings map[string]string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse ssh entries"))
+
+	settings = make(map[string]string)
+	for _, e := range entries {
+		if e.Err != nil {
+			return nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		switch e.Key {
+		case passwordAuthenticationKey:
+			settings[e.Key] = "PasswordAuthentication " + yesNo(!e.Disabled)
+		case gssapiAuthenticationKey, clientGSSAPIAuthenticationKey:
+			settings[e.Key] = "GSSAPIAuthentication " + yesNo(!e.Disabled)
+		}
+		if e.Disabled {
+			continue
+		}
+
+		switch e.Key {
+		case allowUsersKey:
+			users, err := allowedUsers(ctx, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			if len(users) > 0 {
+				settings[e.Key] = "AllowUsers " + strings.Join(users, " ")
+			}
+		case allowGroupsKey:
+			groups, err := allowedGroups(ctx, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			if len(groups) > 0 {
+				settings[e.Key] = "AllowGroups " + strings.Join(groups, " ")
+			}
+		case bannerKey:
+			banner := strings.TrimSpace(e.Value)
+			if banner == "" {
+				continue
+			}
+			if banner != "none" && !filepath.IsAbs(banner) {
+				return nil, errors.New(gotext.Get("invalid banner %q: expected an absolute path or none", banner))
+			}
+			banner, err := quote(banner)
+			if err != nil {
+				return nil, err
+			}
+			settings[e.Key] = "Banner " + banner
+		case clientStrictHostKeyCheckingKey:
+			v := strings.TrimSpace(e.Value)
+			if !slices.Contains(strictHostKeyCheckingValues, v) {
+				return nil, errors.New(gotext.Get("invalid host key checking %q: expected one of %s", v, strings.Join(strictHostKeyCheckingValues, ", ")))
+			}
+			settings[e.Key] = "StrictHostKeyChecking " + v
+		}
+	}
+
+	return settings, nil
+}
+
+// allowedUsers returns the sshd patterns of the users listed in v.
+func allowedUsers(ctx context.Context, v string) (users []string, err error) {
+	for _, u := range privilege.SplitAndNormalizeUsersAndGroups(ctx, v) {
+		if strings.HasPrefix(u, "%") {
+			return nil, errors.New(gotext.Get("%q is a group: groups must be listed in the allowed groups", u))
+		}
+		// sshd reads the part after the last @ as the client host: match the whole account name from any host.
+		if strings.Contains(u, "@") {
+			u += "@*"
+		}
+		if u, err = quote(u); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(users, u) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+// allowedGroups returns the sshd patterns of the groups listed in v, with or without the % prefix.
+func allowedGroups(ctx context.Context, v string) (groups []string, err error) {
+	for _, g := range privilege.SplitAndNormalizeUsersAndGroups(ctx, v) {
+		g = strings.TrimPrefix(g, "%")
+		if g == "" {
+			continue
+		}
+		if g, err = quote(g); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(groups, g) {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// quote returns v quoted if it contains spaces, so that sshd reads it as a single argument.
+func quote(v string) (string, error) {
+	if strings.ContainsAny(v, "\"\n") {
+		return "", errors.New(gotext.Get("invalid value %q: quotes and line breaks are not supported", v))
+	}
+	if strings.ContainsAny(v, " \t") {
+		return fmt.Sprintf("%q", v), nil
+	}
+	return v, nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// applyServerConfig validates and writes the server configuration, then reloads sshd.
+// The configuration is removed if there are no settings.
+func (m *Manager) applyServerConfig(ctx context.Context, settings []string) (err error) {
+	p := filepath.Join(m.sshDir, "sshd_config.d", configFileName)
+	defer decorate.OnError(&err, gotext.Get("can't update %q", p))
+
+	if len(settings) == 0 {
+		if err := os.Remove(p); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		m.reloadSshd(ctx)
+		return nil
+	}
+
+	content := managedFileHeader + strings.Join(settings, "\n") + "\n"
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return nil
+	}
+
+	// #nosec G301 - /etc/ssh/sshd_config.d permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// #nosec G306 - /etc/ssh/sshd_config.d files are world readable.
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return err
+	}
+	if err := m.checkServerConfig(ctx, p+".new"); err != nil {
+		if errRemove := os.Remove(p + ".new"); errRemove != nil {
+			log.Warning(ctx, gotext.Get("Can't remove invalid sshd configuration %q: %v", p+".new", errRemove))
+		}
+		return err
+	}
+	if err := os.Rename(p+".new", p); err != nil {
+		return err
+	}
+
+	m.reloadSshd(ctx)
+	return nil
+}
+
+// checkServerConfig validates the sshd configuration once newConf is in place.
+// As newConf is not included by the main configuration yet, sshd checks a configuration
+// including newConf first, then the main configuration.
+func (m *Manager) checkServerConfig(ctx context.Context, newConf string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid sshd configuration"))
+
+	checkConf := strings.TrimSuffix(newConf, ".new") + ".check"
+	content := fmt.Sprintf("Include %q\nInclude %q\n", newConf, filepath.Join(m.sshDir, "sshd_config"))
+	if err := os.WriteFile(checkConf, []byte(content), 0600); err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(checkConf); err != nil {
+			log.Warning(ctx, gotext.Get("Can't remove sshd check configuration %q: %v", checkConf, err))
+		}
+	}()
+
+	args := append(slices.Clone(m.sshdCmd), "-t", "-f", checkConf)
+	// #nosec G204 - We are in control of the arguments
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// reloadSshd reloads the SSH server so that new connections use the new configuration.
+// sshd can be inactive, for instance when it is socket activated: this only warns.
+func (m *Manager) reloadSshd(ctx context.Context) {
+	if err := m.systemdCaller.ReloadUnit(ctx, sshdUnit); err != nil {
+		log.Warning(ctx, gotext.Get("Can't reload %s, the new configuration will be used on its next start: %v", sshdUnit, err))
+	}
+}
+
+// applyClientConfig writes the client configuration, or removes it if there are no settings.
+func (m *Manager) applyClientConfig(settings []string) (err error) {
+	p := filepath.Join(m.sshDir, "ssh_config.d", configFileName)
+	defer decorate.OnError(&err, gotext.Get("can't update %q", p))
+
+	if len(settings) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	content := managedFileHeader + strings.Join(settings, "\n") + "\n"
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return nil
+	}
+
+	// #nosec G301 - /etc/ssh/ssh_config.d permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// #nosec G306 - /etc/ssh/ssh_config.d files are world readable.
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,189 @@
+package ssh_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/ssh"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "ssh/password-authentication", Disabled: true},
+		{Key: "ssh/gssapi-authentication"},
+		{Key: "ssh/allow-users", Value: "user1@example.com\nEXAMPLE\\user2"},
+		{Key: "ssh/allow-groups", Value: "%ssh-users@example.com,admins@example.com"},
+		{Key: "ssh/banner", Value: "/etc/issue.net"},
+		{Key: "ssh/client-gssapi-authentication"},
+		{Key: "ssh/client-strict-host-key-checking", Value: "accept-new"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		sshdFails        bool
+		reloadFails      bool
+		sshDirIsFile     bool
+		noSshdValidation bool
+
+		wantReload bool
+		wantErr    bool
+	}{
+		"Apply all settings":                          {wantReload: true},
+		"Only server settings":                        {entries: []entry.Entry{{Key: "ssh/password-authentication", Disabled: true}}, wantReload: true},
+		"Only client settings":                        {entries: []entry.Entry{{Key: "ssh/client-strict-host-key-checking", Value: "yes"}}},
+		"Enabled boolean settings are set to yes":     {entries: []entry.Entry{{Key: "ssh/password-authentication"}, {Key: "ssh/client-gssapi-authentication"}}, wantReload: true},
+		"Disabled boolean settings are set to no":     {entries: []entry.Entry{{Key: "ssh/gssapi-authentication", Disabled: true}, {Key: "ssh/client-gssapi-authentication", Disabled: true}}, wantReload: true},
+		"Disabled settings with values are ignored":   {entries: []entry.Entry{{Key: "ssh/allow-users", Value: "user1@example.com", Disabled: true}, {Key: "ssh/banner", Value: "/etc/issue.net", Disabled: true}, {Key: "ssh/password-authentication", Disabled: true}}, wantReload: true},
+		"Users and groups are normalized":             {entries: []entry.Entry{{Key: "ssh/allow-users", Value: "EXAMPLE\\user1\nuser:2@example.com,user1@example.com,localuser"}, {Key: "ssh/allow-groups", Value: "%domain users@example.com\nEXAMPLE\\admins,admins@example.com"}}, wantReload: true},
+		"Empty lists are ignored":                     {entries: []entry.Entry{{Key: "ssh/allow-users", Value: "\n,"}, {Key: "ssh/allow-groups", Value: ""}, {Key: "ssh/banner", Value: " "}}},
+		"Banner can be disabled with none":            {entries: []entry.Entry{{Key: "ssh/banner", Value: "none"}}, wantReload: true},
+		"Unknown keys are ignored":                    {entries: []entry.Entry{{Key: "ssh/unknown", Value: "something"}, {Key: "ssh/password-authentication", Disabled: true}}, wantReload: true},
+		"Update existing configuration":               {existingState: "managed", wantReload: true},
+		"Configuration already up to date":            {existingState: "up_to_date", noSshdValidation: true},
+		"Remove configuration with no entries":        {entries: []entry.Entry{}, existingState: "managed", wantReload: true},
+		"No entries and no configuration":             {entries: []entry.Entry{}},
+		"User objects are ignored":                    {isUser: true, existingState: "managed"},
+		"Failing to reload the SSH server only warns": {reloadFails: true, wantReload: true},
+
+		// Error cases
+		"Error on errored entry":                          {entries: []entry.Entry{{Key: "ssh/allow-users", Value: "user1@example.com", Err: errors.New("some error")}}, wantErr: true},
+		"Error on group in allowed users":                 {entries: []entry.Entry{{Key: "ssh/allow-users", Value: "%admins@example.com"}}, wantErr: true},
+		"Error on quote in allowed groups":                {entries: []entry.Entry{{Key: "ssh/allow-groups", Value: `ad"mins@example.com`}}, wantErr: true},
+		"Error on relative banner path":                   {entries: []entry.Entry{{Key: "ssh/banner", Value: "issue.net"}}, wantErr: true},
+		"Error on invalid host key checking":              {entries: []entry.Entry{{Key: "ssh/client-strict-host-key-checking", Value: "no"}}, wantErr: true},
+		"Error on invalid server configuration keeps it":  {existingState: "managed", sshdFails: true, wantErr: true},
+		"Error on ssh directory being a file":             {sshDirIsFile: true, wantErr: true},
+		"Error on invalid configuration without previous": {sshdFails: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			sshDir := filepath.Join(rootDir, "etc", "ssh")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), sshDir)
+			}
+			if tc.sshDirIsFile {
+				require.NoError(t, os.MkdirAll(filepath.Dir(sshDir), 0750), "Setup: can't create parent directory")
+				testutils.WriteFile(t, sshDir, []byte("not a directory"), 0600)
+			}
+
+			systemd := &mockSystemdCaller{fail: tc.reloadFails}
+			m := ssh.New(systemd,
+				ssh.WithSSHDir(sshDir),
+				ssh.WithSshdCmd(mockSshdCmd(t, rootDir, tc.sshdFails)),
+			)
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			var wantReloads []string
+			if tc.wantReload {
+				wantReloads = []string{"ssh.service"}
+			}
+			require.Equal(t, wantReloads, systemd.reloads, "Reloaded units don't match expectations")
+			if tc.noSshdValidation {
+				require.NoFileExists(t, filepath.Join(rootDir, "sshd_calls"), "sshd should not have been called")
+			}
+
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockSystemdCaller records if ssh.service was reloaded, and can fail to do so.
+type mockSystemdCaller struct {
+	testutils.MockSystemdCaller
+
+	fail bool
+
+	mu      sync.Mutex
+	reloads []string
+}
+
+func (s *mockSystemdCaller) ReloadUnit(_ context.Context, unit string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reloads = append(s.reloads, unit)
+	if s.fail {
+		return fmt.Errorf("reload of %s failed as requested", unit)
+	}
+	return nil
+}
+
+func mockSshdCmd(t *testing.T, rootDir string, fail bool) []string {
+	t.Helper()
+
+	return []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockSshd", "--", rootDir, fmt.Sprint(fail)}
+}
+
+// TestMockSshd simulates sshd -t.
+// Every call is recorded in the sshd_calls file of the root directory, along with the checked configuration.
+func TestMockSshd(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] != "--" {
+			args = args[1:]
+			continue
+		}
+		args = args[1:]
+		break
+	}
+	rootDir, fail, args := args[0], args[1], args[2:]
+
+	if len(args) != 3 || args[0] != "-t" || args[1] != "-f" {
+		fmt.Fprintf(os.Stderr, "unexpected call: sshd %s\n", strings.Join(args, " "))
+		os.Exit(1)
+	}
+
+	f, err := os.OpenFile(filepath.Join(rootDir, "sshd_calls"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	require.NoError(t, err, "Setup: can't open calls file")
+	defer f.Close()
+
+	// The new configuration must be in place when it is checked.
+	if _, err := os.Stat(strings.TrimSuffix(args[2], ".check") + ".new"); err != nil {
+		fmt.Fprintf(os.Stderr, "new configuration is not in place: %v\n", err)
+		os.Exit(1)
+	}
+
+	checkConf, err := os.ReadFile(args[2])
+	require.NoError(t, err, "Setup: can't read checked configuration")
+	call := fmt.Sprintf("sshd %s\n%s", strings.Join(args, " "), checkConf)
+	_, err = f.WriteString(strings.ReplaceAll(call, rootDir, "#ROOTDIR#"))
+	require.NoError(t, err, "Setup: can't write calls file")
+
+	if fail == "true" {
+		fmt.Fprintln(os.Stderr, "EXIT 1 requested in mock")
+		os.Exit(1)
+	}
+}
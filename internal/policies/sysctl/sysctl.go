@@ -0,0 +1,233 @@
+// Package sysctl is the policy manager for kernel parameters.
+//
+// This manager only applies to computer objects.
+//
+// Parameters are defined one per line in the sysctl/parameters entry, in the form name = value, like
+// kernel.kptr_restrict = 2. Names can use "/" as separator instead of ".", for parameters containing dots
+// like net/ipv4/conf/eth0.1/rp_filter. Empty lines and lines starting with # or ; are ignored.
+// Values from multiple GPOs are appended, and the closest GPO wins when a parameter is set multiple times.
+//
+// Following the policy manager guidelines:
+//   - parameters which are not found in /proc/sys or invalid lines prevent authentication;
+//   - parameters are written to /etc/sysctl.d/99-adsys.conf, so that they persist across reboots,
+//     and failing to write the file prevents authentication;
+//   - parameters are then applied live by writing them to /proc/sys. Failing to apply one only
+//     warns the user, as the kernel may refuse some values at runtime.
+//
+// The file is removed when no parameter is configured anymore. Parameters applied live keep their
+// value until the next boot.
+package sysctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	parametersKey = "sysctl/parameters"
+
+	sysctlFileName = "99-adsys.conf"
+)
+
+// parameterNameRegexp matches valid kernel parameter names.
+var parameterNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.:@/-]*$`)
+
+// Manager prevents writing the sysctl configuration concurrently while applying the policy.
+type Manager struct {
+	sysctlDir  string
+	procSysDir string
+
+	mu sync.Mutex
+}
+
+type options struct {
+	sysctlDir  string
+	procSysDir string
+}
+
+// Option reprents an optional function to change the sysctl manager.
+type Option func(*options)
+
+// WithSysctlDir overrides the default sysctl.d directory.
+func WithSysctlDir(p string) Option {
+	return func(o *options) {
+		o.sysctlDir = p
+	}
+}
+
+// WithProcSysDir overrides the default kernel parameters directory, used to validate and apply parameters.
+func WithProcSysDir(p string) Option {
+	return func(o *options) {
+		o.procSysDir = p
+	}
+}
+
+// New returns a new manager for the sysctl policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		sysctlDir:  consts.DefaultSysctlDir,
+		procSysDir: "/proc/sys",
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		sysctlDir:  args.sysctlDir,
+		procSysDir: args.procSysDir,
+	}
+}
+
+// parameter is a kernel parameter to set.
+type parameter struct {
+	name  string
+	path  string
+	value string
+}
+
+// ApplyPolicy writes the kernel parameters to the sysctl configuration and applies them live,
+// or removes the configuration if there are no parameters to set.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply sysctl policy to %s", objectName))
+
+	// Kernel parameters are only supported on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying sysctl policy to %s", objectName)
+
+	params, err := m.parseEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	sysctlPath := filepath.Join(m.sysctlDir, sysctlFileName)
+	if len(params) == 0 {
+		if err := os.Remove(sysctlPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	content := `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`
+	for _, p := range params {
+		content += fmt.Sprintf("%s = %s\n", p.name, p.value)
+	}
+	if err := writeIfChanged(sysctlPath, content); err != nil {
+		return err
+	}
+
+	// Apply the parameters live. The kernel can refuse some values, which shouldn't prevent authentication.
+	for _, p := range params {
+		log.Debugf(ctx, "Setting kernel parameter %s to %q", p.name, p.value)
+		// #nosec G306 - /proc/sys permissions are managed by the kernel.
+		if err := os.WriteFile(p.path, []byte(p.value+"\n"), 0644); err != nil {
+			log.Warning(ctx, gotext.Get("Can't set kernel parameter %s to %q, it will be set on next boot: %v", p.name, p.value, err))
+		}
+	}
+
+	return nil
+}
+
+// parseEntries returns the parameters to set from the entries.
+// When a parameter is set multiple times, the closest GPO wins. Disabled entries are ignored.
+func (m *Manager) parseEntries(entries []entry.Entry) (params []parameter, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse sysctl entries"))
+
+	for _, e := range entries {
+		if e.Disabled || e.Key != parametersKey {
+			continue
+		}
+		if e.Err != nil {
+			return nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+
+		for _, line := range strings.Split(e.Value, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+				continue
+			}
+
+			p, err := m.parseParameter(line)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, p)
+		}
+	}
+
+	return entry.KeepClosest(params, func(p parameter) string { return p.path }, nil), nil
+}
+
+// parseParameter parses a line in the form name = value, and checks that the parameter exists.
+func (m *Manager) parseParameter(line string) (p parameter, err error) {
+	name, value, found := strings.Cut(line, "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !found || name == "" || value == "" {
+		return p, errors.New(gotext.Get("invalid line %q: expected <name> = <value>", line))
+	}
+	if !parameterNameRegexp.MatchString(name) {
+		return p, errors.New(gotext.Get("invalid kernel parameter name %q", name))
+	}
+
+	// As with sysctl, "/" is the separator if the name contains any, so that dots can be used in interface names.
+	relPath := name
+	if !strings.Contains(name, "/") {
+		relPath = strings.ReplaceAll(name, ".", "/")
+	}
+	for _, elem := range strings.Split(relPath, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return p, errors.New(gotext.Get("invalid kernel parameter name %q", name))
+		}
+	}
+
+	path := filepath.Join(m.procSysDir, relPath)
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return p, errors.New(gotext.Get("unknown kernel parameter %q", name))
+	}
+
+	return parameter{name: name, path: path, value: strings.Join(strings.Fields(value), " ")}, nil
+}
+
+// writeIfChanged atomically writes content to p if it differs from the current content.
+func writeIfChanged(p, content string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write sysctl configuration %q", p))
+
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return nil
+	}
+
+	// #nosec G301 - /etc/sysctl.d permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// #nosec G306 - /etc/sysctl.d files are world readable.
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
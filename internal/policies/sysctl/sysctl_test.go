@@ -0,0 +1,122 @@
+package sysctl_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/sysctl"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "sysctl/parameters", Value: `kernel.kptr_restrict = 2
+net.ipv4.conf.all.rp_filter=1`},
+	}
+
+	tests := map[string]struct {
+		entries      []entry.Entry
+		isUser       bool
+		existingConf bool
+
+		readOnlyParameter string
+		sysctlDirIsFile   bool
+
+		wantErr bool
+	}{
+		"Set parameters":                {},
+		"Update existing configuration": {existingConf: true},
+		"Parameters from multiple GPOs, closest wins": {entries: uniqueEntries(
+			[]entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict = 2", Strategy: entry.StrategyAppend}},
+			[]entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict = 1\nkernel.dmesg_restrict = 1", Strategy: entry.StrategyAppend}},
+		)},
+		"Slash separated names":                      {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "net/ipv4/conf/eth0.1/rp_filter = 1"}}},
+		"Same parameter with different separators":   {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "net/ipv4/conf/all/rp_filter = 1\nnet.ipv4.conf.all.rp_filter = 0"}}},
+		"Values with multiple fields":                {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "net.ipv4.ip_local_port_range =  1024 \t 65000 "}}},
+		"Comments and empty lines are ignored":       {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "# CIS hardening\n\n; kernel\nkernel.kptr_restrict = 2\n"}}},
+		"Disabled entries are ignored":               {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict = 2", Disabled: true}}},
+		"Other keys are ignored":                     {entries: []entry.Entry{{Key: "sysctl/other", Value: "kernel.kptr_restrict = 2"}}},
+		"Parameter refused by the kernel only warns": {readOnlyParameter: "fs/suid_dumpable", entries: []entry.Entry{{Key: "sysctl/parameters", Value: "fs.suid_dumpable = 0\nkernel.kptr_restrict = 2"}}},
+		"Remove configuration with no entries":       {entries: []entry.Entry{}, existingConf: true},
+		"No entries and no configuration":            {entries: []entry.Entry{}},
+		"User objects are ignored":                   {isUser: true, existingConf: true},
+
+		// Error cases
+		"Error on errored entry":                 {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict = 2", Err: errors.New("some error")}}, wantErr: true},
+		"Error on line without value":            {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict"}}, wantErr: true},
+		"Error on empty value":                   {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict = "}}, wantErr: true},
+		"Error on empty name":                    {entries: []entry.Entry{{Key: "sysctl/parameters", Value: " = 2"}}, wantErr: true},
+		"Error on invalid name":                  {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr restrict = 2"}}, wantErr: true},
+		"Error on ignore failure prefix":         {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "-kernel.kptr_restrict = 2"}}, wantErr: true},
+		"Error on name escaping proc sys":        {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel/../../sys = 2"}}, wantErr: true},
+		"Error on name with empty element":       {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel..kptr_restrict = 2"}}, wantErr: true},
+		"Error on unknown parameter":             {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.doesnotexist = 2"}}, wantErr: true},
+		"Error on parameter being a directory":   {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "net.ipv4.conf.all = 2"}}, wantErr: true},
+		"Error on sysctl directory being a file": {sysctlDirIsFile: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			sysctlDir := filepath.Join(rootDir, "etc", "sysctl.d")
+			procSysDir := filepath.Join(rootDir, "proc", "sys")
+			testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "procsys"), procSysDir)
+			if tc.existingConf {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "existing"), sysctlDir)
+			}
+			if tc.sysctlDirIsFile {
+				require.NoError(t, os.MkdirAll(filepath.Dir(sysctlDir), 0750), "Setup: can't create parent directory")
+				testutils.WriteFile(t, sysctlDir, []byte("not a directory"), 0600)
+			}
+			if tc.readOnlyParameter != "" {
+				// Writing to /dev/full always fails, as the kernel does with refused values.
+				p := filepath.Join(procSysDir, tc.readOnlyParameter)
+				require.NoError(t, os.Remove(p), "Setup: can't remove parameter file")
+				require.NoError(t, os.Symlink("/dev/full", p), "Setup: can't create read only parameter")
+			}
+
+			m := sysctl.New(sysctl.WithSysctlDir(sysctlDir), sysctl.WithProcSysDir(procSysDir))
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			if tc.readOnlyParameter != "" {
+				require.NoError(t, os.Remove(filepath.Join(procSysDir, tc.readOnlyParameter)), "Teardown: can't remove read only parameter")
+			}
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// uniqueEntries returns the sysctl entries of GPOs, listed from the closest to the furthest, as merged
+// by the policies manager.
+func uniqueEntries(gposEntries ...[]entry.Entry) []entry.Entry {
+	var pols policies.Policies
+	for i, entries := range gposEntries {
+		pols.GPOs = append(pols.GPOs, policies.GPO{
+			ID:    fmt.Sprintf("{GPO%d}", i),
+			Name:  fmt.Sprintf("GPO%d", i),
+			Rules: map[string][]entry.Entry{"sysctl": entries},
+		})
+	}
+	return pols.GetUniqueRules()["sysctl"]
+}
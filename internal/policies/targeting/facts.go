@@ -0,0 +1,118 @@
+package targeting
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os/user"
+
+	"github.com/leonelquinteros/gotext"
+	adcommon "github.com/ubuntu/adsys/internal/ad/common"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+)
+
+type options struct {
+	root           string
+	userGroups     func(string) ([]string, error)
+	interfaceAddrs func() ([]net.Addr, error)
+}
+
+// Option reprents an optional function to change how facts are computed.
+type Option func(*options)
+
+// WithRoot specifies a personalized root directory, to read os-release from.
+func WithRoot(root string) Option {
+	return func(o *options) {
+		o.root = root
+	}
+}
+
+// WithUserGroups specifies a personalized function returning the group names of a user.
+func WithUserGroups(f func(string) ([]string, error)) Option {
+	return func(o *options) {
+		o.userGroups = f
+	}
+}
+
+// WithInterfaceAddrs specifies a personalized function returning the addresses of the network interfaces.
+func WithInterfaceAddrs(f func() ([]net.Addr, error)) Option {
+	return func(o *options) {
+		o.interfaceAddrs = f
+	}
+}
+
+// LocalFacts returns the facts of the local system, with the groups of username if it is not empty.
+// Facts which can't be computed have their error set, so that the expressions relying on them can't be evaluated.
+func LocalFacts(ctx context.Context, hostnames []string, username string, opts ...Option) Facts {
+	// defaults
+	args := options{
+		root:           "/",
+		userGroups:     userGroups,
+		interfaceAddrs: net.InterfaceAddrs,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	facts := Facts{Hostnames: hostnames}
+
+	if username != "" {
+		groups, err := args.userGroups(username)
+		if err != nil {
+			facts.GroupsErr = errors.New(gotext.Get("can't get the groups of %s: %v", username, err))
+			log.Warning(ctx, facts.GroupsErr)
+		}
+		facts.Groups = groups
+	}
+
+	addrs, err := args.interfaceAddrs()
+	if err != nil {
+		facts.AddressesErr = errors.New(gotext.Get("can't get the IP addresses of the client: %v", err))
+		log.Warning(ctx, facts.AddressesErr)
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok || addr.IsLoopback() {
+			continue
+		}
+		facts.Addresses = append(facts.Addresses, addr.Unmap())
+	}
+
+	release, err := adcommon.GetVersionID(args.root)
+	if err != nil {
+		facts.ReleaseErr = errors.New(gotext.Get("can't get the release of the client: %v", err))
+		log.Warning(ctx, facts.ReleaseErr)
+	}
+	facts.Release = release
+
+	return facts
+}
+
+// userGroups returns the names of the groups of username, from the system databases.
+func userGroups(username string) ([]string, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, id := range ids {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			// Groups without a name can't be targeted.
+			continue
+		}
+		groups = append(groups, g.Name)
+	}
+	return groups, nil
+}
@@ -0,0 +1,477 @@
+// Package targeting evaluates the targeting expressions of policy entries, so that an entry only applies to some
+// clients or users, while the rest of its GPO applies to all of them.
+//
+// An expression is made of terms combined with AND, OR, NOT and parentheses. AND has precedence over OR, and
+// keywords are case insensitive. The supported terms are:
+//   - group:<name>: the user is a member of the group. The name can be qualified with its domain, as group@domain.
+//     The NetBIOS domain of DOMAIN\group is ignored. Computers are not members of any group.
+//   - hostname:<pattern>: the short or fully qualified hostname of the client matches the shell pattern
+//     (*, ?, [set]), ignoring case.
+//   - ip:<address, prefix or range>: one of the addresses of the client is the address, in the prefix
+//     (10.0.0.0/8) or in the range (10.0.0.10-10.0.0.50).
+//   - release:[operator]<version>: the Ubuntu release of the client compares to the version, with =, !=, <, >,
+//     <= or >=. The default operator is =.
+//
+// Values containing spaces or parentheses can be quoted, as in group:"Domain Users".
+package targeting
+
+import (
+	"errors"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+)
+
+// Facts are the properties of the client, and of the user for user policies, that the expressions are
+// evaluated against.
+type Facts struct {
+	// Hostnames are the short and fully qualified hostnames of the client.
+	Hostnames []string
+	// Groups are the groups of the user. It is empty for computer policies.
+	Groups []string
+	// Addresses are the IP addresses of the client.
+	Addresses []netip.Addr
+	// Release is the Ubuntu release of the client, like 24.04.
+	Release string
+
+	// GroupsErr, AddressesErr and ReleaseErr are the errors of the facts which couldn't be computed.
+	// Expressions relying on them can't be evaluated.
+	GroupsErr    error
+	AddressesErr error
+	ReleaseErr   error
+}
+
+// Match returns true if facts satisfy the targeting expression.
+// An error is returned if the expression is invalid, even if it would match, or if it relies on a fact which
+// couldn't be computed.
+func Match(expression string, facts Facts) (match bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't evaluate targeting expression %q", expression))
+
+	e, err := parse(expression)
+	if err != nil {
+		return false, err
+	}
+	return e.eval(facts)
+}
+
+// expr is a targeting expression, or one of its terms.
+type expr interface {
+	eval(facts Facts) (bool, error)
+}
+
+type andExpr struct{ left, right expr }
+
+func (e andExpr) eval(facts Facts) (bool, error) {
+	if match, err := e.left.eval(facts); err != nil || !match {
+		return false, err
+	}
+	return e.right.eval(facts)
+}
+
+type orExpr struct{ left, right expr }
+
+func (e orExpr) eval(facts Facts) (bool, error) {
+	if match, err := e.left.eval(facts); err != nil || match {
+		return match, err
+	}
+	return e.right.eval(facts)
+}
+
+type notExpr struct{ e expr }
+
+func (e notExpr) eval(facts Facts) (bool, error) {
+	match, err := e.e.eval(facts)
+	if err != nil {
+		return false, err
+	}
+	return !match, nil
+}
+
+// groupTerm matches the groups of the user, by name and, if both are qualified, by domain.
+type groupTerm struct {
+	name, domain string
+}
+
+func (t groupTerm) eval(facts Facts) (bool, error) {
+	if facts.GroupsErr != nil {
+		return false, facts.GroupsErr
+	}
+	return slices.ContainsFunc(facts.Groups, func(g string) bool {
+		name, domain := splitGroup(g)
+		if !strings.EqualFold(name, t.name) {
+			return false
+		}
+		return t.domain == "" || domain == "" || strings.EqualFold(domain, t.domain)
+	}), nil
+}
+
+// splitGroup returns the name and the domain of the group. The domain is empty if the group is not qualified,
+// or qualified with a NetBIOS domain, which can't be compared with DNS domains.
+func splitGroup(group string) (name, domain string) {
+	if _, n, found := strings.Cut(group, `\`); found {
+		return n, ""
+	}
+	if i := strings.LastIndex(group, "@"); i != -1 {
+		return group[:i], group[i+1:]
+	}
+	return group, ""
+}
+
+// hostnameTerm matches the hostnames of the client against a lowercase shell pattern.
+type hostnameTerm struct {
+	pattern string
+}
+
+func (t hostnameTerm) eval(facts Facts) (bool, error) {
+	return slices.ContainsFunc(facts.Hostnames, func(h string) bool {
+		// The pattern was validated when parsing.
+		match, _ := path.Match(t.pattern, strings.ToLower(h))
+		return match
+	}), nil
+}
+
+// ipTerm matches the addresses of the client in the range from first to last.
+type ipTerm struct {
+	first, last netip.Addr
+}
+
+func (t ipTerm) eval(facts Facts) (bool, error) {
+	if facts.AddressesErr != nil {
+		return false, facts.AddressesErr
+	}
+	return slices.ContainsFunc(facts.Addresses, func(a netip.Addr) bool {
+		a = a.Unmap()
+		return a.BitLen() == t.first.BitLen() && a.Compare(t.first) >= 0 && a.Compare(t.last) <= 0
+	}), nil
+}
+
+// releaseTerm compares the release of the client with a version. An unknown release never matches.
+type releaseTerm struct {
+	op      string
+	version []int
+}
+
+func (t releaseTerm) eval(facts Facts) (bool, error) {
+	if facts.ReleaseErr != nil {
+		return false, facts.ReleaseErr
+	}
+	release, err := parseVersion(facts.Release)
+	if err != nil {
+		return false, nil
+	}
+
+	r := compareVersions(release, t.version)
+	switch t.op {
+	case "=":
+		return r == 0, nil
+	case "!=":
+		return r != 0, nil
+	case "<":
+		return r < 0, nil
+	case ">":
+		return r > 0, nil
+	case "<=":
+		return r <= 0, nil
+	case ">=":
+		return r >= 0, nil
+	}
+	return false, nil
+}
+
+// parseVersion parses a dotted version, like 24.04.
+func parseVersion(v string) ([]int, error) {
+	var version []int
+	for _, f := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return nil, errors.New(gotext.Get("invalid version %q", v))
+		}
+		version = append(version, n)
+	}
+	return version, nil
+}
+
+// compareVersions compares two dotted versions. Missing components are 0, so 24.04 is the same as 24.04.0.
+func compareVersions(a, b []int) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x - y
+		}
+	}
+	return 0
+}
+
+// parse parses the targeting expression.
+func parse(expression string) (expr, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{tokens: tokens}
+
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != eofToken {
+		return nil, errors.New(gotext.Get("unexpected %q", t.text))
+	}
+	return e, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// peek returns the current token, without consuming it.
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// next consumes and returns the current token. The last token is always eofToken.
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != eofToken {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the current token if it is of kind and its text is text, ignoring case.
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if t := p.peek(); t.kind == kind && strings.EqualFold(t.text, text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// parseOr parses: and {OR and}.
+func (p *parser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(keywordToken, "OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+// parseAnd parses: not {AND not}.
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(keywordToken, "AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+// parseNot parses: NOT not | ( or ) | term.
+func (p *parser) parseNot() (expr, error) {
+	if p.accept(keywordToken, "NOT") {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+
+	if p.accept(symbolToken, "(") {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(symbolToken, ")") {
+			return nil, errors.New(gotext.Get("expected ), got %q", p.peek().text))
+		}
+		return e, nil
+	}
+
+	t := p.next()
+	if t.kind != termToken {
+		return nil, errors.New(gotext.Get("expected term, got %q", t.text))
+	}
+	return parseTerm(t.text, t.value)
+}
+
+// parseTerm parses the value of the term of type name.
+func parseTerm(name, value string) (expr, error) {
+	if value == "" {
+		return nil, errors.New(gotext.Get("%s term has no value", name))
+	}
+
+	switch strings.ToLower(name) {
+	case "group":
+		n, domain := splitGroup(value)
+		if n == "" {
+			return nil, errors.New(gotext.Get("invalid group %q", value))
+		}
+		return groupTerm{name: n, domain: domain}, nil
+
+	case "hostname":
+		pattern := strings.ToLower(value)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New(gotext.Get("invalid hostname pattern %q: %v", value, err))
+		}
+		return hostnameTerm{pattern: pattern}, nil
+
+	case "ip":
+		return parseIPTerm(value)
+
+	case "release":
+		op := "="
+		for _, o := range []string{"<=", ">=", "!=", "=", "<", ">"} {
+			if strings.HasPrefix(value, o) {
+				op, value = o, strings.TrimPrefix(value, o)
+				break
+			}
+		}
+		version, err := parseVersion(value)
+		if err != nil {
+			return nil, err
+		}
+		return releaseTerm{op: op, version: version}, nil
+	}
+
+	return nil, errors.New(gotext.Get("unsupported term %q", name))
+}
+
+// parseIPTerm parses an IP address, a prefix in CIDR notation, or a range of addresses separated by -.
+func parseIPTerm(value string) (expr, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, errors.New(gotext.Get("invalid IP prefix %q", value))
+		}
+		prefix = prefix.Masked()
+		last := prefix.Addr()
+		// Set all the host bits of the prefix to get its last address.
+		bits := last.AsSlice()
+		for i := prefix.Bits(); i < len(bits)*8; i++ {
+			bits[i/8] |= 1 << (7 - i%8)
+		}
+		last, _ = netip.AddrFromSlice(bits)
+		return ipTerm{first: prefix.Addr(), last: last}, nil
+	}
+
+	from, to, isRange := strings.Cut(value, "-")
+	if !isRange {
+		to = from
+	}
+	first, err := netip.ParseAddr(from)
+	if err != nil {
+		return nil, errors.New(gotext.Get("invalid IP address %q", from))
+	}
+	last, err := netip.ParseAddr(to)
+	if err != nil {
+		return nil, errors.New(gotext.Get("invalid IP address %q", to))
+	}
+	first, last = first.Unmap(), last.Unmap()
+	if first.BitLen() != last.BitLen() || first.Compare(last) > 0 {
+		return nil, errors.New(gotext.Get("invalid IP range %q", value))
+	}
+	return ipTerm{first: first, last: last}, nil
+}
+
+type tokenKind int
+
+const (
+	eofToken tokenKind = iota
+	keywordToken
+	termToken
+	symbolToken
+)
+
+// token is a token of an expression. The text of a term is its type, and its value is after the colon.
+type token struct {
+	kind  tokenKind
+	text  string
+	value string
+}
+
+// tokenize splits the expression in tokens, ending with an eofToken.
+func tokenize(expression string) (tokens []token, err error) {
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(' || r == ')':
+			tokens = append(tokens, token{kind: symbolToken, text: string(r)})
+			i++
+
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) && runes[j] != ':' && runes[j] != '(' && runes[j] != ')' {
+				j++
+			}
+			word := string(runes[i:j])
+			if j == len(runes) || runes[j] != ':' {
+				switch strings.ToUpper(word) {
+				case "AND", "OR", "NOT":
+					tokens = append(tokens, token{kind: keywordToken, text: word})
+				default:
+					return nil, errors.New(gotext.Get("unexpected %q", word))
+				}
+				i = j
+				continue
+			}
+
+			// Term values are quoted with ", where \ escapes the next character, or end with a space or a parenthesis.
+			var value strings.Builder
+			j++
+			if j < len(runes) && runes[j] == '"' {
+				j++
+				for ; j < len(runes) && runes[j] != '"'; j++ {
+					if runes[j] == '\\' && j+1 < len(runes) {
+						j++
+					}
+					value.WriteRune(runes[j])
+				}
+				if j == len(runes) {
+					return nil, errors.New(gotext.Get("unterminated string"))
+				}
+				j++
+			} else {
+				for ; j < len(runes) && !unicode.IsSpace(runes[j]) && runes[j] != '(' && runes[j] != ')'; j++ {
+					value.WriteRune(runes[j])
+				}
+			}
+			tokens = append(tokens, token{kind: termToken, text: word, value: value.String()})
+			i = j
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New(gotext.Get("empty expression"))
+	}
+	return append(tokens, token{kind: eofToken, text: "end of expression"}), nil
+}
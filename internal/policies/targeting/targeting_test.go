@@ -0,0 +1,224 @@
+package targeting_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/targeting"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+
+	facts := targeting.Facts{
+		Hostnames: []string{"ws-042", "ws-042.example.com"},
+		Groups:    []string{"domain users@example.com", "Developers@example.com", "printers"},
+		Addresses: []netip.Addr{netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("2001:db8::42")},
+		Release:   "24.04",
+	}
+
+	tests := map[string]struct {
+		expression string
+		facts      *targeting.Facts
+
+		want    bool
+		wantErr bool
+	}{
+		// Groups
+		"Group":                                {expression: "group:developers", want: true},
+		"Group not matching":                   {expression: "group:admins"},
+		"Group qualified with its domain":      {expression: "group:developers@EXAMPLE.COM", want: true},
+		"Group qualified with another domain":  {expression: "group:developers@other.com"},
+		"Group qualified with NetBIOS domain":  {expression: `group:EXAMPLE\developers`, want: true},
+		"Qualified group matches unqualified":  {expression: "group:printers@example.com", want: true},
+		"Quoted group with spaces":             {expression: `group:"Domain Users"`, want: true},
+		"Quoted group with escaped characters": {expression: `group:"Domain \"Users\""`},
+		"No group for computers":               {expression: "group:developers", facts: &targeting.Facts{Hostnames: facts.Hostnames}},
+
+		// Hostnames
+		"Hostname":                         {expression: "hostname:ws-042", want: true},
+		"Hostname pattern":                 {expression: "hostname:WS-*", want: true},
+		"Hostname pattern with set":        {expression: "hostname:ws-0[0-4]?", want: true},
+		"Fully qualified hostname pattern": {expression: "hostname:*.example.com", want: true},
+		"Hostname pattern not matching":    {expression: "hostname:srv-*"},
+
+		// IP addresses
+		"IP address":                      {expression: "ip:10.1.2.3", want: true},
+		"IP address not matching":         {expression: "ip:10.1.2.4"},
+		"IP prefix":                       {expression: "ip:10.1.0.0/16", want: true},
+		"IP prefix not matching":          {expression: "ip:10.2.0.0/16"},
+		"IP prefix with host bits":        {expression: "ip:10.1.2.200/24", want: true},
+		"IP range":                        {expression: "ip:10.1.2.1-10.1.2.50", want: true},
+		"IP range not matching":           {expression: "ip:10.1.2.4-10.1.2.50"},
+		"IPv6 prefix":                     {expression: "ip:2001:db8::/32", want: true},
+		"IPv4 mapped IPv6 address":        {expression: "ip:::ffff:10.1.2.3", want: true},
+		"IPv4 prefix does not match IPv6": {expression: "ip:0.0.0.0/0", facts: &targeting.Facts{Addresses: []netip.Addr{netip.MustParseAddr("2001:db8::42")}}},
+
+		// Releases
+		"Release":                       {expression: "release:24.04", want: true},
+		"Release with equal operator":   {expression: "release:=24.04.0", want: true},
+		"Release not matching":          {expression: "release:22.04"},
+		"Release not equal":             {expression: "release:!=22.04", want: true},
+		"Release greater than":          {expression: "release:>23.10", want: true},
+		"Release greater or equal":      {expression: "release:>=24.04", want: true},
+		"Release less than":             {expression: "release:<24.04"},
+		"Release less or equal":         {expression: "release:<=24.10", want: true},
+		"Releases compare numerically":  {expression: "release:>9.10", want: true},
+		"Unknown release never matches": {expression: "release:!=22.04", facts: &targeting.Facts{Release: "noble"}},
+
+		// Facts which can't be computed
+		"Facts which can't be computed are not needed": {expression: "hostname:ws-042 OR NOT group:admins", facts: &targeting.Facts{Hostnames: facts.Hostnames, GroupsErr: errors.New("groups error")}, want: true},
+		"Error on groups which can't be computed":      {expression: "NOT group:admins", facts: &targeting.Facts{GroupsErr: errors.New("groups error")}, wantErr: true},
+		"Error on addresses which can't be computed":   {expression: "NOT ip:10.0.0.0/8", facts: &targeting.Facts{AddressesErr: errors.New("addresses error")}, wantErr: true},
+		"Error on release which can't be computed":     {expression: "NOT release:24.04", facts: &targeting.Facts{ReleaseErr: errors.New("release error")}, wantErr: true},
+		"Error on missing fact after a matching term":  {expression: "hostname:ws-042 AND NOT release:22.04", facts: &targeting.Facts{Hostnames: facts.Hostnames, ReleaseErr: errors.New("release error")}, wantErr: true},
+
+		// Combinations
+		"AND":                           {expression: "group:developers AND release:24.04", want: true},
+		"AND not matching":              {expression: "group:developers AND release:22.04"},
+		"OR":                            {expression: "group:admins OR hostname:ws-*", want: true},
+		"NOT":                           {expression: "NOT group:admins", want: true},
+		"Keywords are case insensitive": {expression: "not group:admins and group:developers", want: true},
+		"AND has precedence over OR":    {expression: "group:developers OR group:admins AND release:22.04", want: true},
+		"Parentheses":                   {expression: "(group:developers OR group:admins) AND release:22.04"},
+		"Parentheses around terms":      {expression: "(group:admins)OR(hostname:ws-042)", want: true},
+		"Nested NOT":                    {expression: "NOT NOT (ip:10.0.0.0/8)", want: true},
+		"Multilines expression":         {expression: "group:developers\n\tAND release:24.04\r\n", want: true},
+
+		// Error cases
+		"Error on empty expression":             {expression: " ", wantErr: true},
+		"Error on unsupported term":             {expression: "ou:Workstations", wantErr: true},
+		"Error on term without value":           {expression: "group:", wantErr: true},
+		"Error on term without type":            {expression: ":developers", wantErr: true},
+		"Error on word without type":            {expression: "developers", wantErr: true},
+		"Error on invalid group":                {expression: "group:@example.com", wantErr: true},
+		"Error on invalid hostname pattern":     {expression: "hostname:ws-[", wantErr: true},
+		"Error on invalid IP address":           {expression: "ip:10.1.2", wantErr: true},
+		"Error on invalid IP prefix":            {expression: "ip:10.1.2.0/33", wantErr: true},
+		"Error on invalid IP range start":       {expression: "ip:10.1.2-10.1.2.50", wantErr: true},
+		"Error on invalid IP range end":         {expression: "ip:10.1.2.1-10.1.2", wantErr: true},
+		"Error on reversed IP range":            {expression: "ip:10.1.2.50-10.1.2.1", wantErr: true},
+		"Error on mixed IP range":               {expression: "ip:10.1.2.1-2001:db8::42", wantErr: true},
+		"Error on invalid release":              {expression: "release:noble", wantErr: true},
+		"Error on invalid release operator":     {expression: "release:=>24.04", wantErr: true},
+		"Error on unterminated string":          {expression: `group:"Domain Users`, wantErr: true},
+		"Error on unclosed parenthesis":         {expression: "(group:developers", wantErr: true},
+		"Error on unexpected parenthesis":       {expression: "group:developers)", wantErr: true},
+		"Error on missing operator":             {expression: "group:developers release:24.04", wantErr: true},
+		"Error on missing operand":              {expression: "group:developers AND", wantErr: true},
+		"Error on invalid term after a match":   {expression: "group:developers OR release:noble", wantErr: true},
+		"Error on keyword used as term operand": {expression: "NOT AND", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			f := facts
+			if tc.facts != nil {
+				f = *tc.facts
+			}
+
+			got, err := targeting.Match(tc.expression, f)
+			if tc.wantErr {
+				require.Error(t, err, "Match should have failed but didn't")
+				require.False(t, got, "Expression should not match when it can't be evaluated")
+				return
+			}
+			require.NoError(t, err, "Match failed but shouldn't have")
+			require.Equal(t, tc.want, got, "Match returned an unexpected result")
+		})
+	}
+}
+
+func TestLocalFacts(t *testing.T) {
+	t.Parallel()
+
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(16, 32)},
+		&net.IPNet{IP: net.ParseIP("::1"), Mask: net.CIDRMask(128, 128)},
+		&net.IPNet{IP: net.ParseIP("2001:db8::42"), Mask: net.CIDRMask(64, 128)},
+		&net.IPAddr{IP: net.ParseIP("10.9.9.9")},
+	}
+
+	tests := map[string]struct {
+		username          string
+		rootDir           string
+		userGroupsErr     bool
+		interfaceAddrsErr bool
+
+		want             targeting.Facts
+		wantGroupsErr    bool
+		wantAddressesErr bool
+		wantReleaseErr   bool
+	}{
+		"Computer facts": {want: targeting.Facts{
+			Hostnames: []string{"myhost", "myhost.example.com"},
+			Addresses: []netip.Addr{netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("2001:db8::42")},
+			Release:   "24.04",
+		}},
+		"User facts include their groups": {username: "bob@example.com", want: targeting.Facts{
+			Hostnames: []string{"myhost", "myhost.example.com"},
+			Groups:    []string{"domain users@example.com", "developers@example.com"},
+			Addresses: []netip.Addr{netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("2001:db8::42")},
+			Release:   "24.04",
+		}},
+
+		// Missing facts
+		"User groups can't be read": {username: "bob@example.com", userGroupsErr: true, wantGroupsErr: true, want: targeting.Facts{
+			Hostnames: []string{"myhost", "myhost.example.com"},
+			Addresses: []netip.Addr{netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("2001:db8::42")},
+			Release:   "24.04",
+		}},
+		"Addresses can't be read": {interfaceAddrsErr: true, wantAddressesErr: true, want: targeting.Facts{
+			Hostnames: []string{"myhost", "myhost.example.com"},
+			Release:   "24.04",
+		}},
+		"Release can't be read": {rootDir: "doesnotexist", wantReleaseErr: true, want: targeting.Facts{
+			Hostnames: []string{"myhost", "myhost.example.com"},
+			Addresses: []netip.Addr{netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("2001:db8::42")},
+		}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.rootDir == "" {
+				tc.rootDir = "noble"
+			}
+
+			opts := []targeting.Option{
+				targeting.WithRoot(filepath.Join(testutils.TestFamilyPath(t), tc.rootDir)),
+				targeting.WithUserGroups(func(username string) ([]string, error) {
+					if tc.userGroupsErr {
+						return nil, errors.New("user groups error")
+					}
+					require.Equal(t, tc.username, username, "Groups should be requested for the user")
+					return []string{"domain users@example.com", "developers@example.com"}, nil
+				}),
+				targeting.WithInterfaceAddrs(func() ([]net.Addr, error) {
+					if tc.interfaceAddrsErr {
+						return nil, errors.New("interface addresses error")
+					}
+					return addrs, nil
+				}),
+			}
+
+			got := targeting.LocalFacts(context.Background(), []string{"myhost", "myhost.example.com"}, tc.username, opts...)
+			require.Equal(t, tc.wantGroupsErr, got.GroupsErr != nil, "LocalFacts should report if groups can't be read")
+			require.Equal(t, tc.wantAddressesErr, got.AddressesErr != nil, "LocalFacts should report if addresses can't be read")
+			require.Equal(t, tc.wantReleaseErr, got.ReleaseErr != nil, "LocalFacts should report if the release can't be read")
+
+			got.GroupsErr, got.AddressesErr, got.ReleaseErr = nil, nil, nil
+			require.Equal(t, tc.want, got, "LocalFacts returned unexpected facts")
+		})
+	}
+}
@@ -0,0 +1,458 @@
+// Package tasks is the policy manager for scheduled tasks, like GPO Scheduled Tasks.
+//
+// This manager only applies to computer objects.
+//
+// The policy is made of:
+//   - tasks/machine: tasks executed as root;
+//   - tasks/user: tasks executed as each logged-in user.
+//
+// Each line of an entry is a task, in the form <schedule> <script>, where the schedule is
+// hourly, daily, weekly, monthly or a time of the day (HH:MM), and the script is relative
+// to the SYSVOL scripts/ subdirectory.
+//
+// The manager downloads the scripts, then creates a systemd service and timer unit pair for each task:
+// in the system unit directory for machine tasks, and in the user unit directory, shared by all users,
+// for user tasks. Machine timers are enabled and started right away, while user timers are enabled
+// globally and started on next login.
+//
+// Units of tasks which are not referenced anymore are stopped, disabled and removed.
+// Should the scripts be missing or a unit fail to be written or enabled, an error will be returned.
+// Failures of the scripts themselves are logged in the journal of their units.
+package tasks
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	machineKey = "tasks/machine"
+	userKey    = "tasks/user"
+
+	unitPrefix = "adsys-task-"
+	tasksDir   = "tasks"
+	// timersWantsDir is where timers are enabled, relative to a unit directory.
+	timersWantsDir = "timers.target.wants"
+)
+
+//go:embed adsys-task-template.service
+var serviceUnitTemplate string
+
+//go:embed adsys-task-template.timer
+var timerUnitTemplate string
+
+var (
+	// timeRegexp matches times of the day, in the form HH:MM.
+	timeRegexp = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+	// schedules are the supported named schedules, which are systemd calendar shorthands.
+	schedules = []string{"hourly", "daily", "weekly", "monthly"}
+)
+
+type systemdCaller interface {
+	StartUnit(context.Context, string) error
+	StopUnit(context.Context, string) error
+	EnableUnit(context.Context, string) error
+	DisableUnit(context.Context, string) error
+	DaemonReload(context.Context) error
+}
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
+// Manager prevents running multiple tasks update process in parallel while applying the policy.
+type Manager struct {
+	runDir        string
+	systemUnitDir string
+	userUnitDir   string
+	systemdCaller systemdCaller
+
+	mu sync.Mutex
+}
+
+type options struct {
+	userUnitDir string
+}
+
+// Option reprents an optional function to change the tasks manager.
+type Option func(*options)
+
+// WithUserUnitDir overrides the default systemd user unit directory.
+func WithUserUnitDir(p string) Option {
+	return func(o *options) {
+		o.userUnitDir = p
+	}
+}
+
+// task is a script to execute on a schedule.
+type task struct {
+	script   string
+	schedule string
+}
+
+// New creates a manager for the tasks policy.
+func New(runDir, systemUnitDir string, systemdCaller systemdCaller, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		userUnitDir: consts.DefaultUserUnitDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		runDir:        runDir,
+		systemUnitDir: systemUnitDir,
+		userUnitDir:   args.userUnitDir,
+		systemdCaller: systemdCaller,
+	}
+}
+
+// ApplyPolicy downloads the scripts of the tasks listed in entries and schedules them with systemd timers.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply tasks policy to %s", objectName))
+
+	// Tasks are only scheduled on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying tasks policy to %s", objectName)
+
+	machineTasks, userTasks, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	scriptsDir := filepath.Join(m.runDir, tasksDir, "scripts")
+	if err := os.RemoveAll(filepath.Dir(scriptsDir)); err != nil {
+		return err
+	}
+	if len(machineTasks)+len(userTasks) > 0 {
+		if err := m.dumpScripts(ctx, scriptsDir, append(machineTasks, userTasks...), assetsDumper); err != nil {
+			return err
+		}
+	}
+
+	if err := m.applySystemUnits(ctx, createUnits(scriptsDir, machineTasks)); err != nil {
+		return err
+	}
+	return m.applyUserUnits(ctx, createUnits(scriptsDir, userTasks))
+}
+
+// parseEntries returns the machine and user tasks from the entries.
+// When a script is scheduled multiple times, the closest GPO wins. Disabled entries are ignored.
+func parseEntries(ctx context.Context, entries []entry.Entry) (machineTasks, userTasks []task, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse tasks entries"))
+
+	for _, e := range entries {
+		if e.Err != nil {
+			return nil, nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+		if e.Disabled {
+			continue
+		}
+
+		var tasks *[]task
+		switch e.Key {
+		case machineKey:
+			tasks = &machineTasks
+		case userKey:
+			tasks = &userTasks
+		default:
+			continue
+		}
+
+		for _, line := range strings.Split(e.Value, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			t, err := parseTask(line)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			*tasks = append(*tasks, t)
+		}
+	}
+
+	dedup := func(tasks []task, key string) []task {
+		return entry.KeepClosest(tasks, func(t task) string { return t.script }, func(further, closest task) {
+			if further.schedule != closest.schedule {
+				log.Warning(ctx, gotext.Get("Script %q is scheduled multiple times in %s. The schedule %q of the closest GPO will be used instead of %q.", closest.script, key, closest.schedule, further.schedule))
+			}
+		})
+	}
+	return dedup(machineTasks, machineKey), dedup(userTasks, userKey), nil
+}
+
+// parseTask parses a task line, in the form <schedule> <script>.
+func parseTask(line string) (t task, err error) {
+	schedule, script, _ := strings.Cut(line, " ")
+	script = strings.TrimSpace(script)
+	if script == "" {
+		return task{}, errors.New(gotext.Get("invalid task %q: expected <schedule> <script>", line))
+	}
+
+	switch {
+	case slices.Contains(schedules, schedule):
+		t.schedule = schedule
+	case timeRegexp.MatchString(schedule):
+		t.schedule = fmt.Sprintf("*-*-* %s:00", schedule)
+	default:
+		return task{}, errors.New(gotext.Get("invalid schedule %q: expected one of %s or a time of the day (HH:MM)", schedule, strings.Join(schedules, ", ")))
+	}
+
+	script = filepath.Clean(script)
+	if !filepath.IsLocal(script) {
+		return task{}, errors.New(gotext.Get("invalid script %q: expected a path relative to the SYSVOL scripts/ subdirectory", script))
+	}
+	// Quotes and backslashes would need to be escaped in the unit command line.
+	if strings.ContainsAny(script, "\"\\") {
+		return task{}, errors.New(gotext.Get("invalid script %q: quotes and backslashes are not supported", script))
+	}
+	t.script = script
+
+	return t, nil
+}
+
+// dumpScripts downloads the scripts to scriptsDir and makes the ones referenced by tasks executable by all users.
+func (m *Manager) dumpScripts(ctx context.Context, scriptsDir string, tasks []task, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't download tasks scripts"))
+
+	//nolint:gosec // G301 - user tasks are executed by every user.
+	if err := os.MkdirAll(filepath.Dir(scriptsDir), 0755); err != nil {
+		return err
+	}
+	if err := assetsDumper(ctx, "scripts/", scriptsDir, -1, -1); err != nil {
+		return err
+	}
+
+	for _, t := range tasks {
+		p := filepath.Join(scriptsDir, t.script)
+		info, err := os.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.New(gotext.Get("script %q doesn't exist in SYSVOL scripts/ subdirectory", t.script))
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return errors.New(gotext.Get("script %q is a directory and not a file to execute", t.script))
+		}
+		//nolint:gosec // G302 - user tasks are executed by every user.
+		if err := os.Chmod(p, 0755); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createUnits returns the content of the service and timer units of each task, by unit name.
+func createUnits(scriptsDir string, tasks []task) map[string]string {
+	units := make(map[string]string)
+	for _, t := range tasks {
+		// Percent signs introduce specifiers in units.
+		p := strings.ReplaceAll(filepath.Join(scriptsDir, t.script), "%", "%%")
+		name := unitPrefix + unit.UnitNameEscape(t.script)
+
+		units[name+".service"] = fmt.Sprintf(serviceUnitTemplate,
+			t.script, // Description
+			p,        // ConditionPathExists
+			p,        // ExecStart
+		)
+		units[name+".timer"] = fmt.Sprintf(timerUnitTemplate,
+			t.script,   // Description
+			t.schedule, // OnCalendar
+		)
+	}
+	return units
+}
+
+// applySystemUnits writes the machine tasks units, then enables and starts the new timers.
+// Units which are not part of units anymore are removed.
+func (m *Manager) applySystemUnits(ctx context.Context, units map[string]string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply machine tasks units"))
+
+	prevUnits := currentUnits(m.systemUnitDir)
+	var stale []string
+	for _, name := range prevUnits {
+		if _, ok := units[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+	needsReload := len(stale) > 0
+
+	for _, name := range stale {
+		if strings.HasSuffix(name, ".timer") {
+			// Tries to stop the timer before disabling and removing it.
+			if err := m.systemdCaller.StopUnit(ctx, name); err != nil {
+				log.Warning(ctx, gotext.Get("Failed to stop unit %q: %v", name, err))
+			}
+			if err := m.systemdCaller.DisableUnit(ctx, name); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(filepath.Join(m.systemUnitDir, name)); err != nil {
+			return err
+		}
+	}
+
+	if len(units) > 0 {
+		//nolint:gosec // G301 - /etc/systemd/system permissions are 0755, so we should keep the same pattern.
+		if err := os.MkdirAll(m.systemUnitDir, 0755); err != nil {
+			return err
+		}
+	}
+	var timersToEnable []string
+	for _, name := range sortedNames(units) {
+		written, err := writeIfChanged(filepath.Join(m.systemUnitDir, name), units[name])
+		if err != nil {
+			return err
+		}
+		if written && strings.HasSuffix(name, ".timer") {
+			timersToEnable = append(timersToEnable, name)
+		}
+		needsReload = needsReload || written
+	}
+
+	if !needsReload {
+		return nil
+	}
+
+	if err := m.systemdCaller.DaemonReload(ctx); err != nil {
+		return err
+	}
+
+	for _, name := range timersToEnable {
+		if err := m.systemdCaller.EnableUnit(ctx, name); err != nil {
+			return err
+		}
+		if err := m.systemdCaller.StartUnit(ctx, name); err != nil {
+			log.Warning(ctx, gotext.Get("failed to start unit %q: %v", name, err))
+		}
+	}
+
+	return nil
+}
+
+// applyUserUnits writes the user tasks units and enables the timers for all users.
+// Units which are not part of units anymore are removed.
+func (m *Manager) applyUserUnits(ctx context.Context, units map[string]string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply user tasks units"))
+
+	wantsDir := filepath.Join(m.userUnitDir, timersWantsDir)
+	var removedLinks bool
+	for _, name := range currentUnits(m.userUnitDir) {
+		if _, ok := units[name]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(wantsDir, name)); err == nil {
+			removedLinks = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Remove(filepath.Join(m.userUnitDir, name)); err != nil {
+			return err
+		}
+	}
+
+	if len(units) == 0 {
+		// Only remove the wants directory if we emptied it.
+		if !removedLinks {
+			return nil
+		}
+		if err := os.Remove(wantsDir); err != nil && !errors.Is(err, syscall.ENOTEMPTY) {
+			return err
+		}
+		return nil
+	}
+
+	//nolint:gosec // G301 - /etc/systemd/user permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return err
+	}
+	for _, name := range sortedNames(units) {
+		if _, err := writeIfChanged(filepath.Join(m.userUnitDir, name), units[name]); err != nil {
+			return err
+		}
+		if !strings.HasSuffix(name, ".timer") {
+			continue
+		}
+
+		// Enable the timer for all users, as systemctl --global enable does.
+		link := filepath.Join(wantsDir, name)
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		if err := os.Symlink(filepath.Join("..", name), link); err != nil {
+			return err
+		}
+		log.Infof(ctx, "User task %q will be scheduled on next login", name)
+	}
+
+	return nil
+}
+
+// currentUnits returns the names of the tasks units found in dir.
+func currentUnits(dir string) []string {
+	var units []string
+	for _, ext := range []string{".service", ".timer"} {
+		paths, _ := filepath.Glob(filepath.Join(dir, unitPrefix+"*"+ext))
+		for _, p := range paths {
+			units = append(units, filepath.Base(p))
+		}
+	}
+	return units
+}
+
+// sortedNames returns the unit names of units in a stable order.
+func sortedNames(units map[string]string) []string {
+	var names []string
+	for name := range units {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// writeIfChanged will only write to path if content is different from current content.
+func writeIfChanged(path string, content string) (done bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save %s", path))
+
+	if oldContent, err := os.ReadFile(path); err == nil && string(oldContent) == content {
+		return false, nil
+	}
+
+	//nolint:gosec // G306 - This asset needs to be world-readable.
+	if err := os.WriteFile(path+".new", []byte(content), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(path+".new", path); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,193 @@
+package tasks_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/tasks"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "tasks/machine", Value: "daily backup.sh\n02:30 cleanup.sh"},
+		{Key: "tasks/user", Value: "weekly reports/weekly report.sh"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		systemdFailOn       string
+		saveAssetsError     bool
+		systemUnitDirIsFile bool
+
+		wantErr bool
+	}{
+		"Schedule machine and user tasks":   {},
+		"Only machine tasks":                {entries: []entry.Entry{{Key: "tasks/machine", Value: "hourly backup.sh"}}},
+		"Only user tasks":                   {entries: []entry.Entry{{Key: "tasks/user", Value: "18:00 cleanup.sh"}}},
+		"All named schedules are supported": {entries: []entry.Entry{{Key: "tasks/machine", Value: "hourly backup.sh\ndaily cleanup.sh\nweekly folder/other.sh\nmonthly reports/weekly report.sh"}}},
+		"Same script for machine and users": {entries: []entry.Entry{{Key: "tasks/machine", Value: "daily backup.sh"}, {Key: "tasks/user", Value: "daily backup.sh"}}},
+		"Closest GPO schedule of a script wins": {entries: uniqueEntries(
+			[]entry.Entry{{Key: "tasks/machine", Value: "daily backup.sh", Strategy: entry.StrategyAppend}},
+			[]entry.Entry{{Key: "tasks/machine", Value: "hourly backup.sh\n  02:30   cleanup.sh", Strategy: entry.StrategyAppend}},
+		)},
+		"Comments and empty lines are ignored":        {entries: []entry.Entry{{Key: "tasks/machine", Value: "# Nightly backup\n\n  00:00 backup.sh  \n"}}},
+		"Disabled entries are ignored":                {entries: []entry.Entry{{Key: "tasks/machine", Value: "daily backup.sh", Disabled: true}, {Key: "tasks/user", Value: "daily cleanup.sh"}}},
+		"Unknown keys are ignored":                    {entries: []entry.Entry{{Key: "tasks/unknown", Value: "daily backup.sh"}, {Key: "tasks/user", Value: "daily cleanup.sh"}}},
+		"Update existing tasks":                       {existingState: "managed"},
+		"Tasks already up to date":                    {existingState: "up_to_date"},
+		"Remove tasks with no entries":                {entries: []entry.Entry{}, existingState: "managed"},
+		"Remove user tasks and their wants directory": {entries: []entry.Entry{}, existingState: "user_tasks"},
+		"No entries and no tasks":                     {entries: []entry.Entry{}},
+		"User objects are ignored":                    {isUser: true, existingState: "managed"},
+		"Failing to start a timer only warns":         {systemdFailOn: "start"},
+		"Failing to stop a removed timer warns":       {entries: []entry.Entry{}, existingState: "managed", systemdFailOn: "stop"},
+
+		// Error cases
+		"Error on errored entry":                      {entries: []entry.Entry{{Key: "tasks/machine", Value: "daily backup.sh", Err: errors.New("some error")}}, wantErr: true},
+		"Error on invalid schedule":                   {entries: []entry.Entry{{Key: "tasks/machine", Value: "24:00 backup.sh"}}, wantErr: true},
+		"Error on task without script":                {entries: []entry.Entry{{Key: "tasks/machine", Value: "daily"}}, wantErr: true},
+		"Error on script outside of scripts":          {entries: []entry.Entry{{Key: "tasks/machine", Value: "daily ../backup.sh"}}, wantErr: true},
+		"Error on script with quotes":                 {entries: []entry.Entry{{Key: "tasks/machine", Value: `daily "backup.sh"`}}, wantErr: true},
+		"Error on missing script":                     {entries: []entry.Entry{{Key: "tasks/machine", Value: "daily missing.sh"}}, wantErr: true},
+		"Error on script being a directory":           {entries: []entry.Entry{{Key: "tasks/machine", Value: "daily folder"}}, wantErr: true},
+		"Error on failing to download scripts":        {saveAssetsError: true, wantErr: true},
+		"Error on daemon reload failure":              {systemdFailOn: "daemon-reload", wantErr: true},
+		"Error on enabling timer failure":             {systemdFailOn: "enable", wantErr: true},
+		"Error on disabling removed timer failure":    {entries: []entry.Entry{}, existingState: "managed", systemdFailOn: "disable", wantErr: true},
+		"Error on system unit directory being a file": {systemUnitDirIsFile: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			runDir := filepath.Join(rootDir, "run", "adsys")
+			systemUnitDir := filepath.Join(rootDir, "etc", "systemd", "system")
+			userUnitDir := filepath.Join(rootDir, "etc", "systemd", "user")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState, "etc"), filepath.Join(rootDir, "etc"))
+				replaceInTree(t, rootDir, "#ROOTDIR#", rootDir)
+			}
+			if tc.systemUnitDirIsFile {
+				require.NoError(t, os.MkdirAll(filepath.Dir(systemUnitDir), 0750), "Setup: can't create parent directory")
+				testutils.WriteFile(t, systemUnitDir, []byte("not a directory"), 0600)
+			}
+
+			systemd := &mockSystemdCaller{failOn: tc.systemdFailOn}
+			m := tasks.New(runDir, systemUnitDir, systemd, tasks.WithUserUnitDir(userUnitDir))
+
+			mockAssetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.saveAssetsError, Path: "scripts/"}
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries, mockAssetsDumper.SaveAssetsTo)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			if len(systemd.calls) > 0 {
+				testutils.WriteFile(t, filepath.Join(rootDir, "systemd_calls"), []byte(strings.Join(systemd.calls, "\n")+"\n"), 0600)
+			}
+			replaceInTree(t, rootDir, rootDir, "#ROOTDIR#")
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// replaceInTree replaces from with to in all regular files of dir, so that units referencing the
+// temporary root directory can be compared to golden files.
+func replaceInTree(t *testing.T, dir, from, to string) {
+	t.Helper()
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(strings.ReplaceAll(string(content), from, to)), info.Mode().Perm())
+	})
+	require.NoError(t, err, "Setup: can't replace root directory in tree")
+}
+
+// mockSystemdCaller records the calls made to systemd, and can fail on one kind of them.
+type mockSystemdCaller struct {
+	failOn string
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (s *mockSystemdCaller) record(action string, unit string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls = append(s.calls, strings.TrimSpace(action+" "+unit))
+	if s.failOn == action {
+		return fmt.Errorf("%s failed as requested", action)
+	}
+	return nil
+}
+
+func (s *mockSystemdCaller) StartUnit(_ context.Context, unit string) error {
+	return s.record("start", unit)
+}
+
+func (s *mockSystemdCaller) StopUnit(_ context.Context, unit string) error {
+	return s.record("stop", unit)
+}
+
+func (s *mockSystemdCaller) EnableUnit(_ context.Context, unit string) error {
+	return s.record("enable", unit)
+}
+
+func (s *mockSystemdCaller) DisableUnit(_ context.Context, unit string) error {
+	return s.record("disable", unit)
+}
+
+func (s *mockSystemdCaller) DaemonReload(_ context.Context) error {
+	return s.record("daemon-reload", "")
+}
+
+// uniqueEntries returns the tasks entries of GPOs, listed from the closest to the furthest, as merged
+// by the policies manager.
+func uniqueEntries(gposEntries ...[]entry.Entry) []entry.Entry {
+	var pols policies.Policies
+	for i, entries := range gposEntries {
+		pols.GPOs = append(pols.GPOs, policies.GPO{
+			ID:    fmt.Sprintf("{GPO%d}", i),
+			Name:  fmt.Sprintf("GPO%d", i),
+			Rules: map[string][]entry.Entry{"tasks": entries},
+		})
+	}
+	return pols.GetUniqueRules()["tasks"]
+}
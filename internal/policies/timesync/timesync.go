@@ -0,0 +1,331 @@
+// Package timesync is the policy manager for the time synchronization and the time zone.
+//
+// This manager only applies to computer objects.
+//
+// NTP servers are written to a drop-in of the time synchronization daemon in use:
+//   - chrony, if /etc/chrony/chrony.conf exists: /etc/chrony/conf.d/adsys.conf, with one server directive per server;
+//   - systemd-timesyncd otherwise: /etc/systemd/timesyncd.conf.d/adsys.conf, in the [Time] section.
+//
+// The domain controller the client is connected to can be used as the first NTP server, as Kerberos
+// authentication requires the clocks of the clients and of the domain controllers to be in sync. If the domain
+// controller is unknown, for instance when offline, the domain name is used, as it resolves to the domain controllers.
+// The drop-in of the daemon not in use is removed, and the daemon is restarted if its configuration changed.
+//
+// The time zone is set through systemd-timedated over D-Bus.
+//
+// Following the policy manager guidelines:
+//   - invalid server names or time zones prevent authentication;
+//   - failing to restart the daemon only warns the user.
+//
+// Drop-ins are removed once no server is configured anymore. The time zone is kept as is.
+package timesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+// Caller is the interface to call a method on a D-Bus object.
+type Caller interface {
+	Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call
+}
+
+const (
+	domainControllerKey = "time/domain-controller"
+	ntpServersKey       = "time/ntp-servers"
+	timezoneKey         = "time/timezone"
+
+	configFileName = "adsys.conf"
+	chronyUnit     = "chrony.service"
+	timesyncdUnit  = "systemd-timesyncd.service"
+
+	managedFileHeader = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`
+)
+
+type systemdCaller interface {
+	TryRestartUnit(context.Context, string) error
+}
+
+type backend interface {
+	Domain() string
+	ServerFQDN(context.Context) (string, error)
+}
+
+// Manager prevents configuring the time synchronization concurrently while applying the policy.
+type Manager struct {
+	backend          backend
+	timesyncdConfDir string
+	chronyDir        string
+	timedate         Caller
+	systemdCaller    systemdCaller
+
+	mu sync.Mutex
+}
+
+type options struct {
+	timesyncdConfDir string
+	chronyDir        string
+	timedate         Caller
+}
+
+// Option reprents an optional function to change the time manager.
+type Option func(*options)
+
+// WithTimesyncdConfDir overrides the default systemd-timesyncd configuration drop-in directory.
+func WithTimesyncdConfDir(p string) Option {
+	return func(o *options) {
+		o.timesyncdConfDir = p
+	}
+}
+
+// WithChronyDir overrides the default chrony configuration directory.
+func WithChronyDir(p string) Option {
+	return func(o *options) {
+		o.chronyDir = p
+	}
+}
+
+// WithTimedateCaller overrides the default systemd-timedated D-Bus object.
+func WithTimedateCaller(c Caller) Option {
+	return func(o *options) {
+		o.timedate = c
+	}
+}
+
+// New returns a new manager for the time policy.
+func New(bus *dbus.Conn, backend backend, systemdCaller systemdCaller, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		timesyncdConfDir: consts.DefaultTimesyncdConfDir,
+		chronyDir:        consts.DefaultChronyDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	if args.timedate == nil {
+		args.timedate = bus.Object("org.freedesktop.timedate1", "/org/freedesktop/timedate1")
+	}
+
+	return &Manager{
+		backend:          backend,
+		timesyncdConfDir: args.timesyncdConfDir,
+		chronyDir:        args.chronyDir,
+		timedate:         args.timedate,
+		systemdCaller:    systemdCaller,
+	}
+}
+
+// ApplyPolicy configures the NTP servers of the time synchronization daemon and the time zone.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply time policy to %s", objectName))
+
+	// Time synchronization is only supported on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying time policy to %s", objectName)
+
+	var useDomainController bool
+	var servers []string
+	var timezone string
+	for _, e := range entries {
+		if e.Err != nil {
+			return errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+		if e.Disabled {
+			continue
+		}
+
+		switch e.Key {
+		case domainControllerKey:
+			useDomainController = true
+		case ntpServersKey:
+			for _, s := range strings.FieldsFunc(e.Value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+				if !isValidServer(s) {
+					return errors.New(gotext.Get("invalid NTP server %q: expected a host name or an IP address", s))
+				}
+				servers = append(servers, s)
+			}
+		case timezoneKey:
+			timezone = strings.TrimSpace(e.Value)
+			if timezone != "" && !isValidTimezone(timezone) {
+				return errors.New(gotext.Get("invalid time zone %q: expected a name like Europe/London", timezone))
+			}
+		}
+	}
+
+	if useDomainController {
+		servers = append([]string{m.domainController(ctx)}, servers...)
+	}
+	// Remove duplicates while keeping the order of preference.
+	var uniqueServers []string
+	for _, s := range servers {
+		if !slices.Contains(uniqueServers, s) {
+			uniqueServers = append(uniqueServers, s)
+		}
+	}
+
+	if err := m.applyServers(ctx, uniqueServers); err != nil {
+		return err
+	}
+
+	if timezone == "" {
+		return nil
+	}
+	log.Debugf(ctx, "Setting time zone to %s", timezone)
+	if err := m.timedate.Call("org.freedesktop.timedate1.SetTimezone", 0, timezone, false).Err; err != nil {
+		return errors.New(gotext.Get("failed to set time zone to %s: %v", timezone, err))
+	}
+	return nil
+}
+
+// domainController returns the FQDN of the domain controller the client is connected to.
+// The domain name is returned if it is unknown, as it resolves to the domain controllers.
+func (m *Manager) domainController(ctx context.Context) string {
+	server, err := m.backend.ServerFQDN(ctx)
+	if err == nil && server != "" {
+		return server
+	}
+	domain := m.backend.Domain()
+	log.Warning(ctx, gotext.Get("Can't get the domain controller, synchronizing time with %s instead: %v", domain, err))
+	return domain
+}
+
+// isValidServer returns true if s is an IP address or a valid host name.
+func isValidServer(s string) bool {
+	if _, err := netip.ParseAddr(s); err == nil {
+		return true
+	}
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isValidTimezone returns true if tz has the form of a time zone name.
+// systemd-timedated checks that the time zone is installed.
+func isValidTimezone(tz string) bool {
+	if strings.HasPrefix(tz, "/") || strings.HasSuffix(tz, "/") {
+		return false
+	}
+	for _, elem := range strings.Split(tz, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+	}
+	for _, r := range tz {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && !strings.ContainsRune("/_+-", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyServers writes the drop-in of the time synchronization daemon in use, and removes the drop-in of the other one.
+// Daemons whose configuration changed are restarted.
+func (m *Manager) applyServers(ctx context.Context, servers []string) (err error) {
+	chronyConf := filepath.Join(m.chronyDir, "conf.d", configFileName)
+	timesyncdConf := filepath.Join(m.timesyncdConfDir, configFileName)
+
+	var chronyContent, timesyncdContent string
+	if len(servers) > 0 {
+		if _, err := os.Stat(filepath.Join(m.chronyDir, "chrony.conf")); err == nil {
+			chronyContent = managedFileHeader
+			for _, s := range servers {
+				chronyContent += fmt.Sprintf("server %s iburst\n", s)
+			}
+		} else {
+			timesyncdContent = managedFileHeader + "[Time]\nNTP=" + strings.Join(servers, " ") + "\n"
+		}
+	}
+
+	for _, c := range []struct {
+		path    string
+		content string
+		unit    string
+	}{
+		{path: chronyConf, content: chronyContent, unit: chronyUnit},
+		{path: timesyncdConf, content: timesyncdContent, unit: timesyncdUnit},
+	} {
+		changed, err := updateFile(c.path, c.content)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		if err := m.systemdCaller.TryRestartUnit(ctx, c.unit); err != nil {
+			log.Warning(ctx, gotext.Get("Can't restart %s, the new configuration will be used on its next start: %v", c.unit, err))
+		}
+	}
+
+	return nil
+}
+
+// updateFile atomically writes content to p if it differs from the current content, or removes p if content is empty.
+// It returns true if the file was written or removed.
+func updateFile(p, content string) (changed bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't update %q", p))
+
+	if content == "" {
+		if err := os.Remove(p); errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if current, err := os.ReadFile(p); err == nil && string(current) == content {
+		return false, nil
+	}
+
+	// #nosec G301 - configuration directories permissions are 0755, so we should keep the same pattern.
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	// #nosec G306 - configuration files are world readable.
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(p+".new", p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,160 @@
+package timesync_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/timesync"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "time/domain-controller"},
+		{Key: "time/ntp-servers", Value: "ntp1.example.com\n10.0.0.123,2001:db8::123"},
+		{Key: "time/timezone", Value: "Europe/London"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		serverFQDNFails bool
+		restartFails    bool
+		timedateFails   bool
+
+		wantRestarts []string
+		wantTimezone string
+		wantErr      bool
+	}{
+		"Apply all settings with timesyncd":             {wantRestarts: []string{"systemd-timesyncd.service"}, wantTimezone: "Europe/London"},
+		"Apply all settings with chrony":                {existingState: "chrony", wantRestarts: []string{"chrony.service"}, wantTimezone: "Europe/London"},
+		"Only domain controller":                        {entries: []entry.Entry{{Key: "time/domain-controller"}}, wantRestarts: []string{"systemd-timesyncd.service"}},
+		"Only NTP servers":                              {entries: []entry.Entry{{Key: "time/ntp-servers", Value: "ntp1.example.com"}}, wantRestarts: []string{"systemd-timesyncd.service"}},
+		"Only time zone":                                {entries: []entry.Entry{{Key: "time/timezone", Value: "America/Argentina/Buenos_Aires"}}, wantTimezone: "America/Argentina/Buenos_Aires"},
+		"Domain name is used if the server is unknown":  {entries: []entry.Entry{{Key: "time/domain-controller"}}, serverFQDNFails: true, wantRestarts: []string{"systemd-timesyncd.service"}},
+		"Duplicated servers are ignored":                {entries: []entry.Entry{{Key: "time/domain-controller"}, {Key: "time/ntp-servers", Value: "adc.example.com ntp1.example.com ntp1.example.com"}}, wantRestarts: []string{"systemd-timesyncd.service"}},
+		"Disabled settings are ignored":                 {entries: []entry.Entry{{Key: "time/domain-controller", Disabled: true}, {Key: "time/ntp-servers", Value: "ntp1.example.com", Disabled: true}, {Key: "time/timezone", Value: "Europe/London", Disabled: true}}},
+		"Empty values are ignored":                      {entries: []entry.Entry{{Key: "time/ntp-servers", Value: " \n,"}, {Key: "time/timezone", Value: " "}}},
+		"Unknown keys are ignored":                      {entries: []entry.Entry{{Key: "time/unknown", Value: "something"}, {Key: "time/ntp-servers", Value: "ntp1.example.com"}}, wantRestarts: []string{"systemd-timesyncd.service"}},
+		"Update existing configuration":                 {existingState: "timesyncd_managed", wantRestarts: []string{"systemd-timesyncd.service"}, wantTimezone: "Europe/London"},
+		"Configuration already up to date":              {existingState: "timesyncd_up_to_date", wantTimezone: "Europe/London"},
+		"Switch from timesyncd to chrony":               {existingState: "chrony_installed_after_timesyncd", wantRestarts: []string{"chrony.service", "systemd-timesyncd.service"}, wantTimezone: "Europe/London"},
+		"Remove configuration with no entries":          {entries: []entry.Entry{}, existingState: "timesyncd_managed", wantRestarts: []string{"systemd-timesyncd.service"}},
+		"Remove chrony configuration with no entries":   {entries: []entry.Entry{}, existingState: "chrony_managed", wantRestarts: []string{"chrony.service"}},
+		"No entries and no configuration":               {entries: []entry.Entry{}},
+		"User objects are ignored":                      {isUser: true, existingState: "timesyncd_managed"},
+		"Failing to restart the daemon only warns":      {restartFails: true, wantRestarts: []string{"systemd-timesyncd.service"}, wantTimezone: "Europe/London"},
+		"Time zone is set after servers are configured": {entries: []entry.Entry{{Key: "time/ntp-servers", Value: "ntp1.example.com"}, {Key: "time/timezone", Value: "UTC"}}, wantRestarts: []string{"systemd-timesyncd.service"}, wantTimezone: "UTC"},
+		"Time zone with signs and numbers is accepted":  {entries: []entry.Entry{{Key: "time/timezone", Value: "Etc/GMT+3"}}, wantTimezone: "Etc/GMT+3"},
+		"Hostnames can be fully qualified with a dot":   {entries: []entry.Entry{{Key: "time/ntp-servers", Value: "ntp1.example.com."}}, wantRestarts: []string{"systemd-timesyncd.service"}},
+
+		// Error cases
+		"Error on errored entry":                          {entries: []entry.Entry{{Key: "time/ntp-servers", Err: errors.New("some error")}}, wantErr: true},
+		"Error on invalid NTP server":                     {entries: []entry.Entry{{Key: "time/ntp-servers", Value: "ntp_1.example.com"}}, wantErr: true},
+		"Error on invalid time zone":                      {entries: []entry.Entry{{Key: "time/timezone", Value: "../../etc/passwd"}}, wantErr: true},
+		"Error on absolute time zone":                     {entries: []entry.Entry{{Key: "time/timezone", Value: "/usr/share/zoneinfo/UTC"}}, wantErr: true},
+		"Error on invalid value keeps existing config":    {entries: []entry.Entry{{Key: "time/ntp-servers", Value: "-ntp.example.com"}}, existingState: "timesyncd_managed", wantErr: true},
+		"Error on configuration directory being a file":   {existingState: "conf_dir_is_file", wantErr: true},
+		"Error on failing to set time zone keeps servers": {timedateFails: true, wantRestarts: []string{"systemd-timesyncd.service"}, wantTimezone: "Europe/London", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			etcDir := filepath.Join(rootDir, "etc")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), etcDir)
+			}
+
+			systemd := &mockSystemdCaller{fail: tc.restartFails}
+			timedate := &mockTimedate{fail: tc.timedateFails}
+			m := timesync.New(nil, mockBackend{serverFQDNFails: tc.serverFQDNFails}, systemd,
+				timesync.WithTimesyncdConfDir(filepath.Join(etcDir, "systemd", "timesyncd.conf.d")),
+				timesync.WithChronyDir(filepath.Join(etcDir, "chrony")),
+				timesync.WithTimedateCaller(timedate),
+			)
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			require.Equal(t, tc.wantRestarts, systemd.restarts, "Restarted units don't match expectations")
+			require.Equal(t, tc.wantTimezone, timedate.timezone, "Time zone doesn't match expectations")
+
+			testutils.CompareTreesWithFiltering(t, etcDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockSystemdCaller records the restarted units, and can fail to restart them.
+type mockSystemdCaller struct {
+	testutils.MockSystemdCaller
+
+	fail bool
+
+	mu       sync.Mutex
+	restarts []string
+}
+
+func (s *mockSystemdCaller) TryRestartUnit(_ context.Context, unit string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.restarts = append(s.restarts, unit)
+	if s.fail {
+		return fmt.Errorf("restart of %s failed as requested", unit)
+	}
+	return nil
+}
+
+// mockTimedate records the time zone set through systemd-timedated, and can fail to set it.
+type mockTimedate struct {
+	fail bool
+
+	timezone string
+}
+
+func (m *mockTimedate) Call(method string, _ dbus.Flags, args ...interface{}) *dbus.Call {
+	if method != "org.freedesktop.timedate1.SetTimezone" || len(args) != 2 {
+		return &dbus.Call{Err: fmt.Errorf("unexpected call %s%v", method, args)}
+	}
+	m.timezone = args[0].(string)
+	if m.fail {
+		return &dbus.Call{Err: errors.New("setting time zone failed as requested")}
+	}
+	return &dbus.Call{}
+}
+
+// mockBackend returns the domain controller the client is connected to.
+type mockBackend struct {
+	serverFQDNFails bool
+}
+
+func (mockBackend) Domain() string { return "example.com" }
+
+func (b mockBackend) ServerFQDN(context.Context) (string, error) {
+	if b.serverFQDNFails {
+		return "", errors.New("no active server found")
+	}
+	return "adc.example.com", nil
+}
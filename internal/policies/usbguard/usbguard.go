@@ -0,0 +1,240 @@
+// Package usbguard is the policy manager for USB device control with usbguard.
+//
+// This manager only applies to computer objects.
+//
+// The policy is made of:
+//   - usbguard/allow: devices to allow;
+//   - usbguard/block: devices to block;
+//   - usbguard/default-policy: the policy (allow or block) applied to devices not matching any other rule.
+//
+// Devices are listed one per line, either by USB ID, like 046d:c52b or 046d:* for all products of a vendor,
+// or by interface class, like "class 08" for mass storage. Empty lines and lines starting with # are ignored.
+// A device is allowed by class only if all its interfaces belong to an allowed class, while having a single
+// interface of a blocked class is enough for a device to be blocked.
+//
+// Rules are written to /etc/usbguard/rules.d/50-adsys.conf: block rules first, so that they take precedence
+// over allow rules, then allow rules and finally the default policy. Rules of the main usbguard rules file
+// are evaluated before them.
+//
+// Following the policy manager guidelines:
+//   - invalid lines or usbguard not being installed prevent authentication;
+//   - the usbguard service is then restarted if it's running, and failing to restart it only warns the user.
+//
+// The rules file is removed once no setting is configured anymore, restoring the distribution rules.
+package usbguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	allowKey         = "usbguard/allow"
+	blockKey         = "usbguard/block"
+	defaultPolicyKey = "usbguard/default-policy"
+
+	rulesFileName = "50-adsys.conf"
+	usbguardUnit  = "usbguard.service"
+)
+
+var (
+	// deviceIDRegexp matches USB IDs, with the product being optionally a wildcard.
+	deviceIDRegexp = regexp.MustCompile(`^([0-9a-fA-F]{4}):([0-9a-fA-F]{4}|\*)$`)
+	// deviceClassRegexp matches USB interface classes.
+	deviceClassRegexp = regexp.MustCompile(`^class\s+([0-9a-fA-F]{2})$`)
+
+	// defaultPolicies are the supported targets of the default policy.
+	defaultPolicies = []string{"allow", "block"}
+)
+
+type systemdCaller interface {
+	TryRestartUnit(context.Context, string) error
+}
+
+// Manager prevents writing the usbguard rules concurrently while applying the policy.
+type Manager struct {
+	usbguardDir   string
+	systemdCaller systemdCaller
+
+	mu sync.Mutex
+}
+
+type options struct {
+	usbguardDir string
+}
+
+// Option reprents an optional function to change the usbguard manager.
+type Option func(*options)
+
+// WithUSBGuardDir overrides the default usbguard configuration directory.
+func WithUSBGuardDir(p string) Option {
+	return func(o *options) {
+		o.usbguardDir = p
+	}
+}
+
+// New returns a new manager for the usbguard policy.
+func New(systemdCaller systemdCaller, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		usbguardDir: consts.DefaultUSBGuardDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		usbguardDir:   args.usbguardDir,
+		systemdCaller: systemdCaller,
+	}
+}
+
+// ApplyPolicy writes the usbguard rules from entries and restarts usbguard,
+// or removes the rules if there are no settings.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply usbguard policy to %s", objectName))
+
+	// USB devices are only managed on computers.
+	if !isComputer {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying usbguard policy to %s", objectName)
+
+	rules, err := parseEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	rulesPath := filepath.Join(m.usbguardDir, "rules.d", rulesFileName)
+	if len(rules) == 0 {
+		if err := os.Remove(rulesPath); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		m.restartUSBGuard(ctx)
+		return nil
+	}
+
+	if _, err := os.Stat(m.usbguardDir); err != nil {
+		return errors.New(gotext.Get("usbguard is not installed: %v", err))
+	}
+
+	content := `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+` + strings.Join(rules, "\n") + "\n"
+	if current, err := os.ReadFile(rulesPath); err == nil && string(current) == content {
+		return nil
+	}
+
+	// usbguard refuses rules directories and files which are readable by other users than root.
+	if err := os.MkdirAll(filepath.Dir(rulesPath), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(rulesPath+".new", []byte(content), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(rulesPath+".new", rulesPath); err != nil {
+		return err
+	}
+
+	m.restartUSBGuard(ctx)
+	return nil
+}
+
+// parseEntries returns the usbguard rules to write, block rules first.
+// Disabled entries are ignored.
+func parseEntries(entries []entry.Entry) (rules []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse usbguard entries"))
+
+	var allowRules, blockRules []string
+	var defaultRule string
+	for _, e := range entries {
+		if e.Err != nil {
+			return nil, errors.New(gotext.Get("entry %q is errored: %v", e.Key, e.Err))
+		}
+		if e.Disabled {
+			continue
+		}
+
+		switch e.Key {
+		case allowKey:
+			if allowRules, err = parseDevices("allow", e.Value); err != nil {
+				return nil, err
+			}
+		case blockKey:
+			if blockRules, err = parseDevices("block", e.Value); err != nil {
+				return nil, err
+			}
+		case defaultPolicyKey:
+			v := strings.TrimSpace(e.Value)
+			if !slices.Contains(defaultPolicies, v) {
+				return nil, errors.New(gotext.Get("invalid default policy %q: expected one of %s", v, strings.Join(defaultPolicies, ", ")))
+			}
+			defaultRule = v
+		}
+	}
+
+	rules = append(blockRules, allowRules...)
+	if defaultRule != "" {
+		rules = append(rules, defaultRule)
+	}
+	return rules, nil
+}
+
+// parseDevices returns the usbguard rules with target for the devices listed in v.
+func parseDevices(target, v string) (rules []string, err error) {
+	for _, line := range strings.Split(v, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule string
+		if m := deviceIDRegexp.FindStringSubmatch(line); m != nil {
+			rule = fmt.Sprintf("%s id %s:%s", target, strings.ToLower(m[1]), strings.ToLower(m[2]))
+		} else if m := deviceClassRegexp.FindStringSubmatch(line); m != nil {
+			// Allow devices only made of interfaces of this class, but block devices with any interface of it.
+			op := "one-of"
+			if target == "allow" {
+				op = "all-of"
+			}
+			rule = fmt.Sprintf("%s with-interface %s { %s:*:* }", target, op, strings.ToLower(m[1]))
+		} else {
+			return nil, errors.New(gotext.Get("invalid device %q: expected <vendor>:<product> or class <class>", line))
+		}
+
+		if !slices.Contains(rules, rule) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// restartUSBGuard restarts usbguard if it's running, so that it loads the new rules.
+func (m *Manager) restartUSBGuard(ctx context.Context) {
+	if err := m.systemdCaller.TryRestartUnit(ctx, usbguardUnit); err != nil {
+		log.Warning(ctx, gotext.Get("Can't restart %s, the new rules will be used on its next start: %v", usbguardUnit, err))
+	}
+}
@@ -0,0 +1,119 @@
+package usbguard_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/usbguard"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaultEntries := []entry.Entry{
+		{Key: "usbguard/allow", Value: "046d:c52b\nclass 03"},
+		{Key: "usbguard/block", Value: "class 08\n0781:*"},
+		{Key: "usbguard/default-policy", Value: "block"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+
+		restartFails    bool
+		rulesDirIsAFile bool
+
+		wantRestart bool
+		wantErr     bool
+	}{
+		"Apply all settings":                              {existingState: "installed", wantRestart: true},
+		"Only allowed devices":                            {entries: []entry.Entry{{Key: "usbguard/allow", Value: "046d:c52b"}}, existingState: "installed", wantRestart: true},
+		"Only default policy":                             {entries: []entry.Entry{{Key: "usbguard/default-policy", Value: "allow"}}, existingState: "installed", wantRestart: true},
+		"IDs and classes are lowercased":                  {entries: []entry.Entry{{Key: "usbguard/block", Value: "0781:55AB\nclass 0A\nCAFE:*"}}, existingState: "installed", wantRestart: true},
+		"Comments empty lines and duplicates are ignored": {entries: []entry.Entry{{Key: "usbguard/block", Value: "# storage\n\n  class 08  \nclass  08\n0781:*\n0781:*"}}, existingState: "installed", wantRestart: true},
+		"Disabled entries are ignored":                    {entries: []entry.Entry{{Key: "usbguard/allow", Value: "046d:c52b", Disabled: true}, {Key: "usbguard/block", Value: "class 08"}}, existingState: "installed", wantRestart: true},
+		"Unknown keys are ignored":                        {entries: []entry.Entry{{Key: "usbguard/unknown", Value: "something"}, {Key: "usbguard/block", Value: "class 08"}}, existingState: "installed", wantRestart: true},
+		"Update existing rules":                           {existingState: "managed", wantRestart: true},
+		"Rules already up to date":                        {existingState: "up_to_date"},
+		"Remove rules with no entries":                    {entries: []entry.Entry{}, existingState: "managed", wantRestart: true},
+		"Remove rules with only disabled entries":         {entries: []entry.Entry{{Key: "usbguard/block", Value: "class 08", Disabled: true}}, existingState: "managed", wantRestart: true},
+		"No entries and no rules":                         {entries: []entry.Entry{}, existingState: "installed"},
+		"No entries and usbguard not installed":           {entries: []entry.Entry{}},
+		"User objects are ignored":                        {isUser: true, existingState: "managed"},
+		"Failing to restart usbguard is not an error":     {existingState: "installed", restartFails: true, wantRestart: true},
+
+		// Error cases
+		"Error on errored entry":                {entries: []entry.Entry{{Key: "usbguard/block", Value: "class 08", Err: errors.New("some error")}}, existingState: "installed", wantErr: true},
+		"Error on invalid device ID":            {entries: []entry.Entry{{Key: "usbguard/block", Value: "781:5567"}}, existingState: "installed", wantErr: true},
+		"Error on invalid device class":         {entries: []entry.Entry{{Key: "usbguard/allow", Value: "class storage"}}, existingState: "installed", wantErr: true},
+		"Error on invalid default policy":       {entries: []entry.Entry{{Key: "usbguard/default-policy", Value: "reject"}}, existingState: "installed", wantErr: true},
+		"Error on usbguard not installed":       {wantErr: true},
+		"Error on rules directory being a file": {existingState: "installed", rulesDirIsAFile: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.entries == nil {
+				tc.entries = defaultEntries
+			}
+
+			rootDir := t.TempDir()
+			usbguardDir := filepath.Join(rootDir, "etc", "usbguard")
+			if tc.existingState != "" {
+				testutils.Copy(t, filepath.Join(testutils.TestFamilyPath(t), "states", tc.existingState), usbguardDir)
+			}
+			if tc.rulesDirIsAFile {
+				testutils.WriteFile(t, filepath.Join(usbguardDir, "rules.d"), []byte("not a directory"), 0600)
+			}
+
+			systemd := &mockSystemdCaller{fail: tc.restartFails}
+			m := usbguard.New(systemd, usbguard.WithUSBGuardDir(usbguardDir))
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			var wantRestarts []string
+			if tc.wantRestart {
+				wantRestarts = []string{"usbguard.service"}
+			}
+			require.Equal(t, wantRestarts, systemd.restarts, "Restarted units don't match expectations")
+
+			testutils.CompareTreesWithFiltering(t, rootDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockSystemdCaller records the restarted units, and can fail to restart them.
+type mockSystemdCaller struct {
+	testutils.MockSystemdCaller
+
+	fail bool
+
+	mu       sync.Mutex
+	restarts []string
+}
+
+func (s *mockSystemdCaller) TryRestartUnit(_ context.Context, unit string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.restarts = append(s.restarts, unit)
+	if s.fail {
+		return fmt.Errorf("restart of %s failed as requested", unit)
+	}
+	return nil
+}
@@ -25,6 +25,7 @@ var errNoSuchUnit = dbus.NewError(fmt.Sprintf("%s.NoSuchUnit", consts.SystemdDbu
 const (
 	absentUnit  = "not-a-service.service"
 	failingUnit = "fail-to-start-stop.service"
+	maskedUnit  = "masked-service.service"
 )
 
 func (s *systemdBus) StartUnit(name string, _ string) (dbus.ObjectPath, *dbus.Error) {
@@ -43,6 +44,22 @@ func (s *systemdBus) StopUnit(name string, _ string) (dbus.ObjectPath, *dbus.Err
 	return s.emitJobSignals(name), nil
 }
 
+func (s *systemdBus) ReloadUnit(name string, _ string) (dbus.ObjectPath, *dbus.Error) {
+	if name == absentUnit {
+		return dbus.ObjectPath("/"), errNoSuchUnit
+	}
+
+	return s.emitJobSignals(name), nil
+}
+
+func (s *systemdBus) TryRestartUnit(name string, _ string) (dbus.ObjectPath, *dbus.Error) {
+	if name == absentUnit {
+		return dbus.ObjectPath("/"), errNoSuchUnit
+	}
+
+	return s.emitJobSignals(name), nil
+}
+
 func (s *systemdBus) EnableUnitFiles(names []string, _ bool, _ bool) (bool, []systemdDbus.EnableUnitFileChange, *dbus.Error) {
 	if len(names) != 1 {
 		panic("method is only expected to be called with a single name")
@@ -67,6 +84,47 @@ func (s *systemdBus) DisableUnitFiles(names []string, _ bool) ([]systemdDbus.Dis
 	return []systemdDbus.DisableUnitFileChange{{Type: "symlink", Filename: "/from/path", Destination: "/to/path"}}, nil
 }
 
+func (s *systemdBus) MaskUnitFiles(names []string, _ bool, _ bool) ([]systemdDbus.MaskUnitFileChange, *dbus.Error) {
+	if len(names) != 1 {
+		panic("method is only expected to be called with a single name")
+	}
+
+	if name := names[0]; name == absentUnit {
+		return nil, errNoSuchUnit
+	}
+
+	return []systemdDbus.MaskUnitFileChange{{Type: "symlink", Filename: "/from/path", Destination: "/dev/null"}}, nil
+}
+
+func (s *systemdBus) UnmaskUnitFiles(names []string, _ bool) ([]systemdDbus.UnmaskUnitFileChange, *dbus.Error) {
+	if len(names) != 1 {
+		panic("method is only expected to be called with a single name")
+	}
+
+	if name := names[0]; name == absentUnit {
+		return nil, errNoSuchUnit
+	}
+
+	return []systemdDbus.UnmaskUnitFileChange{{Type: "unlink", Filename: "/from/path"}}, nil
+}
+
+func (s *systemdBus) ListUnitFilesByPatterns(_ []string, patterns []string) ([]systemdDbus.UnitFile, *dbus.Error) {
+	if len(patterns) != 1 {
+		panic("method is only expected to be called with a single pattern")
+	}
+
+	switch name := patterns[0]; name {
+	case absentUnit:
+		return []systemdDbus.UnitFile{}, nil
+	case failingUnit:
+		return nil, dbus.MakeFailedError(fmt.Errorf("list unit files error"))
+	case maskedUnit:
+		return []systemdDbus.UnitFile{{Path: "/etc/systemd/system/" + name, Type: "masked"}}, nil
+	default:
+		return []systemdDbus.UnitFile{{Path: "/usr/lib/systemd/system/" + name, Type: "enabled"}}, nil
+	}
+}
+
 func (s *systemdBus) Reload() *dbus.Error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -1,10 +1,11 @@
 // Package systemd provides a wrapper around systemd dbus API that allows basic
-// service operations (start/stop/enable/disable).
+// service operations (start/stop/reload/restart/enable/disable/mask/unmask).
 package systemd
 
 import (
 	"context"
 	"errors"
+	"path/filepath"
 
 	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
 	"github.com/godbus/dbus/v5"
@@ -60,6 +61,36 @@ func (s DefaultCaller) StopUnit(ctx context.Context, unit string) (err error) {
 	return nil
 }
 
+// ReloadUnit reloads the configuration of the given unit.
+func (s DefaultCaller) ReloadUnit(ctx context.Context, unit string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to reload unit %s", unit))
+
+	reschan := make(chan string)
+	if _, err = s.conn.ReloadUnitContext(ctx, unit, "replace", reschan); err != nil {
+		return err
+	}
+
+	if job := <-reschan; job != jobDone {
+		return errors.New(gotext.Get("reload job failed"))
+	}
+	return nil
+}
+
+// TryRestartUnit restarts the given unit if it is running.
+func (s DefaultCaller) TryRestartUnit(ctx context.Context, unit string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to restart unit %s", unit))
+
+	reschan := make(chan string)
+	if _, err = s.conn.TryRestartUnitContext(ctx, unit, "replace", reschan); err != nil {
+		return err
+	}
+
+	if job := <-reschan; job != jobDone {
+		return errors.New(gotext.Get("restart job failed"))
+	}
+	return nil
+}
+
 // EnableUnit enables the given unit.
 func (s DefaultCaller) EnableUnit(ctx context.Context, unit string) (err error) {
 	defer decorate.OnError(&err, gotext.Get("failed to enable unit %s", unit))
@@ -80,6 +111,44 @@ func (s DefaultCaller) DisableUnit(ctx context.Context, unit string) (err error)
 	return nil
 }
 
+// MaskUnit masks the given unit.
+func (s DefaultCaller) MaskUnit(ctx context.Context, unit string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to mask unit %s", unit))
+
+	if _, err := s.conn.MaskUnitFilesContext(ctx, []string{unit}, false, true); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmaskUnit unmasks the given unit.
+func (s DefaultCaller) UnmaskUnit(ctx context.Context, unit string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to unmask unit %s", unit))
+
+	if _, err := s.conn.UnmaskUnitFilesContext(ctx, []string{unit}, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnitFileState returns the unit file state of the given unit (enabled, disabled, masked, static…).
+// An empty state is returned if no unit file exists for this unit.
+func (s DefaultCaller) UnitFileState(ctx context.Context, unit string) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to get state of unit %s", unit))
+
+	unitFiles, err := s.conn.ListUnitFilesByPatternsContext(ctx, nil, []string{unit})
+	if err != nil {
+		return "", err
+	}
+	for _, f := range unitFiles {
+		if filepath.Base(f.Path) != unit {
+			continue
+		}
+		return f.Type, nil
+	}
+	return "", nil
+}
+
 // DaemonReload scans and reloads unit files. This is an equivalent to systemctl daemon-reload.
 func (s DefaultCaller) DaemonReload(ctx context.Context) (err error) {
 	defer decorate.OnError(&err, gotext.Get("failed to reload units"))
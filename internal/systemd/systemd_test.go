@@ -34,8 +34,12 @@ func TestManageUnit(t *testing.T) {
 	}{
 		"Start unit that exists":   {action: "start"},
 		"Stop unit that exists":    {action: "stop"},
+		"Reload unit that exists":  {action: "reload"},
+		"Restart unit that exists": {action: "restart"},
 		"Enable unit that exists":  {action: "enable"},
 		"Disable unit that exists": {action: "disable"},
+		"Mask unit that exists":    {action: "mask"},
+		"Unmask unit that exists":  {action: "unmask"},
 
 		// Error cases
 		"Error when starting unit that doesn't exist": {unitName: absentUnit, action: "start", wantErr: true},
@@ -44,8 +48,16 @@ func TestManageUnit(t *testing.T) {
 		"Error when stopping unit that doesn't exist": {unitName: absentUnit, action: "stop", wantErr: true},
 		"Error when stopping failing unit":            {unitName: failingUnit, action: "stop", wantErr: true},
 
+		"Error when reloading unit that doesn't exist": {unitName: absentUnit, action: "reload", wantErr: true},
+		"Error when reloading failing unit":            {unitName: failingUnit, action: "reload", wantErr: true},
+
+		"Error when restarting unit that doesn't exist": {unitName: absentUnit, action: "restart", wantErr: true},
+		"Error when restarting failing unit":            {unitName: failingUnit, action: "restart", wantErr: true},
+
 		"Error when enabling unit that doesn't exist":  {unitName: absentUnit, action: "enable", wantErr: true},
 		"Error when disabling unit that doesn't exist": {unitName: absentUnit, action: "disable", wantErr: true},
+		"Error when masking unit that doesn't exist":   {unitName: absentUnit, action: "mask", wantErr: true},
+		"Error when unmasking unit that doesn't exist": {unitName: absentUnit, action: "unmask", wantErr: true},
 	}
 
 	for name, tc := range tests {
@@ -62,10 +74,18 @@ func TestManageUnit(t *testing.T) {
 				err = systemdCaller.StartUnit(ctx, tc.unitName)
 			case "stop":
 				err = systemdCaller.StopUnit(ctx, tc.unitName)
+			case "reload":
+				err = systemdCaller.ReloadUnit(ctx, tc.unitName)
+			case "restart":
+				err = systemdCaller.TryRestartUnit(ctx, tc.unitName)
 			case "enable":
 				err = systemdCaller.EnableUnit(ctx, tc.unitName)
 			case "disable":
 				err = systemdCaller.DisableUnit(ctx, tc.unitName)
+			case "mask":
+				err = systemdCaller.MaskUnit(ctx, tc.unitName)
+			case "unmask":
+				err = systemdCaller.UnmaskUnit(ctx, tc.unitName)
 			default:
 				panic("unknown systemd action")
 			}
@@ -79,6 +99,42 @@ func TestManageUnit(t *testing.T) {
 	}
 }
 
+func TestUnitFileState(t *testing.T) {
+	t.Parallel()
+
+	bus := testutils.NewDbusConn(t)
+
+	systemdCaller, err := systemd.New(bus)
+	require.NoError(t, err, "Setup: failed to create systemd caller")
+
+	tests := map[string]struct {
+		unitName string
+
+		want    string
+		wantErr bool
+	}{
+		"Enabled unit":           {unitName: "existing-service.service", want: "enabled"},
+		"Masked unit":            {unitName: maskedUnit, want: "masked"},
+		"Unit without unit file": {unitName: absentUnit, want: ""},
+
+		"Error when listing unit files fails": {unitName: failingUnit, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := systemdCaller.UnitFileState(ctx, tc.unitName)
+			if tc.wantErr {
+				require.Error(t, err, "UnitFileState should have failed but it didn't")
+				return
+			}
+			require.NoError(t, err, "UnitFileState shouldn't have failed but it did")
+			require.Equal(t, tc.want, got, "UnitFileState returned an unexpected state")
+		})
+	}
+}
+
 func TestDaemonReload(t *testing.T) {
 	t.Parallel()
 
@@ -7,6 +7,7 @@ from pwd import getpwuid
 from socket import gethostname
 
 SCOPE_BASE = ""
+SCOPE_ONELEVEL = "one"
 
 def binary_encode(s):
     return s
@@ -15,6 +16,31 @@ OUs = {}
 GPOs = {}
 accounts = {}
 
+def wmi_parm2(queries):
+    """ Encode WQL queries, in the root\\CIMv2 namespace, as the msWMI-Parm2 attribute of a WMI filter """
+    parm2 = "%d;" % len(queries)
+    for q in queries:
+        parm2 += "3;10;%d;WQL;root\\CIMv2;%s;" % (len(q), q)
+    return parm2
+
+# WMI filters, by their msWMI-ID, as (msWMI-Name, msWMI-Parm2)
+WMIFilters = {
+    "{5D8C2E1A-0F64-4B0B-9E4C-1E7A0B3C2D11}": ("Ubuntu laptops", wmi_parm2([
+        'SELECT * FROM Win32_OperatingSystem WHERE Caption LIKE "Ubuntu%"',
+        # Multiline queries, with separators in them, are printed on one line.
+        'SELECT *\n  FROM Win32_ComputerSystem\n  WHERE PCSystemType = 2 OR Model = "a;b"',
+    ])),
+}
+
+# Accounts, by their objectSid, as (sAMAccountName, objectClass). Accounts of other domains are foreign
+# security principals, without any sAMAccountName.
+SIDAccounts = {
+    "S-1-5-21-16178157-162784614-155579044-1105": ("alice", [b"top", b"person", b"organizationalPerson", b"user"]),
+    "S-1-5-21-16178157-162784614-155579044-1107": ("linux-users", [b"top", b"group"]),
+    "S-1-5-21-16178157-162784614-155579044-1108": ("hostname1$", [b"top", b"person", b"organizationalPerson", b"user", b"computer"]),
+    "S-1-5-21-11111111-222222222-333333333-1107": (None, [b"top", b"foreignSecurityPrincipal"]),
+}
+
 # Group SIDs reported for an account by a tokenGroups query, split by the
 # directory service that answers it, because the two differ in real AD:
 #  * token_groups    -- the Global Catalog view: universal and global groups
@@ -222,6 +248,12 @@ class GPO:
             # primary group back to the token.
             self.nTSecurityDescriptor = ['O:S-1-5-21-16178157-162784614-155579044-512G:S-1-5-21-16178157-162784614-155579044-512D:PAI(OA;;CR;edacfd8f-ffb3-11d1-b41d-00a0c968f939;;S-1-5-21-16178157-162784614-155579044-515)(A;CI;RPLCLORC;;;S-1-5-21-16178157-162784614-155579044-515)']
 
+        self.gPCWQLFilter = [b'']
+        if name == "WMIFilter GPO":
+            self.gPCWQLFilter = [b'[gpoonly.com;{5D8C2E1A-0F64-4B0B-9E4C-1E7A0B3C2D11};0]']
+        if name == "WMIFilter missing filter GPO":
+            self.gPCWQLFilter = [b'[gpoonly.com;{00000000-0000-0000-0000-000000000000};0]']
+
         smb_port = getenv("ADSYS_TESTS_SMB_PORT")
         if smb_port:
             smb_port = ":" + smb_port
@@ -384,6 +416,14 @@ o = OU("/example/PrimaryGroupFallback")
 o.addGPO(GPO("PrimaryGroupFallback GPO"))
 o.addAccount("UserPrimaryGroupFallback", token_groups_sids=[], dc_token_groups_sids=[], crash_user_session=True)
 
+# WMI filters: the filter name and queries are printed alongside the GPO for the
+# client to evaluate them, and a GPO whose filter doesn't exist anymore is skipped.
+o = OU("/example/WMIFilter")
+o.addGPO(GPO("WMIFilter GPO"))
+o.addGPO(GPO("WMIFilter missing filter GPO"))
+o.addGPO(GPO("WMIFilter no filter GPO"))
+o.addAccount("UserWMIFilter")
+
 # Integration tests OU and GPO
 OU("/example/IntegrationTests")
 
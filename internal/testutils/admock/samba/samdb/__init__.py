@@ -13,13 +13,14 @@ class AccountSearch(dict):
         dict.__setitem__(self, "objectSid", objectSid)
 
 class GPOSearch(dict):
-    def __init__(self, name, displayName, flags, nTSecurityDescriptor, gPCFileSysPath):
+    def __init__(self, name, displayName, flags, nTSecurityDescriptor, gPCFileSysPath, gPCWQLFilter):
         self.dn = name
         dict.__setitem__(self, "name", name)
         dict.__setitem__(self, "displayName", [displayName])
         dict.__setitem__(self, "flags", flags)
         dict.__setitem__(self, "nTSecurityDescriptor", nTSecurityDescriptor)
         dict.__setitem__(self, "gPCFileSysPath", gPCFileSysPath)
+        dict.__setitem__(self, "gPCWQLFilter", gPCWQLFilter)
 
 class SamDB:
     def __init__(self, url=None, session_info=None, credentials=None, lp=None):
@@ -62,6 +63,16 @@ class SamDB:
 
             return [AccountSearch(accountName, objectClass, ["S-1-5-21-16178157-162784614-155579044-1103"])]
 
+        # Account search by SID
+        elif "objectSid=" in expression:
+            sid = str(expression)[len("(objectSid="):].split(")")[0]
+            if sid not in ldb.SIDAccounts:
+                return []
+            name, objectClass = ldb.SIDAccounts[sid]
+            if name is None:
+                return [{"objectClass": objectClass}]
+            return [{"objectClass": objectClass, "sAMAccountName": [name.encode()]}]
+
         # Group search
         elif "objectClass=group" in expression:
             return [{"objectSid": ["SidGroup1"]},{"objectSid": ["SidGroup2"]}]
@@ -77,6 +88,14 @@ class SamDB:
         elif "primaryGroupID" in attrs:
             return [{"primaryGroupID": [b"515"]}]
 
+        # WMI filter search
+        elif "msWMI-Som" in expression:
+            filterID = str(expression)[len("(&(objectClass=msWMI-Som)(msWMI-ID="):].split(")")[0]
+            if filterID not in ldb.WMIFilters:
+                return []
+            name, parm2 = ldb.WMIFilters[filterID]
+            return [{"msWMI-Name": [name.encode()], "msWMI-Parm2": [parm2.encode()]}]
+
         # OU search
         elif "gPLink" in attrs:
             ou = ldb.OUs[base.strdn]
@@ -90,7 +109,7 @@ class SamDB:
         gpo = ldb.GPOs[base]
         if gpo.nTSecurityDescriptor[0] == "MISSING":
             raise "nTSecurityDescriptor not available as requested"
-        return [GPOSearch(gpo.name, gpo.display_name, gpo.flags, gpo.nTSecurityDescriptor, gpo.gPCFileSysPath)]
+        return [GPOSearch(gpo.name, gpo.display_name, gpo.flags, gpo.nTSecurityDescriptor, gpo.gPCFileSysPath, gpo.gPCWQLFilter)]
 
 
     def get_default_basedn(self):
@@ -65,8 +65,13 @@ func (m MockAssetsDumper) SaveAssetsTo(_ context.Context, relSrc, dest string, _
 // It is embedded in manager tests which implement subsets of the systemd caller interface according to their needs.
 type MockSystemdCaller struct{}
 
-func (s MockSystemdCaller) StartUnit(_ context.Context, _ string) error   { return nil } //nolint:revive
-func (s MockSystemdCaller) StopUnit(_ context.Context, _ string) error    { return nil } //nolint:revive
-func (s MockSystemdCaller) EnableUnit(_ context.Context, _ string) error  { return nil } //nolint:revive
-func (s MockSystemdCaller) DisableUnit(_ context.Context, _ string) error { return nil } //nolint:revive
-func (s MockSystemdCaller) DaemonReload(_ context.Context) error          { return nil } //nolint:revive
+func (s MockSystemdCaller) StartUnit(_ context.Context, _ string) error               { return nil }     //nolint:revive
+func (s MockSystemdCaller) StopUnit(_ context.Context, _ string) error                { return nil }     //nolint:revive
+func (s MockSystemdCaller) ReloadUnit(_ context.Context, _ string) error              { return nil }     //nolint:revive
+func (s MockSystemdCaller) TryRestartUnit(_ context.Context, _ string) error          { return nil }     //nolint:revive
+func (s MockSystemdCaller) EnableUnit(_ context.Context, _ string) error              { return nil }     //nolint:revive
+func (s MockSystemdCaller) DisableUnit(_ context.Context, _ string) error             { return nil }     //nolint:revive
+func (s MockSystemdCaller) MaskUnit(_ context.Context, _ string) error                { return nil }     //nolint:revive
+func (s MockSystemdCaller) UnmaskUnit(_ context.Context, _ string) error              { return nil }     //nolint:revive
+func (s MockSystemdCaller) UnitFileState(_ context.Context, _ string) (string, error) { return "", nil } //nolint:revive
+func (s MockSystemdCaller) DaemonReload(_ context.Context) error                      { return nil }     //nolint:revive